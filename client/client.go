@@ -4,18 +4,24 @@ package client
 
 import (
 	"QemuUserNet/entities"
+	"QemuUserNet/tools"
 	"encoding/json"
 	"fmt"
+	"io"
 	"log"
 	"net"
+	"os"
+	"strconv"
+	"time"
 )
 
 // send establishes a TCP connection to the given IP and port,
 // and sends the provided data. It returns the connection and any error encountered.
 func send(ip string, port int, data []byte) (net.Conn, error) {
-	conn, err := net.Dial("tcp", fmt.Sprintf("%s:%d", ip, port))
+	conn, err := net.Dial("tcp", net.JoinHostPort(ip, strconv.Itoa(port)))
 	if err != nil {
 		log.Println("Socket dial error: ", err.Error())
+		return nil, err
 	}
 	_, err = conn.Write(data)
 	if err != nil {
@@ -27,21 +33,35 @@ func send(ip string, port int, data []byte) (net.Conn, error) {
 // listen reads the response from the server on the given connection
 // and prints it if it is not "nil". Closes the connection after reading.
 func listen(conn net.Conn) error {
-	buffer := make([]byte, 2048)
-	l, err := conn.Read(buffer)
+	// The server closes the connection once the response is sent
+	buffer, err := io.ReadAll(conn)
 	if err != nil {
 		log.Println("Socket dial read error: ", err.Error())
 	}
-	if string(buffer[:l]) != "nil" {
-		fmt.Println(string(buffer[:l]))
+	if string(buffer) != "nil" {
+		fmt.Println(string(buffer))
 	}
 	return conn.Close()
 }
 
 // Create sends a create network command to the server with the specified parameters.
-func Create(ip string, port int, nameNetwork string, subnet string, gatewayIP string, gatewayMAC string, rangeIP string, dnsIP string, dnsMAC string, disconnectOnPowerOff bool) error {
-	cmd := entities.CreateCommand{nameNetwork, subnet, gatewayIP, gatewayMAC, rangeIP, dnsIP, dnsMAC, disconnectOnPowerOff}
-	wrapper := entities.CommandWrapper{"create", cmd}
+func Create(ip string, port int, nameNetwork string, subnet string, gatewayIP string, gatewayMAC string, rangeIP string, dnsIP string, dnsMAC string, disconnectOnPowerOff bool, portSecurity bool, staleTimeout time.Duration, cleanupAfter time.Duration, mtu int, pipeline []entities.ModuleSpec) error {
+	cmd := entities.CreateCommand{
+		NetworkName:          nameNetwork,
+		Subnet:               subnet,
+		GatewayIP:            gatewayIP,
+		GatewayMAC:           gatewayMAC,
+		RangeIP:              rangeIP,
+		DnsIP:                dnsIP,
+		DnsMAC:               dnsMAC,
+		DisconnectOnPowerOff: disconnectOnPowerOff,
+		PortSecurity:         portSecurity,
+		StaleTimeout:         staleTimeout,
+		CleanupAfter:         cleanupAfter,
+		MTU:                  mtu,
+		Modules:              pipeline,
+	}
+	wrapper := entities.CommandWrapper{Type: entities.CreateCommandType, Command: cmd}
 
 	data, err := json.Marshal(wrapper)
 	if err != nil {
@@ -56,9 +76,8 @@ func Create(ip string, port int, nameNetwork string, subnet string, gatewayIP st
 }
 
 // Connect sends a connect VM command to the server with the specified parameters.
-func Connect(ip string, port int, nameNetwork string, vmId string) error {
-	cmd := entities.ConnectCommand{nameNetwork, vmId}
-	wrapper := entities.CommandWrapper{"connect", cmd}
+func Connect(ip string, port int, cmd entities.ConnectCommand) error {
+	wrapper := entities.CommandWrapper{Type: entities.ConnectCommandType, Command: cmd}
 
 	data, err := json.Marshal(wrapper)
 	if err != nil {
@@ -73,9 +92,9 @@ func Connect(ip string, port int, nameNetwork string, vmId string) error {
 }
 
 // Disconnect sends a disconnect VM command to the server with the specified parameters.
-func Disconnect(ip string, port int, nameNetwork string, vmId string) error {
-	cmd := entities.DisconnectCommand{nameNetwork, vmId}
-	wrapper := entities.CommandWrapper{"disconnect", cmd}
+func Disconnect(ip string, port int, nameNetwork string, vmId string, nic int) error {
+	cmd := entities.DisconnectCommand{NetworkName: nameNetwork, VmID: vmId, Nic: nic}
+	wrapper := entities.CommandWrapper{Type: entities.DisconnectCommandType, Command: cmd}
 
 	data, err := json.Marshal(wrapper)
 	if err != nil {
@@ -90,8 +109,8 @@ func Disconnect(ip string, port int, nameNetwork string, vmId string) error {
 
 // Inspect sends an inspect network command to the server with the specified network names.
 func Inspect(ip string, port int, names []string) error {
-	cmd := entities.InspectCommand{names}
-	wrapper := entities.CommandWrapper{"inspect", cmd}
+	cmd := entities.InspectCommand{NetworkNames: names}
+	wrapper := entities.CommandWrapper{Type: entities.InspectCommandType, Command: cmd}
 
 	data, err := json.Marshal(wrapper)
 	if err != nil {
@@ -107,7 +126,40 @@ func Inspect(ip string, port int, names []string) error {
 // Ls sends a list networks command to the server to retrieve all network names.
 func Ls(ip string, port int) error {
 	cmd := entities.LsCommand{}
-	wrapper := entities.CommandWrapper{"ls", cmd}
+	wrapper := entities.CommandWrapper{Type: entities.LsCommandType, Command: cmd}
+
+	data, err := json.Marshal(wrapper)
+	if err != nil {
+		log.Println("Json marshal error: ", err.Error())
+	}
+	conn, err := send(ip, port, data)
+	if err != nil {
+		return err
+	}
+	return listen(conn)
+}
+
+// Shutdown sends a shutdown command to the server to stop the daemon.
+func Shutdown(ip string, port int) error {
+	cmd := entities.ShutdownCommand{}
+	wrapper := entities.CommandWrapper{Type: entities.ShutdownCommandType, Command: cmd}
+
+	data, err := json.Marshal(wrapper)
+	if err != nil {
+		log.Println("Json marshal error: ", err.Error())
+	}
+	conn, err := send(ip, port, data)
+	if err != nil {
+		return err
+	}
+	return listen(conn)
+}
+
+// Upgrade sends an upgrade command to the server, asking the daemon to hand
+// off its networks to the new daemon listening on the Unix socket at path.
+func Upgrade(ip string, port int, path string) error {
+	cmd := entities.UpgradeCommand{Socket: path}
+	wrapper := entities.CommandWrapper{Type: entities.UpgradeCommandType, Command: cmd}
 
 	data, err := json.Marshal(wrapper)
 	if err != nil {
@@ -123,7 +175,7 @@ func Ls(ip string, port int) error {
 // Prune sends a prune command to the server to remove unused resources.
 func Prune(ip string, port int) error {
 	cmd := entities.PruneCommand{}
-	wrapper := entities.CommandWrapper{"prune", cmd}
+	wrapper := entities.CommandWrapper{Type: entities.PruneCommandType, Command: cmd}
 
 	data, err := json.Marshal(wrapper)
 	if err != nil {
@@ -138,8 +190,338 @@ func Prune(ip string, port int) error {
 
 // Rm sends a remove network command to the server with the specified network name.
 func Rm(ip string, port int, name string) error {
-	cmd := entities.RmCommand{name}
-	wrapper := entities.CommandWrapper{"rm", cmd}
+	cmd := entities.RmCommand{NetworkName: name}
+	wrapper := entities.CommandWrapper{Type: entities.RmCommandType, Command: cmd}
+
+	data, err := json.Marshal(wrapper)
+	if err != nil {
+		log.Println("Json marshal error: ", err.Error())
+	}
+	conn, err := send(ip, port, data)
+	if err != nil {
+		return err
+	}
+	return listen(conn)
+}
+
+// RouterCreate sends a create router command to the server with the specified router name.
+func RouterCreate(ip string, port int, name string) error {
+	cmd := entities.RouterCreateCommand{RouterName: name}
+	wrapper := entities.CommandWrapper{Type: entities.RouterCreateCommandType, Command: cmd}
+
+	data, err := json.Marshal(wrapper)
+	if err != nil {
+		log.Println("Json marshal error: ", err.Error())
+	}
+	conn, err := send(ip, port, data)
+	if err != nil {
+		return err
+	}
+	return listen(conn)
+}
+
+// RouterAttach sends an attach router command to the server with the specified router and network names.
+func RouterAttach(ip string, port int, name string, nameNetwork string) error {
+	cmd := entities.RouterAttachCommand{RouterName: name, NetworkName: nameNetwork}
+	wrapper := entities.CommandWrapper{Type: entities.RouterAttachCommandType, Command: cmd}
+
+	data, err := json.Marshal(wrapper)
+	if err != nil {
+		log.Println("Json marshal error: ", err.Error())
+	}
+	conn, err := send(ip, port, data)
+	if err != nil {
+		return err
+	}
+	return listen(conn)
+}
+
+// RouterRouteAdd sends an add route command to the server with the specified router, destination and next hop.
+func RouterRouteAdd(ip string, port int, name string, destination string, nextHop string) error {
+	cmd := entities.RouterRouteAddCommand{RouterName: name, Destination: destination, NextHop: nextHop}
+	wrapper := entities.CommandWrapper{Type: entities.RouterRouteAddCommandType, Command: cmd}
+
+	data, err := json.Marshal(wrapper)
+	if err != nil {
+		log.Println("Json marshal error: ", err.Error())
+	}
+	conn, err := send(ip, port, data)
+	if err != nil {
+		return err
+	}
+	return listen(conn)
+}
+
+// RouterLs sends a list routers command to the server to retrieve all routers.
+func RouterLs(ip string, port int) error {
+	cmd := entities.RouterLsCommand{}
+	wrapper := entities.CommandWrapper{Type: entities.RouterLsCommandType, Command: cmd}
+
+	data, err := json.Marshal(wrapper)
+	if err != nil {
+		log.Println("Json marshal error: ", err.Error())
+	}
+	conn, err := send(ip, port, data)
+	if err != nil {
+		return err
+	}
+	return listen(conn)
+}
+
+// NatAllow sends a command to the server adding a rule to the NAT allow-list of a network.
+func NatAllow(ip string, port int, nameNetwork string, rule string) error {
+	cmd := entities.NatAllowCommand{NetworkName: nameNetwork, Rule: rule}
+	wrapper := entities.CommandWrapper{Type: entities.NatAllowCommandType, Command: cmd}
+
+	data, err := json.Marshal(wrapper)
+	if err != nil {
+		log.Println("Json marshal error: ", err.Error())
+	}
+	conn, err := send(ip, port, data)
+	if err != nil {
+		return err
+	}
+	return listen(conn)
+}
+
+// NatRm sends a command to the server removing a rule from the NAT allow-list of a network.
+func NatRm(ip string, port int, nameNetwork string, rule string) error {
+	cmd := entities.NatRmCommand{NetworkName: nameNetwork, Rule: rule}
+	wrapper := entities.CommandWrapper{Type: entities.NatRmCommandType, Command: cmd}
+
+	data, err := json.Marshal(wrapper)
+	if err != nil {
+		log.Println("Json marshal error: ", err.Error())
+	}
+	conn, err := send(ip, port, data)
+	if err != nil {
+		return err
+	}
+	return listen(conn)
+}
+
+// PortForwardAdd sends a command to the server relaying a host port to a VM.
+func PortForwardAdd(ip string, port int, nameNetwork string, vmId string, forward string) error {
+	cmd := entities.PortForwardAddCommand{NetworkName: nameNetwork, VmID: vmId, Forward: forward}
+	wrapper := entities.CommandWrapper{Type: entities.PortForwardAddCommandType, Command: cmd}
+
+	data, err := json.Marshal(wrapper)
+	if err != nil {
+		log.Println("Json marshal error: ", err.Error())
+	}
+	conn, err := send(ip, port, data)
+	if err != nil {
+		return err
+	}
+	return listen(conn)
+}
+
+// PortForwardRm sends a command to the server removing the forward of a host port to a VM.
+func PortForwardRm(ip string, port int, nameNetwork string, vmId string, forward string) error {
+	cmd := entities.PortForwardRmCommand{NetworkName: nameNetwork, VmID: vmId, Forward: forward}
+	wrapper := entities.CommandWrapper{Type: entities.PortForwardRmCommandType, Command: cmd}
+
+	data, err := json.Marshal(wrapper)
+	if err != nil {
+		log.Println("Json marshal error: ", err.Error())
+	}
+	conn, err := send(ip, port, data)
+	if err != nil {
+		return err
+	}
+	return listen(conn)
+}
+
+// AclAdd sends a command to the server appending a rule to the ACL of a network.
+func AclAdd(ip string, port int, cmd entities.AclAddCommand) error {
+	wrapper := entities.CommandWrapper{Type: entities.AclAddCommandType, Command: cmd}
+
+	data, err := json.Marshal(wrapper)
+	if err != nil {
+		log.Println("Json marshal error: ", err.Error())
+	}
+	conn, err := send(ip, port, data)
+	if err != nil {
+		return err
+	}
+	return listen(conn)
+}
+
+// AclRm sends a command to the server removing a rule from the ACL of a network.
+func AclRm(ip string, port int, nameNetwork string, ruleID int) error {
+	cmd := entities.AclRmCommand{NetworkName: nameNetwork, RuleID: ruleID}
+	wrapper := entities.CommandWrapper{Type: entities.AclRmCommandType, Command: cmd}
+
+	data, err := json.Marshal(wrapper)
+	if err != nil {
+		log.Println("Json marshal error: ", err.Error())
+	}
+	conn, err := send(ip, port, data)
+	if err != nil {
+		return err
+	}
+	return listen(conn)
+}
+
+// AclLs sends a command to the server listing the ACL rules of a network.
+func AclLs(ip string, port int, nameNetwork string) error {
+	cmd := entities.AclLsCommand{NetworkName: nameNetwork}
+	wrapper := entities.CommandWrapper{Type: entities.AclLsCommandType, Command: cmd}
+
+	data, err := json.Marshal(wrapper)
+	if err != nil {
+		log.Println("Json marshal error: ", err.Error())
+	}
+	conn, err := send(ip, port, data)
+	if err != nil {
+		return err
+	}
+	return listen(conn)
+}
+
+// AclGroup sends a command to the server defining the VMs of an ACL group.
+func AclGroup(ip string, port int, nameNetwork string, group string, vmIds []string) error {
+	cmd := entities.AclGroupCommand{NetworkName: nameNetwork, GroupName: group, VmIDs: vmIds}
+	wrapper := entities.CommandWrapper{Type: entities.AclGroupCommandType, Command: cmd}
+
+	data, err := json.Marshal(wrapper)
+	if err != nil {
+		log.Println("Json marshal error: ", err.Error())
+	}
+	conn, err := send(ip, port, data)
+	if err != nil {
+		return err
+	}
+	return listen(conn)
+}
+
+// ModuleAdd sends a command to the server adding a module to the pipeline of a network.
+func ModuleAdd(ip string, port int, cmd entities.ModuleAddCommand) error {
+	wrapper := entities.CommandWrapper{Type: entities.ModuleAddCommandType, Command: cmd}
+
+	data, err := json.Marshal(wrapper)
+	if err != nil {
+		log.Println("Json marshal error: ", err.Error())
+	}
+	conn, err := send(ip, port, data)
+	if err != nil {
+		return err
+	}
+	return listen(conn)
+}
+
+// ModuleRm sends a command to the server removing a module from the pipeline of a network.
+func ModuleRm(ip string, port int, nameNetwork string, name string) error {
+	cmd := entities.ModuleRmCommand{NetworkName: nameNetwork, Name: name}
+	wrapper := entities.CommandWrapper{Type: entities.ModuleRmCommandType, Command: cmd}
+
+	data, err := json.Marshal(wrapper)
+	if err != nil {
+		log.Println("Json marshal error: ", err.Error())
+	}
+	conn, err := send(ip, port, data)
+	if err != nil {
+		return err
+	}
+	return listen(conn)
+}
+
+// ModuleLs sends a command to the server listing the pipeline of a network, or the modules that can be added.
+func ModuleLs(ip string, port int, nameNetwork string) error {
+	cmd := entities.ModuleLsCommand{NetworkName: nameNetwork}
+	wrapper := entities.CommandWrapper{Type: entities.ModuleLsCommandType, Command: cmd}
+
+	data, err := json.Marshal(wrapper)
+	if err != nil {
+		log.Println("Json marshal error: ", err.Error())
+	}
+	conn, err := send(ip, port, data)
+	if err != nil {
+		return err
+	}
+	return listen(conn)
+}
+
+// PeerAdd sends a command to the server peering a network with the network of another daemon sharing its VNI.
+// A vni of 0 derives the VNI from the name of the network.
+func PeerAdd(ip string, port int, nameNetwork string, address string, vni uint32) error {
+	cmd := entities.PeerAddCommand{NetworkName: nameNetwork, Address: address, VNI: vni}
+	wrapper := entities.CommandWrapper{Type: entities.PeerAddCommandType, Command: cmd}
+
+	data, err := json.Marshal(wrapper)
+	if err != nil {
+		log.Println("Json marshal error: ", err.Error())
+	}
+	conn, err := send(ip, port, data)
+	if err != nil {
+		return err
+	}
+	return listen(conn)
+}
+
+// PeerRm sends a command to the server removing a peer of a network.
+func PeerRm(ip string, port int, nameNetwork string, address string) error {
+	cmd := entities.PeerRmCommand{NetworkName: nameNetwork, Address: address}
+	wrapper := entities.CommandWrapper{Type: entities.PeerRmCommandType, Command: cmd}
+
+	data, err := json.Marshal(wrapper)
+	if err != nil {
+		log.Println("Json marshal error: ", err.Error())
+	}
+	conn, err := send(ip, port, data)
+	if err != nil {
+		return err
+	}
+	return listen(conn)
+}
+
+// PeerLs sends a command to the server listing the peers of a network, or of every network if the name is empty.
+func PeerLs(ip string, port int, nameNetwork string) error {
+	cmd := entities.PeerLsCommand{NetworkName: nameNetwork}
+	wrapper := entities.CommandWrapper{Type: entities.PeerLsCommandType, Command: cmd}
+
+	data, err := json.Marshal(wrapper)
+	if err != nil {
+		log.Println("Json marshal error: ", err.Error())
+	}
+	conn, err := send(ip, port, data)
+	if err != nil {
+		return err
+	}
+	return listen(conn)
+}
+
+// Uplink sends a command to the server bridging a network to a TAP device or a veth pair of the host.
+// A TAP device opened by this process as the file descriptor tapFd, -1 if unused, is passed to the server
+// over a Unix socket.
+func Uplink(ip string, port int, nameNetwork string, id string, tap string, tapFd int, veth string, peerName string, netns string) error {
+	cmd := entities.UplinkCommand{NetworkName: nameNetwork, ID: id, Tap: tap, Veth: veth, PeerName: peerName, Netns: netns}
+	if tapFd >= 0 {
+		cmd.TapSocket = fmt.Sprintf("/tmp/QemuUserNet_%d.tap", os.Getpid())
+		listener, err := tools.ListenFile(cmd.TapSocket)
+		if err != nil {
+			return err
+		}
+		defer listener.Close()
+		go tools.SendFile(listener, os.NewFile(uintptr(tapFd), "tap"))
+	}
+	wrapper := entities.CommandWrapper{Type: entities.UplinkCommandType, Command: cmd}
+
+	data, err := json.Marshal(wrapper)
+	if err != nil {
+		log.Println("Json marshal error: ", err.Error())
+	}
+	conn, err := send(ip, port, data)
+	if err != nil {
+		return err
+	}
+	return listen(conn)
+}
+
+// External sends a command to the server plugging a user-mode network stack process into a network.
+func External(ip string, port int, nameNetwork string, id string, socket string, helper string) error {
+	cmd := entities.ExternalCommand{NetworkName: nameNetwork, ID: id, Socket: socket, Helper: helper}
+	wrapper := entities.CommandWrapper{Type: entities.ExternalCommandType, Command: cmd}
 
 	data, err := json.Marshal(wrapper)
 	if err != nil {
@@ -0,0 +1,103 @@
+package client
+
+import (
+	"QemuUserNet/entities"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"strings"
+	"syscall"
+)
+
+// request sends a command to the server and returns its response.
+func request(ip string, port int, wrapper entities.CommandWrapper) (string, error) {
+	data, err := json.Marshal(wrapper)
+	if err != nil {
+		return "", err
+	}
+	conn, err := send(ip, port, data)
+	if err != nil {
+		return "", err
+	}
+	defer conn.Close()
+
+	buffer, err := io.ReadAll(conn)
+	if err != nil {
+		return "", err
+	}
+	return string(buffer), nil
+}
+
+// Run connects a VM to each of the given networks, starts QEMU with the
+// network arguments appended to command, and disconnects the VM from the
+// networks when QEMU exits. The network card connected to the i-th network
+// has the index i, a network can be given several times. The signals received meanwhile are forwarded to
+// QEMU. Returns the exit code of QEMU.
+func Run(ip string, port int, networks []string, vmId string, transport string, command []string) (int, error) {
+	if len(command) == 0 {
+		return 1, errors.New("No command to run")
+	}
+
+	var connected []string
+	disconnect := func() {
+		for nic, name := range connected {
+			cmd := entities.DisconnectCommand{NetworkName: name, VmID: vmId, Nic: nic}
+			if _, err := request(ip, port, entities.CommandWrapper{Type: entities.DisconnectCommandType, Command: cmd}); err != nil {
+				log.Printf("WARNING: cannot disconnect %s from %s: %s", vmId, name, err.Error())
+			}
+		}
+	}
+
+	args := append([]string{}, command[1:]...)
+	for nic, name := range networks {
+		cmd := entities.ConnectCommand{NetworkName: name, VmID: vmId, Transport: transport, Nic: nic}
+		r, err := request(ip, port, entities.CommandWrapper{Type: entities.ConnectCommandType, Command: cmd})
+		if err != nil {
+			disconnect()
+			return 1, err
+		}
+		// The network arguments are the only answer starting with an option
+		if !strings.HasPrefix(r, "-") {
+			disconnect()
+			return 1, fmt.Errorf("cannot connect to %s: %s", name, r)
+		}
+		connected = append(connected, name)
+		args = append(args, strings.Fields(r)...)
+	}
+
+	qemu := exec.Command(command[0], args...)
+	qemu.Stdin, qemu.Stdout, qemu.Stderr = os.Stdin, os.Stdout, os.Stderr
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	if err := qemu.Start(); err != nil {
+		disconnect()
+		return 1, err
+	}
+	go func() {
+		for sig := range signals {
+			qemu.Process.Signal(sig)
+		}
+	}()
+
+	err := qemu.Wait()
+	disconnect()
+
+	var exitErr *exec.ExitError
+	switch {
+	case err == nil:
+		return 0, nil
+	case errors.As(err, &exitErr):
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Signaled() {
+			return 128 + int(status.Signal()), nil
+		}
+		return exitErr.ExitCode(), nil
+	default:
+		return 1, err
+	}
+}
@@ -0,0 +1,111 @@
+package daemon
+
+import (
+	"QemuUserNet/entities"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+// networkConfig is a network of the configuration file. Its keys are the
+// options of the create command, and the options left out take their
+// defaults.
+type networkConfig struct {
+	Name                 string                       `json:"name"`
+	Subnet               string                       `json:"subnet"`
+	Gateway              string                       `json:"gateway"`
+	GatewayMac           string                       `json:"gatewaymac"`
+	RangeIp              string                       `json:"rangeip"`
+	Dns                  string                       `json:"dns"`
+	DnsMac               string                       `json:"dnsmac"`
+	DisconnectOnPowerOff bool                         `json:"disconnectOnPowerOff"`
+	PortSecurity         bool                         `json:"portsecurity"`
+	StaleTimeout         string                       `json:"staletimeout"`
+	Cleanup              string                       `json:"cleanup"`
+	Mtu                  int                          `json:"mtu"`
+	Modules              []string                     `json:"modules"`
+	ModuleConfig         map[string]map[string]string `json:"moduleconfig"`
+}
+
+// config is the configuration file of the daemon.
+type config struct {
+	Networks []networkConfig     `json:"networks"`
+	Helpers  map[string][]string `json:"helpers"` // Commands of the external helpers, by name
+}
+
+// readConfig reads the configuration file at path. Returns the create
+// commands of its networks and the commands of its external helpers.
+func readConfig(path string) ([]entities.CreateCommand, map[string][]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, nil, err
+	}
+	var conf config
+	if err := json.Unmarshal(data, &conf); err != nil {
+		return nil, nil, fmt.Errorf("invalid configuration %s: %s", path, err.Error())
+	}
+	for name, command := range conf.Helpers {
+		if name == "" || len(command) == 0 || command[0] == "" {
+			return nil, nil, fmt.Errorf("invalid configuration %s: the helper %q has no command", path, name)
+		}
+	}
+
+	var cmds []entities.CreateCommand
+	names := make(map[string]bool)
+	for _, nc := range conf.Networks {
+		if nc.Name == "" {
+			return nil, nil, fmt.Errorf("invalid configuration %s: a network has no name", path)
+		}
+		if names[nc.Name] {
+			return nil, nil, fmt.Errorf("invalid configuration %s: network %s is defined twice", path, nc.Name)
+		}
+		names[nc.Name] = true
+
+		cmd := entities.NewCreateCommand(nc.Name)
+		for _, option := range []struct {
+			value  string
+			target *string
+		}{
+			{nc.Subnet, &cmd.Subnet},
+			{nc.Gateway, &cmd.GatewayIP},
+			{nc.GatewayMac, &cmd.GatewayMAC},
+			{nc.RangeIp, &cmd.RangeIP},
+			{nc.Dns, &cmd.DnsIP},
+			{nc.DnsMac, &cmd.DnsMAC},
+		} {
+			if option.value != "" {
+				*option.target = option.value
+			}
+		}
+		cmd.DisconnectOnPowerOff = nc.DisconnectOnPowerOff
+		cmd.PortSecurity = nc.PortSecurity
+		if nc.StaleTimeout != "" {
+			if cmd.StaleTimeout, err = time.ParseDuration(nc.StaleTimeout); err != nil {
+				return nil, nil, fmt.Errorf("invalid configuration %s: network %s: %s", path, nc.Name, err.Error())
+			}
+		}
+		if nc.Cleanup != "" {
+			if cmd.CleanupAfter, err = time.ParseDuration(nc.Cleanup); err != nil {
+				return nil, nil, fmt.Errorf("invalid configuration %s: network %s: %s", path, nc.Name, err.Error())
+			}
+		}
+		if nc.Mtu != 0 {
+			cmd.MTU = nc.Mtu
+		}
+		for _, name := range nc.Modules {
+			cmd.Modules = append(cmd.Modules, entities.ModuleSpec{Name: name, Config: nc.ModuleConfig[name]})
+		}
+		for name := range nc.ModuleConfig {
+			found := false
+			for _, module := range nc.Modules {
+				found = found || module == name
+			}
+			if !found {
+				return nil, nil, fmt.Errorf("invalid configuration %s: network %s: the module %s is not in modules", path, nc.Name, name)
+			}
+		}
+		cmds = append(cmds, cmd)
+	}
+	return cmds, conf.Helpers, nil
+}
@@ -5,39 +5,194 @@ import (
 	"QemuUserNet/entities"
 	"QemuUserNet/middleware"
 	"encoding/json"
-	"fmt"
+	"errors"
+	"io"
 	"log"
 	"net"
 	"os"
+	"os/signal"
 	"strconv"
+	"sync"
+	"syscall"
+	"time"
 )
 
 var myMiddleware middleware.Middleware
 
+// drainTimeout bounds the time the commands being handled are given to
+// complete when the daemon shuts down.
+const drainTimeout = 10 * time.Second
+
+// maxCommandSize bounds the size of a command read from a client.
+const maxCommandSize = 1 << 20
+
+var (
+	handling sync.WaitGroup                // Commands being handled
+	shutdown = make(chan struct{}, 1)      // Requests of the shutdown command
+	upgrades = make(chan *net.UnixConn, 1) // Connections to the new daemons requesting an upgrade, see dialHandoff
+)
+
 // InitDaemon initializes the daemon server with the specified IP interface and port.
-func InitDaemon(ipInterface string, port int) {
+// The networks are peered with other daemons over the UDP port vxlanPort, 0 disables peering.
+// The networks of the configuration file at configPath are created, and
+// created again or removed when the daemon receives SIGHUP. With a state
+// file at statePath, the networks and the cards of the VMs are saved when the
+// daemon shuts down, and restored when it starts. With upgrade, the networks
+// of the daemon already listening on ipInterface:port are handed off to this
+// process, which then takes over the port.
+func InitDaemon(ipInterface string, port int, vxlanPort int, configPath string, statePath string, upgrade bool) {
 	myMiddleware = middleware.Middleware{}
 	err := myMiddleware.Init()
 	if err != nil {
 		log.Println("WARNING: Error initializing middleware: ", err.Error())
 	}
+	tookOver := false
+	if upgrade {
+		networks, cards, err := takeOver(ipInterface, port)
+		if err != nil {
+			log.Println("WARNING: Error taking over the running daemon: ", err.Error())
+		}
+		if networks > 0 {
+			log.Printf("INFO: took over %d networks and %d cards", networks, cards)
+		}
+		tookOver = err == nil || networks > 0
+	}
+	// The running daemon releases the port of the overlay once it handed off
+	if vxlanPort != 0 {
+		err = myMiddleware.EnableOverlay(net.JoinHostPort(ipInterface, strconv.Itoa(vxlanPort)))
+		if err != nil {
+			log.Println("WARNING: Error initializing overlay: ", err.Error())
+		}
+	}
+	if statePath != "" && !tookOver {
+		networks, cards, err := myMiddleware.RestoreState(statePath)
+		if err != nil {
+			log.Println("WARNING: Error restoring the state: ", err.Error())
+		}
+		if networks > 0 {
+			log.Printf("INFO: restored %d networks and %d cards from %s", networks, cards, statePath)
+		}
+	}
+	if configPath != "" {
+		configure(configPath)
+	}
 
-	socket, err := net.Listen("tcp", fmt.Sprintf("%s:%d", ipInterface, port))
-	if err != nil {
-		log.Panic("Socket error: ", err.Error())
-		os.Exit(0)
+	for first := true; ; first = false {
+		socket, err := net.Listen("tcp", net.JoinHostPort(ipInterface, strconv.Itoa(port)))
+		if err != nil && !first {
+			// The new daemon took over the port without acknowledging the handoff
+			log.Println("WARNING: Error listening again: ", err.Error())
+			break
+		}
+		if err != nil {
+			log.Panic("Socket error: ", err.Error())
+			os.Exit(0)
+		}
+
+		log.Println("Middleware listing " + ipInterface + ":" + strconv.Itoa(port))
+		upgradeConn := serve(socket, configPath)
+		if upgradeConn == nil {
+			break
+		}
+		if err := handoff(upgradeConn); err != nil {
+			log.Println("WARNING: Error handing off to the new daemon, serving again: ", err.Error())
+			continue
+		}
+		log.Println("INFO: networks handed off to the new daemon")
+		log.Println("INFO: daemon stopped")
+		return
+	}
+
+	if err := myMiddleware.Shutdown(statePath); err != nil {
+		log.Println("WARNING: Error saving the state: ", err.Error())
+	} else if statePath != "" {
+		log.Println("INFO: state saved to " + statePath)
 	}
-	defer socket.Close()
+	log.Println("INFO: daemon stopped")
+}
+
+// serve handles the commands received on socket until the daemon is asked
+// to shut down or to hand off its networks, then closes socket and waits for
+// the commands being handled. Returns the connection to the new daemon of an
+// upgrade, nil to shut down.
+func serve(socket net.Listener, configPath string) *net.UnixConn {
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGTERM, syscall.SIGINT, syscall.SIGHUP)
+	accepting := make(chan struct{})
+	go accept(socket, accepting)
 
-	log.Println("Middleware listing " + ipInterface + ":" + strconv.Itoa(port))
+	var upgradeConn *net.UnixConn
+	for running := true; running; {
+		select {
+		case sig := <-signals:
+			if sig == syscall.SIGHUP {
+				if configPath == "" {
+					log.Println("WARNING: SIGHUP received, but the daemon has no configuration file")
+				} else {
+					log.Println("INFO: SIGHUP received, reloading " + configPath)
+					configure(configPath)
+				}
+				continue
+			}
+			log.Println("INFO: " + sig.String() + " received, shutting down")
+			running = false
+		case <-shutdown:
+			log.Println("INFO: shutdown requested, shutting down")
+			running = false
+		case upgradeConn = <-upgrades:
+			log.Println("INFO: upgrade requested, handing off to " + upgradeConn.RemoteAddr().String())
+			running = false
+		}
+	}
+	signal.Stop(signals)
+
+	// No command is accepted any more, the commands being handled complete
+	socket.Close()
+	<-accepting
+	drained := make(chan struct{})
+	go func() {
+		handling.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-time.After(drainTimeout):
+		log.Println("WARNING: some commands did not complete before the shutdown")
+	}
+	return upgradeConn
+}
 
+// accept handles the connections of the clients until the socket is closed,
+// then closes done.
+func accept(socket net.Listener, done chan struct{}) {
+	defer close(done)
 	for {
 		conn, err := socket.Accept()
+		if errors.Is(err, net.ErrClosed) {
+			return
+		}
 		if err != nil {
 			log.Println("WARNING: Socket accept error: ", err.Error())
 			return
 		}
-		go handle(conn)
+		handling.Add(1)
+		go func() {
+			defer handling.Done()
+			handle(conn)
+		}()
+	}
+}
+
+// configure applies the configuration file at path.
+func configure(path string) {
+	cmds, helpers, err := readConfig(path)
+	if err != nil {
+		log.Println("WARNING: Error reading the configuration: ", err.Error())
+		return
+	}
+	myMiddleware.SetHelpers(helpers)
+	if err := myMiddleware.Configure(cmds); err != nil {
+		log.Println("WARNING: Error applying the configuration: ", err.Error())
 	}
 }
 
@@ -71,15 +226,14 @@ func deserialiseCommand[T any](wrapper interface{}, finalCmd T) (*T, error) {
 func handle(conn net.Conn) {
 	var wrapper entities.CommandWrapper
 
-	buffer := make([]byte, 2048)
-	l, err := conn.Read(buffer)
-	if err != nil {
+	// A command may span several reads, such as a connect command with many
+	// QEMU options
+	if err := json.NewDecoder(io.LimitReader(conn, maxCommandSize)).Decode(&wrapper); err != nil {
 		log.Println("WARNING: Socket read error: ", err.Error())
+		conn.Close()
 		return
 	}
 
-	err = json.Unmarshal(buffer[:l], &wrapper)
-
 	switch wrapper.Type {
 	case entities.CreateCommandType:
 		var cmd entities.CreateCommand
@@ -151,7 +305,241 @@ func handle(conn net.Conn) {
 		r, err := myMiddleware.Rm(*command)
 		response(conn, r, err)
 
+	case entities.RouterCreateCommandType:
+		var cmd entities.RouterCreateCommand
+		command, err := deserialiseCommand(wrapper.Command, cmd)
+		if err != nil {
+			log.Println("WARNING: deserialiseCommand error")
+		}
+		log.Println("INFO: daemon received : router create : ", *command)
+		r, err := myMiddleware.RouterCreate(*command)
+		response(conn, r, err)
+
+	case entities.RouterAttachCommandType:
+		var cmd entities.RouterAttachCommand
+		command, err := deserialiseCommand(wrapper.Command, cmd)
+		if err != nil {
+			log.Println("WARNING: deserialiseCommand error")
+		}
+		log.Println("INFO: daemon received : router attach : ", *command)
+		r, err := myMiddleware.RouterAttach(*command)
+		response(conn, r, err)
+
+	case entities.RouterRouteAddCommandType:
+		var cmd entities.RouterRouteAddCommand
+		command, err := deserialiseCommand(wrapper.Command, cmd)
+		if err != nil {
+			log.Println("WARNING: deserialiseCommand error")
+		}
+		log.Println("INFO: daemon received : router route add : ", *command)
+		r, err := myMiddleware.RouterRouteAdd(*command)
+		response(conn, r, err)
+
+	case entities.RouterLsCommandType:
+		var cmd entities.RouterLsCommand
+		command, err := deserialiseCommand(wrapper.Command, cmd)
+		if err != nil {
+			log.Println("WARNING: deserialiseCommand error")
+		}
+		log.Println("INFO: daemon received : router ls : ", *command)
+		r, err := myMiddleware.RouterLs(*command)
+		response(conn, r, err)
+
+	case entities.NatAllowCommandType:
+		var cmd entities.NatAllowCommand
+		command, err := deserialiseCommand(wrapper.Command, cmd)
+		if err != nil {
+			log.Println("WARNING: deserialiseCommand error")
+		}
+		log.Println("INFO: daemon received : nat allow : ", *command)
+		r, err := myMiddleware.NatAllow(*command)
+		response(conn, r, err)
+
+	case entities.NatRmCommandType:
+		var cmd entities.NatRmCommand
+		command, err := deserialiseCommand(wrapper.Command, cmd)
+		if err != nil {
+			log.Println("WARNING: deserialiseCommand error")
+		}
+		log.Println("INFO: daemon received : nat rm : ", *command)
+		r, err := myMiddleware.NatRm(*command)
+		response(conn, r, err)
+
+	case entities.PortForwardAddCommandType:
+		var cmd entities.PortForwardAddCommand
+		command, err := deserialiseCommand(wrapper.Command, cmd)
+		if err != nil {
+			log.Println("WARNING: deserialiseCommand error")
+		}
+		log.Println("INFO: daemon received : portforward add : ", *command)
+		r, err := myMiddleware.PortForwardAdd(*command)
+		response(conn, r, err)
+
+	case entities.PortForwardRmCommandType:
+		var cmd entities.PortForwardRmCommand
+		command, err := deserialiseCommand(wrapper.Command, cmd)
+		if err != nil {
+			log.Println("WARNING: deserialiseCommand error")
+		}
+		log.Println("INFO: daemon received : portforward rm : ", *command)
+		r, err := myMiddleware.PortForwardRm(*command)
+		response(conn, r, err)
+
+	case entities.AclAddCommandType:
+		var cmd entities.AclAddCommand
+		command, err := deserialiseCommand(wrapper.Command, cmd)
+		if err != nil {
+			log.Println("WARNING: deserialiseCommand error")
+		}
+		log.Println("INFO: daemon received : acl add : ", *command)
+		r, err := myMiddleware.AclAdd(*command)
+		response(conn, r, err)
+
+	case entities.AclRmCommandType:
+		var cmd entities.AclRmCommand
+		command, err := deserialiseCommand(wrapper.Command, cmd)
+		if err != nil {
+			log.Println("WARNING: deserialiseCommand error")
+		}
+		log.Println("INFO: daemon received : acl rm : ", *command)
+		r, err := myMiddleware.AclRm(*command)
+		response(conn, r, err)
+
+	case entities.AclLsCommandType:
+		var cmd entities.AclLsCommand
+		command, err := deserialiseCommand(wrapper.Command, cmd)
+		if err != nil {
+			log.Println("WARNING: deserialiseCommand error")
+		}
+		log.Println("INFO: daemon received : acl ls : ", *command)
+		r, err := myMiddleware.AclLs(*command)
+		response(conn, r, err)
+
+	case entities.AclGroupCommandType:
+		var cmd entities.AclGroupCommand
+		command, err := deserialiseCommand(wrapper.Command, cmd)
+		if err != nil {
+			log.Println("WARNING: deserialiseCommand error")
+		}
+		log.Println("INFO: daemon received : acl group : ", *command)
+		r, err := myMiddleware.AclGroup(*command)
+		response(conn, r, err)
+
+	case entities.ModuleAddCommandType:
+		var cmd entities.ModuleAddCommand
+		command, err := deserialiseCommand(wrapper.Command, cmd)
+		if err != nil {
+			log.Println("WARNING: deserialiseCommand error")
+		}
+		log.Println("INFO: daemon received : module add : ", *command)
+		r, err := myMiddleware.ModuleAdd(*command)
+		response(conn, r, err)
+
+	case entities.ModuleRmCommandType:
+		var cmd entities.ModuleRmCommand
+		command, err := deserialiseCommand(wrapper.Command, cmd)
+		if err != nil {
+			log.Println("WARNING: deserialiseCommand error")
+		}
+		log.Println("INFO: daemon received : module rm : ", *command)
+		r, err := myMiddleware.ModuleRm(*command)
+		response(conn, r, err)
+
+	case entities.ModuleLsCommandType:
+		var cmd entities.ModuleLsCommand
+		command, err := deserialiseCommand(wrapper.Command, cmd)
+		if err != nil {
+			log.Println("WARNING: deserialiseCommand error")
+		}
+		log.Println("INFO: daemon received : module ls : ", *command)
+		r, err := myMiddleware.ModuleLs(*command)
+		response(conn, r, err)
+
+	case entities.PeerAddCommandType:
+		var cmd entities.PeerAddCommand
+		command, err := deserialiseCommand(wrapper.Command, cmd)
+		if err != nil {
+			log.Println("WARNING: deserialiseCommand error")
+		}
+		log.Println("INFO: daemon received : peer add : ", *command)
+		r, err := myMiddleware.PeerAdd(*command)
+		response(conn, r, err)
+
+	case entities.PeerRmCommandType:
+		var cmd entities.PeerRmCommand
+		command, err := deserialiseCommand(wrapper.Command, cmd)
+		if err != nil {
+			log.Println("WARNING: deserialiseCommand error")
+		}
+		log.Println("INFO: daemon received : peer rm : ", *command)
+		r, err := myMiddleware.PeerRm(*command)
+		response(conn, r, err)
+
+	case entities.PeerLsCommandType:
+		var cmd entities.PeerLsCommand
+		command, err := deserialiseCommand(wrapper.Command, cmd)
+		if err != nil {
+			log.Println("WARNING: deserialiseCommand error")
+		}
+		log.Println("INFO: daemon received : peer ls : ", *command)
+		r, err := myMiddleware.PeerLs(*command)
+		response(conn, r, err)
+
+	case entities.UplinkCommandType:
+		var cmd entities.UplinkCommand
+		command, err := deserialiseCommand(wrapper.Command, cmd)
+		if err != nil {
+			log.Println("WARNING: deserialiseCommand error")
+		}
+		log.Println("INFO: daemon received : uplink : ", *command)
+		r, err := myMiddleware.Uplink(*command)
+		response(conn, r, err)
+
+	case entities.ExternalCommandType:
+		var cmd entities.ExternalCommand
+		command, err := deserialiseCommand(wrapper.Command, cmd)
+		if err != nil {
+			log.Println("WARNING: deserialiseCommand error")
+		}
+		log.Println("INFO: daemon received : external : ", *command)
+		r, err := myMiddleware.External(*command)
+		response(conn, r, err)
+
+	case entities.ShutdownCommandType:
+		log.Println("INFO: daemon received : shutdown")
+		response(conn, []byte("Shutting down"), nil)
+		select {
+		case shutdown <- struct{}{}:
+		default:
+		}
+
+	case entities.UpgradeCommandType:
+		var cmd entities.UpgradeCommand
+		command, err := deserialiseCommand(wrapper.Command, cmd)
+		if err != nil {
+			log.Println("WARNING: deserialiseCommand error")
+		}
+		log.Println("INFO: daemon received : upgrade : ", *command)
+		if command.Socket == "" {
+			response(conn, []byte("Invalid upgrade socket"), nil)
+			break
+		}
+		// The daemon keeps serving unless the new daemon is reached
+		upgradeConn, err := dialHandoff(command.Socket)
+		if err != nil {
+			response(conn, []byte("Cannot reach the new daemon: "+err.Error()), nil)
+			break
+		}
+		select {
+		case upgrades <- upgradeConn:
+			response(conn, []byte("Handing off to the new daemon"), nil)
+		default:
+			upgradeConn.Close()
+			response(conn, []byte("An upgrade is already in progress"), nil)
+		}
+
 	default:
 		log.Println("WARNING: Unknow command")
+		conn.Close()
 	}
 }
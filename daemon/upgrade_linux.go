@@ -0,0 +1,239 @@
+package daemon
+
+import (
+	"QemuUserNet/client"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// The running daemon hands off its networks to a new daemon process over a
+// Unix SEQPACKET socket listened on by the new process: a header, then the
+// sockets of the VMs passed with SCM_RIGHTS, then the state of the daemon,
+// the format of the state file. The new process acknowledges once it has
+// received everything.
+const (
+	handoffVersion = 1                // Version of the handoff, both processes must use the same
+	handoffBatch   = 200              // Sockets passed per message, below the limit of the kernel
+	handoffChunk   = 32 * 1024        // Bytes of the state sent per message
+	handoffTimeout = 30 * time.Second // Time the new process waits for the handoff
+	handoffAck     = "ok"             // Acknowledgement of the new process
+)
+
+// handoffHeader is the first message of a handoff.
+type handoffHeader struct {
+	Version int
+	Files   int // Number of sockets passed after the header
+	Length  int // Length of the state sent after the sockets
+}
+
+// takeOver asks the daemon listening on ipInterface:port to hand off its
+// networks to this process, and restores them. Returns the number of
+// networks and cards restored.
+func takeOver(ipInterface string, port int) (int, int, error) {
+	path := fmt.Sprintf("/tmp/QemuUserNet_%d.upgrade", os.Getpid())
+	os.Remove(path)
+	listener, err := net.ListenUnix("unixpacket", &net.UnixAddr{Name: path, Net: "unixpacket"})
+	if err != nil {
+		return 0, 0, err
+	}
+	defer listener.Close()
+	// Only a daemon of the same user can hand off its networks
+	if err := os.Chmod(path, 0600); err != nil {
+		return 0, 0, err
+	}
+
+	if err := client.Upgrade(ipInterface, port, path); err != nil {
+		return 0, 0, err
+	}
+	data, files, err := receiveHandoff(listener)
+	if err != nil {
+		return 0, 0, err
+	}
+	return myMiddleware.TakeOver(data, files)
+}
+
+// receiveHandoff accepts the connection of the running daemon and receives
+// the handoff.
+func receiveHandoff(listener *net.UnixListener) ([]byte, []*os.File, error) {
+	listener.SetDeadline(time.Now().Add(handoffTimeout))
+	conn, err := listener.AcceptUnix()
+	if err != nil {
+		return nil, nil, err
+	}
+	defer conn.Close()
+	if err := checkPeer(conn); err != nil {
+		return nil, nil, err
+	}
+	conn.SetDeadline(time.Now().Add(handoffTimeout))
+
+	buffer := make([]byte, handoffChunk)
+	l, err := conn.Read(buffer)
+	if err != nil {
+		return nil, nil, err
+	}
+	var header handoffHeader
+	if err := json.Unmarshal(buffer[:l], &header); err != nil {
+		return nil, nil, fmt.Errorf("invalid handoff header: %s", err.Error())
+	}
+	if header.Version != handoffVersion {
+		return nil, nil, fmt.Errorf("handoff version %d, expected %d", header.Version, handoffVersion)
+	}
+
+	var files []*os.File
+	closeFiles := func() {
+		for _, file := range files {
+			file.Close()
+		}
+	}
+	oob := make([]byte, syscall.CmsgSpace(handoffBatch*4))
+	for len(files) < header.Files {
+		_, oobn, flags, _, err := conn.ReadMsgUnix(buffer, oob)
+		if err != nil {
+			closeFiles()
+			return nil, nil, err
+		}
+		messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err != nil {
+			closeFiles()
+			return nil, nil, err
+		}
+		for _, message := range messages {
+			fds, err := syscall.ParseUnixRights(&message)
+			if err != nil {
+				continue
+			}
+			for _, fd := range fds {
+				files = append(files, os.NewFile(uintptr(fd), "handoff"))
+			}
+		}
+		if flags&syscall.MSG_CTRUNC != 0 {
+			closeFiles()
+			return nil, nil, errors.New("sockets of the handoff truncated")
+		}
+	}
+
+	data := make([]byte, 0, header.Length)
+	for len(data) < header.Length {
+		l, err := conn.Read(buffer)
+		if err != nil {
+			closeFiles()
+			return nil, nil, err
+		}
+		data = append(data, buffer[:l]...)
+	}
+	if _, err := conn.Write([]byte(handoffAck)); err != nil {
+		log.Println("WARNING: the handoff cannot be acknowledged: ", err.Error())
+	}
+	return data, files, nil
+}
+
+// dialHandoff connects to the new daemon process listening on the Unix
+// socket at path, and checks that it runs as the same user.
+func dialHandoff(path string) (*net.UnixConn, error) {
+	conn, err := net.DialUnix("unixpacket", nil, &net.UnixAddr{Name: path, Net: "unixpacket"})
+	if err != nil {
+		return nil, err
+	}
+	if err := checkPeer(conn); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return conn, nil
+}
+
+// checkPeer checks that the process at the other end of conn runs as the
+// same user as this process, only such a process can take over or hand off
+// the networks.
+func checkPeer(conn *net.UnixConn) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var cred *syscall.Ucred
+	var credErr error
+	if err := raw.Control(func(fd uintptr) {
+		cred, credErr = syscall.GetsockoptUcred(int(fd), syscall.SOL_SOCKET, syscall.SO_PEERCRED)
+	}); err != nil {
+		return err
+	}
+	if credErr != nil {
+		return credErr
+	}
+	if int(cred.Uid) != os.Getuid() {
+		return fmt.Errorf("the process %d runs as the user %d, not %d", cred.Pid, cred.Uid, os.Getuid())
+	}
+	return nil
+}
+
+// handoff hands off the networks to the new daemon process connected with
+// conn, see dialHandoff. If the new process does not acknowledge the
+// handoff, the networks are restored in this process, which keeps serving
+// them.
+func handoff(conn *net.UnixConn) error {
+	defer conn.Close()
+
+	data, files, err := myMiddleware.Handoff()
+	if err != nil {
+		log.Println("WARNING: Error handing off the networks: ", err.Error())
+	}
+
+	if err := sendHandoff(conn, data, files); err != nil {
+		networks, cards, restoreErr := myMiddleware.CancelHandoff(data, files)
+		if restoreErr != nil {
+			log.Println("WARNING: Error restoring the networks: ", restoreErr.Error())
+		}
+		log.Printf("INFO: restored %d networks and %d cards", networks, cards)
+		return err
+	}
+	for _, file := range files {
+		file.Close()
+	}
+	return nil
+}
+
+// sendHandoff sends the state and the sockets of the handoff, and waits for
+// the new process to acknowledge them.
+func sendHandoff(conn *net.UnixConn, data []byte, files []*os.File) error {
+	conn.SetDeadline(time.Now().Add(handoffTimeout))
+	header, err := json.Marshal(handoffHeader{Version: handoffVersion, Files: len(files), Length: len(data)})
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(header); err != nil {
+		return err
+	}
+
+	for start := 0; start < len(files); start += handoffBatch {
+		end := min(start+handoffBatch, len(files))
+		fds := make([]int, 0, end-start)
+		for _, file := range files[start:end] {
+			fds = append(fds, int(file.Fd()))
+		}
+		if _, _, err := conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(fds...), nil); err != nil {
+			return err
+		}
+	}
+
+	for start := 0; start < len(data); start += handoffChunk {
+		end := min(start+handoffChunk, len(data))
+		if _, err := conn.Write(data[start:end]); err != nil {
+			return err
+		}
+	}
+
+	ack := make([]byte, len(handoffAck))
+	l, err := conn.Read(ack)
+	if err != nil {
+		return err
+	}
+	if string(ack[:l]) != handoffAck {
+		return errors.New("handoff not acknowledged")
+	}
+	return nil
+}
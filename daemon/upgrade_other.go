@@ -0,0 +1,29 @@
+//go:build !linux
+
+package daemon
+
+import (
+	"errors"
+	"net"
+)
+
+// errUpgradeUnsupported is returned by the upgrades, which check the user of
+// the other daemon process with SO_PEERCRED.
+var errUpgradeUnsupported = errors.New("Upgrades are only supported on Linux")
+
+// takeOver is not supported on this system.
+func takeOver(ipInterface string, port int) (int, int, error) {
+	return 0, 0, errUpgradeUnsupported
+}
+
+// dialHandoff is not supported on this system, the running daemon refuses
+// the upgrade and keeps serving.
+func dialHandoff(path string) (*net.UnixConn, error) {
+	return nil, errUpgradeUnsupported
+}
+
+// handoff is not supported on this system.
+func handoff(conn *net.UnixConn) error {
+	conn.Close()
+	return errUpgradeUnsupported
+}
@@ -2,6 +2,8 @@
 // virtual machines (VMs) and network commands in a virtualized environment.
 package entities
 
+import "time"
+
 // CommandType represents the type of command issued.
 type CommandType string
 
@@ -14,6 +16,35 @@ const (
 	LsCommandType         CommandType = "ls"
 	PruneCommandType      CommandType = "prune"
 	RmCommandType         CommandType = "rm"
+	ShutdownCommandType   CommandType = "shutdown"
+	UpgradeCommandType    CommandType = "upgrade"
+
+	ModuleAddCommandType CommandType = "module-add"
+	ModuleRmCommandType  CommandType = "module-rm"
+	ModuleLsCommandType  CommandType = "module-ls"
+
+	RouterCreateCommandType   CommandType = "router-create"
+	RouterAttachCommandType   CommandType = "router-attach"
+	RouterRouteAddCommandType CommandType = "router-route-add"
+	RouterLsCommandType       CommandType = "router-ls"
+
+	NatAllowCommandType CommandType = "nat-allow"
+	NatRmCommandType    CommandType = "nat-rm"
+
+	PortForwardAddCommandType CommandType = "portforward-add"
+	PortForwardRmCommandType  CommandType = "portforward-rm"
+
+	AclAddCommandType   CommandType = "acl-add"
+	AclRmCommandType    CommandType = "acl-rm"
+	AclLsCommandType    CommandType = "acl-ls"
+	AclGroupCommandType CommandType = "acl-group"
+
+	PeerAddCommandType CommandType = "peer-add"
+	PeerRmCommandType  CommandType = "peer-rm"
+	PeerLsCommandType  CommandType = "peer-ls"
+
+	UplinkCommandType   CommandType = "uplink"
+	ExternalCommandType CommandType = "external"
 )
 
 // CommandWrapper wraps a command with its type for processing.
@@ -25,28 +56,81 @@ type CommandWrapper struct {
 // CreateCommand defines the structure for the 'create' command,
 // including network configuration details.
 type CreateCommand struct {
-	NetworkName          string // Name of the network
-	Subnet               string // Subnet address
-	GatewayIP            string // Gateway IP address
-	GatewayMAC           string // Gateway MAC address
-	RangeIP              string // Range of IP addresses
-	DnsIP                string // DNS server IP address
-	DnsMAC               string // DNS server MAC address
-	DisconnectOnPowerOff bool   // Flag to disconnect on power off
+	NetworkName          string        // Name of the network
+	Subnet               string        // Subnet address
+	GatewayIP            string        // Gateway IP address
+	GatewayMAC           string        // Gateway MAC address
+	RangeIP              string        // Range of IP addresses
+	DnsIP                string        // DNS server IP address
+	DnsMAC               string        // DNS server MAC address
+	DisconnectOnPowerOff bool          // Flag to disconnect on power off
+	PortSecurity         bool          // Flag to drop the frames sent with spoofed addresses
+	StaleTimeout         time.Duration // Time without frames after which a port is stale, 0 to never be
+	CleanupAfter         time.Duration // Time after which a stale or disconnected port is removed, 0 to keep it
+	MTU                  int           // Largest IP packet of the network, 0 for DefaultMTU
+	Modules              []ModuleSpec  `json:",omitempty"` // Pipeline of the network in order, empty for the default pipeline
+}
+
+// ModuleSpec is a module of the pipeline of a network.
+type ModuleSpec struct {
+	Name   string            // Name of the module, TYPE or TYPE:INSTANCE
+	Config map[string]string `json:",omitempty"` // Options of the module
+}
+
+// MTUs of a network, the largest IP packets its VMs exchange. The frames
+// are 14 bytes longer, with their Ethernet header.
+const (
+	DefaultMTU = 1500
+	MinMTU     = 68   // Smallest MTU of IPv4
+	MaxMTU     = 9216 // Largest jumbo frames
+)
+
+// NewCreateCommand returns the 'create' command of a network with the
+// default options.
+func NewCreateCommand(name string) CreateCommand {
+	return CreateCommand{
+		NetworkName:  name,
+		Subnet:       "10.10.10.0/24",
+		GatewayIP:    "10.10.10.1",
+		GatewayMAC:   "52:54:00:12:34:ff",
+		RangeIP:      "10.10.10.100-200",
+		DnsIP:        "10.10.10.1",
+		DnsMAC:       "52:54:00:12:34:ff",
+		StaleTimeout: 5 * time.Minute,
+		MTU:          DefaultMTU,
+	}
 }
 
 // ConnectCommand defines the structure for the 'connect' command,
-// specifying the network name and VM ID.
+// specifying the network name, VM ID, optional static IP address, transport
+// and network card.
 type ConnectCommand struct {
-	NetworkName string // Name of the network
-	VmID        string // ID of the VM
+	NetworkName string        // Name of the network
+	VmID        string        // ID of the VM
+	Ip          string        // IP address statically bound to the VM, empty to use DHCP
+	Transport   string        // Transport of the frames, "dgram", "stream", "udp" or "vhost-user", empty for dgram
+	Nic         int           // Index of the network card, -1 for the first unused index
+	Model       string        // QEMU device model of the network card, empty for virtio-net
+	NetdevID    string        // id of the QEMU netdev, empty for a generated id
+	Bus         string        // PCI bus of the network card, empty for the default bus
+	Addr        string        // PCI slot and function of the network card, empty for the first free slot
+	Queues      int           // Number of queue pairs, more than 1 for multiqueue vhost-user
+	Romfile     string        // Option ROM of the network card, "none" to disable it
+	BootIndex   int           // Boot priority of the network card, 0 to not boot from it
+	Format      string        // Format of the returned arguments, "cli", "json", "qmp" or "xml", empty for cli
+	Qmp         string        // QMP socket of a running VM to hot-plug the card into, empty to return the arguments
+	WatchQmp    string        // QMP socket watched for the power off of the VM
+	Pid         int           // PID of the QEMU process watched for the power off of the VM, 0 if unused
+	Pidfile     string        // Pidfile of the QEMU process watched for the power off of the VM
+	Grace       time.Duration // Time a powered off VM stays connected before it is disconnected
 }
 
 // DisconnectCommand defines the structure for the 'disconnect' command,
-// specifying the network name and VM ID.
+// specifying the network name, VM ID and optional network card.
 type DisconnectCommand struct {
 	NetworkName string // Name of the network
 	VmID        string // ID of the VM
+	Nic         int    // Index of the network card, -1 for all the cards of the VM
 }
 
 // InspectCommand defines the structure for the 'inspect' command,
@@ -68,3 +152,169 @@ type PruneCommand struct{}
 type RmCommand struct {
 	NetworkName string // Name of the network to remove
 }
+
+// ShutdownCommand defines the structure for the 'shutdown' command,
+// used to stop the daemon.
+type ShutdownCommand struct{}
+
+// UpgradeCommand defines the structure for the 'upgrade' command, sent by a
+// new daemon process to the running one to take over its networks.
+type UpgradeCommand struct {
+	Socket string // Path of the Unix socket the new daemon receives the handoff on
+}
+
+// RouterCreateCommand defines the structure for the 'router create' command,
+// specifying the name of the router to create.
+type RouterCreateCommand struct {
+	RouterName string // Name of the router
+}
+
+// RouterAttachCommand defines the structure for the 'router attach' command,
+// specifying the router and the network it is attached to.
+type RouterAttachCommand struct {
+	RouterName  string // Name of the router
+	NetworkName string // Name of the network
+}
+
+// RouterRouteAddCommand defines the structure for the 'router route add'
+// command, specifying a static route of a router.
+type RouterRouteAddCommand struct {
+	RouterName  string // Name of the router
+	Destination string // Destination subnet in CIDR format
+	NextHop     string // IP address of the next hop
+}
+
+// RouterLsCommand defines the structure for the 'router ls' command,
+// used to list all routers with their interfaces and routes.
+type RouterLsCommand struct{}
+
+// ModuleAddCommand defines the structure for the 'module add' command,
+// adding a module to the pipeline of a running network.
+type ModuleAddCommand struct {
+	NetworkName string     // Name of the network
+	Module      ModuleSpec // Module to add
+	Before      string     // Module it is added before, empty to add it before the switch
+	After       string     // Module it is added after, empty to add it before the switch
+}
+
+// ModuleRmCommand defines the structure for the 'module rm' command,
+// removing a module from the pipeline of a running network.
+type ModuleRmCommand struct {
+	NetworkName string // Name of the network
+	Name        string // Name of the module
+}
+
+// ModuleLsCommand defines the structure for the 'module ls' command,
+// listing the pipeline of a network with the verdicts of its modules.
+type ModuleLsCommand struct {
+	NetworkName string // Name of the network, empty to list the modules that can be added
+}
+
+// NatAllowCommand defines the structure for the 'nat allow' command,
+// specifying a rule to add to the NAT allow-list of a network.
+type NatAllowCommand struct {
+	NetworkName string // Name of the network
+	Rule        string // Rule in the format [gwport=]host:port[/tcp|udp]
+}
+
+// NatRmCommand defines the structure for the 'nat rm' command,
+// specifying the gateway port of the rule to remove.
+type NatRmCommand struct {
+	NetworkName string // Name of the network
+	Rule        string // Gateway port in the format port[/tcp|udp]
+}
+
+// PortForwardAddCommand defines the structure for the 'portforward add'
+// command, specifying a host port to relay to a VM.
+type PortForwardAddCommand struct {
+	NetworkName string // Name of the network
+	VmID        string // ID of the VM
+	Forward     string // Forward in the format [hostip:]hostport:guestport[/tcp|udp]
+}
+
+// PortForwardRmCommand defines the structure for the 'portforward rm'
+// command, specifying the host port of the forward to remove.
+type PortForwardRmCommand struct {
+	NetworkName string // Name of the network
+	VmID        string // ID of the VM
+	Forward     string // Host port in the format [hostip:]hostport[/tcp|udp]
+}
+
+// AclAddCommand defines the structure for the 'acl add' command,
+// specifying a rule to append to the ACL of a network.
+type AclAddCommand struct {
+	NetworkName string // Name of the network
+	Action      string // allow, deny or log
+	SrcMAC      string // Source MAC address
+	DstMAC      string // Destination MAC address
+	Src         string // Source IP, CIDR, vm:ID or group:NAME
+	Dst         string // Destination IP, CIDR, vm:ID or group:NAME
+	Protocol    string // Protocol matched by the rule
+	SrcPort     string // Source port or port range
+	DstPort     string // Destination port or port range
+	Stateful    bool   // Flag to allow the connections opened through the rule
+}
+
+// AclRmCommand defines the structure for the 'acl rm' command,
+// specifying the rule to remove.
+type AclRmCommand struct {
+	NetworkName string // Name of the network
+	RuleID      int    // ID of the rule
+}
+
+// AclLsCommand defines the structure for the 'acl ls' command,
+// used to list the rules of a network.
+type AclLsCommand struct {
+	NetworkName string // Name of the network
+}
+
+// AclGroupCommand defines the structure for the 'acl group' command,
+// specifying the VMs of a group.
+type AclGroupCommand struct {
+	NetworkName string   // Name of the network
+	GroupName   string   // Name of the group
+	VmIDs       []string // IDs of the VMs of the group
+}
+
+// PeerAddCommand defines the structure for the 'peer add' command, peering a
+// network with the network of another daemon sharing its VNI.
+type PeerAddCommand struct {
+	NetworkName string // Name of the network
+	Address     string // VXLAN address of the remote daemon, host[:port]
+	VNI         uint32 // VXLAN network identifier, derived from the name of the network if 0
+}
+
+// PeerRmCommand defines the structure for the 'peer rm' command.
+type PeerRmCommand struct {
+	NetworkName string // Name of the network
+	Address     string // VXLAN address of the remote daemon, host[:port]
+}
+
+// PeerLsCommand defines the structure for the 'peer ls' command, listing the
+// peers of the given network or of every network when the name is empty.
+type PeerLsCommand struct {
+	NetworkName string // Name of the network
+}
+
+// UplinkCommand defines the structure for the 'uplink' command, bridging a
+// network to a TAP device or to a veth pair. Exactly one of Tap, TapSocket
+// and Veth is set.
+type UplinkCommand struct {
+	NetworkName string // Name of the network
+	ID          string // ID of the uplink, used to disconnect it
+	Tap         string // Name of the TAP device to open
+	TapSocket   string // Socket the client passes an opened TAP device on
+	Veth        string // Name of the interface to attach, created if PeerName is set
+	PeerName    string // Name of the other end of the veth pair to create
+	Netns       string // Network namespace receiving the other end, name or PID
+}
+
+// ExternalCommand defines the structure for the 'external' command, plugging
+// a user-mode network stack process into a network. Exactly one of Socket and
+// Helper is set.
+type ExternalCommand struct {
+	NetworkName string // Name of the network
+	ID          string // ID of the port, used to disconnect it
+	Socket      string // Path of the stream socket the process listens on
+	Helper      string // Name of the helper of the configuration of the daemon to spawn
+}
@@ -0,0 +1,30 @@
+package entities
+
+import "strconv"
+
+// DefaultNICModel is the QEMU device model of a network card when none is
+// given.
+const DefaultNICModel = "virtio-net"
+
+// NIC identifies a network card of a VM. A VM can have several cards, on the
+// same network or on different networks, each card being a port of its
+// network.
+type NIC struct {
+	Index     int    // Index of the card among the cards of the VM
+	Model     string // QEMU device model of the card
+	NetdevID  string // id of the QEMU netdev of the card
+	Bus       string // PCI bus of the card, empty for the default bus
+	Addr      string // PCI slot and function of the card on its bus, empty for the first free slot
+	Queues    int    // Number of queue pairs, 0 for a single pair
+	Romfile   string // Option ROM of the card, "none" to disable it, empty for the default ROM
+	BootIndex int    // Boot priority of the card for PXE from 1, 0 to not boot from it
+}
+
+// Name returns the name of the card of a VM: the ID of the VM for its first
+// card, ID.nicN for the others.
+func (v *VM) Name() string {
+	if v.NIC.Index == 0 {
+		return v.ID
+	}
+	return v.ID + ".nic" + strconv.Itoa(v.NIC.Index)
+}
@@ -0,0 +1,108 @@
+package entities
+
+import "time"
+
+// PortState is the state of the port of a network card on the switch.
+type PortState string
+
+// States of a port. A port is created when the card is connected, waits for
+// the first frame of QEMU once its sockets are open, and is active while
+// frames flow. It becomes stale when no frame was received for the idle
+// timeout of the network or when its VM is powered off, and disconnected
+// when QEMU closes its sockets.
+const (
+	PortCreated      PortState = "created"
+	PortWaiting      PortState = "waiting"
+	PortActive       PortState = "active"
+	PortStale        PortState = "stale"
+	PortDisconnected PortState = "disconnected"
+)
+
+// NewThread creates the thread of a port in the created state.
+func NewThread(vm VM, transport Transport, uplink bool) *Thread {
+	now := time.Now()
+	return &Thread{
+		VM:        vm,
+		Done:      make(chan struct{}),
+		exited:    make(chan struct{}),
+		Transport: transport,
+		Uplink:    uplink,
+		state:     PortCreated,
+		created:   now,
+		since:     now,
+	}
+}
+
+// Exit signals that the goroutine reading the frames of the port returned.
+func (t *Thread) Exit() {
+	close(t.exited)
+}
+
+// WaitExit waits for the goroutine reading the frames of the port to return,
+// at most for timeout. Returns false if it did not return in time.
+func (t *Thread) WaitExit(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-t.exited:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// State returns the state of the port and the time it was entered.
+func (t *Thread) State() (PortState, time.Time) {
+	t.stateMu.Lock()
+	defer t.stateMu.Unlock()
+	return t.state, t.since
+}
+
+// SetState changes the state of the port.
+func (t *Thread) SetState(state PortState) {
+	t.stateMu.Lock()
+	defer t.stateMu.Unlock()
+	t.setState(state)
+}
+
+// setState changes the state of the port, the caller holding stateMu.
+func (t *Thread) setState(state PortState) {
+	if t.state != state {
+		t.state = state
+		t.since = time.Now()
+	}
+}
+
+// Received records that a frame was received on the port, which makes it
+// active.
+func (t *Thread) Received() {
+	t.stateMu.Lock()
+	defer t.stateMu.Unlock()
+	t.lastFrame = time.Now()
+	t.setState(PortActive)
+}
+
+// Created returns the time the port was created.
+func (t *Thread) Created() time.Time {
+	return t.created
+}
+
+// LastFrame returns the time the last frame was received on the port, zero
+// if none was.
+func (t *Thread) LastFrame() time.Time {
+	t.stateMu.Lock()
+	defer t.stateMu.Unlock()
+	return t.lastFrame
+}
+
+// ExpireIdle makes the port stale if it is active and no frame was received
+// for timeout. Returns whether the port became stale.
+func (t *Thread) ExpireIdle(timeout time.Duration) bool {
+	t.stateMu.Lock()
+	defer t.stateMu.Unlock()
+	if t.state != PortActive || time.Since(t.lastFrame) < timeout {
+		return false
+	}
+	t.setState(PortStale)
+	return true
+}
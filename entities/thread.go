@@ -3,105 +3,406 @@ package entities
 import (
 	"QemuUserNet/tools"
 	"errors"
+	"net"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
-// Thread represents a VM instance, including its active status and a done channel for signaling.
+// Thread represents a VM instance, including the state of its port and a done channel for signaling.
 type Thread struct {
-	VM     VM            // Virtual Machine instance
-	Active bool          // Indicates if the VM is active
-	Done   chan struct{} // Channel to signal when the VM is stopped
+	VM        VM            // Virtual Machine instance, whose Ip, StaticIp and Qmp are read with IP, StaticIP and Qmp
+	Done      chan struct{} // Channel to signal when the VM is stopped
+	exited    chan struct{} // Closed when the goroutine reading the frames of the VM returned
+	Transport Transport     // Sockets carrying the frames of the VM
+	Uplink    bool          // Indicates if the thread is an uplink to host devices rather than a VM
+
+	stopped   atomic.Bool // Indicates if Done is closed
+	watched   atomic.Bool // Indicates if the power state of the VM is watched rather than guessed from its sockets
+	stateMu   sync.Mutex  // Guards the state of the port, and the IP address and the QMP socket of the VM
+	state     PortState   // State of the port, see NewThread
+	created   time.Time   // Time the port was created
+	since     time.Time   // Time the port entered its state
+	lastFrame time.Time   // Time the last frame was received, zero if none was
 }
 
 // Stop closes the done channel to signal that the VM is stopped.
-func (t *Thread) Stop() {
+// Returns false if the VM was already stopped.
+func (t *Thread) Stop() bool {
+	if !t.stopped.CompareAndSwap(false, true) {
+		return false
+	}
 	close(t.Done)
+	return true
+}
+
+// IP returns the IP address of the VM, nil if it has none.
+func (t *Thread) IP() *string {
+	t.stateMu.Lock()
+	defer t.stateMu.Unlock()
+	return t.VM.Ip
+}
+
+// StaticIP checks if the IP address of the VM was bound when it was
+// connected.
+func (t *Thread) StaticIP() bool {
+	t.stateMu.Lock()
+	defer t.stateMu.Unlock()
+	return t.VM.StaticIp
+}
+
+// CurrentVM returns a copy of the VM, with its current IP address.
+func (t *Thread) CurrentVM() VM {
+	t.stateMu.Lock()
+	defer t.stateMu.Unlock()
+	return t.VM
+}
+
+// Qmp returns the QMP socket of the running VM the card was hot-plugged
+// into, empty if it was not.
+func (t *Thread) Qmp() string {
+	t.stateMu.Lock()
+	defer t.stateMu.Unlock()
+	return t.VM.Qmp
+}
+
+// SetQmp records the QMP socket of the running VM the card was hot-plugged
+// into.
+func (t *Thread) SetQmp(path string) {
+	t.stateMu.Lock()
+	defer t.stateMu.Unlock()
+	t.VM.Qmp = path
 }
 
-// Clients manages a collection of VM threads.
+// SetWatched records that the power state of the VM is watched.
+func (t *Thread) SetWatched() {
+	t.watched.Store(true)
+}
+
+// Watched checks if the power state of the VM is watched.
+func (t *Thread) Watched() bool {
+	return t.watched.Load()
+}
+
+// Clients is the registry of the ports of a network. Readers use an immutable
+// snapshot of the ports indexed by ID, MAC, IP and socket, which writers
+// replace on every change, so that lookups never wait for writers.
 type Clients struct {
-	Threads []*Thread
+	mu       sync.Mutex                  // Serialises the changes
+	snapshot atomic.Pointer[clientIndex] // Current ports, nil when there is none
+	fdb      fdb
+}
+
+// clientIndex is an immutable snapshot of the ports of a network.
+type clientIndex struct {
+	threads  []*Thread
+	byID     map[string][]*Thread // Cards of every VM, ordered by index
+	byNetdev map[string]*Thread
+	byMac    map[string]*Thread
+	byIP     map[string]*Thread
+	byLocal  map[string]*Thread
+	uplinks  int
+}
+
+// emptyIndex is the snapshot of a registry without ports.
+var emptyIndex = newClientIndex(nil)
+
+// newClientIndex indexes a list of ports.
+func newClientIndex(threads []*Thread) *clientIndex {
+	index := &clientIndex{
+		threads:  threads,
+		byID:     make(map[string][]*Thread),
+		byNetdev: make(map[string]*Thread),
+		byMac:    make(map[string]*Thread),
+		byIP:     make(map[string]*Thread),
+		byLocal:  make(map[string]*Thread),
+	}
+	for _, thread := range threads {
+		vm := thread.VM
+		index.byID[vm.ID] = append(index.byID[vm.ID], thread)
+		if vm.NIC.NetdevID != "" {
+			index.byNetdev[vm.NIC.NetdevID] = thread
+		}
+		if vm.Mac != "" {
+			index.byMac[vm.Mac] = thread
+		}
+		if ip := thread.IP(); ip != nil {
+			index.byIP[*ip] = thread
+		}
+		if vm.LocalSocket != "" {
+			index.byLocal[vm.LocalSocket] = thread
+		}
+		if thread.Uplink {
+			index.uplinks++
+		}
+	}
+	for _, cards := range index.byID {
+		sort.Slice(cards, func(i, j int) bool { return cards[i].VM.NIC.Index < cards[j].VM.NIC.Index })
+	}
+	return index
+}
+
+// load returns the current snapshot of the ports.
+func (c *Clients) load() *clientIndex {
+	if index := c.snapshot.Load(); index != nil {
+		return index
+	}
+	return emptyIndex
+}
+
+// fdb is the table of the MAC addresses learned behind the uplinks.
+type fdb struct {
+	mu    sync.Mutex
+	ports map[string]*Thread
+}
+
+// Threads returns the ports of the network. The slice must not be modified.
+func (c *Clients) Threads() []*Thread {
+	return c.load().threads
 }
 
-// GetClientByID retrieves a VM thread by its ID.
+// Len returns the number of ports of the network.
+func (c *Clients) Len() int {
+	return len(c.load().threads)
+}
+
+// Add adds a port to the network.
+// Returns an error if the network card or its MAC address is already connected.
+func (c *Clients) Add(thread *Thread) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	index := c.load()
+	for _, client := range index.byID[thread.VM.ID] {
+		if client.Uplink || thread.Uplink {
+			return errors.New("This ID is already used")
+		}
+		if client.VM.NIC.Index == thread.VM.NIC.Index {
+			return errors.New("This NIC of the VM is already connected")
+		}
+	}
+	if _, ok := index.byNetdev[thread.VM.NIC.NetdevID]; ok && thread.VM.NIC.NetdevID != "" {
+		return errors.New("This netdev id is already used")
+	}
+	if _, ok := index.byMac[thread.VM.Mac]; ok && thread.VM.Mac != "" {
+		return errors.New("This MAC address is already used")
+	}
+
+	threads := make([]*Thread, 0, len(index.threads)+1)
+	threads = append(append(threads, index.threads...), thread)
+	c.snapshot.Store(newClientIndex(threads))
+	return nil
+}
+
+// GetClientByID retrieves the thread of the first network card of a VM by
+// the ID of the VM.
 // Returns the thread and an error if the VM is not found.
-func (c Clients) GetClientByID(id string) (*Thread, error) {
-	for _, client := range c.Threads {
-		if client.VM.ID == id {
+func (c *Clients) GetClientByID(id string) (*Thread, error) {
+	if cards := c.load().byID[id]; len(cards) > 0 {
+		return cards[0], nil
+	}
+	return nil, errors.New("VM not found")
+}
+
+// GetClientsByID retrieves the threads of all the network cards of a VM,
+// ordered by index.
+func (c *Clients) GetClientsByID(id string) []*Thread {
+	return append([]*Thread(nil), c.load().byID[id]...)
+}
+
+// GetClientByNIC retrieves the thread of a network card by the ID of its VM
+// and its index.
+// Returns the thread and an error if the card is not found.
+func (c *Clients) GetClientByNIC(id string, index int) (*Thread, error) {
+	for _, client := range c.load().byID[id] {
+		if client.VM.NIC.Index == index {
 			return client, nil
 		}
 	}
-	return nil, errors.New("VM not found")
+	return nil, errors.New("NIC not found")
+}
+
+// GetClientByNetdevID retrieves the thread of a network card by the id of
+// its QEMU netdev.
+// Returns the thread and an error if the card is not found.
+func (c *Clients) GetClientByNetdevID(netdevID string) (*Thread, error) {
+	if client, ok := c.load().byNetdev[netdevID]; ok {
+		return client, nil
+	}
+	return nil, errors.New("NIC not found")
 }
 
 // GetClientByMac retrieves a VM thread by its MAC address.
 // Returns the thread and an error if the VM is not found.
-func (c Clients) GetClientByMac(mac string) (*Thread, error) {
-	for _, client := range c.Threads {
-		if client.VM.Mac == mac {
-			return client, nil
-		}
+func (c *Clients) GetClientByMac(mac string) (*Thread, error) {
+	if client, ok := c.load().byMac[mac]; ok {
+		return client, nil
+	}
+	return nil, errors.New("VM not found")
+}
+
+// GetClientByIP retrieves a VM thread by its IP address.
+// Returns the thread and an error if the VM is not found.
+func (c *Clients) GetClientByIP(ip string) (*Thread, error) {
+	if client, ok := c.load().byIP[ip]; ok {
+		return client, nil
+	}
+	return nil, errors.New("VM not found")
+}
+
+// GetPortByMac retrieves the thread a frame for a MAC address must be sent
+// to: the VM owning the address, or the uplink the address was learned on.
+// Returns the thread and an error if the address is unknown.
+func (c *Clients) GetPortByMac(mac string) (*Thread, error) {
+	if client, err := c.GetClientByMac(mac); err == nil {
+		return client, nil
+	}
+	c.fdb.mu.Lock()
+	defer c.fdb.mu.Unlock()
+	if port, ok := c.fdb.ports[mac]; ok {
+		return port, nil
+	}
+	return nil, errors.New("VM not found")
+}
+
+// GetPortByAddr is GetPortByMac for a MAC address in binary form, looked up
+// without allocating.
+func (c *Clients) GetPortByAddr(mac net.HardwareAddr) (*Thread, error) {
+	var buf [17]byte
+	key := tools.FormatMAC(&buf, mac)
+	if client, ok := c.load().byMac[string(key)]; ok {
+		return client, nil
+	}
+	c.fdb.mu.Lock()
+	defer c.fdb.mu.Unlock()
+	if port, ok := c.fdb.ports[string(key)]; ok {
+		return port, nil
 	}
 	return nil, errors.New("VM not found")
 }
 
+// Learn records that a MAC address is reachable through an uplink. The
+// addresses of the VMs are never learned.
+func (c *Clients) Learn(mac string, port *Thread) {
+	if _, err := c.GetClientByMac(mac); err == nil {
+		return
+	}
+	c.fdb.mu.Lock()
+	defer c.fdb.mu.Unlock()
+	if c.fdb.ports == nil {
+		c.fdb.ports = make(map[string]*Thread)
+	}
+	c.fdb.ports[mac] = port
+}
+
+// Learned returns the number of MAC addresses learned on an uplink.
+func (c *Clients) Learned(port *Thread) int {
+	c.fdb.mu.Lock()
+	defer c.fdb.mu.Unlock()
+	count := 0
+	for _, p := range c.fdb.ports {
+		if p == port {
+			count++
+		}
+	}
+	return count
+}
+
+// HasUplink checks if one of the threads is an uplink.
+func (c *Clients) HasUplink() bool {
+	return c.load().uplinks > 0
+}
+
 // GetVMs returns a slice of all VMs managed by Clients.
-func (c Clients) GetVMs() ([]VM, error) {
+func (c *Clients) GetVMs() ([]VM, error) {
 	var vm = []VM{}
-	for _, client := range c.Threads {
-		vm = append(vm, client.VM)
+	for _, client := range c.Threads() {
+		vm = append(vm, client.CurrentVM())
 	}
 	return vm, nil
 }
 
 // GetClientByLocalSocket retrieves a VM thread by its local socket.
 // Returns the thread and an error if the VM is not found.
-func (c Clients) GetClientByLocalSocket(localSock string) (*Thread, error) {
-	for _, client := range c.Threads {
-		if client.VM.LocalSocket == localSock {
-			return client, nil
-		}
+func (c *Clients) GetClientByLocalSocket(localSock string) (*Thread, error) {
+	if client, ok := c.load().byLocal[localSock]; ok {
+		return client, nil
 	}
 	return nil, errors.New("VM not found")
 }
 
-// RemoveClient removes a VM thread from the Clients list and closes its local socket.
-// Returns the updated Clients and an error if the VM is not found.
-func (c Clients) RemoveClient(client *Thread) (Clients, error) {
-	index := -1
-	for i, c := range c.Threads {
-		if client.VM.ID == c.VM.ID {
-			index = i
-			break
+// RemoveClient removes a VM thread from the Clients list and closes its transport.
+// Returns an error if the VM is not found.
+func (c *Clients) RemoveClient(client *Thread) error {
+	c.mu.Lock()
+	index := c.load()
+	threads := make([]*Thread, 0, len(index.threads))
+	for _, t := range index.threads {
+		if t != client {
+			threads = append(threads, t)
 		}
 	}
-
-	if index == -1 {
-		return c, errors.New("VM not found")
+	if len(threads) == len(index.threads) {
+		c.mu.Unlock()
+		return errors.New("VM not found")
 	}
+	c.snapshot.Store(newClientIndex(threads))
+	c.mu.Unlock()
 
-	if client.VM.LocalSock != nil {
-		client.VM.LocalSock.Close()
+	if client.Transport != nil {
+		client.Transport.Close()
 	}
+	c.fdb.mu.Lock()
+	for mac, port := range c.fdb.ports {
+		if port == client {
+			delete(c.fdb.ports, mac)
+		}
+	}
+	c.fdb.mu.Unlock()
+	return nil
+}
 
-	return Clients{
-		Threads: append(c.Threads[:index], c.Threads[index+1:]...),
-	}, nil
+// SetIP changes the IP address of a VM. static indicates if the address is
+// bound to the VM rather than leased.
+// Returns an error if the address is used by another VM.
+func (c *Clients) SetIP(client *Thread, ip string, static bool) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.setIP(client, ip, static)
+}
+
+// setIP changes the IP address of a VM, the caller holding mu.
+func (c *Clients) setIP(client *Thread, ip string, static bool) error {
+	index := c.load()
+	if owner, ok := index.byIP[ip]; ok && owner != client {
+		return errors.New("The IP address is used by another VM")
+	}
+	client.stateMu.Lock()
+	client.VM.Ip = &ip
+	client.VM.StaticIp = static
+	client.stateMu.Unlock()
+	c.snapshot.Store(newClientIndex(index.threads))
+	return nil
 }
 
 // UpdateIPIFEmpty updates the IP address of a VM if it is currently empty.
 // Returns an error if the IP is invalid or if the VM already has an IP.
-func (c Clients) UpdateIPIFEmpty(mac string, ip string) error {
+func (c *Clients) UpdateIPIFEmpty(mac string, ip string) error {
+	client, err := c.GetClientByMac(mac)
+	if err != nil {
+		return err
+	}
+	if client.IP() != nil {
+		return errors.New("The VM already has an Ip")
+	}
 	if !tools.IsUsableIP(ip) {
 		return errors.New("Ip is invalid")
 	}
-	for _, client := range c.Threads {
-		if client.VM.Mac == mac {
-			if client.VM.Ip == nil {
-				client.VM.Ip = &ip
-			} else {
-				return errors.New("The VM already has an Ip")
-			}
-		}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if client.IP() != nil {
+		return errors.New("The VM already has an Ip")
 	}
-	return errors.New("VM not found")
+	return c.setIP(client, ip, false)
 }
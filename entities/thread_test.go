@@ -0,0 +1,146 @@
+package entities
+
+import (
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+)
+
+// newTestThread returns the port of the card index of the VM id.
+func newTestThread(id string, index int) *Thread {
+	vm := VM{
+		ID:          id,
+		NIC:         NIC{Index: index, NetdevID: fmt.Sprintf("net-%s-%d", id, index)},
+		Mac:         net.HardwareAddr{0x52, 0x54, 0, 0, id[len(id)-1], byte(index)}.String(),
+		LocalSocket: fmt.Sprintf("/tmp/%s-%d.local", id, index),
+	}
+	return NewThread(vm, nil, false)
+}
+
+// checkIndex checks that the snapshot of c is consistent: every port is
+// found by each of its keys, no address is shared, and the cards of a VM are ordered.
+func checkIndex(t *testing.T, c *Clients) {
+	index := c.load()
+	ips := make(map[string]bool)
+	for _, thread := range index.threads {
+		if thread.Uplink {
+			continue
+		}
+		if found, err := c.GetClientByMac(thread.VM.Mac); err != nil || found != thread {
+			t.Errorf("%s not found by MAC address", thread.VM.Name())
+		}
+		if found, err := c.GetClientByNetdevID(thread.VM.NIC.NetdevID); err != nil || found != thread {
+			t.Errorf("%s not found by netdev id", thread.VM.Name())
+		}
+		if found, err := c.GetClientByLocalSocket(thread.VM.LocalSocket); err != nil || found != thread {
+			t.Errorf("%s not found by socket", thread.VM.Name())
+		}
+		if ip := thread.IP(); ip != nil {
+			if ips[*ip] {
+				t.Errorf("%s shared by several ports", *ip)
+			}
+			ips[*ip] = true
+		}
+	}
+	for id, cards := range index.byID {
+		for i := 1; i < len(cards); i++ {
+			if cards[i-1].VM.NIC.Index >= cards[i].VM.NIC.Index {
+				t.Errorf("cards of %s out of order", id)
+			}
+		}
+	}
+}
+
+// TestClientsConcurrent adds and removes ports, and changes their addresses,
+// while other goroutines read the snapshots. Run with -race.
+func TestClientsConcurrent(t *testing.T) {
+	const (
+		writers = 4
+		rounds  = 200
+	)
+	c := &Clients{}
+	uplink := NewThread(VM{ID: "uplink"}, nil, true)
+	if err := c.Add(uplink); err != nil {
+		t.Fatal(err)
+	}
+	c.Learn("52:54:00:ff:00:01", uplink)
+
+	var readers, wg sync.WaitGroup
+	stop := make(chan struct{})
+	for r := 0; r < 4; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			mac := net.HardwareAddr{0x52, 0x54, 0, 0xff, 0, 1}
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				for _, thread := range c.Threads() {
+					thread.CurrentVM()
+					if _, err := c.GetPortByAddr(mac); err != nil {
+						t.Error("learned address lost")
+						return
+					}
+				}
+				c.GetClientByIP("10.0.0.1")
+				c.GetVMs()
+				c.HasUplink()
+			}
+		}()
+	}
+
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			id := fmt.Sprintf("vm%d", w)
+			for i := 0; i < rounds; i++ {
+				cards := []*Thread{newTestThread(id, 1), newTestThread(id, 0)}
+				for _, card := range cards {
+					if err := c.Add(card); err != nil {
+						t.Error(err)
+						return
+					}
+				}
+				if err := c.Add(newTestThread(id, 0)); err == nil {
+					t.Error("card added twice")
+				}
+				// Every writer competes for the same addresses
+				c.SetIP(cards[0], fmt.Sprintf("10.0.0.%d", i%8+1), true)
+				c.UpdateIPIFEmpty(cards[1].VM.Mac, fmt.Sprintf("10.0.0.%d", (i+1)%8+1))
+				if got := c.GetClientsByID(id); len(got) != 2 || got[0] != cards[1] {
+					t.Errorf("cards of %s: %d", id, len(got))
+				}
+				for _, card := range cards {
+					if err := c.RemoveClient(card); err != nil {
+						t.Error(err)
+					}
+				}
+				if err := c.RemoveClient(cards[0]); err == nil {
+					t.Error("card removed twice")
+				}
+			}
+		}(w)
+	}
+	for w := 0; w < writers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				checkIndex(t, c)
+			}
+		}()
+	}
+
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+	if c.Len() != 1 || c.Learned(uplink) != 1 {
+		t.Fatalf("%d ports and %d learned addresses left", c.Len(), c.Learned(uplink))
+	}
+	checkIndex(t, c)
+}
@@ -0,0 +1,45 @@
+package entities
+
+// Transports supported between the daemon and a VM.
+const (
+	TransportDgram     = "dgram"      // Unix datagram sockets, one frame per datagram
+	TransportStream    = "stream"     // Unix stream socket, frames prefixed by their 4-byte length
+	TransportUDP       = "udp"        // UDP sockets on localhost, for QEMU builds without -netdev dgram
+	TransportVhostUser = "vhost-user" // Virtqueues in the guest memory shared over a vhost-user socket
+
+	TransportTap  = "tap"  // TAP device of the host, used by uplinks
+	TransportVeth = "veth" // Packet socket on a host interface, used by uplinks
+
+	TransportExternal = "external" // Stream socket to a user-mode network stack process
+)
+
+// Transport carries the Ethernet frames between the daemon and a VM.
+type Transport interface {
+	// ReadFrame blocks until a frame is received from the VM, copies it into
+	// buffer and returns its length.
+	ReadFrame(buffer []byte) (int, error)
+
+	// WriteFrame sends a frame to the VM.
+	WriteFrame(frame []byte) error
+
+	// Close closes the sockets of the transport and removes their files.
+	// Blocked calls to ReadFrame return an error.
+	Close() error
+}
+
+// BatchReader is implemented by the transports reading several frames with
+// one system call.
+type BatchReader interface {
+	// ReadFrames blocks until at least one frame is received from the VM,
+	// copies up to len(buffers) frames into buffers and stores their lengths
+	// in lengths. Returns the number of frames read.
+	ReadFrames(buffers [][]byte, lengths []int) (int, error)
+}
+
+// BatchWriter is implemented by the transports sending several frames with
+// one system call.
+type BatchWriter interface {
+	// WriteFrames sends frames to the VM, in order. The frames that cannot
+	// be queued are dropped like by WriteFrame.
+	WriteFrames(frames [][]byte) error
+}
@@ -1,14 +1,16 @@
 package entities
 
-import "net"
-
-// VM represents a virtual machine with network attributes.
+// VM represents a network card of a virtual machine with its network
+// attributes. A VM with several cards is represented once per card.
 type VM struct {
-	ID           string        // ID of the VM
-	Mac          string        // MAC address of the VM
-	Socket       string        // Network socket
-	RemoteSocket string        // Remote network socket
-	LocalSocket  string        // Local network socket
-	Ip           *string       // IP address of the VM
-	LocalSock    *net.UnixConn // Local Unix connection socket
+	ID           string  // ID of the VM
+	NIC          NIC     // Network card of the VM connected to the network
+	Mac          string  // MAC address of the VM
+	Socket       string  // Network socket
+	RemoteSocket string  // Remote network socket
+	LocalSocket  string  // Local network socket
+	Transport    string  // Transport of the frames, TransportDgram, TransportStream, TransportUDP or TransportVhostUser
+	Ip           *string // IP address of the VM
+	StaticIp     bool    // Indicates if the IP address was bound when the VM was connected
+	Qmp          string  // QMP socket of the running VM the card was hot-plugged into, empty otherwise
 }
@@ -3,6 +3,6 @@ module QemuUserNet
 go 1.22.0
 
 require (
-	github.com/google/gopacket v1.1.19 // indirect
-	github.com/google/uuid v1.6.0 // indirect
+	github.com/google/gopacket v1.1.19
+	github.com/google/uuid v1.6.0
 )
@@ -3,12 +3,33 @@ package main
 import (
 	"QemuUserNet/client"
 	"QemuUserNet/daemon"
+	"QemuUserNet/entities"
+	"QemuUserNet/modules"
+	"QemuUserNet/overlay"
+	"errors"
 	"flag"
 	"fmt"
 	"log"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 )
 
+// stringList is a flag that can be given several times.
+type stringList []string
+
+// String returns the values of the flag separated by commas.
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+// Set appends a value to the flag.
+func (l *stringList) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
 func main() {
 	var (
 		ip                   string
@@ -20,6 +41,29 @@ func main() {
 		dnsIP                string
 		dnsMAC               string
 		disconnectOnPowerOff bool
+		portSecurity         bool
+		staleTimeout         time.Duration
+		cleanupAfter         time.Duration
+		mtu                  int
+		vxlanPort            int
+		configPath           string
+		statePath            string
+		upgrade              bool
+		transport            string
+		nic                  int
+		connect              entities.ConnectCommand
+		aclRule              entities.AclAddCommand
+		uplink               entities.UplinkCommand
+		uplinkTapFd          int
+		externalSocket       string
+		externalHelper       string
+		runNetworks          stringList
+		runID                string
+		pipeline             string
+		pipelineConfig       stringList
+		moduleAdd            entities.ModuleAddCommand
+		moduleConfig         stringList
+		peerVNI              uint
 	)
 
 	daemonCmd := flag.NewFlagSet("daemon", flag.ExitOnError)
@@ -30,17 +74,90 @@ func main() {
 	lsCmd := flag.NewFlagSet("ls", flag.ExitOnError)
 	pruneCmd := flag.NewFlagSet("prune", flag.ExitOnError)
 	rmCmd := flag.NewFlagSet("rm", flag.ExitOnError)
+	shutdownCmd := flag.NewFlagSet("shutdown", flag.ExitOnError)
+	routerCmd := flag.NewFlagSet("router", flag.ExitOnError)
+	natCmd := flag.NewFlagSet("nat", flag.ExitOnError)
+	portForwardCmd := flag.NewFlagSet("portforward", flag.ExitOnError)
+	aclCmd := flag.NewFlagSet("acl", flag.ExitOnError)
+	peerCmd := flag.NewFlagSet("peer", flag.ExitOnError)
+	moduleCmd := flag.NewFlagSet("module", flag.ExitOnError)
+	uplinkCmd := flag.NewFlagSet("uplink", flag.ExitOnError)
+	externalCmd := flag.NewFlagSet("external", flag.ExitOnError)
+	runCmd := flag.NewFlagSet("run", flag.ExitOnError)
 
-	createCmd.StringVar(&subnet, "subnet", "10.10.10.0/24", "Subnet in CIDR format that represents a network segment")
-	createCmd.StringVar(&gatewayIP, "gateway", "10.10.10.1", "The IP address of the gateway for the network segment")
-	createCmd.StringVar(&gatewayMAC, "gatewaymac", "52:54:00:12:34:ff", "The MAC (Media Access Control) address of the gateway device")
-	createCmd.StringVar(&rangeIP, "rangeip", "10.10.10.100-200", "A range of IP addresses within the subnet that can be assigned to devices. The range is specified with a start and end IP address, indicating the pool of IP addresses available for DHCP assignment")
-	createCmd.StringVar(&dnsIP, "dns", "10.10.10.1", "The IP address of the DNS server that will be used by devices within the network segment")
-	createCmd.StringVar(&dnsMAC, "dnsmac", "52:54:00:12:34:ff", "The MAC (Media Access Control) address of the DNS server device")
+	defaults := entities.NewCreateCommand("")
+	createCmd.StringVar(&subnet, "subnet", defaults.Subnet, "Subnet in CIDR format that represents a network segment")
+	createCmd.StringVar(&gatewayIP, "gateway", defaults.GatewayIP, "The IP address of the gateway for the network segment")
+	createCmd.StringVar(&gatewayMAC, "gatewaymac", defaults.GatewayMAC, "The MAC (Media Access Control) address of the gateway device")
+	createCmd.StringVar(&rangeIP, "rangeip", defaults.RangeIP, "A range of IP addresses within the subnet that can be assigned to devices. The range is specified with a start and end IP address, indicating the pool of IP addresses available for DHCP assignment")
+	createCmd.StringVar(&dnsIP, "dns", defaults.DnsIP, "The IP address of the DNS server that will be used by devices within the network segment")
+	createCmd.StringVar(&dnsMAC, "dnsmac", defaults.DnsMAC, "The MAC (Media Access Control) address of the DNS server device")
 	createCmd.BoolVar(&disconnectOnPowerOff, "disconnectOnPowerOff", false, "Automatically disconnect the VM when it is powered off")
+	createCmd.BoolVar(&portSecurity, "portsecurity", false, "Drop the frames a VM sends with a MAC or IP address that is not its own")
+	createCmd.DurationVar(&staleTimeout, "staletimeout", defaults.StaleTimeout, "Time without frames after which the port of a VM is stale, 0 to never mark ports stale")
+	createCmd.DurationVar(&cleanupAfter, "cleanup", 0, "Time after which a stale or disconnected port is removed automatically, 0 to keep ports until prune")
+	createCmd.IntVar(&mtu, "mtu", defaults.MTU, fmt.Sprintf("Largest IP packet of the network, sent to the VMs by DHCP, from %d up to %d for jumbo frames", entities.MinMTU, entities.MaxMTU))
+	createCmd.StringVar(&pipeline, "modules", "", "Modules the frames go through, in order, separated by commas (default "+strings.Join(modules.DefaultPipeline, ",")+")")
+	createCmd.Var(&pipelineConfig, "moduleconfig", "Option of a module of -modules as MODULE.KEY=VALUE, repeat it for several options")
+
+	connectCmd.StringVar(&connect.Ip, "ip", "", "Statically bind an IP address of the subnet to the VM instead of using DHCP")
+	connectCmd.IntVar(&connect.Nic, "nic", -1, "Index of the network card of the VM, the first unused index by default")
+	connectCmd.StringVar(&connect.Model, "model", "", "QEMU device model of the network card (default virtio-net)")
+	connectCmd.StringVar(&connect.NetdevID, "netdev", "", "id of the QEMU netdev, generated by default")
+	connectCmd.StringVar(&connect.Bus, "bus", "", "PCI bus of the network card, such as pcie.0")
+	connectCmd.StringVar(&connect.Addr, "addr", "", "PCI slot and function of the network card, such as 0x3 or 0x3.0")
+	connectCmd.IntVar(&connect.Queues, "queues", 1, "Number of queue pairs of the network card, more than 1 requires vhost-user")
+	connectCmd.StringVar(&connect.Romfile, "romfile", "", "Option ROM of the network card, none to disable it")
+	connectCmd.IntVar(&connect.BootIndex, "bootindex", 0, "Boot priority of the network card, counted from 1")
+	connectCmd.StringVar(&connect.Qmp, "qmp", "", "QMP socket of a running VM to hot-plug the network card into, instead of printing its arguments")
+	connectCmd.StringVar(&connect.WatchQmp, "watchqmp", "", "QMP socket watched to disconnect the VM when it is powered off")
+	connectCmd.IntVar(&connect.Pid, "pid", 0, "PID of QEMU, watched to disconnect the VM when it exits")
+	connectCmd.StringVar(&connect.Pidfile, "pidfile", "", "Pidfile of QEMU (-pidfile), watched to disconnect the VM when it exits")
+	connectCmd.DurationVar(&connect.Grace, "grace", 0, "Time a powered off VM stays connected, in case it is started again")
+	connectCmd.StringVar(&connect.Format, "format", "cli", "Format of the arguments: cli (QEMU options), json (QEMU options in JSON), qmp (hot-plug commands) or xml (libvirt <interface>)")
+	disconnectCmd.IntVar(&nic, "nic", -1, "Index of the network card to disconnect, all the cards of the VM by default")
+	connectCmd.StringVar(&connect.Transport, "transport", "dgram", "Sockets carrying the frames: dgram (-netdev dgram), stream (-netdev stream, length-prefixed) udp (-netdev socket, for older QEMU) or vhost-user (-netdev vhost-user, requires shared guest memory)")
+
+	aclCmd.StringVar(&aclRule.Action, "action", "allow", "Action applied to the matching packets: allow, deny or log")
+	aclCmd.StringVar(&aclRule.SrcMAC, "srcmac", "", "Source MAC address")
+	aclCmd.StringVar(&aclRule.DstMAC, "dstmac", "", "Destination MAC address")
+	aclCmd.StringVar(&aclRule.Src, "src", "", "Source IP, CIDR, vm:ID or group:NAME")
+	aclCmd.StringVar(&aclRule.Dst, "dst", "", "Destination IP, CIDR, vm:ID or group:NAME")
+	aclCmd.StringVar(&aclRule.Protocol, "proto", "", "Protocol: arp, ipv4, ipv6, icmp, tcp, udp or an IP protocol number")
+	aclCmd.StringVar(&aclRule.SrcPort, "sport", "", "Source port or port range (e.g. 1000-2000)")
+	aclCmd.StringVar(&aclRule.DstPort, "dport", "", "Destination port or port range (e.g. 1000-2000)")
+	aclCmd.BoolVar(&aclRule.Stateful, "stateful", false, "Also allow the packets of the connections opened through this rule")
+
+	moduleCmd.StringVar(&moduleAdd.Before, "before", "", "Module the module is added before (default the switch)")
+	moduleCmd.StringVar(&moduleAdd.After, "after", "", "Module the module is added after")
+	moduleCmd.Var(&moduleConfig, "config", "Option of the module as KEY=VALUE, repeat it for several options")
+
+	peerCmd.UintVar(&peerVNI, "vni", 0, "VXLAN network identifier of the network, from 1 to 16777215 (default derived from the name of the network)")
+
+	uplinkCmd.StringVar(&uplink.Tap, "tap", "", "Name of the TAP device to bridge, created if it does not exist")
+	uplinkCmd.IntVar(&uplinkTapFd, "tapfd", -1, "File descriptor of a TAP device opened by this process, passed to the daemon")
+	uplinkCmd.StringVar(&uplink.Veth, "veth", "", "Name of the host interface to bridge, created as a veth pair with -peername")
+	uplinkCmd.StringVar(&uplink.PeerName, "peername", "", "Name of the other end of the veth pair to create")
+	uplinkCmd.StringVar(&uplink.Netns, "netns", "", "Network namespace (name or PID) receiving the other end of the veth pair")
+
+	externalCmd.StringVar(&externalSocket, "socket", "", "Stream socket the process listens on")
+	externalCmd.StringVar(&externalHelper, "helper", "", "Helper of the configuration of the daemon to spawn")
+
+	runCmd.Var(&runNetworks, "network", "Network to connect the VM to, repeat it for several network cards")
+	runCmd.StringVar(&runID, "id", "", "ID of the VM in the networks")
+	runCmd.StringVar(&transport, "transport", "dgram", "Sockets carrying the frames: dgram, stream, udp or vhost-user")
+
+	daemonCmd.IntVar(&vxlanPort, "vxlan", overlay.DefaultPort, "UDP port of the VXLAN tunnels to the peers, 0 disables peering")
+	daemonCmd.StringVar(&configPath, "config", "", "JSON file of the networks to create, read again on SIGHUP")
+	daemonCmd.StringVar(&statePath, "state", "", "File the networks and the cards of the VMs are saved to on shutdown, and restored from on start")
+	daemonCmd.BoolVar(&upgrade, "upgrade", false, "Take over the networks of the daemon running on the same port, without losing any frame")
 
 	flag.StringVar(&ip, "h", "0.0.0.0", "Set hostname")
 	flag.IntVar(&port, "p", 9000, "Set port")
+	for _, cmd := range []*flag.FlagSet{daemonCmd, createCmd, connectCmd, disconnectCmd, inspectCmd, lsCmd, pruneCmd, rmCmd, shutdownCmd, routerCmd, natCmd, portForwardCmd, aclCmd, peerCmd, moduleCmd, uplinkCmd, externalCmd, runCmd} {
+		cmd.StringVar(&ip, "h", "0.0.0.0", "Set hostname")
+		cmd.IntVar(&port, "p", 9000, "Set port")
+	}
 
 	flag.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s <subcommand> [options]\n", os.Args[0])
@@ -48,11 +165,21 @@ func main() {
 		fmt.Fprintf(os.Stderr, "  daemon	Start the daemon\n")
 		fmt.Fprintf(os.Stderr, "  create	Create a network\n")
 		fmt.Fprintf(os.Stderr, "  connect	Connect a vm to a network\n")
+		fmt.Fprintf(os.Stderr, "  run		Run QEMU connected to one or more networks\n")
 		fmt.Fprintf(os.Stderr, "  disconnect	Disconnect a vm to a network\n")
 		fmt.Fprintf(os.Stderr, "  inspect	Display detailed information on one or more networks\n")
 		fmt.Fprintf(os.Stderr, "  ls		List networks\n")
-		fmt.Fprintf(os.Stderr, "  prune		Remove all unsuned networks\n")
+		fmt.Fprintf(os.Stderr, "  prune		Remove the stale and disconnected ports, then the unused networks\n")
 		fmt.Fprintf(os.Stderr, "  rm		Remove one or more networks\n")
+		fmt.Fprintf(os.Stderr, "  shutdown	Stop the daemon, saving its state if it has a state file\n")
+		fmt.Fprintf(os.Stderr, "  router	Manage routers between networks\n")
+		fmt.Fprintf(os.Stderr, "  nat		Manage the host services reachable through the gateway\n")
+		fmt.Fprintf(os.Stderr, "  portforward	Manage the host ports forwarded to VMs\n")
+		fmt.Fprintf(os.Stderr, "  acl		Manage the access control list of a network\n")
+		fmt.Fprintf(os.Stderr, "  peer		Manage the peers of a network on other daemons\n")
+		fmt.Fprintf(os.Stderr, "  module	Manage the pipeline of modules of a network\n")
+		fmt.Fprintf(os.Stderr, "  uplink	Bridge a network to a TAP device or a veth pair of the host\n")
+		fmt.Fprintf(os.Stderr, "  external	Plug a user-mode network stack process (passt...) into a network\n")
 		fmt.Fprintf(os.Stderr, "\nOptions:\n")
 		flag.PrintDefaults()
 	}
@@ -60,59 +187,141 @@ func main() {
 	daemonCmd.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s daemon [options]\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\nOptions:\n")
-		flag.PrintDefaults()
 		daemonCmd.PrintDefaults()
 	}
 
 	createCmd.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s create [options] NETWORK\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\nOptions:\n")
-		flag.PrintDefaults()
 		createCmd.PrintDefaults()
 	}
 
 	connectCmd.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s connect [options] NETWORK ID\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\nOptions:\n")
-		flag.PrintDefaults()
 		connectCmd.PrintDefaults()
 	}
 
+	runCmd.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s run [options] -network NETWORK -id ID -- QEMU [ARG...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nThe VM is disconnected from the networks when QEMU exits.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		runCmd.PrintDefaults()
+	}
+
 	disconnectCmd.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s disconnect [options] NETWORK ID\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\nOptions:\n")
-		flag.PrintDefaults()
 		disconnectCmd.PrintDefaults()
 	}
 
 	inspectCmd.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s inspect [options] NETWORK [NETWORK...]\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\nOptions:\n")
-		flag.PrintDefaults()
 		inspectCmd.PrintDefaults()
 	}
 
 	lsCmd.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s ls [options]\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\nOptions:\n")
-		flag.PrintDefaults()
 		lsCmd.PrintDefaults()
 	}
 
 	pruneCmd.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s prune [options]\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\nOptions:\n")
-		flag.PrintDefaults()
 		pruneCmd.PrintDefaults()
 	}
 
 	rmCmd.Usage = func() {
 		fmt.Fprintf(os.Stderr, "Usage: %s rm [options] NETWORK [NETWORK...]\n", os.Args[0])
 		fmt.Fprintf(os.Stderr, "\nOptions:\n")
-		flag.PrintDefaults()
 		rmCmd.PrintDefaults()
 	}
 
+	shutdownCmd.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s shutdown [options]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		shutdownCmd.PrintDefaults()
+	}
+
+	routerCmd.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s router [options] <command>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nCommands:\n")
+		fmt.Fprintf(os.Stderr, "  create ROUTER			Create a router\n")
+		fmt.Fprintf(os.Stderr, "  attach ROUTER NETWORK		Attach a router to a network through its gateway address\n")
+		fmt.Fprintf(os.Stderr, "  route add ROUTER CIDR NEXTHOP	Add a static route to a router\n")
+		fmt.Fprintf(os.Stderr, "  ls				List routers\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		routerCmd.PrintDefaults()
+	}
+
+	natCmd.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s nat [options] <command>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nCommands:\n")
+		fmt.Fprintf(os.Stderr, "  allow NETWORK [GWPORT=]HOST:PORT[/tcp|udp]	Proxy the flows sent to a gateway port to a host address\n")
+		fmt.Fprintf(os.Stderr, "  rm NETWORK GWPORT[/tcp|udp]			Remove a rule from the allow-list\n")
+		fmt.Fprintf(os.Stderr, "\nPort 53/udp cannot be proxied while the dns module comes before the nat module.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		natCmd.PrintDefaults()
+	}
+
+	portForwardCmd.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s portforward [options] <command>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nCommands:\n")
+		fmt.Fprintf(os.Stderr, "  add NETWORK ID [HOSTIP:]HOSTPORT:GUESTPORT[/tcp|udp]	Relay a host port to a VM\n")
+		fmt.Fprintf(os.Stderr, "  rm NETWORK ID [HOSTIP:]HOSTPORT[/tcp|udp]		Stop relaying a host port\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		portForwardCmd.PrintDefaults()
+	}
+
+	aclCmd.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s acl <command>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nCommands:\n")
+		fmt.Fprintf(os.Stderr, "  add [options] NETWORK		Append a rule, rules are evaluated in order\n")
+		fmt.Fprintf(os.Stderr, "  rm NETWORK ID			Remove a rule\n")
+		fmt.Fprintf(os.Stderr, "  ls NETWORK			List the rules with their hit counters\n")
+		fmt.Fprintf(os.Stderr, "  group NETWORK NAME [ID,...]	Define the VMs of a group, an empty list removes it\n")
+		fmt.Fprintf(os.Stderr, "\nThe rules apply to the frames of the VMs and to the frames the NAT, the port\nforwards and the routers send to them.\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		aclCmd.PrintDefaults()
+	}
+
+	peerCmd.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s peer [options] <command>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nCommands:\n")
+		fmt.Fprintf(os.Stderr, "  add [-vni VNI] NETWORK HOST[:PORT]	Extend a network to the network of another daemon with the same VNI\n")
+		fmt.Fprintf(os.Stderr, "  rm NETWORK HOST[:PORT]	Remove a peer\n")
+		fmt.Fprintf(os.Stderr, "  ls [NETWORK]			List the peers and the health of their tunnels\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		peerCmd.PrintDefaults()
+	}
+
+	moduleCmd.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s module <command>\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nCommands:\n")
+		fmt.Fprintf(os.Stderr, "  ls [NETWORK]			List the pipeline of a network with the verdicts of its modules, or the modules available\n")
+		fmt.Fprintf(os.Stderr, "  add [options] NETWORK MODULE	Add a module, named TYPE or TYPE:INSTANCE, to a running network\n")
+		fmt.Fprintf(os.Stderr, "  rm NETWORK MODULE		Remove a module from a running network\n")
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		moduleCmd.PrintDefaults()
+	}
+
+	uplinkCmd.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s uplink [options] NETWORK ID\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nThe uplink is removed with: %s disconnect NETWORK ID\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		uplinkCmd.PrintDefaults()
+	}
+
+	externalCmd.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s external -socket PATH | -helper NAME NETWORK ID\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nThe daemon only spawns the helpers of its configuration file, with their socket as file\n")
+		fmt.Fprintf(os.Stderr, "descriptor 3. The port is removed with: %s disconnect NETWORK ID\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "\nOptions:\n")
+		externalCmd.PrintDefaults()
+	}
+
 	if len(os.Args) < 2 {
 		flag.Usage()
 		os.Exit(0)
@@ -121,14 +330,19 @@ func main() {
 	switch os.Args[1] {
 	case "daemon":
 		daemonCmd.Parse(os.Args[2:])
-		daemon.InitDaemon(ip, port)
+		daemon.InitDaemon(ip, port, vxlanPort, configPath, statePath, upgrade)
 	case "create":
 		createCmd.Parse(os.Args[2:])
 		if createCmd.NArg() != 1 {
 			createCmd.Usage()
 			os.Exit(0)
 		}
-		err := client.Create(ip, port, createCmd.Arg(0), subnet, gatewayIP, gatewayMAC, rangeIP, dnsIP, dnsMAC, disconnectOnPowerOff)
+		specs, err := parsePipeline(pipeline, pipelineConfig)
+		if err != nil {
+			log.Println("error", err.Error())
+			os.Exit(1)
+		}
+		err = client.Create(ip, port, createCmd.Arg(0), subnet, gatewayIP, gatewayMAC, rangeIP, dnsIP, dnsMAC, disconnectOnPowerOff, portSecurity, staleTimeout, cleanupAfter, mtu, specs)
 		if err != nil {
 			log.Println("error: ", err.Error())
 			os.Exit(1)
@@ -140,19 +354,32 @@ func main() {
 			connectCmd.Usage()
 			os.Exit(0)
 		}
-		err := client.Connect(ip, port, connectCmd.Arg(0), connectCmd.Arg(1))
+		connect.NetworkName = connectCmd.Arg(0)
+		connect.VmID = connectCmd.Arg(1)
+		err := client.Connect(ip, port, connect)
 		if err != nil {
 			log.Println("error: ", err.Error())
 			os.Exit(1)
 		}
 		os.Exit(0)
+	case "run":
+		runCmd.Parse(os.Args[2:])
+		if len(runNetworks) == 0 || runID == "" || runCmd.NArg() == 0 {
+			runCmd.Usage()
+			os.Exit(0)
+		}
+		code, err := client.Run(ip, port, runNetworks, runID, transport, runCmd.Args())
+		if err != nil {
+			log.Println("error: ", err.Error())
+		}
+		os.Exit(code)
 	case "disconnect":
 		disconnectCmd.Parse(os.Args[2:])
 		if disconnectCmd.NArg() != 2 {
 			disconnectCmd.Usage()
 			os.Exit(0)
 		}
-		err := client.Disconnect(ip, port, disconnectCmd.Arg(0), disconnectCmd.Arg(1))
+		err := client.Disconnect(ip, port, disconnectCmd.Arg(0), disconnectCmd.Arg(1), nic)
 		if err != nil {
 			log.Println("error", err.Error())
 			os.Exit(1)
@@ -206,8 +433,240 @@ func main() {
 			log.Println("error", err.Error())
 			os.Exit(1)
 		}
+	case "shutdown":
+		shutdownCmd.Parse(os.Args[2:])
+		if shutdownCmd.NArg() != 0 {
+			shutdownCmd.Usage()
+			os.Exit(0)
+		}
+		err := client.Shutdown(ip, port)
+		if err != nil {
+			log.Println("error", err.Error())
+			os.Exit(1)
+		}
+	case "router":
+		routerCmd.Parse(os.Args[2:])
+		var err error
+		switch {
+		case routerCmd.NArg() == 2 && routerCmd.Arg(0) == "create":
+			err = client.RouterCreate(ip, port, routerCmd.Arg(1))
+		case routerCmd.NArg() == 3 && routerCmd.Arg(0) == "attach":
+			err = client.RouterAttach(ip, port, routerCmd.Arg(1), routerCmd.Arg(2))
+		case routerCmd.NArg() == 5 && routerCmd.Arg(0) == "route" && routerCmd.Arg(1) == "add":
+			err = client.RouterRouteAdd(ip, port, routerCmd.Arg(2), routerCmd.Arg(3), routerCmd.Arg(4))
+		case routerCmd.NArg() == 1 && routerCmd.Arg(0) == "ls":
+			err = client.RouterLs(ip, port)
+		default:
+			routerCmd.Usage()
+			os.Exit(0)
+		}
+		if err != nil {
+			log.Println("error", err.Error())
+			os.Exit(1)
+		}
+	case "nat":
+		natCmd.Parse(os.Args[2:])
+		if natCmd.NArg() != 3 {
+			natCmd.Usage()
+			os.Exit(0)
+		}
+		var err error
+		switch natCmd.Arg(0) {
+		case "allow":
+			err = client.NatAllow(ip, port, natCmd.Arg(1), natCmd.Arg(2))
+		case "rm":
+			err = client.NatRm(ip, port, natCmd.Arg(1), natCmd.Arg(2))
+		default:
+			natCmd.Usage()
+			os.Exit(0)
+		}
+		if err != nil {
+			log.Println("error", err.Error())
+			os.Exit(1)
+		}
+	case "portforward":
+		portForwardCmd.Parse(os.Args[2:])
+		if portForwardCmd.NArg() != 4 {
+			portForwardCmd.Usage()
+			os.Exit(0)
+		}
+		var err error
+		switch portForwardCmd.Arg(0) {
+		case "add":
+			err = client.PortForwardAdd(ip, port, portForwardCmd.Arg(1), portForwardCmd.Arg(2), portForwardCmd.Arg(3))
+		case "rm":
+			err = client.PortForwardRm(ip, port, portForwardCmd.Arg(1), portForwardCmd.Arg(2), portForwardCmd.Arg(3))
+		default:
+			portForwardCmd.Usage()
+			os.Exit(0)
+		}
+		if err != nil {
+			log.Println("error", err.Error())
+			os.Exit(1)
+		}
+	case "acl":
+		if len(os.Args) < 3 {
+			aclCmd.Usage()
+			os.Exit(0)
+		}
+		aclCmd.Parse(os.Args[3:])
+		var err error
+		switch {
+		case os.Args[2] == "add" && aclCmd.NArg() == 1:
+			aclRule.NetworkName = aclCmd.Arg(0)
+			err = client.AclAdd(ip, port, aclRule)
+		case os.Args[2] == "rm" && aclCmd.NArg() == 2:
+			id, e := strconv.Atoi(aclCmd.Arg(1))
+			if e != nil {
+				aclCmd.Usage()
+				os.Exit(0)
+			}
+			err = client.AclRm(ip, port, aclCmd.Arg(0), id)
+		case os.Args[2] == "ls" && aclCmd.NArg() == 1:
+			err = client.AclLs(ip, port, aclCmd.Arg(0))
+		case os.Args[2] == "group" && (aclCmd.NArg() == 2 || aclCmd.NArg() == 3):
+			var vmIds []string
+			if aclCmd.NArg() == 3 && aclCmd.Arg(2) != "" {
+				vmIds = strings.Split(aclCmd.Arg(2), ",")
+			}
+			err = client.AclGroup(ip, port, aclCmd.Arg(0), aclCmd.Arg(1), vmIds)
+		default:
+			aclCmd.Usage()
+			os.Exit(0)
+		}
+		if err != nil {
+			log.Println("error", err.Error())
+			os.Exit(1)
+		}
+	case "module":
+		if len(os.Args) < 3 {
+			moduleCmd.Usage()
+			os.Exit(0)
+		}
+		moduleCmd.Parse(os.Args[3:])
+		var err error
+		switch {
+		case os.Args[2] == "ls" && moduleCmd.NArg() <= 1:
+			err = client.ModuleLs(ip, port, moduleCmd.Arg(0))
+		case os.Args[2] == "add" && moduleCmd.NArg() == 2:
+			moduleAdd.NetworkName = moduleCmd.Arg(0)
+			moduleAdd.Module = entities.ModuleSpec{Name: moduleCmd.Arg(1)}
+			if moduleAdd.Module.Config, err = parseOptions(moduleConfig); err == nil {
+				err = client.ModuleAdd(ip, port, moduleAdd)
+			}
+		case os.Args[2] == "rm" && moduleCmd.NArg() == 2:
+			err = client.ModuleRm(ip, port, moduleCmd.Arg(0), moduleCmd.Arg(1))
+		default:
+			moduleCmd.Usage()
+			os.Exit(0)
+		}
+		if err != nil {
+			log.Println("error", err.Error())
+			os.Exit(1)
+		}
+	case "uplink":
+		uplinkCmd.Parse(os.Args[2:])
+		if uplinkCmd.NArg() != 2 {
+			uplinkCmd.Usage()
+			os.Exit(0)
+		}
+		err := client.Uplink(ip, port, uplinkCmd.Arg(0), uplinkCmd.Arg(1), uplink.Tap, uplinkTapFd, uplink.Veth, uplink.PeerName, uplink.Netns)
+		if err != nil {
+			log.Println("error", err.Error())
+			os.Exit(1)
+		}
+	case "external":
+		externalCmd.Parse(os.Args[2:])
+		if externalCmd.NArg() != 2 || (externalSocket == "") == (externalHelper == "") {
+			externalCmd.Usage()
+			os.Exit(0)
+		}
+		err := client.External(ip, port, externalCmd.Arg(0), externalCmd.Arg(1), externalSocket, externalHelper)
+		if err != nil {
+			log.Println("error", err.Error())
+			os.Exit(1)
+		}
+	case "peer":
+		peerCmd.Parse(os.Args[2:])
+		// The options may come before or after the command
+		command := peerCmd.Arg(0)
+		if peerCmd.NArg() > 0 {
+			peerCmd.Parse(peerCmd.Args()[1:])
+		}
+		var err error
+		switch {
+		case command == "add" && peerCmd.NArg() == 2 && peerVNI > overlay.MaxVNI:
+			err = fmt.Errorf("The VNI must be lower than %d", overlay.MaxVNI+1)
+		case command == "add" && peerCmd.NArg() == 2:
+			err = client.PeerAdd(ip, port, peerCmd.Arg(0), peerCmd.Arg(1), uint32(peerVNI))
+		case command == "rm" && peerCmd.NArg() == 2:
+			err = client.PeerRm(ip, port, peerCmd.Arg(0), peerCmd.Arg(1))
+		case command == "ls" && peerCmd.NArg() <= 1:
+			err = client.PeerLs(ip, port, peerCmd.Arg(0))
+		default:
+			peerCmd.Usage()
+			os.Exit(0)
+		}
+		if err != nil {
+			log.Println("error", err.Error())
+			os.Exit(1)
+		}
 	default:
 		flag.Usage()
 		os.Exit(0)
 	}
 }
+
+// parsePipeline parses the -modules and -moduleconfig options of create.
+// Returns nil for the default pipeline.
+func parsePipeline(list string, config []string) ([]entities.ModuleSpec, error) {
+	var specs []entities.ModuleSpec
+	if list != "" {
+		for _, name := range strings.Split(list, ",") {
+			specs = append(specs, entities.ModuleSpec{Name: strings.TrimSpace(name)})
+		}
+	}
+	for _, option := range config {
+		name, keyValue, ok := strings.Cut(option, ".")
+		if !ok {
+			return nil, errors.New("Invalid module option " + option + ", expected MODULE.KEY=VALUE")
+		}
+		found := false
+		for i := range specs {
+			if specs[i].Name != name {
+				continue
+			}
+			options, err := parseOptions([]string{keyValue})
+			if err != nil {
+				return nil, err
+			}
+			if specs[i].Config == nil {
+				specs[i].Config = make(map[string]string)
+			}
+			for key, value := range options {
+				specs[i].Config[key] = value
+			}
+			found = true
+		}
+		if !found {
+			return nil, errors.New("The module " + name + " is not in -modules")
+		}
+	}
+	return specs, nil
+}
+
+// parseOptions parses the options of a module given as KEY=VALUE.
+func parseOptions(options []string) (map[string]string, error) {
+	if len(options) == 0 {
+		return nil, nil
+	}
+	config := make(map[string]string)
+	for _, option := range options {
+		key, value, ok := strings.Cut(option, "=")
+		if !ok || key == "" {
+			return nil, errors.New("Invalid module option " + option + ", expected KEY=VALUE")
+		}
+		config[key] = value
+	}
+	return config, nil
+}
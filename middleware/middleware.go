@@ -8,91 +8,312 @@ import (
 	"QemuUserNet/entities"
 	"QemuUserNet/modules"
 	"QemuUserNet/network"
+	"QemuUserNet/overlay"
+	"QemuUserNet/qmp"
+	"QemuUserNet/router"
 	"QemuUserNet/tools"
 	"errors"
 	"fmt"
+	"net"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 )
 
 // Middleware struct holds a slice of network pointers representing the
-// managed networks.
+// managed networks, the routers connecting them, and the overlay endpoint
+// peering them with other daemons. The commands are handled concurrently, so
+// the slices are only read through listNetworks, listRouters, getNetwork and
+// getRouter, and replaced under mu.
 type Middleware struct {
-	networks []*network.Network
+	mu         sync.RWMutex // Guards networks, specs, configured, helpers and routers
+	networks   []*network.Network
+	specs      map[string]entities.CreateCommand // Commands the networks were created with, by name
+	configured map[string]entities.CreateCommand // Networks created from the configuration file, see Configure
+	helpers    map[string][]string               // Commands of the external helpers the daemon may spawn, by name, see SetHelpers
+	routers    []*router.Router
+	overlay    *overlay.Overlay
 }
 
-// Init initializes the Middleware by creating an empty slice for networks.
+// Init initializes the Middleware by creating empty slices for networks and routers.
 func (s *Middleware) Init() error {
 	s.networks = []*network.Network{}
+	s.specs = make(map[string]entities.CreateCommand)
+	s.configured = make(map[string]entities.CreateCommand)
+	s.routers = []*router.Router{}
 
 	return nil
 }
 
+// EnableOverlay starts the VXLAN endpoint used to peer the networks with the
+// networks of other daemons, listening on the UDP address addr.
+func (s *Middleware) EnableOverlay(addr string) error {
+	ov, err := overlay.NewOverlay(addr)
+	if err != nil {
+		return err
+	}
+	s.overlay = ov
+	return nil
+}
+
 // Create initializes and adds a new network to the Middleware. It takes a
-// CreateCommand object, creates necessary network modules (DHCP, DNS, ARP,
-// and Switch), and appends the network to the Middleware's networks slice.
+// CreateCommand object, creates the modules of its pipeline (by default ARP,
+// DHCP, DNS, NAT, port forwarding, ACL and Switch), and appends the network to the Middleware's networks slice.
 // Returns the network name and any error encountered during creation.
 func (s *Middleware) Create(cmd entities.CreateCommand) ([]byte, error) {
-	_, err := s.getNetwork(cmd.NetworkName)
-	if err == nil {
-		r := []string{"This name is already in use"}
-		return []byte(strings.Join(r, "\n")), nil
+	if _, err := s.create(cmd); err != nil {
+		return []byte(err.Error()), nil
+	}
+	r := []string{cmd.NetworkName}
+	return []byte(strings.Join(r, "\n")), nil
+}
+
+// create creates a network and appends it to the networks slice, recording
+// the command it was created with. Returns the network.
+func (s *Middleware) create(cmd entities.CreateCommand) (*network.Network, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, nt := range s.networks {
+		if nt.Name == cmd.NetworkName {
+			return nil, errors.New("This name is already in use")
+		}
+	}
+
+	mtu := cmd.MTU
+	if mtu == 0 {
+		mtu = entities.DefaultMTU
+	}
+	if mtu < entities.MinMTU || mtu > entities.MaxMTU {
+		return nil, fmt.Errorf("Invalid MTU, expected %d to %d", entities.MinMTU, entities.MaxMTU)
 	}
 
-	clients := &entities.Clients{}
+	_, subnet, err := net.ParseCIDR(cmd.Subnet)
+	if err != nil {
+		return nil, err
+	}
+	gatewayMAC, err := net.ParseMAC(cmd.GatewayMAC)
+	if err != nil {
+		return nil, err
+	}
 
-	dhcp, err := modules.NewDhcp(cmd.Subnet, cmd.GatewayIP, cmd.GatewayMAC, cmd.RangeIP, cmd.DnsIP, clients)
+	nt := &network.Network{
+		Name:                 cmd.NetworkName,
+		MTU:                  mtu + 14,
+		Subnet:               subnet,
+		GatewayIP:            net.ParseIP(cmd.GatewayIP),
+		GatewayMAC:           gatewayMAC,
+		Clients:              &entities.Clients{},
+		Pipeline:             modules.NewPipeline(),
+		DisconnectOnPowerOff: cmd.DisconnectOnPowerOff,
+		StaleTimeout:         cmd.StaleTimeout,
+		CleanupAfter:         cmd.CleanupAfter}
+	if cmd.PortSecurity {
+		nt.PortSecurity = network.NewPortSecurity()
+	}
+	specs := cmd.Modules
+	if len(specs) == 0 {
+		for _, name := range modules.DefaultPipeline {
+			specs = append(specs, entities.ModuleSpec{Name: name})
+		}
+	}
+	for _, spec := range specs {
+		if err := insertModule(nt, cmd, spec, -1); err != nil {
+			closeModules(nt.ModuleChain())
+			return nil, err
+		}
+	}
+
+	s.networks = append(append([]*network.Network(nil), s.networks...), nt)
+	s.specs[cmd.NetworkName] = cmd
+	nt.Start()
+	return nt, nil
+}
+
+// Connect attaches a virtual machine (VM) to the specified network. It takes
+// a ConnectCommand object, adds the VM to the network, and returns the network
+// command required for the VM to join the network, along with any error encountered.
+// With a QMP socket, the card is hot-plugged into the running VM instead and
+// the id of the device is returned.
+func (s *Middleware) Connect(cmd entities.ConnectCommand) ([]byte, error) {
+	nt, err := s.getNetwork(cmd.NetworkName)
+	if err != nil {
+		return []byte(err.Error()), nil
+	}
+	transport := cmd.Transport
+	if transport == "" {
+		transport = entities.TransportDgram
+	}
+	model := cmd.Model
+	if model == "" && transport == entities.TransportVhostUser {
+		model = "virtio-net-pci"
+	}
+	if transport == entities.TransportVhostUser && !strings.HasPrefix(model, "virtio-net") {
+		return []byte("vhost-user requires a virtio-net device model"), nil
+	}
+	if cmd.Queues > 1 && transport != entities.TransportVhostUser {
+		return []byte("Several queues require the vhost-user transport"), nil
+	}
+	if cmd.Queues > network.VhostUserMaxQueues {
+		return []byte(fmt.Sprintf("At most %d queues are supported", network.VhostUserMaxQueues)), nil
+	}
+	nic := entities.NIC{
+		Index:     cmd.Nic,
+		Model:     model,
+		NetdevID:  cmd.NetdevID,
+		Bus:       cmd.Bus,
+		Addr:      cmd.Addr,
+		Queues:    cmd.Queues,
+		Romfile:   cmd.Romfile,
+		BootIndex: cmd.BootIndex,
+	}
+	vm, err := nt.AddVM(cmd.VmID, nic, transport)
 	if err != nil {
 		return []byte(err.Error()), nil
 	}
-	dns, err := modules.NewDns(cmd.DnsIP, cmd.DnsMAC, clients)
+	if cmd.Ip != "" {
+		if err := nt.BindIP(cmd.VmID, vm.NIC.Index, cmd.Ip); err != nil {
+			nt.RemoveNIC(cmd.VmID, vm.NIC.Index)
+			return []byte(err.Error()), nil
+		}
+	}
+	if cmd.WatchQmp != "" || cmd.Pid != 0 || cmd.Pidfile != "" {
+		liveness := network.LivenessConfig{Qmp: cmd.WatchQmp, Pid: cmd.Pid, Pidfile: cmd.Pidfile, Grace: cmd.Grace}
+		if err := nt.Watch(cmd.VmID, vm.NIC.Index, liveness); err != nil {
+			nt.RemoveNIC(cmd.VmID, vm.NIC.Index)
+			return []byte(err.Error()), nil
+		}
+	}
+	if cmd.Qmp != "" {
+		if err := qmp.HotPlug(cmd.Qmp, qemuNIC(vm)); err != nil {
+			nt.RemoveNIC(cmd.VmID, vm.NIC.Index)
+			return []byte(err.Error()), nil
+		}
+		if client, err := nt.Clients.GetClientByNIC(cmd.VmID, vm.NIC.Index); err == nil {
+			client.SetQmp(cmd.Qmp)
+		}
+		return []byte(tools.DeviceID(vm.NIC.NetdevID)), nil
+	}
+	args, err := tools.CraftQemuNetworkArgs(cmd.Format, qemuNIC(vm))
 	if err != nil {
+		nt.RemoveNIC(cmd.VmID, vm.NIC.Index)
 		return []byte(err.Error()), nil
 	}
-	ar, err := modules.NewAddressResolution(clients)
+	return args, nil
+}
+
+// qemuNIC returns the description of the netdev and the network card of a
+// VM used to generate its QEMU arguments.
+func qemuNIC(vm *entities.VM) tools.QemuNIC {
+	return tools.QemuNIC{
+		Transport:    vm.Transport,
+		NetdevID:     vm.NIC.NetdevID,
+		RemoteSocket: vm.RemoteSocket,
+		LocalSocket:  vm.LocalSocket,
+		Mac:          vm.Mac,
+		Model:        vm.NIC.Model,
+		Bus:          vm.NIC.Bus,
+		Addr:         vm.NIC.Addr,
+		Queues:       vm.NIC.Queues,
+		Romfile:      vm.NIC.Romfile,
+		BootIndex:    vm.NIC.BootIndex,
+	}
+}
+
+// Uplink bridges the specified network to a TAP device or a veth pair of the
+// host. Returns the name of the device if successful or an error message. The
+// uplink is removed with Disconnect.
+func (s *Middleware) Uplink(cmd entities.UplinkCommand) ([]byte, error) {
+	nt, err := s.getNetwork(cmd.NetworkName)
 	if err != nil {
 		return []byte(err.Error()), nil
 	}
-	vswitch, err := modules.NewSwitch(clients)
+	config := network.UplinkConfig{Tap: cmd.Tap, TapFd: -1, Veth: cmd.Veth, PeerName: cmd.PeerName, Netns: cmd.Netns}
+	if cmd.TapSocket != "" {
+		if config.TapFd, err = tools.ReceiveFile(cmd.TapSocket); err != nil {
+			return []byte("Cannot receive the TAP device: " + err.Error()), nil
+		}
+	}
+	vm, err := nt.AddUplink(cmd.ID, config)
 	if err != nil {
 		return []byte(err.Error()), nil
 	}
+	return []byte(vm.Socket), nil
+}
 
-	s.networks = append(
-		s.networks,
-		&network.Network{
-			Name:                 cmd.NetworkName,
-			MTU:                  1500 + 14,
-			Modules:              []modules.Module{ar, dhcp, dns, vswitch},
-			Clients:              clients,
-			DisconnectOnPowerOff: cmd.DisconnectOnPowerOff})
-	r := []string{cmd.NetworkName}
-	return []byte(strings.Join(r, "\n")), nil
+// SetHelpers sets the external helpers the daemon may spawn, their commands
+// by name. The clients only choose a helper by its name, the commands come
+// from the configuration of the daemon.
+func (s *Middleware) SetHelpers(helpers map[string][]string) {
+	s.mu.Lock()
+	s.helpers = helpers
+	s.mu.Unlock()
 }
 
-// Connect attaches a virtual machine (VM) to the specified network. It takes
-// a ConnectCommand object, adds the VM to the network, and returns the network
-// command required for the VM to join the network, along with any error encountered.
-func (s *Middleware) Connect(cmd entities.ConnectCommand) ([]byte, error) {
-	net, err := s.getNetwork(cmd.NetworkName)
+// External plugs a user-mode network stack process into the specified
+// network, connecting to its socket or spawning one of the helpers of the
+// configuration. Returns the socket or the program of the process if
+// successful or an error message. The port is removed with Disconnect.
+func (s *Middleware) External(cmd entities.ExternalCommand) ([]byte, error) {
+	nt, err := s.getNetwork(cmd.NetworkName)
 	if err != nil {
 		return []byte(err.Error()), nil
 	}
-	vm, err := net.AddVM(cmd.VmID)
+	var command []string
+	if cmd.Helper != "" {
+		s.mu.RLock()
+		command = s.helpers[cmd.Helper]
+		s.mu.RUnlock()
+		if command == nil {
+			return []byte("Unknown helper " + cmd.Helper + ", the helpers are set in the configuration of the daemon"), nil
+		}
+	}
+	vm, err := nt.AddExternal(cmd.ID, network.ExternalConfig{Socket: cmd.Socket, Command: command})
 	if err != nil {
 		return []byte(err.Error()), nil
 	}
-	return tools.CraftQemuNetworkCommand(vm.Socket, vm.RemoteSocket, vm.LocalSocket, vm.Mac), nil
+	return []byte(vm.Socket), nil
 }
 
 // Disconnect removes a VM from the specified network. It takes a DisconnectCommand
 // object, removes the VM from the network, and returns the VM ID along with any
-// error encountered.
+// error encountered. The hot-plugged cards are unplugged from the VM first.
 func (s *Middleware) Disconnect(cmd entities.DisconnectCommand) ([]byte, error) {
-	net, err := s.getNetwork(cmd.NetworkName)
+	nt, err := s.getNetwork(cmd.NetworkName)
 	if err != nil {
 		return []byte(err.Error()), nil
 	}
-	net.RemoveVM(cmd.VmID)
+	clients := nt.Clients.GetClientsByID(cmd.VmID)
+	if cmd.Nic >= 0 {
+		client, err := nt.Clients.GetClientByNIC(cmd.VmID, cmd.Nic)
+		if err != nil {
+			return []byte(err.Error()), nil
+		}
+		clients = []*entities.Thread{client}
+	}
+
+	// Hot-plugged cards are unplugged before their sockets are closed. The
+	// cards are removed from the network even if the VM cannot be reached.
+	var unplugErrors []string
+	for _, client := range clients {
+		if client.Qmp() == "" {
+			continue
+		}
+		vm := client.CurrentVM()
+		if err := qmp.HotUnplug(vm.Qmp, qemuNIC(&vm)); err != nil {
+			unplugErrors = append(unplugErrors, client.VM.Name()+": "+err.Error())
+		}
+	}
+	if cmd.Nic >= 0 {
+		if err := nt.RemoveNIC(cmd.VmID, cmd.Nic); err != nil {
+			return []byte(err.Error()), nil
+		}
+	} else {
+		nt.RemoveVM(cmd.VmID)
+	}
+	if len(unplugErrors) > 0 {
+		return []byte("Disconnected, but the unplug failed: " + strings.Join(unplugErrors, ", ")), nil
+	}
 	return []byte(cmd.VmID), nil
 }
 
@@ -100,19 +321,46 @@ func (s *Middleware) Disconnect(cmd entities.DisconnectCommand) ([]byte, error)
 // an InspectCommand object, retrieves information about each VM in the networks,
 // and returns the details as a formatted byte slice along with any error encountered.
 func (s *Middleware) Inspect(cmd entities.InspectCommand) ([]byte, error) {
-	r := []string{"ID	Mac Address		Ip		Socket"}
-	for _, network := range s.networks {
+	r := []string{"ID	NIC	MODEL		Mac Address		Ip		State		Since			Last frame		Socket"}
+	for _, network := range s.listNetworks() {
 		for _, selectedNetwork := range cmd.NetworkNames {
 			if network.Name == selectedNetwork {
 				r = append(r, "-"+selectedNetwork+"-------------------------------------------------------------------------------------------")
-				vms, _ := network.Clients.GetVMs()
-				for _, vm := range vms {
-					if vm.Ip == nil {
-						r = append(r, vm.ID+"	"+vm.Mac+"	"+"None	"+"	"+vm.Socket)
+				for _, client := range network.Clients.Threads() {
+					vm := client.CurrentVM()
+					state, since := client.State()
+					lastFrame := "None			"
+					if t := client.LastFrame(); !t.IsZero() {
+						lastFrame = t.Format(time.RFC3339) + "	"
+					}
+					port := string(state) + "	"
+					if len(state) < 8 {
+						port += "	"
+					}
+					port += since.Format(time.RFC3339) + "	" + lastFrame + "	" + vm.Socket
+					nic := strconv.Itoa(vm.NIC.Index) + "	" + vm.NIC.Model + "	"
+					if vm.Mac == "" {
+						r = append(r, vm.ID+"	-	uplink		"+vm.Transport+"			"+"None	"+"	"+port)
+					} else if vm.Ip == nil {
+						r = append(r, vm.ID+"	"+nic+vm.Mac+"	"+"None	"+"	"+port)
 					} else {
-						r = append(r, vm.ID+"	"+vm.Mac+"	"+*vm.Ip+"	"+vm.Socket)
+						r = append(r, vm.ID+"	"+nic+vm.Mac+"	"+*vm.Ip+"	"+port)
 					}
 				}
+				if nat := getNat(network); nat != nil {
+					r = append(r, nat.Describe()...)
+				}
+				if portForward := getPortForward(network); portForward != nil {
+					r = append(r, portForward.Describe()...)
+				}
+				if s.overlay != nil {
+					if segment := s.overlay.Segment(network); segment != nil {
+						r = append(r, segment.Describe()...)
+					}
+				}
+				if network.PortSecurity != nil {
+					r = append(r, network.PortSecurity.Describe()...)
+				}
 			}
 		}
 	}
@@ -124,17 +372,34 @@ func (s *Middleware) Inspect(cmd entities.InspectCommand) ([]byte, error) {
 // with any error encountered.
 func (s *Middleware) Ls(cmd entities.LsCommand) ([]byte, error) {
 	r := []string{"NAME", "----"}
-	for _, network := range s.networks {
+	for _, network := range s.listNetworks() {
 		r = append(r, network.Name)
 	}
 
 	return []byte(strings.Join(r, "\n")), nil
 }
 
-// Prune is a placeholder method for pruning unused resources. Currently, it is not
-// implemented and returns a "Not implemented" message.
+// Prune removes the ports of the VMs that are stale or disconnected, then the
+// networks left without any port. Returns the removed ports and networks.
 func (s *Middleware) Prune(cmd entities.PruneCommand) ([]byte, error) {
-	r := []string{"Not implemented"}
+	r := []string{"NETWORK	PORT	STATE", "-------	----	-----"}
+	var unused []*network.Network
+	for _, nt := range s.listNetworks() {
+		for _, port := range nt.Prune() {
+			r = append(r, nt.Name+"	"+port.Name+"	"+string(port.State))
+		}
+		if nt.Clients.Len() == 0 {
+			unused = append(unused, nt)
+		}
+	}
+	for _, nt := range unused {
+		// A VM may have been connected meanwhile
+		if s.removeNetwork(nt.Name, true) == nil {
+			continue
+		}
+		s.stopNetwork(nt, false)
+		r = append(r, nt.Name+"	-	unused")
+	}
 	return []byte(strings.Join(r, "\n")), nil
 }
 
@@ -142,40 +407,562 @@ func (s *Middleware) Prune(cmd entities.PruneCommand) ([]byte, error) {
 // the specified network, and removes it from the Middleware's networks slice.
 // Returns the network name if successful or an error message if the network is not found.
 func (s *Middleware) Rm(cmd entities.RmCommand) ([]byte, error) {
-	var updatedList []*network.Network
 	var r = []string{}
 
-	removed := false
-	for _, net := range s.networks {
-		if cmd.NetworkName != net.Name {
-			updatedList = append(updatedList, net)
-		} else {
-			err := net.Stop()
-			if err != nil {
-				str := fmt.Sprintf("Error: cannot remove the network : %s", err.Error())
-				r = []string{str}
-				return []byte(strings.Join(r, "\n")), nil
-			}
-			removed = true
-		}
-	}
-	s.networks = updatedList
-	if removed {
-		r = []string{cmd.NetworkName}
-	} else {
+	nt := s.removeNetwork(cmd.NetworkName, false)
+	if nt == nil {
 		str := fmt.Sprintf("Error: unable to find network with name %s: network not found", cmd.NetworkName)
 		r = []string{str}
+		return []byte(strings.Join(r, "\n")), nil
+	}
+	if err := s.stopNetwork(nt, false); err != nil {
+		str := fmt.Sprintf("Error: cannot remove the network : %s", err.Error())
+		r = []string{str}
+		return []byte(strings.Join(r, "\n")), nil
 	}
+	r = []string{cmd.NetworkName}
 	return []byte(strings.Join(r, "\n")), nil
 }
 
+// removeNetwork removes a network from the networks slice, only if it has no
+// port when unused is set. Returns the removed network, nil if none was.
+func (s *Middleware) removeNetwork(name string, unused bool) *network.Network {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for i, nt := range s.networks {
+		if nt.Name != name {
+			continue
+		}
+		if unused && nt.Clients.Len() > 0 {
+			return nil
+		}
+		updatedList := make([]*network.Network, 0, len(s.networks)-1)
+		updatedList = append(updatedList, s.networks[:i]...)
+		s.networks = append(updatedList, s.networks[i+1:]...)
+		delete(s.specs, name)
+		delete(s.configured, name)
+		return nt
+	}
+	return nil
+}
+
+// stopNetwork stops the ports of a network removed from the networks slice,
+// and detaches it from the routers and the overlay. A suspended network keeps
+// the socket files of QEMU, see network.Suspend.
+func (s *Middleware) stopNetwork(nt *network.Network, suspend bool) error {
+	stop := nt.Stop
+	if suspend {
+		stop = nt.Suspend
+	}
+	err := stop()
+	closeModules(nt.ModuleChain())
+	for _, rt := range s.listRouters() {
+		rt.Detach(nt)
+	}
+	if s.overlay != nil {
+		s.overlay.Detach(nt)
+	}
+	return err
+}
+
+// insertModule creates the module of spec for a network created with cmd
+// and adds it to its pipeline at position, or at the end if position is
+// negative.
+func insertModule(nt *network.Network, cmd entities.CreateCommand, spec entities.ModuleSpec, position int) error {
+	mtu := cmd.MTU
+	if mtu == 0 {
+		mtu = entities.DefaultMTU
+	}
+	env := &modules.Env{Network: cmd, Clients: nt.Clients, Output: nt.Inject, Pipeline: nt.Pipeline}
+	env.Network.MTU = mtu
+	module, err := modules.New(spec.Name, env, spec.Config)
+	if err != nil {
+		return err
+	}
+	if err := nt.Pipeline.Insert(spec.Name, module, position); err != nil {
+		closeModules([]modules.Module{module})
+		return err
+	}
+	return nil
+}
+
+// closeModules releases the resources of modules, in the reverse order of
+// the pipeline so that a module is closed before those it requires.
+func closeModules(chain []modules.Module) {
+	for i := len(chain) - 1; i >= 0; i-- {
+		if closer, ok := chain[i].(modules.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+// listNetworks returns the networks. The slice must not be modified.
+func (s *Middleware) listNetworks() []*network.Network {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.networks
+}
+
+// listRouters returns the routers. The slice must not be modified.
+func (s *Middleware) listRouters() []*router.Router {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.routers
+}
+
 // getNetwork searches for a network by name and returns the corresponding
 // network object and an error if the network is not found.
 func (s *Middleware) getNetwork(nameNetwork string) (*network.Network, error) {
-	for _, net := range s.networks {
-		if nameNetwork == net.Name {
-			return net, nil
+	for _, nt := range s.listNetworks() {
+		if nameNetwork == nt.Name {
+			return nt, nil
 		}
 	}
 	return nil, errors.New("Network not found")
 }
+
+// RouterCreate creates a new router that is not attached to any network yet.
+// Returns the router name if successful or an error message if the name is already used.
+func (s *Middleware) RouterCreate(cmd entities.RouterCreateCommand) ([]byte, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, rt := range s.routers {
+		if rt.Name == cmd.RouterName {
+			return []byte("This name is already in use"), nil
+		}
+	}
+	rt, err := router.NewRouter(cmd.RouterName)
+	if err != nil {
+		return []byte(err.Error()), nil
+	}
+	s.routers = append(append([]*router.Router(nil), s.routers...), rt)
+	return []byte(cmd.RouterName), nil
+}
+
+// RouterAttach attaches a router to a network through the gateway address of
+// the network. Returns the network name if successful or an error message.
+func (s *Middleware) RouterAttach(cmd entities.RouterAttachCommand) ([]byte, error) {
+	rt, err := s.getRouter(cmd.RouterName)
+	if err != nil {
+		return []byte(err.Error()), nil
+	}
+	nt, err := s.getNetwork(cmd.NetworkName)
+	if err != nil {
+		return []byte(err.Error()), nil
+	}
+	if err := rt.Attach(nt); err != nil {
+		return []byte(err.Error()), nil
+	}
+	return []byte(cmd.NetworkName), nil
+}
+
+// RouterRouteAdd adds a static route to a router. Returns the destination if
+// successful or an error message.
+func (s *Middleware) RouterRouteAdd(cmd entities.RouterRouteAddCommand) ([]byte, error) {
+	rt, err := s.getRouter(cmd.RouterName)
+	if err != nil {
+		return []byte(err.Error()), nil
+	}
+	if err := rt.AddRoute(cmd.Destination, cmd.NextHop); err != nil {
+		return []byte(err.Error()), nil
+	}
+	return []byte(cmd.Destination), nil
+}
+
+// RouterLs lists the routers with their interfaces and routing tables.
+func (s *Middleware) RouterLs(cmd entities.RouterLsCommand) ([]byte, error) {
+	r := []string{}
+	for _, rt := range s.listRouters() {
+		r = append(r, rt.Describe()...)
+	}
+	if len(r) == 0 {
+		r = []string{"No router"}
+	}
+	return []byte(strings.Join(r, "\n")), nil
+}
+
+// getRouter searches for a router by name and returns the corresponding
+// router object and an error if the router is not found.
+func (s *Middleware) getRouter(nameRouter string) (*router.Router, error) {
+	for _, rt := range s.listRouters() {
+		if nameRouter == rt.Name {
+			return rt, nil
+		}
+	}
+	return nil, errors.New("Router not found")
+}
+
+// NatAllow adds a rule to the NAT allow-list of a network. Returns the rule
+// if successful or an error message.
+func (s *Middleware) NatAllow(cmd entities.NatAllowCommand) ([]byte, error) {
+	nt, err := s.getNetwork(cmd.NetworkName)
+	if err != nil {
+		return []byte(err.Error()), nil
+	}
+	nat := getNat(nt)
+	if nat == nil {
+		return []byte("The network has no NAT module"), nil
+	}
+	rule, err := modules.ParseNatRule(cmd.Rule)
+	if err != nil {
+		return []byte(err.Error()), nil
+	}
+	if rule.Protocol == "udp" && rule.Port == 53 && dnsBeforeNat(nt) {
+		return []byte("The dns module answers the DNS queries before the nat module, remove it to proxy port 53/udp"), nil
+	}
+	if err := nat.Allow(rule); err != nil {
+		return []byte(err.Error()), nil
+	}
+	return []byte(rule.String()), nil
+}
+
+// NatRm removes the rule of a gateway port from the NAT allow-list of a
+// network. Returns the rule if successful or an error message.
+func (s *Middleware) NatRm(cmd entities.NatRmCommand) ([]byte, error) {
+	nt, err := s.getNetwork(cmd.NetworkName)
+	if err != nil {
+		return []byte(err.Error()), nil
+	}
+	nat := getNat(nt)
+	if nat == nil {
+		return []byte("The network has no NAT module"), nil
+	}
+	protocol := "tcp"
+	port := cmd.Rule
+	if i := strings.LastIndex(port, "/"); i != -1 {
+		port, protocol = port[:i], port[i+1:]
+	}
+	p, err := strconv.ParseUint(port, 10, 16)
+	if err != nil {
+		return []byte("Invalid gateway port"), nil
+	}
+	if err := nat.Remove(protocol, uint16(p)); err != nil {
+		return []byte(err.Error()), nil
+	}
+	return []byte(cmd.Rule), nil
+}
+
+// getNat returns the NAT module of a network, or nil if it has none.
+func getNat(nt *network.Network) *modules.Nat {
+	for _, module := range nt.ModuleChain() {
+		if nat, ok := module.(*modules.Nat); ok {
+			return nat
+		}
+	}
+	return nil
+}
+
+// dnsBeforeNat checks if a dns module comes before the nat module in the
+// pipeline of a network, the DNS queries then never reaching the NAT.
+func dnsBeforeNat(nt *network.Network) bool {
+	for _, module := range nt.ModuleChain() {
+		switch module.(type) {
+		case *modules.Dns:
+			return true
+		case *modules.Nat:
+			return false
+		}
+	}
+	return false
+}
+
+// PortForwardAdd starts relaying a host port to a VM of a network. Returns
+// the forward if successful or an error message.
+func (s *Middleware) PortForwardAdd(cmd entities.PortForwardAddCommand) ([]byte, error) {
+	nt, err := s.getNetwork(cmd.NetworkName)
+	if err != nil {
+		return []byte(err.Error()), nil
+	}
+	portForward := getPortForward(nt)
+	if portForward == nil {
+		return []byte("The network has no port forwarding module"), nil
+	}
+	forward, err := modules.ParseForward(cmd.VmID, cmd.Forward)
+	if err != nil {
+		return []byte(err.Error()), nil
+	}
+	if err := portForward.Add(forward); err != nil {
+		return []byte(err.Error()), nil
+	}
+	return []byte(forward.String()), nil
+}
+
+// PortForwardRm stops relaying a host port to a VM of a network. Returns
+// the host port if successful or an error message.
+func (s *Middleware) PortForwardRm(cmd entities.PortForwardRmCommand) ([]byte, error) {
+	nt, err := s.getNetwork(cmd.NetworkName)
+	if err != nil {
+		return []byte(err.Error()), nil
+	}
+	portForward := getPortForward(nt)
+	if portForward == nil {
+		return []byte("The network has no port forwarding module"), nil
+	}
+	protocol, hostAddr, err := modules.ParseForwardHost(cmd.Forward)
+	if err != nil {
+		return []byte(err.Error()), nil
+	}
+	if err := portForward.Remove(cmd.VmID, protocol, hostAddr); err != nil {
+		return []byte(err.Error()), nil
+	}
+	return []byte(cmd.Forward), nil
+}
+
+// getPortForward returns the port forwarding module of a network, or nil if
+// it has none.
+func getPortForward(nt *network.Network) *modules.PortForward {
+	for _, module := range nt.ModuleChain() {
+		if portForward, ok := module.(*modules.PortForward); ok {
+			return portForward
+		}
+	}
+	return nil
+}
+
+// AclAdd appends a rule to the ACL of a network. Returns the ID of the rule
+// if successful or an error message.
+func (s *Middleware) AclAdd(cmd entities.AclAddCommand) ([]byte, error) {
+	nt, err := s.getNetwork(cmd.NetworkName)
+	if err != nil {
+		return []byte(err.Error()), nil
+	}
+	acl := getAcl(nt)
+	if acl == nil {
+		return []byte("The network has no ACL module"), nil
+	}
+	id, err := acl.Add(modules.AclRule{
+		Action:   modules.AclAction(cmd.Action),
+		SrcMAC:   cmd.SrcMAC,
+		DstMAC:   cmd.DstMAC,
+		Src:      cmd.Src,
+		Dst:      cmd.Dst,
+		Protocol: cmd.Protocol,
+		SrcPort:  cmd.SrcPort,
+		DstPort:  cmd.DstPort,
+		Stateful: cmd.Stateful,
+	})
+	if err != nil {
+		return []byte(err.Error()), nil
+	}
+	return []byte(strconv.Itoa(id)), nil
+}
+
+// AclRm removes a rule from the ACL of a network. Returns the ID of the rule
+// if successful or an error message.
+func (s *Middleware) AclRm(cmd entities.AclRmCommand) ([]byte, error) {
+	nt, err := s.getNetwork(cmd.NetworkName)
+	if err != nil {
+		return []byte(err.Error()), nil
+	}
+	acl := getAcl(nt)
+	if acl == nil {
+		return []byte("The network has no ACL module"), nil
+	}
+	if err := acl.Remove(cmd.RuleID); err != nil {
+		return []byte(err.Error()), nil
+	}
+	return []byte(strconv.Itoa(cmd.RuleID)), nil
+}
+
+// AclLs lists the rules of the ACL of a network with their hit counters.
+func (s *Middleware) AclLs(cmd entities.AclLsCommand) ([]byte, error) {
+	nt, err := s.getNetwork(cmd.NetworkName)
+	if err != nil {
+		return []byte(err.Error()), nil
+	}
+	acl := getAcl(nt)
+	if acl == nil {
+		return []byte("The network has no ACL module"), nil
+	}
+	return []byte(strings.Join(acl.Describe(), "\n")), nil
+}
+
+// AclGroup defines the VMs of a group that ACL rules can refer to. Returns
+// the group name if successful or an error message.
+func (s *Middleware) AclGroup(cmd entities.AclGroupCommand) ([]byte, error) {
+	nt, err := s.getNetwork(cmd.NetworkName)
+	if err != nil {
+		return []byte(err.Error()), nil
+	}
+	acl := getAcl(nt)
+	if acl == nil {
+		return []byte("The network has no ACL module"), nil
+	}
+	acl.SetGroup(cmd.GroupName, cmd.VmIDs)
+	return []byte(cmd.GroupName), nil
+}
+
+// getAcl returns the ACL module of a network, or nil if it has none.
+func getAcl(nt *network.Network) *modules.Acl {
+	for _, module := range nt.ModuleChain() {
+		if acl, ok := module.(*modules.Acl); ok {
+			return acl
+		}
+	}
+	return nil
+}
+
+// ModuleAdd adds a module to the pipeline of a running network, before the
+// switch unless another position is given. Returns the name of the module if
+// successful or an error message.
+func (s *Middleware) ModuleAdd(cmd entities.ModuleAddCommand) ([]byte, error) {
+	nt, err := s.getNetwork(cmd.NetworkName)
+	if err != nil {
+		return []byte(err.Error()), nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	position := nt.Pipeline.Index("switch")
+	switch {
+	case cmd.Before != "" && cmd.After != "":
+		return []byte("Expected a module to add the module before or after, not both"), nil
+	case cmd.Before != "":
+		if position = nt.Pipeline.Index(cmd.Before); position == -1 {
+			return []byte("Module not found: " + cmd.Before), nil
+		}
+	case cmd.After != "":
+		if position = nt.Pipeline.Index(cmd.After); position == -1 {
+			return []byte("Module not found: " + cmd.After), nil
+		}
+		position++
+	}
+	if err := insertModule(nt, s.specs[nt.Name], cmd.Module, position); err != nil {
+		return []byte(err.Error()), nil
+	}
+	s.recordModules(nt, cmd.Module)
+	return []byte(cmd.Module.Name), nil
+}
+
+// ModuleRm removes a module from the pipeline of a running network and
+// releases its resources. The modules of routers and peers are removed by
+// detaching them. Returns the name of the module if successful or an error
+// message.
+func (s *Middleware) ModuleRm(cmd entities.ModuleRmCommand) ([]byte, error) {
+	nt, err := s.getNetwork(cmd.NetworkName)
+	if err != nil {
+		return []byte(err.Error()), nil
+	}
+	if nt.Pipeline.Get(cmd.Name) != nil && !modules.Registered(cmd.Name) {
+		return []byte("The module " + cmd.Name + " is removed by detaching it"), nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	module, err := nt.Pipeline.Remove(cmd.Name)
+	if err != nil {
+		return []byte(err.Error()), nil
+	}
+	closeModules([]modules.Module{module})
+	s.recordModules(nt, entities.ModuleSpec{})
+	return []byte(cmd.Name), nil
+}
+
+// ModuleLs lists the pipeline of a network with the verdicts of its
+// modules, or the modules that can be added without a network.
+func (s *Middleware) ModuleLs(cmd entities.ModuleLsCommand) ([]byte, error) {
+	if cmd.NetworkName == "" {
+		return []byte(strings.Join(modules.DescribeRegistry(), "\n")), nil
+	}
+	nt, err := s.getNetwork(cmd.NetworkName)
+	if err != nil {
+		return []byte(err.Error()), nil
+	}
+	return []byte(strings.Join(nt.Pipeline.Describe(), "\n")), nil
+}
+
+// recordModules records the pipeline of a network in the command it was
+// created with, so that the network is created again with it. added is the
+// module just added, with its configuration. s.mu must be held.
+func (s *Middleware) recordModules(nt *network.Network, added entities.ModuleSpec) {
+	spec := s.specs[nt.Name]
+	previous := spec.Modules
+	if len(previous) == 0 {
+		for _, name := range modules.DefaultPipeline {
+			previous = append(previous, entities.ModuleSpec{Name: name})
+		}
+	}
+	var updated []entities.ModuleSpec
+	for _, name := range nt.Pipeline.Names() {
+		if !modules.Registered(name) {
+			continue
+		}
+		module := entities.ModuleSpec{Name: name}
+		for _, p := range previous {
+			if p.Name == name {
+				module = p
+			}
+		}
+		if name == added.Name {
+			module = added
+		}
+		updated = append(updated, module)
+	}
+	spec.Modules = updated
+	s.specs[nt.Name] = spec
+}
+
+// PeerAdd peers a network with the network of another daemon sharing its
+// VNI, by default the same-named network. Returns the address of the peer if
+// successful or an error message.
+func (s *Middleware) PeerAdd(cmd entities.PeerAddCommand) ([]byte, error) {
+	if s.overlay == nil {
+		return []byte("Peering is disabled on this daemon"), nil
+	}
+	nt, err := s.getNetwork(cmd.NetworkName)
+	if err != nil {
+		return []byte(err.Error()), nil
+	}
+	segment, err := s.overlay.Attach(nt, cmd.VNI)
+	if err != nil {
+		return []byte(err.Error()), nil
+	}
+	if err := segment.AddPeer(cmd.Address); err != nil {
+		if segment.Empty() {
+			s.overlay.Detach(nt)
+		}
+		return []byte(err.Error()), nil
+	}
+	return []byte(cmd.Address), nil
+}
+
+// PeerRm removes a peer of a network. The network leaves the overlay when
+// its last peer is removed. Returns the address of the peer if successful or
+// an error message.
+func (s *Middleware) PeerRm(cmd entities.PeerRmCommand) ([]byte, error) {
+	if s.overlay == nil {
+		return []byte("Peering is disabled on this daemon"), nil
+	}
+	nt, err := s.getNetwork(cmd.NetworkName)
+	if err != nil {
+		return []byte(err.Error()), nil
+	}
+	segment := s.overlay.Segment(nt)
+	if segment == nil {
+		return []byte("The network has no peer"), nil
+	}
+	if err := segment.RemovePeer(cmd.Address); err != nil {
+		return []byte(err.Error()), nil
+	}
+	if segment.Empty() {
+		s.overlay.Detach(nt)
+	}
+	return []byte(cmd.Address), nil
+}
+
+// PeerLs lists the peers of a network, or of every network if no name is
+// given, with the health of their tunnels.
+func (s *Middleware) PeerLs(cmd entities.PeerLsCommand) ([]byte, error) {
+	if s.overlay == nil {
+		return []byte("Peering is disabled on this daemon"), nil
+	}
+	r := []string{"VXLAN endpoint " + s.overlay.Addr().String()}
+	for _, nt := range s.listNetworks() {
+		if cmd.NetworkName != "" && cmd.NetworkName != nt.Name {
+			continue
+		}
+		if segment := s.overlay.Segment(nt); segment != nil {
+			r = append(r, "-"+nt.Name+"-------------------------------------------------------------------------------------------")
+			r = append(r, segment.Describe()...)
+		}
+	}
+	return []byte(strings.Join(r, "\n")), nil
+}
@@ -0,0 +1,281 @@
+package middleware
+
+import (
+	"QemuUserNet/entities"
+	"QemuUserNet/modules"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newMiddleware returns a middleware whose networks are removed at the end
+// of the test.
+func newMiddleware(t *testing.T) *Middleware {
+	s := &Middleware{}
+	s.Init()
+	t.Cleanup(func() {
+		for _, nt := range s.listNetworks() {
+			s.Rm(entities.RmCommand{NetworkName: nt.Name})
+		}
+	})
+	return s
+}
+
+// TestMiddlewareConcurrent runs the commands adding and removing networks,
+// VMs and modules concurrently with the commands reading them. Run with
+// -race.
+func TestMiddlewareConcurrent(t *testing.T) {
+	const rounds = 20
+	s := newMiddleware(t)
+	if out, _ := s.Create(entities.NewCreateCommand("shared")); string(out) != "shared" {
+		t.Fatal(string(out))
+	}
+
+	var readers, wg sync.WaitGroup
+	stop := make(chan struct{})
+	for r := 0; r < 2; r++ {
+		readers.Add(1)
+		go func() {
+			defer readers.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				s.Ls(entities.LsCommand{})
+				s.Inspect(entities.InspectCommand{})
+				s.ModuleLs(entities.ModuleLsCommand{NetworkName: "shared"})
+				s.AclLs(entities.AclLsCommand{NetworkName: "shared"})
+			}
+		}()
+	}
+
+	// Networks created and removed
+	for w := 0; w < 2; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			name := fmt.Sprintf("net%d", w)
+			for i := 0; i < rounds; i++ {
+				if out, _ := s.Create(entities.NewCreateCommand(name)); string(out) != name {
+					t.Error(string(out))
+					return
+				}
+				s.Connect(entities.ConnectCommand{NetworkName: name, VmID: "vm", Nic: -1})
+				if out, _ := s.Rm(entities.RmCommand{NetworkName: name}); string(out) != name {
+					t.Error(string(out))
+					return
+				}
+			}
+		}(w)
+	}
+
+	// VMs connected to and disconnected from the same network
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			id := fmt.Sprintf("vm%d", w)
+			for i := 0; i < rounds; i++ {
+				connect := entities.ConnectCommand{NetworkName: "shared", VmID: id, Nic: -1, Ip: fmt.Sprintf("10.10.10.%d", 10+w)}
+				if out, _ := s.Connect(connect); !strings.Contains(string(out), "-netdev") {
+					t.Error(string(out))
+					return
+				}
+				if out, _ := s.Disconnect(entities.DisconnectCommand{NetworkName: "shared", VmID: id, Nic: -1}); string(out) != id {
+					t.Error(string(out))
+					return
+				}
+			}
+		}(w)
+	}
+
+	// Modules added to and removed from the pipeline of the network
+	wg.Add(1)
+	go func() {
+		defer wg.Done()
+		for i := 0; i < rounds; i++ {
+			add := entities.ModuleAddCommand{NetworkName: "shared", Module: entities.ModuleSpec{Name: "acl:extra"}}
+			if out, _ := s.ModuleAdd(add); string(out) != "acl:extra" {
+				t.Error(string(out))
+				return
+			}
+			if out, _ := s.ModuleRm(entities.ModuleRmCommand{NetworkName: "shared", Name: "acl:extra"}); string(out) != "acl:extra" {
+				t.Error(string(out))
+				return
+			}
+		}
+	}()
+
+	wg.Wait()
+	close(stop)
+	readers.Wait()
+	if networks := s.listNetworks(); len(networks) != 1 || networks[0].Clients.Len() != 0 {
+		t.Fatalf("%d networks left", len(networks))
+	}
+	var recorded []string
+	for _, spec := range s.specs["shared"].Modules {
+		recorded = append(recorded, spec.Name)
+	}
+	if got, want := strings.Join(recorded, ","), strings.Join(modules.DefaultPipeline, ","); got != want {
+		t.Fatalf("recorded pipeline %s, want %s", got, want)
+	}
+}
+
+// vmSocket binds the local socket of the card of the VM id, like QEMU, and
+// returns it with the remote socket the VM sends its frames to.
+func vmSocket(t *testing.T, s *Middleware, networkName string, id string) (*net.UnixConn, *net.UnixAddr, net.HardwareAddr) {
+	nt, err := s.getNetwork(networkName)
+	if err != nil {
+		t.Error(err)
+		return nil, nil, nil
+	}
+	cards := nt.Clients.GetClientsByID(id)
+	if len(cards) != 1 {
+		t.Errorf("%d cards for %s", len(cards), id)
+		return nil, nil, nil
+	}
+	vm := cards[0].CurrentVM()
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: vm.LocalSocket, Net: "unixgram"})
+	if err != nil {
+		t.Error(err)
+		return nil, nil, nil
+	}
+	mac, _ := net.ParseMAC(vm.Mac)
+	return conn, &net.UnixAddr{Name: vm.RemoteSocket, Net: "unixgram"}, mac
+}
+
+// broadcastFrame returns a broadcast frame of an unknown protocol sent by mac.
+func broadcastFrame(mac net.HardwareAddr) []byte {
+	frame := make([]byte, 64)
+	copy(frame, []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff})
+	copy(frame[6:], mac)
+	frame[12], frame[13] = 0x88, 0xb5
+	return frame
+}
+
+// TestMiddlewareFrames sends frames over the sockets of the VMs connected to
+// a network while other goroutines connect and disconnect VMs and prune the
+// ports. Run with -race.
+func TestMiddlewareFrames(t *testing.T) {
+	const rounds = 20
+	s := newMiddleware(t)
+	if out, _ := s.Create(entities.NewCreateCommand("shared")); string(out) != "shared" {
+		t.Fatal(string(out))
+	}
+
+	// The VM receiving the frames keeps the network from being pruned
+	if out, _ := s.Connect(entities.ConnectCommand{NetworkName: "shared", VmID: "receiver", Nic: -1}); !strings.Contains(string(out), "-netdev") {
+		t.Fatal(string(out))
+	}
+	receiver, _, _ := vmSocket(t, s, "shared", "receiver")
+	if receiver == nil {
+		t.FailNow()
+	}
+	defer receiver.Close()
+	received := make(chan int)
+	go func() {
+		count := 0
+		buffer := make([]byte, entities.DefaultMTU+14)
+		for {
+			receiver.SetReadDeadline(time.Now().Add(time.Second))
+			if _, err := receiver.Read(buffer); err != nil {
+				received <- count
+				return
+			}
+			count++
+		}
+	}()
+
+	var wg sync.WaitGroup
+	stop := make(chan struct{})
+	pruned := make(chan struct{})
+	go func() {
+		defer close(pruned)
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+			}
+			s.Prune(entities.PruneCommand{})
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	// VMs connected, sending frames to the others, then disconnected
+	for w := 0; w < 4; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			id := fmt.Sprintf("vm%d", w)
+			for i := 0; i < rounds; i++ {
+				if out, _ := s.Connect(entities.ConnectCommand{NetworkName: "shared", VmID: id, Nic: -1}); !strings.Contains(string(out), "-netdev") {
+					t.Error(string(out))
+					return
+				}
+				conn, remote, mac := vmSocket(t, s, "shared", id)
+				if conn == nil {
+					return
+				}
+				// The frames of the other VMs are read like QEMU does
+				go func() {
+					buffer := make([]byte, entities.DefaultMTU+14)
+					for {
+						if _, err := conn.Read(buffer); err != nil {
+							return
+						}
+					}
+				}()
+				for f := 0; f < 10; f++ {
+					conn.WriteToUnix(broadcastFrame(mac), remote)
+				}
+				// The frames are read before the sockets are removed
+				time.Sleep(5 * time.Millisecond)
+				conn.Close()
+				// The port may have been pruned meanwhile
+				s.Disconnect(entities.DisconnectCommand{NetworkName: "shared", VmID: id, Nic: -1})
+			}
+		}(w)
+	}
+
+	wg.Wait()
+	close(stop)
+	<-pruned
+	if count := <-received; count == 0 {
+		t.Fatal("no frame received")
+	}
+	nt, err := s.getNetwork("shared")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if threads := nt.Clients.Threads(); len(threads) != 1 || threads[0].VM.ID != "receiver" {
+		t.Fatalf("%d ports left", len(threads))
+	}
+}
+
+// TestNatAllowDns checks that port 53/udp of the gateway is proxied only
+// once no dns module comes before the nat module.
+func TestNatAllowDns(t *testing.T) {
+	s := newMiddleware(t)
+	if out, _ := s.Create(entities.NewCreateCommand("net-a")); string(out) != "net-a" {
+		t.Fatal(string(out))
+	}
+	allow := entities.NatAllowCommand{NetworkName: "net-a", Rule: "127.0.0.1:53/udp"}
+	if out, _ := s.NatAllow(allow); !strings.Contains(string(out), "dns module") {
+		t.Fatalf("rule on 53/udp accepted before the dns module: %s", out)
+	}
+	if out, _ := s.NatAllow(entities.NatAllowCommand{NetworkName: "net-a", Rule: "127.0.0.1:53/tcp"}); string(out) != "53=127.0.0.1:53/tcp" {
+		t.Fatal(string(out))
+	}
+	if out, _ := s.ModuleRm(entities.ModuleRmCommand{NetworkName: "net-a", Name: "dns"}); string(out) != "dns" {
+		t.Fatal(string(out))
+	}
+	if out, _ := s.NatAllow(allow); string(out) != "53=127.0.0.1:53/udp" {
+		t.Fatal(string(out))
+	}
+}
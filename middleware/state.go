@@ -0,0 +1,302 @@
+package middleware
+
+import (
+	"QemuUserNet/entities"
+	"QemuUserNet/modules"
+	"QemuUserNet/network"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+)
+
+// savedState is the state of the daemon written to the state file when it
+// shuts down: its networks and the cards of the VMs connected to them.
+type savedState struct {
+	Networks []savedNetwork
+}
+
+// savedNetwork is a network of the state file.
+type savedNetwork struct {
+	Create   entities.CreateCommand // Command the network was created with
+	Ports    []entities.VM          // Cards of the VMs, the uplinks and external ports are not saved
+	Files    map[string]int         `json:",omitempty"` // Index of the handed off socket of a card by its Socket, see Handoff
+	Forwards map[string][]string    `json:",omitempty"` // Forwarded host ports by VM ID, see modules.ParseForward
+}
+
+// savedForwards returns the forwarded host ports of a network to save.
+func savedForwards(nt *network.Network) map[string][]string {
+	if portForward := getPortForward(nt); portForward != nil {
+		if forwards := portForward.Forwards(); len(forwards) > 0 {
+			return forwards
+		}
+	}
+	return nil
+}
+
+// restoreForwards forwards again the host ports saved for a network. The
+// VMs do not need to be connected.
+func restoreForwards(nt *network.Network, forwards map[string][]string) []string {
+	if len(forwards) == 0 {
+		return nil
+	}
+	portForward := getPortForward(nt)
+	if portForward == nil {
+		return []string{nt.Name + ": the network has no port forwarding module"}
+	}
+	var errs []string
+	for vmID, specs := range forwards {
+		for _, spec := range specs {
+			forward, err := modules.ParseForward(vmID, spec)
+			if err == nil {
+				err = portForward.Restore(forward)
+			}
+			if err != nil {
+				errs = append(errs, nt.Name+"/"+vmID+": "+spec+": "+err.Error())
+			}
+		}
+	}
+	return errs
+}
+
+// SaveState writes the networks and the cards of the VMs to the state file
+// at path.
+func (s *Middleware) SaveState(path string) error {
+	var state savedState
+	s.mu.RLock()
+	for _, nt := range s.networks {
+		saved := savedNetwork{Create: s.specs[nt.Name], Forwards: savedForwards(nt)}
+		for _, client := range nt.Clients.Threads() {
+			if !client.Uplink {
+				saved.Ports = append(saved.Ports, client.CurrentVM())
+			}
+		}
+		state.Networks = append(state.Networks, saved)
+	}
+	s.mu.RUnlock()
+
+	data, err := json.MarshalIndent(state, "", "  ")
+	if err != nil {
+		return err
+	}
+	// A daemon killed while writing never leaves a truncated state
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// RestoreState creates the networks of the state file at path and restores
+// the cards of their VMs, then removes the file so that the same cards are
+// never restored twice. A missing file is not an error. Returns the number
+// of networks and cards restored.
+func (s *Middleware) RestoreState(path string) (int, int, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, 0, nil
+	}
+	if err != nil {
+		return 0, 0, err
+	}
+	var state savedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		return 0, 0, err
+	}
+	networks, cards, err := s.restore(state, nil)
+	os.Remove(path)
+	return networks, cards, err
+}
+
+// Handoff removes every network and closes the overlay like Shutdown, and
+// returns the state of the daemon with the sockets handed off by the
+// networks, for another daemon process to take over with TakeOver.
+func (s *Middleware) Handoff() ([]byte, []*os.File, error) {
+	var state savedState
+	var files []*os.File
+	var errs []string
+	for _, nt := range s.listNetworks() {
+		s.mu.RLock()
+		spec := s.specs[nt.Name]
+		s.mu.RUnlock()
+		if s.removeNetwork(nt.Name, false) == nil {
+			continue
+		}
+		forwards := savedForwards(nt)
+		vms, handedOff, err := nt.Handoff()
+		if err != nil {
+			errs = append(errs, nt.Name+": "+err.Error())
+		}
+		s.stopNetwork(nt, false)
+
+		saved := savedNetwork{Create: spec, Ports: vms, Files: make(map[string]int), Forwards: forwards}
+		for socket, file := range handedOff {
+			saved.Files[socket] = len(files)
+			files = append(files, file)
+		}
+		state.Networks = append(state.Networks, saved)
+	}
+	if s.overlay != nil {
+		s.overlay.Close()
+	}
+
+	data, err := json.Marshal(state)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return data, files, errors.New(strings.Join(errs, ", "))
+	}
+	return data, files, nil
+}
+
+// CancelHandoff restores the networks of a handoff that another daemon
+// process did not take over, like TakeOver, and starts the overlay closed by
+// Handoff again. The files are closed. Returns the number of networks and
+// cards restored.
+func (s *Middleware) CancelHandoff(data []byte, files []*os.File) (int, int, error) {
+	var errs []string
+	if s.overlay != nil {
+		if err := s.EnableOverlay(s.overlay.Addr().String()); err != nil {
+			s.overlay = nil
+			errs = append(errs, "overlay: "+err.Error())
+		}
+	}
+	networks, cards, err := s.TakeOver(data, files)
+	if err != nil {
+		errs = append(errs, err.Error())
+	}
+	if len(errs) > 0 {
+		return networks, cards, errors.New(strings.Join(errs, ", "))
+	}
+	return networks, cards, nil
+}
+
+// TakeOver creates the networks of the state handed off by another daemon
+// process and restores the cards of their VMs around the sockets handed off
+// with it. The files are closed. Returns the number of networks and cards
+// restored.
+func (s *Middleware) TakeOver(data []byte, files []*os.File) (int, int, error) {
+	var state savedState
+	if err := json.Unmarshal(data, &state); err != nil {
+		for _, file := range files {
+			file.Close()
+		}
+		return 0, 0, err
+	}
+	return s.restore(state, files)
+}
+
+// restore creates the networks of a saved state and restores the cards of
+// their VMs, around the handed off files if any. The files are closed.
+func (s *Middleware) restore(state savedState, files []*os.File) (int, int, error) {
+	used := make(map[int]bool)
+	var errs []string
+	networks, cards := 0, 0
+	for _, saved := range state.Networks {
+		nt, err := s.create(saved.Create)
+		if err != nil {
+			errs = append(errs, saved.Create.NetworkName+": "+err.Error())
+			continue
+		}
+		networks++
+		for _, vm := range saved.Ports {
+			var file *os.File
+			if i, ok := saved.Files[vm.Socket]; ok && i >= 0 && i < len(files) && !used[i] {
+				file = files[i]
+				used[i] = true
+			}
+			if err := nt.RestoreVM(vm, file); err != nil {
+				errs = append(errs, saved.Create.NetworkName+"/"+vm.Name()+": "+err.Error())
+				continue
+			}
+			cards++
+		}
+		errs = append(errs, restoreForwards(nt, saved.Forwards)...)
+	}
+	// The sockets of the cards not restored are closed
+	for i, file := range files {
+		if !used[i] {
+			file.Close()
+		}
+	}
+	if len(errs) > 0 {
+		return networks, cards, errors.New(strings.Join(errs, ", "))
+	}
+	return networks, cards, nil
+}
+
+// Configure applies the networks of the configuration file: the networks
+// missing are created, and the networks of a previous configuration that
+// are no longer in it are removed. The networks created with the create
+// command are kept. A network whose options changed is kept as it is, it
+// must be removed to apply them.
+func (s *Middleware) Configure(cmds []entities.CreateCommand) error {
+	var errs []string
+	wanted := make(map[string]bool)
+	for _, cmd := range cmds {
+		wanted[cmd.NetworkName] = true
+		s.mu.RLock()
+		spec, exists := s.specs[cmd.NetworkName]
+		s.mu.RUnlock()
+		if exists {
+			if !reflect.DeepEqual(spec, cmd) {
+				log.Println("WARNING: the options of network " + cmd.NetworkName + " changed, remove it to apply them")
+			}
+		} else if _, err := s.create(cmd); err != nil {
+			errs = append(errs, cmd.NetworkName+": "+err.Error())
+			continue
+		} else {
+			log.Println("INFO: network created from the configuration: " + cmd.NetworkName)
+		}
+		s.mu.Lock()
+		if _, ok := s.specs[cmd.NetworkName]; ok {
+			s.configured[cmd.NetworkName] = cmd
+		}
+		s.mu.Unlock()
+	}
+
+	s.mu.RLock()
+	var removed []string
+	for name := range s.configured {
+		if !wanted[name] {
+			removed = append(removed, name)
+		}
+	}
+	s.mu.RUnlock()
+	for _, name := range removed {
+		if nt := s.removeNetwork(name, false); nt != nil {
+			if err := s.stopNetwork(nt, false); err != nil {
+				errs = append(errs, name+": "+err.Error())
+			}
+			log.Println("INFO: network removed from the configuration: " + name)
+		}
+	}
+
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
+
+// Shutdown removes every network and closes the overlay. With a state file,
+// the state of the daemon is saved first and the socket files of QEMU are
+// kept, so that the next daemon restores the cards of the running VMs.
+func (s *Middleware) Shutdown(statePath string) error {
+	var err error
+	if statePath != "" {
+		err = s.SaveState(statePath)
+	}
+	suspend := statePath != "" && err == nil
+	for _, nt := range s.listNetworks() {
+		if s.removeNetwork(nt.Name, false) != nil {
+			s.stopNetwork(nt, suspend)
+		}
+	}
+	if s.overlay != nil {
+		s.overlay.Close()
+	}
+	return err
+}
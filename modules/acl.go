@@ -0,0 +1,524 @@
+package modules
+
+import (
+	"QemuUserNet/entities"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Timeouts of the connections tracked by stateful rules.
+const (
+	aclTcpTimeout   = 5 * time.Minute
+	aclOtherTimeout = 60 * time.Second
+)
+
+// AclAction is the action of an ACL rule.
+type AclAction string
+
+// Enumeration of ACL actions. A log rule reports the packets it matches and
+// lets the next rules decide.
+const (
+	AclAllow AclAction = "allow"
+	AclDeny  AclAction = "deny"
+	AclLog   AclAction = "log"
+)
+
+// AclRule is a rule of an ACL. Empty fields match any packet. Src and Dst
+// accept an IP address, a CIDR, vm:ID or group:NAME. Ports accept a single
+// port or a range such as 1000-2000.
+type AclRule struct {
+	ID       int       // Identifier of the rule, rules are evaluated in ascending order
+	Action   AclAction // Action applied to the matching packets
+	SrcMAC   string    // Source MAC address
+	DstMAC   string    // Destination MAC address
+	Src      string    // Source address
+	Dst      string    // Destination address
+	Protocol string    // arp, ipv4, ipv6, icmp, tcp, udp or an IP protocol number
+	SrcPort  string    // Source port or port range
+	DstPort  string    // Destination port or port range
+	Stateful bool      // Allow the packets of the connections opened through the rule
+	hits     uint64
+}
+
+// aclFlow identifies a connection tracked by a stateful rule.
+type aclFlow struct {
+	protocol layers.IPProtocol
+	srcIP    [16]byte
+	dstIP    [16]byte
+	srcPort  uint16
+	dstPort  uint16
+}
+
+// aclPacket holds the fields of a packet the rules match on.
+type aclPacket struct {
+	srcMAC   net.HardwareAddr
+	dstMAC   net.HardwareAddr
+	arp      bool
+	ipv6     bool
+	srcIP    net.IP
+	dstIP    net.IP
+	protocol layers.IPProtocol
+	srcPort  uint16
+	dstPort  uint16
+	ports    bool
+}
+
+// Acl filters the packets of a network with an ordered list of rules. A
+// packet that matches no allow or deny rule is allowed.
+type Acl struct {
+	clients *entities.Clients
+	mu      sync.Mutex
+	rules   []*AclRule
+	groups  map[string][]string
+	flows   map[aclFlow]time.Time
+	nextID  int
+}
+
+// NewAcl creates a new Acl instance without any rule.
+func NewAcl(clients *entities.Clients) (*Acl, error) {
+	return &Acl{
+		clients: clients,
+		groups:  make(map[string][]string),
+		flows:   make(map[aclFlow]time.Time),
+		nextID:  1,
+	}, nil
+}
+
+// Listen drops the packets denied by the rules. Allowed packets are left
+// to the next modules.
+func (a *Acl) Listen(packet gopacket.Packet) Result {
+	p, ok := parseAclPacket(packet)
+	if !ok {
+		return Pass()
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(a.rules) == 0 {
+		return Pass()
+	}
+
+	if flow, ok := p.flow(); ok {
+		reverse := aclFlow{protocol: flow.protocol, srcIP: flow.dstIP, dstIP: flow.srcIP, srcPort: flow.dstPort, dstPort: flow.srcPort}
+		for _, key := range []aclFlow{flow, reverse} {
+			if last, ok := a.flows[key]; ok {
+				if time.Since(last) < a.timeout(key.protocol) {
+					a.flows[key] = time.Now()
+					return Pass()
+				}
+				delete(a.flows, key)
+			}
+		}
+	}
+
+	for _, rule := range a.rules {
+		if !a.match(rule, p) {
+			continue
+		}
+		rule.hits++
+		switch rule.Action {
+		case AclLog:
+			log.Printf("INFO: acl: rule %d matched %s -> %s", rule.ID, p.describeSrc(), p.describeDst())
+		case AclDeny:
+			return Dropped()
+		case AclAllow:
+			if rule.Stateful {
+				if flow, ok := p.flow(); ok {
+					a.track(flow)
+				}
+			}
+			return Pass()
+		}
+	}
+	return Pass()
+}
+
+// Selects selects every frame once the ACL has a rule.
+func (a *Acl) Selects(frame *Frame) bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return len(a.rules) > 0
+}
+
+// Filter checks if the rules let through a frame that does not come from a
+// port, such as a frame sent by the NAT, a port forward or a router. The
+// frame is only decoded once the ACL has a rule.
+func (a *Acl) Filter(data []byte) bool {
+	a.mu.Lock()
+	empty := len(a.rules) == 0
+	a.mu.Unlock()
+	if empty {
+		return true
+	}
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	return a.Listen(packet).Verdict != VerdictDrop
+}
+
+// Quit forgets the connections of a client when it disconnects.
+func (a *Acl) Quit(client *entities.Thread) error {
+	leased := client.IP()
+	if leased == nil {
+		return nil
+	}
+	ip := net.ParseIP(*leased).To16()
+	if ip == nil {
+		return nil
+	}
+	var key [16]byte
+	copy(key[:], ip)
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for flow := range a.flows {
+		if flow.srcIP == key || flow.dstIP == key {
+			delete(a.flows, flow)
+		}
+	}
+	return nil
+}
+
+// Add validates a rule and appends it to the ACL. Returns the ID of the rule.
+func (a *Acl) Add(rule AclRule) (int, error) {
+	if rule.Action != AclAllow && rule.Action != AclDeny && rule.Action != AclLog {
+		return 0, errors.New("Invalid action, expected allow, deny or log")
+	}
+	for _, mac := range []string{rule.SrcMAC, rule.DstMAC} {
+		if mac != "" {
+			if _, err := net.ParseMAC(mac); err != nil {
+				return 0, err
+			}
+		}
+	}
+	for _, addr := range []string{rule.Src, rule.Dst} {
+		if err := validateAclAddress(addr); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := parseAclProtocol(rule.Protocol); err != nil {
+		return 0, err
+	}
+	for _, ports := range []string{rule.SrcPort, rule.DstPort} {
+		if _, _, err := parseAclPorts(ports); err != nil {
+			return 0, err
+		}
+	}
+
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	rule.ID = a.nextID
+	rule.hits = 0
+	a.nextID++
+	a.rules = append(a.rules, &rule)
+	return rule.ID, nil
+}
+
+// Remove removes a rule from the ACL.
+func (a *Acl) Remove(id int) error {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	for i, rule := range a.rules {
+		if rule.ID == id {
+			a.rules = append(a.rules[:i:i], a.rules[i+1:]...)
+			return nil
+		}
+	}
+	return errors.New("Rule not found")
+}
+
+// SetGroup defines the VMs of a group. An empty list removes the group.
+func (a *Acl) SetGroup(name string, vmIDs []string) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	if len(vmIDs) == 0 {
+		delete(a.groups, name)
+		return
+	}
+	a.groups[name] = vmIDs
+}
+
+// Describe returns a human readable description of the rules, their hit
+// counters and the groups.
+func (a *Acl) Describe() []string {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	lines := []string{"ID	ACTION	PROTO	SOURCE				DESTINATION			HITS"}
+	for _, rule := range a.rules {
+		src := describeAclEndpoint(rule.SrcMAC, rule.Src, rule.SrcPort)
+		dst := describeAclEndpoint(rule.DstMAC, rule.Dst, rule.DstPort)
+		action := string(rule.Action)
+		if rule.Stateful {
+			action += "+state"
+		}
+		protocol := rule.Protocol
+		if protocol == "" {
+			protocol = "any"
+		}
+		lines = append(lines, fmt.Sprintf("%d	%s	%s	%s			%s			%d", rule.ID, action, protocol, src, dst, rule.hits))
+	}
+
+	var names []string
+	for name := range a.groups {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	if len(names) > 0 {
+		lines = append(lines, "GROUP	VMS")
+	}
+	for _, name := range names {
+		lines = append(lines, name+"	"+strings.Join(a.groups[name], ","))
+	}
+	lines = append(lines, fmt.Sprintf("Tracked connections: %d", len(a.flows)))
+	return lines
+}
+
+// track records a connection opened through a stateful rule. Expired
+// connections are swept when the table grows. The caller must hold the lock.
+func (a *Acl) track(flow aclFlow) {
+	if len(a.flows) >= 4096 {
+		for key, last := range a.flows {
+			if time.Since(last) >= a.timeout(key.protocol) {
+				delete(a.flows, key)
+			}
+		}
+	}
+	a.flows[flow] = time.Now()
+}
+
+// timeout returns the idle timeout of a tracked connection.
+func (a *Acl) timeout(protocol layers.IPProtocol) time.Duration {
+	if protocol == layers.IPProtocolTCP {
+		return aclTcpTimeout
+	}
+	return aclOtherTimeout
+}
+
+// match reports whether a packet matches a rule. The caller must hold the lock.
+func (a *Acl) match(rule *AclRule, p aclPacket) bool {
+	if rule.SrcMAC != "" && !strings.EqualFold(rule.SrcMAC, p.srcMAC.String()) {
+		return false
+	}
+	if rule.DstMAC != "" && !strings.EqualFold(rule.DstMAC, p.dstMAC.String()) {
+		return false
+	}
+	if rule.Src != "" && !a.matchAddress(rule.Src, p.srcMAC, p.srcIP) {
+		return false
+	}
+	if rule.Dst != "" && !a.matchAddress(rule.Dst, p.dstMAC, p.dstIP) {
+		return false
+	}
+	if rule.Protocol != "" {
+		switch strings.ToLower(rule.Protocol) {
+		case "arp":
+			if !p.arp {
+				return false
+			}
+		case "ipv4":
+			if p.srcIP == nil || p.ipv6 {
+				return false
+			}
+		case "ipv6":
+			if !p.ipv6 {
+				return false
+			}
+		default:
+			protocol, _ := parseAclProtocol(rule.Protocol)
+			if p.srcIP == nil || p.protocol != protocol {
+				return false
+			}
+		}
+	}
+	if rule.SrcPort != "" && !matchAclPorts(rule.SrcPort, p.srcPort, p.ports) {
+		return false
+	}
+	if rule.DstPort != "" && !matchAclPorts(rule.DstPort, p.dstPort, p.ports) {
+		return false
+	}
+	return true
+}
+
+// matchAddress reports whether an endpoint of a packet matches an address
+// of a rule. VMs and groups match on the MAC address of the VMs, so they
+// also match non-IP packets.
+func (a *Acl) matchAddress(addr string, mac net.HardwareAddr, ip net.IP) bool {
+	var ids []string
+	switch {
+	case strings.HasPrefix(addr, "vm:"):
+		ids = []string{addr[3:]}
+	case strings.HasPrefix(addr, "group:"):
+		ids = a.groups[addr[6:]]
+	default:
+		if ip == nil {
+			return false
+		}
+		if _, subnet, err := net.ParseCIDR(addr); err == nil {
+			return subnet.Contains(ip)
+		}
+		return net.ParseIP(addr).Equal(ip)
+	}
+
+	for _, id := range ids {
+		for _, client := range a.clients.GetClientsByID(id) {
+			if strings.EqualFold(client.VM.Mac, mac.String()) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// parseAclPacket extracts the fields of a packet the rules match on.
+func parseAclPacket(packet gopacket.Packet) (aclPacket, bool) {
+	var p aclPacket
+	etherLayer := packet.Layer(layers.LayerTypeEthernet)
+	if etherLayer == nil {
+		return p, false
+	}
+	eth, _ := etherLayer.(*layers.Ethernet)
+	p.srcMAC, p.dstMAC = eth.SrcMAC, eth.DstMAC
+
+	if packet.Layer(layers.LayerTypeARP) != nil {
+		p.arp = true
+		return p, true
+	}
+	if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
+		ip, _ := ipLayer.(*layers.IPv4)
+		p.srcIP, p.dstIP, p.protocol = ip.SrcIP, ip.DstIP, ip.Protocol
+	} else if ipLayer := packet.Layer(layers.LayerTypeIPv6); ipLayer != nil {
+		ip, _ := ipLayer.(*layers.IPv6)
+		p.srcIP, p.dstIP, p.protocol, p.ipv6 = ip.SrcIP, ip.DstIP, ip.NextHeader, true
+	}
+	if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
+		tcp, _ := tcpLayer.(*layers.TCP)
+		p.srcPort, p.dstPort, p.ports = uint16(tcp.SrcPort), uint16(tcp.DstPort), true
+	} else if udpLayer := packet.Layer(layers.LayerTypeUDP); udpLayer != nil {
+		udp, _ := udpLayer.(*layers.UDP)
+		p.srcPort, p.dstPort, p.ports = uint16(udp.SrcPort), uint16(udp.DstPort), true
+	} else if icmpLayer := packet.Layer(layers.LayerTypeICMPv4); icmpLayer != nil {
+		icmp, _ := icmpLayer.(*layers.ICMPv4)
+		p.srcPort, p.dstPort = icmp.Id, icmp.Id
+	}
+	return p, true
+}
+
+// flow returns the connection a packet belongs to.
+func (p aclPacket) flow() (aclFlow, bool) {
+	if p.srcIP == nil {
+		return aclFlow{}, false
+	}
+	f := aclFlow{protocol: p.protocol, srcPort: p.srcPort, dstPort: p.dstPort}
+	copy(f.srcIP[:], p.srcIP.To16())
+	copy(f.dstIP[:], p.dstIP.To16())
+	return f, true
+}
+
+// describeSrc returns the source of a packet for the logs.
+func (p aclPacket) describeSrc() string {
+	if p.srcIP == nil {
+		return p.srcMAC.String()
+	}
+	return p.srcMAC.String() + "/" + p.srcIP.String() + ":" + strconv.Itoa(int(p.srcPort))
+}
+
+// describeDst returns the destination of a packet for the logs.
+func (p aclPacket) describeDst() string {
+	if p.dstIP == nil {
+		return p.dstMAC.String()
+	}
+	return p.dstMAC.String() + "/" + p.dstIP.String() + ":" + strconv.Itoa(int(p.dstPort))
+}
+
+// matchAclPorts reports whether a port of a TCP or UDP packet is in a range.
+func matchAclPorts(ports string, port uint16, hasPorts bool) bool {
+	if !hasPorts {
+		return false
+	}
+	low, high, _ := parseAclPorts(ports)
+	return port >= low && port <= high
+}
+
+// parseAclPorts parses a port or a port range.
+func parseAclPorts(ports string) (uint16, uint16, error) {
+	if ports == "" {
+		return 0, 65535, nil
+	}
+	parts := strings.SplitN(ports, "-", 2)
+	low, err := strconv.ParseUint(parts[0], 10, 16)
+	if err != nil {
+		return 0, 0, errors.New("Invalid port")
+	}
+	high := low
+	if len(parts) == 2 {
+		if high, err = strconv.ParseUint(parts[1], 10, 16); err != nil || high < low {
+			return 0, 0, errors.New("Invalid port range")
+		}
+	}
+	return uint16(low), uint16(high), nil
+}
+
+// parseAclProtocol parses the protocol of a rule.
+func parseAclProtocol(protocol string) (layers.IPProtocol, error) {
+	switch strings.ToLower(protocol) {
+	case "", "arp", "ipv4", "ipv6":
+		return 0, nil
+	case "icmp":
+		return layers.IPProtocolICMPv4, nil
+	case "tcp":
+		return layers.IPProtocolTCP, nil
+	case "udp":
+		return layers.IPProtocolUDP, nil
+	}
+	n, err := strconv.ParseUint(protocol, 10, 8)
+	if err != nil {
+		return 0, errors.New("Invalid protocol")
+	}
+	return layers.IPProtocol(n), nil
+}
+
+// validateAclAddress checks an address of a rule.
+func validateAclAddress(addr string) error {
+	switch {
+	case addr == "":
+		return nil
+	case strings.HasPrefix(addr, "vm:") && len(addr) > 3:
+		return nil
+	case strings.HasPrefix(addr, "group:") && len(addr) > 6:
+		return nil
+	}
+	if _, _, err := net.ParseCIDR(addr); err == nil {
+		return nil
+	}
+	if net.ParseIP(addr) != nil {
+		return nil
+	}
+	return fmt.Errorf("Invalid address %s", addr)
+}
+
+// describeAclEndpoint returns an endpoint of a rule for the listing.
+func describeAclEndpoint(mac string, addr string, ports string) string {
+	var parts []string
+	if mac != "" {
+		parts = append(parts, mac)
+	}
+	if addr != "" {
+		parts = append(parts, addr)
+	}
+	if len(parts) == 0 {
+		parts = append(parts, "any")
+	}
+	endpoint := strings.Join(parts, "/")
+	if ports != "" {
+		endpoint += ":" + ports
+	}
+	return endpoint
+}
@@ -2,7 +2,6 @@ package modules
 
 import (
 	"QemuUserNet/entities"
-	"errors"
 	"net"
 
 	"github.com/google/gopacket"
@@ -23,8 +22,8 @@ func NewAddressResolution(clients *entities.Clients) (*AddressResolution, error)
 // It extracts the Ethernet, ARP, and IPv4 layers from the packet, and if an ARP packet is found, it updates the client's IP address.
 // If only an IPv4 packet is found, it also updates the client's IP address.
 // It only updates the IP address if the client's IP is currently empty.
-// Returns an error indicating "Job done" to signify the packet was processed.
-func (a *AddressResolution) Listen(packet gopacket.Packet) ([]byte, Receiver, *entities.Thread, error) {
+// The packet is always left to the next modules.
+func (a *AddressResolution) Listen(packet gopacket.Packet) Result {
 	// Extract Ethernet, IPv4, and ARP layers from the packet
 	etherLayer := packet.Layer(layers.LayerTypeEthernet)
 	ipLayer := packet.Layer(layers.LayerTypeIPv4)
@@ -34,39 +33,49 @@ func (a *AddressResolution) Listen(packet gopacket.Packet) ([]byte, Receiver, *e
 	if etherLayer != nil && arpLayer != nil {
 		ethl, ok := etherLayer.(*layers.Ethernet)
 		if !ok {
-			return nil, Nobody, nil, errors.New("Failed to assert Ethernet layer")
+			return Pass()
 		}
 		arp, ok := arpLayer.(*layers.ARP)
 		if !ok {
-			return nil, Nobody, nil, errors.New("Failed to assert ARP layer")
+			return Pass()
 		}
 		srcMAC := ethl.SrcMAC
 		ip := net.IP(arp.SourceProtAddress)
 
 		// Update the client's IP address if it is empty
 		a.clients.UpdateIPIFEmpty(srcMAC.String(), ip.String())
-		return packet.Data(), All, nil, errors.New("Job done")
+		return Pass()
 	}
 
 	// Check if either Ethernet or IPv4 layers are missing
 	if etherLayer == nil || ipLayer == nil {
-		return packet.Data(), All, nil, errors.New("Required layers not found")
+		return Pass()
 	}
 
 	// Extract source MAC address and source IP address
 	ethl, ok := etherLayer.(*layers.Ethernet)
 	if !ok {
-		return nil, Nobody, nil, errors.New("Failed to assert Ethernet layer")
+		return Pass()
 	}
 	srcMAC := ethl.SrcMAC
 	ipl, ok := ipLayer.(*layers.IPv4)
 	if !ok {
-		return nil, Nobody, nil, errors.New("Failed to assert IPv4 layer")
+		return Pass()
 	}
 
 	// Update the client's IP address if it is empty
 	a.clients.UpdateIPIFEmpty(srcMAC.String(), ipl.SrcIP.String())
-	return packet.Data(), All, nil, errors.New("Job done")
+	return Pass()
+}
+
+// Selects checks if a frame is an ARP packet, or an IPv4 packet of a VM
+// whose address is not known yet.
+func (a *AddressResolution) Selects(frame *Frame) bool {
+	if frame.EtherType == layers.EthernetTypeARP {
+		return true
+	}
+	sender := frame.Sender
+	return frame.EtherType == layers.EthernetTypeIPv4 && (sender == nil || !sender.Uplink && sender.IP() == nil)
 }
 
 // Quit handles any necessary cleanup for a client when it disconnects. Currently, it does nothing.
@@ -5,6 +5,7 @@ import (
 	"QemuUserNet/tools"
 	"errors"
 	"net"
+	"sync"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -17,13 +18,16 @@ type Dhcp struct {
 	subnetIP   net.IP
 	subnetMask net.IPMask
 	dnsIP      net.IP
+	mtu        uint16     // MTU of the network, sent in the leases
+	mu         sync.Mutex // Guards the pool, shared by the threads of the network
 	freeIP     []net.IP
 	usedIP     []net.IP
 	clients    *entities.Clients
 }
 
-// NewDhcp creates a new Dhcp instance with the provided parameters.
-func NewDhcp(subnet string, gateway string, gatewayM string, rangeIp string, dnsIp string, clients *entities.Clients) (*Dhcp, error) {
+// NewDhcp creates a new Dhcp instance with the provided parameters. mtu is
+// the largest IP packet of the network.
+func NewDhcp(subnet string, gateway string, gatewayM string, rangeIp string, dnsIp string, mtu int, clients *entities.Clients) (*Dhcp, error) {
 	// Parse subnet and gateway IP
 	_, ipnet, err := net.ParseCIDR(subnet)
 	if err != nil {
@@ -59,6 +63,7 @@ func NewDhcp(subnet string, gateway string, gatewayM string, rangeIp string, dns
 		subnetIP:   ipnet.IP,
 		subnetMask: ipnet.Mask,
 		dnsIP:      dnsIP,
+		mtu:        uint16(mtu),
 		freeIP:     freeIP,
 		usedIP:     []net.IP{},
 		clients:    clients,
@@ -66,7 +71,7 @@ func NewDhcp(subnet string, gateway string, gatewayM string, rangeIp string, dns
 }
 
 // Listen processes a DHCP packet, assigns an IP address to the client, and constructs a DHCP response.
-func (d *Dhcp) Listen(packet gopacket.Packet) ([]byte, Receiver, *entities.Thread, error) {
+func (d *Dhcp) Listen(packet gopacket.Packet) Result {
 	etherLayer := packet.Layer(layers.LayerTypeEthernet)
 	ipLayer := packet.Layer(layers.LayerTypeIPv4)
 	udpLayer := packet.Layer(layers.LayerTypeUDP)
@@ -74,20 +79,32 @@ func (d *Dhcp) Listen(packet gopacket.Packet) ([]byte, Receiver, *entities.Threa
 
 	// Check if all required layers are present
 	if etherLayer == nil || ipLayer == nil || udpLayer == nil || dhcpLayer == nil {
-		return packet.Data(), All, nil, errors.New("Not a dhcp packet")
-	}
-
-	// Get an available IP address from the DHCP pool
-	clientIP, err := d.getAnIp()
-
-	if err != nil {
-		return packet.Data(), All, nil, err
+		return Pass()
 	}
 
 	// Extract Ethernet and DHCP layers
 	ether, _ := etherLayer.(*layers.Ethernet)
 	dhcp, _ := dhcpLayer.(*layers.DHCPv4)
 
+	// The hosts behind an uplink are not served, their leases could not be tracked
+	if port, e := d.clients.GetPortByMac(dhcp.ClientHWAddr.String()); e == nil && port.Uplink {
+		return Pass()
+	}
+
+	// Offer the address bound to the client, or get an available IP address from the DHCP pool
+	var clientIP *net.IP
+	var err error
+	if client, e := d.clients.GetClientByMac(dhcp.ClientHWAddr.String()); e == nil && client.StaticIP() {
+		ip := net.ParseIP(*client.IP())
+		clientIP = &ip
+	} else {
+		clientIP, err = d.getAnIp()
+	}
+
+	if err != nil {
+		return Pass()
+	}
+
 	// Determine DHCP message type
 	var messagetype layers.DHCPMsgType
 	for _, option := range dhcp.Options {
@@ -99,7 +116,7 @@ func (d *Dhcp) Listen(packet gopacket.Packet) ([]byte, Receiver, *entities.Threa
 			case layers.DHCPMsgTypeRequest:
 				messagetype = layers.DHCPMsgTypeAck
 			default:
-				return packet.Data(), Nobody, nil, errors.New("DHCP message type not supported")
+				return Pass()
 			}
 		}
 	}
@@ -168,6 +185,11 @@ func (d *Dhcp) Listen(packet gopacket.Packet) ([]byte, Receiver, *entities.Threa
 			Data:   d.dnsIP.To4(),
 			Length: 4,
 		},
+		{
+			Type:   layers.DHCPOptInterfaceMTU,
+			Data:   []byte{byte(d.mtu >> 8), byte(d.mtu)},
+			Length: 2,
+		},
 		{
 			Type:   layers.DHCPOptEnd,
 			Length: 0,
@@ -182,28 +204,37 @@ func (d *Dhcp) Listen(packet gopacket.Packet) ([]byte, Receiver, *entities.Threa
 	err = gopacket.SerializeLayers(buf, opts, responseEther, responseIP, responseUDP, responseDHCP)
 
 	if err != nil {
-		return packet.Data(), Nobody, nil, errors.New("Packet serialization error")
+		return Pass()
 	}
 
 	// Retrieve the client based on the DHCP client's MAC address
 	client, err := d.clients.GetClientByMac(dhcp.ClientHWAddr.String())
 	if err != nil {
-		return packet.Data(), Nobody, nil, errors.New("Client not found")
+		return Pass()
 	}
 
 	// Update the client's IP address
-	ip := clientIP.String()
-	client.VM.Ip = &ip
+	if err := d.clients.SetIP(client, clientIP.String(), client.StaticIP()); err != nil {
+		return Pass()
+	}
 
-	return buf.Bytes(), Himself, nil, nil
+	return Send(buf.Bytes(), Himself, nil)
+}
+
+// Selects checks if a frame is a DHCP packet.
+func (d *Dhcp) Selects(frame *Frame) bool {
+	return frame.IsUDP(67) || frame.IsUDP(68)
 }
 
 // Quit handles any cleanup operations needed for a client upon disconnection.
 // It releases the IP address used by the client back into the DHCP pool.
 func (d *Dhcp) Quit(client *entities.Thread) error {
 	// Release the used IP address back into the pool of free IP addresses
+	leased := client.IP()
+	d.mu.Lock()
+	defer d.mu.Unlock()
 	for _, ip := range d.usedIP {
-		if client.VM.Ip != nil && ip.String() == *client.VM.Ip {
+		if leased != nil && ip.String() == *leased {
 			d.freeIP = append(d.freeIP, ip)
 		}
 	}
@@ -213,11 +244,16 @@ func (d *Dhcp) Quit(client *entities.Thread) error {
 // returns an available IP address from the DHCP pool.
 func (d *Dhcp) getAnIp() (*net.IP, error) {
 	var value net.IP
-	if len(d.freeIP) > 0 {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	for len(d.freeIP) > 0 {
 		value, d.freeIP = d.freeIP[0], d.freeIP[1:]
 		d.usedIP = append(d.usedIP, value)
+		// Skip the addresses statically bound to a client
+		if _, err := d.clients.GetClientByIP(value.String()); err == nil {
+			continue
+		}
 		return &value, nil
-	} else {
-		return nil, errors.New("No IP left in the DHCP pool")
 	}
+	return nil, errors.New("No IP left in the DHCP pool")
 }
@@ -31,16 +31,18 @@ func NewDns(ip string, mac string, clients *entities.Clients) (*Dns, error) {
 }
 
 // Listen processes incoming packets and responds to ARP and DNS requests.
-func (d *Dns) Listen(packet gopacket.Packet) ([]byte, Receiver, *entities.Thread, error) {
+// The other packets are left to the next modules.
+func (d *Dns) Listen(packet gopacket.Packet) Result {
 	// Check if the packet is an ARP request directed to the DNS server
-	t, r, err := d.respondToArpRequest(packet)
-	if err == nil {
-		return t, r, nil, err
+	if t, r, err := d.respondToArpRequest(packet); err == nil {
+		return Send(t, r, nil)
 	}
 
 	// If not an ARP request, check if it is a DNS request
-	t, r, err = d.respondToDnsRequest(packet)
-	return t, r, nil, err
+	if t, r, err := d.respondToDnsRequest(packet); err == nil {
+		return Send(t, r, nil)
+	}
+	return Pass()
 }
 
 // respondToDnsRequest handles DNS requests and builds appropriate responses.
@@ -166,15 +168,7 @@ func (d *Dns) respondToArpRequest(packet gopacket.Packet) ([]byte, Receiver, err
 // buildDNSAnswer constructs a DNS answer for a given DNS question.
 func (d *Dns) buildDNSAnswer(question layers.DNSQuestion) *layers.DNSResourceRecord {
 	// Retrieve client information based on the question name
-	client, err := d.clients.GetClientByID(string(question.Name))
-	if err != nil {
-		return nil
-	}
-	if client.VM.Ip == nil {
-		return nil
-	}
-
-	ip := net.ParseIP(*client.VM.Ip)
+	ip := d.resolve(string(question.Name))
 	if ip == nil {
 		return nil
 	}
@@ -200,6 +194,27 @@ func (d *Dns) buildDNSAnswer(question layers.DNSQuestion) *layers.DNSResourceRec
 	return answer
 }
 
+// resolve finds the address of the network card named name: ID.nicN names
+// a card of a VM, and the ID of a VM names its first card with an address.
+func (d *Dns) resolve(name string) net.IP {
+	for _, client := range d.clients.Threads() {
+		if ip := client.IP(); client.VM.Name() == name && ip != nil {
+			return net.ParseIP(*ip)
+		}
+	}
+	for _, client := range d.clients.GetClientsByID(name) {
+		if ip := client.IP(); ip != nil {
+			return net.ParseIP(*ip)
+		}
+	}
+	return nil
+}
+
+// Selects checks if a frame is an ARP or a DNS packet.
+func (d *Dns) Selects(frame *Frame) bool {
+	return frame.EtherType == layers.EthernetTypeARP || frame.SrcPort == 53 || frame.DstPort == 53
+}
+
 // Quit handles any necessary cleanup for a client when it disconnects. Currently, it does nothing.
 func (d *Dns) Quit(client *entities.Thread) error {
 	return nil
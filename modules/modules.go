@@ -7,8 +7,10 @@ package modules
 
 import (
 	"QemuUserNet/entities"
+	"net"
 
 	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
 )
 
 // Receiver is an enumeration representing the intended recipient(s) of a packet.
@@ -24,15 +26,105 @@ const (
 	Explicit                  // Send the packet to a specific client
 )
 
+// Verdict is the decision of a module about a frame.
+type Verdict int
+
+// Enumeration values for Verdict.
+const (
+	VerdictContinue Verdict = iota // Leave the frame to the next modules
+	VerdictConsume                 // The module handled the frame, nothing is sent
+	VerdictDrop                    // Discard the frame
+	VerdictForward                 // Send the data of the Result to its receivers
+)
+
+// String returns the name of the verdict.
+func (v Verdict) String() string {
+	switch v {
+	case VerdictContinue:
+		return "continue"
+	case VerdictConsume:
+		return "consume"
+	case VerdictDrop:
+		return "drop"
+	case VerdictForward:
+		return "forward"
+	}
+	return "unknown"
+}
+
+// Result is the outcome of the processing of a frame by a module.
+type Result struct {
+	Verdict  Verdict          // Fate of the frame
+	Data     []byte           // Frame to send, with VerdictForward
+	Receiver Receiver         // Recipients of Data, with VerdictForward
+	Client   *entities.Thread // Recipient of an Explicit receiver
+}
+
+// Pass leaves a frame to the next modules.
+func Pass() Result {
+	return Result{Verdict: VerdictContinue}
+}
+
+// Consumed reports a frame the module handled without sending anything.
+func Consumed() Result {
+	return Result{Verdict: VerdictConsume}
+}
+
+// Dropped reports a frame that must be discarded.
+func Dropped() Result {
+	return Result{Verdict: VerdictDrop}
+}
+
+// Send forwards data to receiver, client being the recipient of an Explicit
+// receiver.
+func Send(data []byte, receiver Receiver, client *entities.Thread) Result {
+	return Result{Verdict: VerdictForward, Data: data, Receiver: receiver, Client: client}
+}
+
 // Module is an interface that defines methods for processing and cleaning up network packets.
 type Module interface {
-	// Listen processes a network packet and determines how it should be forwarded.
-	// Returns the modified packet data, the receiver type, the specific client thread (if applicable),
-	// and any error encountered. If the error is nil, it indicates that the packet was successfully processed,
-	// and further processing of the packet is unnecessary.
-	Listen(gopacket.Packet) ([]byte, Receiver, *entities.Thread, error)
+	// Listen processes a network packet and decides its fate. The packet
+	// goes through the modules of the pipeline in order, until one of them
+	// returns another verdict than VerdictContinue.
+	Listen(gopacket.Packet) Result
 
 	// Quit handles any necessary cleanup for a client when it disconnects.
 	// Returns any error encountered during the cleanup process.
 	Quit(*entities.Thread) error
 }
+
+// Closer is implemented by the modules that hold resources, released when
+// the module is removed from its pipeline or its network is removed.
+type Closer interface {
+	Close()
+}
+
+// Frame holds the headers of a frame, decoded without allocation before the
+// frame goes through the modules. The slices point into the frame and are
+// only valid while it is processed.
+type Frame struct {
+	Sender    *entities.Thread    // Port the frame was received from
+	SrcMAC    net.HardwareAddr    // Source MAC address
+	DstMAC    net.HardwareAddr    // Destination MAC address
+	EtherType layers.EthernetType // Type of the payload of the frame
+	SrcIP     net.IP              // Source address of an IPv4 or IPv6 packet, nil otherwise
+	DstIP     net.IP              // Destination address of an IPv4 or IPv6 packet, nil otherwise
+	Protocol  layers.IPProtocol   // Transport protocol of an IPv4 or IPv6 packet
+	SrcPort   uint16              // Source port of a TCP or UDP segment, 0 otherwise
+	DstPort   uint16              // Destination port of a TCP or UDP segment, 0 otherwise
+}
+
+// IsUDP checks if the frame carries a UDP datagram from or to port.
+func (f *Frame) IsUDP(port uint16) bool {
+	return f.Protocol == layers.IPProtocolUDP && (f.SrcPort == port || f.DstPort == port)
+}
+
+// Selector is implemented by the modules that only process some frames. The
+// frames selected by no module of the chain are switched without being
+// decoded any further, and without going through the modules. A module that
+// is not a Selector sees every frame.
+type Selector interface {
+	// Selects checks if the module may process a frame. Selecting a frame the
+	// module does not process is harmless, the reverse is not.
+	Selects(frame *Frame) bool
+}
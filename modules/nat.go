@@ -0,0 +1,401 @@
+package modules
+
+import (
+	"QemuUserNet/entities"
+	"QemuUserNet/netstack"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// udpFlowTimeout is the time after which an idle UDP flow is forgotten.
+const udpFlowTimeout = 60 * time.Second
+
+// NatRule maps a port of the gateway to an allow-listed host address.
+type NatRule struct {
+	Protocol string // Protocol of the rule, "tcp" or "udp"
+	Port     uint16 // Port of the gateway the VMs send to
+	Target   string // Host address the flows are proxied to
+}
+
+// String returns the rule in the format accepted by ParseNatRule.
+func (r NatRule) String() string {
+	return strconv.Itoa(int(r.Port)) + "=" + r.Target + "/" + r.Protocol
+}
+
+// ParseNatRule parses a rule in the format [gwport=]host:port[/tcp|udp].
+// When the gateway port is omitted, the port of the host address is used.
+func ParseNatRule(spec string) (NatRule, error) {
+	rule := NatRule{Protocol: "tcp"}
+	if i := strings.LastIndex(spec, "/"); i != -1 {
+		rule.Protocol = spec[i+1:]
+		spec = spec[:i]
+	}
+	if rule.Protocol != "tcp" && rule.Protocol != "udp" {
+		return rule, errors.New("Invalid protocol, expected tcp or udp")
+	}
+
+	gwPort := ""
+	if i := strings.Index(spec, "="); i != -1 {
+		gwPort, spec = spec[:i], spec[i+1:]
+	}
+	host, port, err := net.SplitHostPort(spec)
+	if err != nil {
+		return rule, err
+	}
+	if net.ParseIP(host) == nil {
+		return rule, errors.New("Invalid host IP")
+	}
+	if gwPort == "" {
+		gwPort = port
+	}
+	p, err := strconv.ParseUint(gwPort, 10, 16)
+	if err != nil || p == 0 {
+		return rule, errors.New("Invalid gateway port")
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return rule, errors.New("Invalid host port")
+	}
+	rule.Port = uint16(p)
+	rule.Target = net.JoinHostPort(host, port)
+	return rule, nil
+}
+
+// natFlow is a connection tracked by the NAT module.
+type natFlow struct {
+	id      uint64
+	rule    NatRule
+	guest   string
+	started time.Time
+	tcp     *netstack.TCPConn
+	udp     *net.UDPConn
+	in      uint64
+	out     uint64
+}
+
+// Nat terminates the TCP and UDP flows that VMs send to the gateway with a
+// user-space TCP/IP stack, and proxies them to allow-listed host addresses.
+type Nat struct {
+	stack    *netstack.Stack
+	mu       sync.Mutex
+	rules    map[string]NatRule
+	flows    map[uint64]*natFlow
+	udpFlows map[string]*natFlow
+	nextFlow uint64
+}
+
+// NewNat creates a new Nat instance bound to the gateway address of a
+// network. mtu is the largest IP packet of the network and output sends
+// frames to the network.
+func NewNat(gatewayIP string, gatewayMAC string, mtu int, clients *entities.Clients, output func([]byte) error) (*Nat, error) {
+	ip := net.ParseIP(gatewayIP)
+	if ip == nil {
+		return nil, errors.New("Invalid gateway IP")
+	}
+	mac, err := net.ParseMAC(gatewayMAC)
+	if err != nil {
+		return nil, err
+	}
+	resolve := func(ip net.IP) (net.HardwareAddr, error) {
+		client, err := clients.GetClientByIP(ip.String())
+		if err != nil {
+			return nil, err
+		}
+		return net.ParseMAC(client.VM.Mac)
+	}
+	stack, err := netstack.NewStack(ip, mac, mtu, output, resolve)
+	if err != nil {
+		return nil, err
+	}
+	return &Nat{
+		stack:    stack,
+		rules:    make(map[string]NatRule),
+		flows:    make(map[uint64]*natFlow),
+		udpFlows: make(map[string]*natFlow),
+	}, nil
+}
+
+// Stack returns the user-space stack of the gateway.
+func (n *Nat) Stack() *netstack.Stack {
+	return n.stack
+}
+
+// Listen hands the packets addressed to the gateway over to the user-space
+// stack. Other packets are left to the next modules.
+func (n *Nat) Listen(packet gopacket.Packet) Result {
+	if n.stack.Input(packet) {
+		return Consumed()
+	}
+	return Pass()
+}
+
+// Selects checks if a frame is an ARP packet or is addressed to the gateway.
+func (n *Nat) Selects(frame *Frame) bool {
+	return frame.EtherType == layers.EthernetTypeARP || frame.DstIP != nil && frame.DstIP.Equal(n.stack.IP())
+}
+
+// Quit closes the flows of a client when it disconnects.
+func (n *Nat) Quit(client *entities.Thread) error {
+	leased := client.IP()
+	if leased == nil {
+		return nil
+	}
+	n.mu.Lock()
+	var flows []*natFlow
+	for _, flow := range n.flows {
+		if host, _, _ := net.SplitHostPort(flow.guest); host == *leased {
+			flows = append(flows, flow)
+		}
+	}
+	n.mu.Unlock()
+
+	for _, flow := range flows {
+		n.closeFlow(flow)
+	}
+	n.stack.Forget(net.ParseIP(*leased))
+	return nil
+}
+
+// Allow adds a rule to the allow-list of the gateway.
+func (n *Nat) Allow(rule NatRule) error {
+	key := rule.Protocol + "/" + strconv.Itoa(int(rule.Port))
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	if _, ok := n.rules[key]; ok {
+		return errors.New("A rule already exists for this port")
+	}
+
+	var err error
+	if rule.Protocol == "tcp" {
+		err = n.stack.Listen(rule.Port, func(conn *netstack.TCPConn) { n.proxyTcp(rule, conn) })
+	} else {
+		err = n.stack.HandleUDP(rule.Port, func(src *net.UDPAddr, mac net.HardwareAddr, payload []byte) {
+			n.proxyUdp(rule, src, payload)
+		})
+	}
+	if err != nil {
+		return err
+	}
+	n.rules[key] = rule
+	return nil
+}
+
+// Remove removes the rule of a gateway port from the allow-list. The
+// established flows are closed.
+func (n *Nat) Remove(protocol string, port uint16) error {
+	key := protocol + "/" + strconv.Itoa(int(port))
+
+	n.mu.Lock()
+	rule, ok := n.rules[key]
+	if !ok {
+		n.mu.Unlock()
+		return errors.New("Rule not found")
+	}
+	delete(n.rules, key)
+	var flows []*natFlow
+	for _, flow := range n.flows {
+		if flow.rule == rule {
+			flows = append(flows, flow)
+		}
+	}
+	n.mu.Unlock()
+
+	if protocol == "tcp" {
+		n.stack.Unlisten(port)
+	} else {
+		n.stack.UnhandleUDP(port)
+	}
+	for _, flow := range flows {
+		n.closeFlow(flow)
+	}
+	return nil
+}
+
+// Close closes every flow of the gateway.
+func (n *Nat) Close() {
+	n.mu.Lock()
+	var flows []*natFlow
+	for _, flow := range n.flows {
+		flows = append(flows, flow)
+	}
+	n.mu.Unlock()
+	for _, flow := range flows {
+		n.closeFlow(flow)
+	}
+	n.stack.Close()
+}
+
+// Describe returns a human readable description of the allow-list and of
+// the tracked connections.
+func (n *Nat) Describe() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if len(n.rules) == 0 && len(n.flows) == 0 {
+		return nil
+	}
+	lines := []string{"NAT RULE"}
+	var rules []string
+	for _, rule := range n.rules {
+		rules = append(rules, rule.String())
+	}
+	sort.Strings(rules)
+	lines = append(lines, rules...)
+
+	lines = append(lines, "FLOW	PROTO	GUEST			TARGET			IN	OUT	AGE")
+	var ids []uint64
+	for id := range n.flows {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+	for _, id := range ids {
+		flow := n.flows[id]
+		in, out := flow.in, flow.out
+		if flow.tcp != nil {
+			in, out = flow.tcp.Stats()
+		}
+		lines = append(lines, fmt.Sprintf("%d	%s	%s		%s		%d	%d	%s",
+			flow.id, flow.rule.Protocol, flow.guest, flow.rule.Target, in, out,
+			time.Since(flow.started).Truncate(time.Second).String()))
+	}
+	return lines
+}
+
+// track registers a new flow in the connection tracking table.
+func (n *Nat) track(flow *natFlow) {
+	n.mu.Lock()
+	n.trackLocked(flow)
+	n.mu.Unlock()
+}
+
+// trackLocked registers a new flow like track. The caller must hold the
+// lock.
+func (n *Nat) trackLocked(flow *natFlow) {
+	n.nextFlow++
+	flow.id = n.nextFlow
+	n.flows[flow.id] = flow
+	if flow.udp != nil {
+		n.udpFlows[flow.rule.String()+"|"+flow.guest] = flow
+	}
+}
+
+// closeFlow closes both sides of a flow and forgets it.
+func (n *Nat) closeFlow(flow *natFlow) {
+	n.mu.Lock()
+	if _, ok := n.flows[flow.id]; !ok {
+		n.mu.Unlock()
+		return
+	}
+	delete(n.flows, flow.id)
+	if flow.udp != nil {
+		delete(n.udpFlows, flow.rule.String()+"|"+flow.guest)
+	}
+	n.mu.Unlock()
+
+	if flow.tcp != nil {
+		flow.tcp.Abort()
+	}
+	if flow.udp != nil {
+		flow.udp.Close()
+	}
+}
+
+// proxyTcp relays a TCP connection of a VM to the target of a rule.
+func (n *Nat) proxyTcp(rule NatRule, conn *netstack.TCPConn) {
+	host, err := net.DialTimeout("tcp", rule.Target, 5*time.Second)
+	if err != nil {
+		log.Println("WARNING: nat: cannot reach ", rule.Target, ": ", err.Error())
+		conn.Abort()
+		return
+	}
+	flow := &natFlow{rule: rule, guest: conn.RemoteAddr().String(), started: time.Now(), tcp: conn}
+	n.track(flow)
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(host, conn)
+		if tcp, ok := host.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(conn, host)
+		conn.CloseWrite()
+		done <- struct{}{}
+	}()
+	<-done
+	<-done
+
+	host.Close()
+	conn.Close()
+	n.mu.Lock()
+	delete(n.flows, flow.id)
+	n.mu.Unlock()
+}
+
+// proxyUdp relays a datagram of a VM to the target of a rule. The answers
+// of the target are sent back to the VM until the flow is idle.
+func (n *Nat) proxyUdp(rule NatRule, src *net.UDPAddr, payload []byte) {
+	key := rule.String() + "|" + src.String()
+	n.mu.Lock()
+	flow, ok := n.udpFlows[key]
+	n.mu.Unlock()
+
+	if !ok {
+		target, err := net.ResolveUDPAddr("udp", rule.Target)
+		if err != nil {
+			return
+		}
+		// The flow is looked up again and created under the same lock, as
+		// another datagram of the VM may have created it meanwhile
+		n.mu.Lock()
+		if flow, ok = n.udpFlows[key]; !ok {
+			conn, err := net.DialUDP("udp", nil, target)
+			if err != nil {
+				n.mu.Unlock()
+				log.Println("WARNING: nat: cannot reach ", rule.Target, ": ", err.Error())
+				return
+			}
+			flow = &natFlow{rule: rule, guest: src.String(), started: time.Now(), udp: conn}
+			n.trackLocked(flow)
+			go n.relayUdp(flow, src)
+		}
+		n.mu.Unlock()
+	}
+
+	if l, err := flow.udp.Write(payload); err == nil {
+		n.mu.Lock()
+		flow.in += uint64(l)
+		n.mu.Unlock()
+	}
+}
+
+// relayUdp sends the answers of the target of a UDP flow back to the VM.
+func (n *Nat) relayUdp(flow *natFlow, guest *net.UDPAddr) {
+	buffer := make([]byte, 65535)
+	for {
+		flow.udp.SetReadDeadline(time.Now().Add(udpFlowTimeout))
+		l, err := flow.udp.Read(buffer)
+		if err != nil {
+			n.closeFlow(flow)
+			return
+		}
+		if err := n.stack.SendUDP(flow.rule.Port, guest, buffer[:l]); err == nil {
+			n.mu.Lock()
+			flow.out += uint64(l)
+			n.mu.Unlock()
+		}
+	}
+}
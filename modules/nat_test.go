@@ -0,0 +1,61 @@
+package modules
+
+import (
+	"QemuUserNet/entities"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// TestNatUdpFlow sends the first datagrams of a flow concurrently: a single
+// flow must be created, relaying them from a single host socket.
+func TestNatUdpFlow(t *testing.T) {
+	target, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IP{127, 0, 0, 1}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer target.Close()
+	n, err := NewNat("10.10.10.1", "52:54:00:12:34:ff", entities.DefaultMTU, &entities.Clients{}, func([]byte) error { return nil })
+	if err != nil {
+		t.Fatal(err)
+	}
+	rule := NatRule{Protocol: "udp", Port: 5000, Target: target.LocalAddr().String()}
+	guest := &net.UDPAddr{IP: net.IP{10, 10, 10, 11}, Port: 40000}
+
+	const datagrams = 64
+	var wg sync.WaitGroup
+	start := make(chan struct{})
+	for i := 0; i < datagrams; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			n.proxyUdp(rule, guest, []byte("ping"))
+		}()
+	}
+	close(start)
+	wg.Wait()
+
+	sources := make(map[string]bool)
+	buffer := make([]byte, 64)
+	for i := 0; i < datagrams; i++ {
+		target.SetReadDeadline(time.Now().Add(time.Second))
+		_, src, err := target.ReadFromUDP(buffer)
+		if err != nil {
+			t.Fatalf("datagram %d: %v", i, err)
+		}
+		sources[src.String()] = true
+	}
+	n.mu.Lock()
+	flows := len(n.flows)
+	n.mu.Unlock()
+	if flows != 1 || len(sources) != 1 {
+		t.Fatalf("%d flows and %d host sockets, want one", flows, len(sources))
+	}
+	ip := guest.IP.String()
+	n.Quit(entities.NewThread(entities.VM{ID: "vm", Ip: &ip}, nil, false))
+	if len(n.flows) != 0 {
+		t.Fatalf("%d flows left", len(n.flows))
+	}
+}
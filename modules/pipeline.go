@@ -0,0 +1,258 @@
+package modules
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/google/gopacket"
+)
+
+// stage is a module of a pipeline with the counters of its verdicts.
+type stage struct {
+	name      string
+	module    Module
+	consumed  atomic.Uint64
+	dropped   atomic.Uint64
+	forwarded atomic.Uint64
+}
+
+// chain is the list of stages of a pipeline at a point in time. It is never
+// modified once published.
+type chain struct {
+	stages   []*stage
+	modules  []Module
+	all      bool   // A module is not a Selector, every frame goes through the modules
+	switcher *stage // Switch of the pipeline, nil if there is none
+}
+
+// Pipeline is the ordered list of modules the frames of a network go
+// through. Modules can be added and removed while frames flow: the
+// listeners see the list of modules of the moment each frame arrives.
+type Pipeline struct {
+	mu      sync.Mutex // Serializes the changes
+	current atomic.Pointer[chain]
+}
+
+// NewPipeline creates an empty pipeline.
+func NewPipeline() *Pipeline {
+	p := &Pipeline{}
+	p.current.Store(&chain{})
+	return p
+}
+
+// Modules returns the modules of the pipeline, in order. The slice must not
+// be modified.
+func (p *Pipeline) Modules() []Module {
+	return p.current.Load().modules
+}
+
+// Names returns the names of the modules of the pipeline, in order.
+func (p *Pipeline) Names() []string {
+	stages := p.current.Load().stages
+	names := make([]string, len(stages))
+	for i, stage := range stages {
+		names[i] = stage.name
+	}
+	return names
+}
+
+// Get returns the module of the pipeline named name, nil if there is none.
+func (p *Pipeline) Get(name string) Module {
+	for _, stage := range p.current.Load().stages {
+		if stage.name == name {
+			return stage.module
+		}
+	}
+	return nil
+}
+
+// Index returns the position of the module named name, -1 if there is none.
+func (p *Pipeline) Index(name string) int {
+	for i, stage := range p.current.Load().stages {
+		if stage.name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// Insert adds a module named name at position, or at the end if position is
+// out of range. The modules the module requires, see Registration, must come
+// before it.
+func (p *Pipeline) Insert(name string, module Module, position int) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stages := p.current.Load().stages
+	if position < 0 || position > len(stages) {
+		position = len(stages)
+	}
+	for _, stage := range stages {
+		if stage.name == name {
+			return errors.New("The pipeline already has a module " + name)
+		}
+	}
+	for _, required := range lookupRegistration(name).Requires {
+		found := false
+		for _, stage := range stages[:position] {
+			found = found || moduleType(stage.name) == required
+		}
+		if !found {
+			return fmt.Errorf("The module %s requires a module %s before it", name, required)
+		}
+	}
+
+	updated := make([]*stage, 0, len(stages)+1)
+	updated = append(updated, stages[:position]...)
+	updated = append(updated, &stage{name: name, module: module})
+	updated = append(updated, stages[position:]...)
+	p.publish(updated)
+	return nil
+}
+
+// Remove removes the module named name. Returns the module removed.
+func (p *Pipeline) Remove(name string) (Module, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stages := p.current.Load().stages
+	var removed *stage
+	updated := make([]*stage, 0, len(stages))
+	for _, stage := range stages {
+		if stage.name == name {
+			removed = stage
+		} else {
+			updated = append(updated, stage)
+		}
+	}
+	if removed == nil {
+		return nil, errors.New("Module not found")
+	}
+	for _, stage := range updated {
+		for _, required := range lookupRegistration(stage.name).Requires {
+			if required == moduleType(name) && !hasType(updated, required) {
+				return nil, fmt.Errorf("The module %s requires %s", stage.name, name)
+			}
+		}
+	}
+	p.publish(updated)
+	return removed.module, nil
+}
+
+// RemoveModule removes a module, whatever its name.
+func (p *Pipeline) RemoveModule(module Module) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	stages := p.current.Load().stages
+	updated := make([]*stage, 0, len(stages))
+	for _, stage := range stages {
+		if stage.module != module {
+			updated = append(updated, stage)
+		}
+	}
+	p.publish(updated)
+}
+
+// publish makes stages the modules of the pipeline. p.mu must be held.
+func (p *Pipeline) publish(stages []*stage) {
+	c := &chain{stages: stages, modules: make([]Module, len(stages))}
+	for i, stage := range stages {
+		c.modules[i] = stage.module
+		if _, ok := stage.module.(Selector); !ok {
+			c.all = true
+		}
+		if _, ok := stage.module.(*Switch); ok && c.switcher == nil {
+			c.switcher = stage
+		}
+	}
+	p.current.Store(c)
+}
+
+// Process passes a packet through the modules, in order, until one of them
+// decides its fate. A packet every module leaves to the next ones is
+// dropped.
+func (p *Pipeline) Process(packet gopacket.Packet) Result {
+	for _, stage := range p.current.Load().stages {
+		result := stage.module.Listen(packet)
+		switch result.Verdict {
+		case VerdictContinue:
+			continue
+		case VerdictConsume:
+			stage.consumed.Add(1)
+		case VerdictDrop:
+			stage.dropped.Add(1)
+		case VerdictForward:
+			stage.forwarded.Add(1)
+		}
+		return result
+	}
+	return Dropped()
+}
+
+// Selects checks if a module of the pipeline may process a frame, see
+// Selector.
+func (p *Pipeline) Selects(frame *Frame) bool {
+	c := p.current.Load()
+	if c.all {
+		return true
+	}
+	for _, module := range c.modules {
+		if module.(Selector).Selects(frame) {
+			return true
+		}
+	}
+	return false
+}
+
+// Switches checks if the pipeline has a switch, which forwards the frames
+// no other module processes. Without a switch, these frames are dropped.
+func (p *Pipeline) Switches() bool {
+	return p.current.Load().switcher != nil
+}
+
+// Switched counts the verdict of a frame switched without going through
+// the modules as a verdict of the switch.
+func (p *Pipeline) Switched(verdict Verdict) {
+	s := p.current.Load().switcher
+	switch {
+	case s == nil:
+	case verdict == VerdictDrop:
+		s.dropped.Add(1)
+	case verdict == VerdictForward:
+		s.forwarded.Add(1)
+	}
+}
+
+// Describe returns a human readable description of the modules with the
+// counters of their verdicts.
+func (p *Pipeline) Describe() []string {
+	lines := []string{"MODULE		CONSUMED	DROPPED		FORWARDED"}
+	for _, stage := range p.current.Load().stages {
+		name := stage.name + "	"
+		if len(stage.name) < 8 {
+			name += "	"
+		}
+		lines = append(lines, fmt.Sprintf("%s%d		%d		%d", name, stage.consumed.Load(), stage.dropped.Load(), stage.forwarded.Load()))
+	}
+	return lines
+}
+
+// moduleType returns the type of a module from its name in a pipeline,
+// TYPE or TYPE:INSTANCE.
+func moduleType(name string) string {
+	if i := strings.Index(name, ":"); i != -1 {
+		return name[:i]
+	}
+	return name
+}
+
+// hasType checks if stages has a module of type kind.
+func hasType(stages []*stage, kind string) bool {
+	for _, stage := range stages {
+		if moduleType(stage.name) == kind {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,380 @@
+package modules
+
+import (
+	"QemuUserNet/entities"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// PluginVersion is the version of the protocol spoken with the plugins. A
+// plugin answering the hello message with another version is refused.
+const PluginVersion = 1
+
+const (
+	// DefaultPluginTimeout bounds the time a plugin is given to decide on a
+	// frame.
+	DefaultPluginTimeout = 100 * time.Millisecond
+	// pluginDialTimeout bounds the connection to a plugin and its hello.
+	pluginDialTimeout = 5 * time.Second
+	// pluginRetry is the time between two connections to a plugin that is
+	// not reachable.
+	pluginRetry = time.Second
+)
+
+// Types of the messages exchanged with a plugin.
+const (
+	pluginHello  = "hello"  // Both ways, first message of a connection
+	pluginListen = "listen" // To the plugin, a frame to decide on
+	pluginResult = "result" // From the plugin, the verdict on a frame
+	pluginQuit   = "quit"   // To the plugin, a port left the network
+)
+
+// pluginReceivers are the names of the receivers in the messages.
+var pluginReceivers = map[string]Receiver{
+	"nobody":   Nobody,
+	"himself":  Himself,
+	"all":      All,
+	"others":   Others,
+	"explicit": Explicit,
+}
+
+// pluginMessage is a message exchanged with a plugin, a JSON object per
+// line. Frames are encoded in base64.
+type pluginMessage struct {
+	Type     string      `json:"type"`
+	Version  int         `json:"version,omitempty"`  // hello
+	Network  string      `json:"network,omitempty"`  // hello
+	MTU      int         `json:"mtu,omitempty"`      // hello
+	ID       uint64      `json:"id,omitempty"`       // listen and result
+	Frame    []byte      `json:"frame,omitempty"`    // listen, and result to send another frame
+	Source   string      `json:"source,omitempty"`   // listen, port owning the source MAC address
+	Verdict  string      `json:"verdict,omitempty"`  // result: continue, consume, drop or forward
+	Receiver string      `json:"receiver,omitempty"` // result: nobody, himself, all, others or explicit
+	Target   string      `json:"target,omitempty"`   // result: MAC address of the explicit receiver
+	Port     *pluginPort `json:"port,omitempty"`     // quit
+}
+
+// pluginPort is a port of the network in the messages.
+type pluginPort struct {
+	ID  string `json:"id"`
+	NIC int    `json:"nic"`
+	MAC string `json:"mac"`
+}
+
+// Plugin is a module implemented by another process, reached through a Unix
+// stream socket. Frames are sent to the plugin, which answers with a
+// verdict. When the plugin does not answer in time or cannot be reached,
+// the frame continues through the pipeline (fail-open) or is dropped
+// (fail-closed).
+type Plugin struct {
+	path       string
+	network    string
+	mtu        int // Largest frame of the network, with its Ethernet header
+	timeout    time.Duration
+	failClosed bool
+	clients    *entities.Clients
+
+	// writeMu serializes the writes to the plugin and the connections to it,
+	// so that mu is never held while writing and the reader delivering the
+	// verdicts never waits behind a blocked write. It is acquired before mu.
+	writeMu sync.Mutex
+	mu      sync.Mutex // Guards the fields below
+	conn    net.Conn
+	encoder *json.Encoder
+	pending map[uint64]chan pluginMessage // Frames waiting for their verdict, by ID
+	id      uint64
+	retry   time.Time // Time before which the plugin is not dialed again
+	failing bool      // The last frame was not decided by the plugin
+	closed  bool
+}
+
+// NewPlugin connects to the plugin listening on the Unix socket at path for
+// the network named network. mtu is the largest IP packet of the network.
+func NewPlugin(path string, network string, mtu int, timeout time.Duration, failClosed bool, clients *entities.Clients) (*Plugin, error) {
+	if path == "" {
+		return nil, errors.New("The plugin has no socket")
+	}
+	if timeout <= 0 {
+		return nil, errors.New("Invalid plugin timeout")
+	}
+	p := &Plugin{
+		path:       path,
+		network:    network,
+		mtu:        mtu + 14,
+		timeout:    timeout,
+		failClosed: failClosed,
+		clients:    clients,
+		pending:    make(map[uint64]chan pluginMessage),
+	}
+	conn, decoder, err := p.connect(pluginDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	p.mu.Lock()
+	p.attach(conn, decoder)
+	p.mu.Unlock()
+	return p, nil
+}
+
+// connect dials the plugin and exchanges the hello messages within timeout.
+// Returns the connection and the decoder of its messages.
+func (p *Plugin) connect(timeout time.Duration) (net.Conn, *json.Decoder, error) {
+	conn, err := net.DialTimeout("unix", p.path, timeout)
+	if err != nil {
+		return nil, nil, fmt.Errorf("cannot connect to the plugin %s: %s", p.path, err.Error())
+	}
+	conn.SetDeadline(time.Now().Add(timeout))
+	encoder := json.NewEncoder(conn)
+	decoder := json.NewDecoder(conn)
+	hello := pluginMessage{Type: pluginHello, Version: PluginVersion, Network: p.network, MTU: p.mtu - 14}
+	var answer pluginMessage
+	if err := encoder.Encode(hello); err != nil {
+		conn.Close()
+		return nil, nil, fmt.Errorf("cannot greet the plugin %s: %s", p.path, err.Error())
+	}
+	if err := decoder.Decode(&answer); err != nil || answer.Type != pluginHello {
+		conn.Close()
+		return nil, nil, fmt.Errorf("no hello from the plugin %s", p.path)
+	}
+	if answer.Version != PluginVersion {
+		conn.Close()
+		return nil, nil, fmt.Errorf("the plugin %s speaks version %d of the protocol, expected %d", p.path, answer.Version, PluginVersion)
+	}
+	conn.SetDeadline(time.Time{})
+	return conn, decoder, nil
+}
+
+// attach makes conn the connection to the plugin and starts reading its
+// verdicts. p.mu must be held.
+func (p *Plugin) attach(conn net.Conn, decoder *json.Decoder) {
+	p.conn = conn
+	p.encoder = json.NewEncoder(conn)
+	go p.read(conn, decoder)
+}
+
+// read delivers the verdicts of the plugin until the connection is closed.
+// The frames still waiting for their verdict are then failed.
+func (p *Plugin) read(conn net.Conn, decoder *json.Decoder) {
+	for {
+		var msg pluginMessage
+		if err := decoder.Decode(&msg); err != nil {
+			break
+		}
+		if msg.Type != pluginResult {
+			continue
+		}
+		p.mu.Lock()
+		if waiting, ok := p.pending[msg.ID]; ok {
+			delete(p.pending, msg.ID)
+			waiting <- msg
+		}
+		p.mu.Unlock()
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.conn != conn {
+		return
+	}
+	conn.Close()
+	p.conn = nil
+	p.encoder = nil
+	for id, waiting := range p.pending {
+		close(waiting)
+		delete(p.pending, id)
+	}
+	if !p.closed {
+		log.Println("WARNING: the plugin " + p.path + " disconnected")
+	}
+}
+
+// Listen sends a frame to the plugin and applies its verdict.
+func (p *Plugin) Listen(packet gopacket.Packet) Result {
+	request := pluginMessage{Type: pluginListen, Frame: packet.Data()}
+	if eth, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); ok {
+		if source, err := p.clients.GetPortByAddr(eth.SrcMAC); err == nil {
+			request.Source = source.VM.Name()
+		}
+	}
+
+	p.writeMu.Lock()
+	waiting, err := p.send(&request)
+	p.writeMu.Unlock()
+	if err != nil {
+		return p.fail(err)
+	}
+
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	select {
+	case msg, ok := <-waiting:
+		if !ok {
+			return p.fail(errors.New("the plugin disconnected"))
+		}
+		return p.result(packet, msg)
+	case <-timer.C:
+		p.mu.Lock()
+		delete(p.pending, request.ID)
+		p.mu.Unlock()
+		return p.fail(errors.New("no verdict within " + p.timeout.String()))
+	}
+}
+
+// send numbers a listen message and writes it to the plugin, connecting to
+// it again if the connection was lost. Returns the channel the verdict is
+// delivered to. p.writeMu must be held.
+func (p *Plugin) send(msg *pluginMessage) (chan pluginMessage, error) {
+	p.mu.Lock()
+	if p.closed {
+		p.mu.Unlock()
+		return nil, errors.New("the plugin is closed")
+	}
+	if p.conn == nil {
+		if time.Now().Before(p.retry) {
+			p.mu.Unlock()
+			return nil, errors.New("the plugin is not connected")
+		}
+		p.mu.Unlock()
+		// The frames wait for the connection, it is bounded like a verdict
+		conn, decoder, err := p.connect(p.timeout)
+		p.mu.Lock()
+		if err != nil {
+			p.retry = time.Now().Add(pluginRetry)
+			p.mu.Unlock()
+			return nil, err
+		}
+		if p.closed {
+			p.mu.Unlock()
+			conn.Close()
+			return nil, errors.New("the plugin is closed")
+		}
+		p.attach(conn, decoder)
+		log.Println("INFO: reconnected to the plugin " + p.path)
+	}
+	conn, encoder := p.conn, p.encoder
+	p.id++
+	msg.ID = p.id
+	// The frame waits for its verdict before it is written, the verdict may
+	// be read before the write returns
+	waiting := make(chan pluginMessage, 1)
+	p.pending[msg.ID] = waiting
+	p.mu.Unlock()
+
+	conn.SetWriteDeadline(time.Now().Add(p.timeout))
+	if err := encoder.Encode(msg); err != nil {
+		// The reader fails the other frames waiting for their verdict
+		conn.Close()
+		p.mu.Lock()
+		delete(p.pending, msg.ID)
+		p.mu.Unlock()
+		return nil, err
+	}
+	return waiting, nil
+}
+
+// result converts the verdict of the plugin on a frame.
+func (p *Plugin) result(packet gopacket.Packet, msg pluginMessage) Result {
+	p.recovered()
+	switch msg.Verdict {
+	case "continue":
+		return Pass()
+	case "consume":
+		return Consumed()
+	case "drop":
+		return Dropped()
+	case "forward":
+	default:
+		return p.fail(errors.New("unknown verdict " + msg.Verdict))
+	}
+
+	data := msg.Frame
+	if data == nil {
+		data = packet.Data()
+	}
+	if len(data) < 14 || len(data) > p.mtu {
+		return p.fail(fmt.Errorf("invalid frame of %d bytes", len(data)))
+	}
+	receiver, ok := pluginReceivers[msg.Receiver]
+	if !ok {
+		return p.fail(errors.New("unknown receiver " + msg.Receiver))
+	}
+	if receiver != Explicit {
+		return Send(data, receiver, nil)
+	}
+	mac, err := net.ParseMAC(msg.Target)
+	if err != nil {
+		return p.fail(errors.New("invalid target " + msg.Target))
+	}
+	client, err := p.clients.GetPortByAddr(mac)
+	if err != nil {
+		return p.fail(errors.New("no port owns the target " + msg.Target))
+	}
+	return Send(data, Explicit, client)
+}
+
+// fail applies the policy of the plugin to a frame it did not decide on.
+// The failures are reported when the plugin starts failing.
+func (p *Plugin) fail(err error) Result {
+	p.mu.Lock()
+	report := !p.failing
+	p.failing = true
+	p.mu.Unlock()
+	policy, result := "open", Pass()
+	if p.failClosed {
+		policy, result = "closed", Dropped()
+	}
+	if report {
+		log.Printf("WARNING: plugin %s: %s, failing %s\n", p.path, err.Error(), policy)
+	}
+	return result
+}
+
+// recovered reports that the plugin decides on the frames again.
+func (p *Plugin) recovered() {
+	p.mu.Lock()
+	report := p.failing
+	p.failing = false
+	p.mu.Unlock()
+	if report {
+		log.Println("INFO: the plugin " + p.path + " decides on the frames again")
+	}
+}
+
+// Quit tells the plugin that a port left the network. The plugin is not
+// dialed again for it.
+func (p *Plugin) Quit(client *entities.Thread) error {
+	p.writeMu.Lock()
+	defer p.writeMu.Unlock()
+	p.mu.Lock()
+	conn, encoder := p.conn, p.encoder
+	p.mu.Unlock()
+	if conn == nil {
+		return nil
+	}
+	msg := pluginMessage{Type: pluginQuit, Port: &pluginPort{ID: client.VM.ID, NIC: client.VM.NIC.Index, MAC: client.VM.Mac}}
+	conn.SetWriteDeadline(time.Now().Add(p.timeout))
+	if err := encoder.Encode(msg); err != nil {
+		conn.Close()
+		return err
+	}
+	return nil
+}
+
+// Close disconnects from the plugin. A write blocked on the connection
+// returns.
+func (p *Plugin) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	if p.conn != nil {
+		p.conn.Close()
+	}
+}
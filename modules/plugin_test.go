@@ -0,0 +1,200 @@
+package modules
+
+import (
+	"QemuUserNet/entities"
+	"encoding/json"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// fakePlugin accepts the connections of the plugin module, answers their
+// hello with version, and hands them to serve. A negative version closes
+// the connections without a hello.
+func fakePlugin(t *testing.T, version int, serve func(decoder *json.Decoder, encoder *json.Encoder)) string {
+	path := filepath.Join(t.TempDir(), "plugin.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { listener.Close() })
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				return
+			}
+			t.Cleanup(func() { conn.Close() })
+			go func() {
+				defer conn.Close()
+				decoder, encoder := json.NewDecoder(conn), json.NewEncoder(conn)
+				var hello pluginMessage
+				if err := decoder.Decode(&hello); err != nil || version < 0 {
+					return
+				}
+				encoder.Encode(pluginMessage{Type: pluginHello, Version: version})
+				serve(decoder, encoder)
+			}()
+		}
+	}()
+	return path
+}
+
+// answer answers every frame with verdict.
+func answer(verdict string) func(*json.Decoder, *json.Encoder) {
+	return func(decoder *json.Decoder, encoder *json.Encoder) {
+		for {
+			var msg pluginMessage
+			if err := decoder.Decode(&msg); err != nil {
+				return
+			}
+			if msg.Type == pluginListen {
+				encoder.Encode(pluginMessage{Type: pluginResult, ID: msg.ID, Verdict: verdict, Receiver: "all"})
+			}
+		}
+	}
+}
+
+// testPacket returns a frame of size bytes.
+func testPacket(size int) gopacket.Packet {
+	data := make([]byte, size)
+	copy(data, []byte{0x52, 0x54, 0, 0, 0, 2, 0x52, 0x54, 0, 0, 0, 1, 0x88, 0xb5})
+	return gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+}
+
+func TestPluginHello(t *testing.T) {
+	tests := []struct {
+		name    string
+		version int
+		err     string
+	}{
+		{"same version", PluginVersion, ""},
+		{"other version", PluginVersion + 1, "speaks version 2 of the protocol, expected 1"},
+		{"no hello", -1, "no hello from the plugin"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			path := fakePlugin(t, test.version, answer("continue"))
+			p, err := NewPlugin(path, "net-a", entities.DefaultMTU, time.Second, false, &entities.Clients{})
+			if test.err == "" {
+				if err != nil {
+					t.Fatal(err)
+				}
+				p.Close()
+				return
+			}
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Fatalf("error %v, want %q", err, test.err)
+			}
+		})
+	}
+	if _, err := NewPlugin(filepath.Join(t.TempDir(), "none.sock"), "net-a", entities.DefaultMTU, time.Second, false, &entities.Clients{}); err == nil {
+		t.Fatal("connected to no plugin")
+	}
+}
+
+func TestPluginVerdicts(t *testing.T) {
+	tests := []struct {
+		verdict string
+		want    Verdict
+	}{
+		{"continue", VerdictContinue},
+		{"consume", VerdictConsume},
+		{"drop", VerdictDrop},
+		{"forward", VerdictForward},
+		{"unknown", VerdictDrop}, // Failing closed
+	}
+	for _, test := range tests {
+		t.Run(test.verdict, func(t *testing.T) {
+			p, err := NewPlugin(fakePlugin(t, PluginVersion, answer(test.verdict)), "net-a", entities.DefaultMTU, time.Second, true, &entities.Clients{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Close()
+			if result := p.Listen(testPacket(64)); result.Verdict != test.want {
+				t.Fatalf("verdict %v, want %v", result.Verdict, test.want)
+			}
+		})
+	}
+}
+
+// TestPluginFailure checks the policies of a plugin that does not answer in
+// time, then is gone.
+func TestPluginFailure(t *testing.T) {
+	for _, failClosed := range []bool{false, true} {
+		want := VerdictContinue
+		if failClosed {
+			want = VerdictDrop
+		}
+		gone := make(chan struct{})
+		path := fakePlugin(t, PluginVersion, func(decoder *json.Decoder, encoder *json.Encoder) {
+			<-gone
+		})
+		timeout := 100 * time.Millisecond
+		p, err := NewPlugin(path, "net-a", entities.DefaultMTU, timeout, failClosed, &entities.Clients{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		start := time.Now()
+		if result := p.Listen(testPacket(64)); result.Verdict != want {
+			t.Fatalf("fail closed %v: verdict %v on a timeout, want %v", failClosed, result.Verdict, want)
+		}
+		if elapsed := time.Since(start); elapsed < timeout || elapsed > 10*timeout {
+			t.Fatalf("verdict after %s, want %s", elapsed, timeout)
+		}
+
+		// The plugin is gone and cannot be dialed again
+		close(gone)
+		os.Remove(path)
+		time.Sleep(50 * time.Millisecond)
+		if result := p.Listen(testPacket(64)); result.Verdict != want {
+			t.Fatalf("fail closed %v: verdict %v after a disconnection, want %v", failClosed, result.Verdict, want)
+		}
+		p.Close()
+		if result := p.Listen(testPacket(64)); result.Verdict != want {
+			t.Fatalf("fail closed %v: verdict %v once closed, want %v", failClosed, result.Verdict, want)
+		}
+	}
+}
+
+// TestPluginBlockedWrite checks that the verdicts are delivered while a
+// write to the plugin is blocked.
+func TestPluginBlockedWrite(t *testing.T) {
+	received, answered := make(chan pluginMessage), make(chan struct{})
+	path := fakePlugin(t, PluginVersion, func(decoder *json.Decoder, encoder *json.Encoder) {
+		// The first frame is read, the others are left in the socket
+		var msg pluginMessage
+		if err := decoder.Decode(&msg); err != nil {
+			return
+		}
+		received <- msg
+		<-answered
+		encoder.Encode(pluginMessage{Type: pluginResult, ID: msg.ID, Verdict: "drop"})
+		time.Sleep(2 * time.Second)
+	})
+	p, err := NewPlugin(path, "net-a", entities.DefaultMTU, time.Second, false, &entities.Clients{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Close()
+
+	result := make(chan Result)
+	go func() { result <- p.Listen(testPacket(64)) }()
+	<-received
+
+	// Large frames fill the socket until a write blocks
+	for i := 0; i < 8; i++ {
+		go p.Listen(testPacket(64 * 1024))
+	}
+	time.Sleep(200 * time.Millisecond)
+	close(answered)
+	if r := <-result; r.Verdict != VerdictDrop {
+		t.Fatalf("verdict %v, want the verdict of the plugin", r.Verdict)
+	}
+}
@@ -0,0 +1,426 @@
+package modules
+
+import (
+	"QemuUserNet/entities"
+	"QemuUserNet/netstack"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+)
+
+// Forward is a host port relayed to a port of a VM.
+type Forward struct {
+	VmID      string // ID of the VM
+	Protocol  string // Protocol of the forward, "tcp" or "udp"
+	HostAddr  string // Host address listened on
+	GuestPort uint16 // Port of the VM
+	listener  net.Listener
+	udp       *net.UDPConn
+	done      chan struct{}
+	quit      chan struct{} // Closed when the VM disconnects, guarded by the lock of the PortForward
+}
+
+// String returns the forward in the format accepted by ParseForward.
+func (f *Forward) String() string {
+	return f.HostAddr + ":" + strconv.Itoa(int(f.GuestPort)) + "/" + f.Protocol
+}
+
+// ParseForward parses a forward in the format
+// [hostip:]hostport:guestport[/tcp|udp]. The host IP defaults to 127.0.0.1.
+func ParseForward(vmID string, spec string) (*Forward, error) {
+	protocol, spec, err := splitProtocol(spec)
+	if err != nil {
+		return nil, err
+	}
+	i := strings.LastIndex(spec, ":")
+	if i == -1 {
+		return nil, errors.New("Invalid format, expected hostport:guestport")
+	}
+	hostAddr, err := parseHostAddr(spec[:i])
+	if err != nil {
+		return nil, err
+	}
+	p, err := strconv.ParseUint(spec[i+1:], 10, 16)
+	if err != nil || p == 0 {
+		return nil, errors.New("Invalid guest port")
+	}
+	return &Forward{VmID: vmID, Protocol: protocol, HostAddr: hostAddr, GuestPort: uint16(p)}, nil
+}
+
+// ParseForwardHost parses the host side of a forward in the format
+// [hostip:]hostport[/tcp|udp], as used to remove a forward. Returns the
+// protocol and the host address.
+func ParseForwardHost(spec string) (string, string, error) {
+	protocol, spec, err := splitProtocol(spec)
+	if err != nil {
+		return "", "", err
+	}
+	hostAddr, err := parseHostAddr(spec)
+	return protocol, hostAddr, err
+}
+
+// splitProtocol extracts the optional /tcp or /udp suffix of a forward.
+func splitProtocol(spec string) (string, string, error) {
+	protocol := "tcp"
+	if i := strings.LastIndex(spec, "/"); i != -1 {
+		protocol, spec = spec[i+1:], spec[:i]
+	}
+	if protocol != "tcp" && protocol != "udp" {
+		return "", "", errors.New("Invalid protocol, expected tcp or udp")
+	}
+	return protocol, spec, nil
+}
+
+// parseHostAddr parses a host address in the format [hostip:]hostport.
+func parseHostAddr(hostAddr string) (string, error) {
+	if !strings.Contains(hostAddr, ":") {
+		hostAddr = "127.0.0.1:" + hostAddr
+	}
+	host, port, err := net.SplitHostPort(hostAddr)
+	if err != nil {
+		return "", err
+	}
+	if net.ParseIP(host) == nil {
+		return "", errors.New("Invalid host IP")
+	}
+	if _, err := strconv.ParseUint(port, 10, 16); err != nil {
+		return "", errors.New("Invalid host port")
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+// PortForward relays host ports to the VMs of a network through the
+// user-space stack of the gateway. Forwards belong to a VM and are kept
+// while the VM is disconnected, to relay to it again once it reconnects.
+type PortForward struct {
+	stack    *netstack.Stack
+	clients  *entities.Clients
+	mu       sync.Mutex
+	forwards map[string][]*Forward
+}
+
+// NewPortForward creates a new PortForward instance using the stack of the
+// gateway to reach the VMs.
+func NewPortForward(stack *netstack.Stack, clients *entities.Clients) (*PortForward, error) {
+	if stack == nil {
+		return nil, errors.New("A stack is required")
+	}
+	return &PortForward{stack: stack, clients: clients, forwards: make(map[string][]*Forward)}, nil
+}
+
+// Listen does not process packets, the frames of the forwarded connections
+// are handled by the stack of the gateway.
+func (p *PortForward) Listen(packet gopacket.Packet) Result {
+	return Pass()
+}
+
+// Selects selects no frame, the forwarded connections go through the NAT.
+func (p *PortForward) Selects(frame *Frame) bool {
+	return false
+}
+
+// Quit aborts the forwarded connections of a client when its last network
+// card disconnects. Its forwards are kept.
+func (p *PortForward) Quit(client *entities.Thread) error {
+	for _, other := range p.clients.GetClientsByID(client.VM.ID) {
+		if other != client {
+			return nil
+		}
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, forward := range p.forwards[client.VM.ID] {
+		close(forward.quit)
+		forward.quit = make(chan struct{})
+	}
+	return nil
+}
+
+// Add starts relaying a host port to a connected VM.
+func (p *PortForward) Add(forward *Forward) error {
+	if _, err := p.clients.GetClientByID(forward.VmID); err != nil {
+		return err
+	}
+	return p.Restore(forward)
+}
+
+// Restore starts relaying a host port to a VM that may not be connected
+// yet, such as a forward saved with Forwards.
+func (p *PortForward) Restore(forward *Forward) error {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	for _, forwards := range p.forwards {
+		for _, f := range forwards {
+			if f.HostAddr == forward.HostAddr && f.Protocol == forward.Protocol {
+				return errors.New("The host port is already forwarded")
+			}
+		}
+	}
+
+	forward.done = make(chan struct{})
+	forward.quit = make(chan struct{})
+	if forward.Protocol == "tcp" {
+		listener, err := net.Listen("tcp", forward.HostAddr)
+		if err != nil {
+			return err
+		}
+		forward.listener = listener
+		go p.serveTcp(forward)
+	} else {
+		addr, err := net.ResolveUDPAddr("udp", forward.HostAddr)
+		if err != nil {
+			return err
+		}
+		conn, err := net.ListenUDP("udp", addr)
+		if err != nil {
+			return err
+		}
+		forward.udp = conn
+		go p.serveUdp(forward)
+	}
+	p.forwards[forward.VmID] = append(p.forwards[forward.VmID], forward)
+	return nil
+}
+
+// Remove stops relaying a host port of a VM.
+func (p *PortForward) Remove(vmID string, protocol string, hostAddr string) error {
+	p.mu.Lock()
+	var removed *Forward
+	var kept []*Forward
+	for _, forward := range p.forwards[vmID] {
+		if forward.Protocol == protocol && forward.HostAddr == hostAddr {
+			removed = forward
+		} else {
+			kept = append(kept, forward)
+		}
+	}
+	if len(kept) == 0 {
+		delete(p.forwards, vmID)
+	} else {
+		p.forwards[vmID] = kept
+	}
+	p.mu.Unlock()
+
+	if removed == nil {
+		return errors.New("Forward not found")
+	}
+	removed.stop()
+	return nil
+}
+
+// Close removes every forward.
+func (p *PortForward) Close() {
+	p.mu.Lock()
+	forwards := p.forwards
+	p.forwards = make(map[string][]*Forward)
+	p.mu.Unlock()
+
+	for _, list := range forwards {
+		for _, forward := range list {
+			forward.stop()
+		}
+	}
+}
+
+// Forwards returns the forwards in the format accepted by ParseForward, by
+// VM ID.
+func (p *PortForward) Forwards() map[string][]string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	specs := make(map[string][]string)
+	for id, forwards := range p.forwards {
+		for _, forward := range forwards {
+			specs[id] = append(specs[id], forward.String())
+		}
+	}
+	return specs
+}
+
+// Describe returns a human readable description of the forwards.
+func (p *PortForward) Describe() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if len(p.forwards) == 0 {
+		return nil
+	}
+	lines := []string{"FORWARD ID	HOST			GUEST PORT	PROTO"}
+	var ids []string
+	for id := range p.forwards {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		for _, forward := range p.forwards[id] {
+			lines = append(lines, fmt.Sprintf("%s		%s		%d		%s", id, forward.HostAddr, forward.GuestPort, forward.Protocol))
+		}
+	}
+	return lines
+}
+
+// guestIP returns the IP address of the VM of a forward, the address of its
+// first network card with one.
+func (p *PortForward) guestIP(forward *Forward) (net.IP, error) {
+	clients := p.clients.GetClientsByID(forward.VmID)
+	if len(clients) == 0 {
+		return nil, errors.New("VM not found")
+	}
+	for _, client := range clients {
+		if ip := client.IP(); ip != nil {
+			return net.ParseIP(*ip), nil
+		}
+	}
+	return nil, errors.New("The VM has no IP address yet")
+}
+
+// stop closes the host socket of a forward.
+func (f *Forward) stop() {
+	close(f.done)
+	if f.listener != nil {
+		f.listener.Close()
+	}
+	if f.udp != nil {
+		f.udp.Close()
+	}
+}
+
+// serveTcp accepts the connections of a forwarded TCP port.
+func (p *PortForward) serveTcp(forward *Forward) {
+	for {
+		host, err := forward.listener.Accept()
+		if err != nil {
+			return
+		}
+		go p.relayTcp(forward, host)
+	}
+}
+
+// relayTcp relays a host connection to the VM of a forward.
+func (p *PortForward) relayTcp(forward *Forward, host net.Conn) {
+	defer host.Close()
+	p.mu.Lock()
+	quit := forward.quit
+	p.mu.Unlock()
+	ip, err := p.guestIP(forward)
+	if err != nil {
+		log.Println("WARNING: portforward: ", forward.VmID, ": ", err.Error())
+		return
+	}
+	guest, err := p.stack.Dial(ip, forward.GuestPort)
+	if err != nil {
+		log.Println("WARNING: portforward: ", forward.VmID, ": ", err.Error())
+		// The connection is reset, like a refused one
+		if tcp, ok := host.(*net.TCPConn); ok {
+			tcp.SetLinger(0)
+		}
+		return
+	}
+
+	done := make(chan struct{}, 2)
+	go func() {
+		io.Copy(guest, host)
+		guest.CloseWrite()
+		done <- struct{}{}
+	}()
+	go func() {
+		io.Copy(host, guest)
+		if tcp, ok := host.(*net.TCPConn); ok {
+			tcp.CloseWrite()
+		}
+		done <- struct{}{}
+	}()
+
+	select {
+	case <-done:
+		<-done
+		guest.Close()
+	case <-forward.done:
+		guest.Abort()
+	case <-quit:
+		guest.Abort()
+	}
+}
+
+// udpSession is a host peer of a forwarded UDP port.
+type udpSession struct {
+	port     uint16
+	lastSeen time.Time
+}
+
+// serveUdp relays the datagrams of a forwarded UDP port. Every host peer is
+// given its own port of the stack so that the answers of the VM reach it.
+// The sessions idle for udpFlowTimeout are removed.
+func (p *PortForward) serveUdp(forward *Forward) {
+	var mu sync.Mutex
+	sessions := make(map[string]*udpSession)
+	lastSweep := time.Now()
+	sweep := func() {
+		for key, session := range sessions {
+			if time.Since(session.lastSeen) > udpFlowTimeout {
+				p.stack.UnhandleUDP(session.port)
+				delete(sessions, key)
+			}
+		}
+		lastSweep = time.Now()
+	}
+	defer func() {
+		mu.Lock()
+		for _, session := range sessions {
+			p.stack.UnhandleUDP(session.port)
+		}
+		mu.Unlock()
+	}()
+
+	buffer := make([]byte, 65535)
+	for {
+		forward.udp.SetReadDeadline(time.Now().Add(udpFlowTimeout))
+		l, src, err := forward.udp.ReadFromUDP(buffer)
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && ne.Timeout() {
+				mu.Lock()
+				sweep()
+				mu.Unlock()
+				continue
+			}
+			return
+		}
+		ip, err := p.guestIP(forward)
+		if err != nil {
+			continue
+		}
+
+		mu.Lock()
+		// A port that never idles for udpFlowTimeout is swept as it goes
+		if time.Since(lastSweep) > udpFlowTimeout {
+			sweep()
+		}
+		session, ok := sessions[src.String()]
+		if !ok {
+			port, err := p.stack.AllocatePort()
+			if err != nil {
+				mu.Unlock()
+				log.Println("WARNING: portforward: ", forward.VmID, ": ", err.Error())
+				continue
+			}
+			session = &udpSession{port: port}
+			peer := src
+			p.stack.HandleUDP(session.port, func(from *net.UDPAddr, mac net.HardwareAddr, payload []byte) {
+				forward.udp.WriteToUDP(payload, peer)
+			})
+			sessions[src.String()] = session
+		}
+		session.lastSeen = time.Now()
+		mu.Unlock()
+
+		p.stack.SendUDP(session.port, &net.UDPAddr{IP: ip, Port: int(forward.GuestPort)}, buffer[:l])
+	}
+}
@@ -0,0 +1,215 @@
+package modules
+
+import (
+	"QemuUserNet/entities"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// DefaultPipeline is the pipeline of the networks created without a list of
+// modules. The ACL comes before the modules answering for the gateway, so
+// that no frame reaches them unfiltered.
+var DefaultPipeline = []string{"arp-learn", "acl", "dhcp", "dns", "nat", "portforward", "switch"}
+
+// Env holds what the modules of a network are created with.
+type Env struct {
+	Network  entities.CreateCommand // Options of the network, with its MTU
+	Clients  *entities.Clients      // Ports of the network
+	Output   func([]byte) error     // Sends a frame to the ports of the network
+	Pipeline *Pipeline              // Pipeline of the network, with the modules created before
+}
+
+// Factory creates a module for a network. config holds the options of the
+// module, among the Options of its Registration.
+type Factory func(env *Env, config map[string]string) (Module, error)
+
+// Registration describes a type of module of the registry.
+type Registration struct {
+	Factory     Factory
+	Description string   // One-line description of the module
+	Options     []string // Keys accepted in the configuration of the module
+	Requires    []string // Types of modules that must come before it in the pipeline
+}
+
+var (
+	registryMu sync.RWMutex
+	registry   = map[string]Registration{
+		"arp-learn": {
+			Factory:     newArpLearn,
+			Description: "Learns the addresses of the VMs from their ARP and IPv4 packets",
+		},
+		"dhcp": {
+			Factory:     newDhcpModule,
+			Description: "Leases the addresses of the network to the VMs",
+			Options:     []string{"range", "dns"},
+		},
+		"dns": {
+			Factory:     newDnsModule,
+			Description: "Resolves the IDs of the VMs to their addresses",
+			Options:     []string{"ip", "mac"},
+		},
+		"nat": {
+			Factory:     newNatModule,
+			Description: "Proxies the flows sent to the gateway to allow-listed host addresses",
+		},
+		"portforward": {
+			Factory:     newPortForwardModule,
+			Description: "Relays host ports to the VMs through the gateway",
+			Requires:    []string{"nat"},
+		},
+		"acl": {
+			Factory:     newAclModule,
+			Description: "Filters the frames with an ordered list of rules",
+		},
+		"switch": {
+			Factory:     newSwitchModule,
+			Description: "Forwards the frames to the ports owning their destination address",
+		},
+		"plugin": {
+			Factory:     newPluginModule,
+			Description: "Sends the frames to another process deciding on them, see Plugin",
+			Options:     []string{"socket", "timeout", "policy"},
+		},
+	}
+)
+
+// Register adds a type of module to the registry.
+func Register(name string, registration Registration) error {
+	if name == "" || strings.ContainsAny(name, ":, ") {
+		return errors.New("Invalid module name")
+	}
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	if _, ok := registry[name]; ok {
+		return errors.New("A module is already registered as " + name)
+	}
+	registry[name] = registration
+	return nil
+}
+
+// Registered checks if the type of the module named name is registered.
+func Registered(name string) bool {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	_, ok := registry[moduleType(name)]
+	return ok
+}
+
+// New creates the module named name, TYPE or TYPE:INSTANCE, for the network
+// of env.
+func New(name string, env *Env, config map[string]string) (Module, error) {
+	registryMu.RLock()
+	registration, ok := registry[moduleType(name)]
+	registryMu.RUnlock()
+	if !ok {
+		return nil, fmt.Errorf("Unknown module %s, expected one of %s", name, strings.Join(registeredNames(), ", "))
+	}
+	for key := range config {
+		known := false
+		for _, option := range registration.Options {
+			known = known || option == key
+		}
+		if !known {
+			return nil, fmt.Errorf("Unknown option %s of module %s", key, name)
+		}
+	}
+	return registration.Factory(env, config)
+}
+
+// DescribeRegistry returns a human readable description of the types of
+// modules of the registry.
+func DescribeRegistry() []string {
+	lines := []string{"MODULE		OPTIONS		REQUIRES	DESCRIPTION"}
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	for _, name := range registeredNames() {
+		r := registry[name]
+		lines = append(lines, fmt.Sprintf("%-15s	%-15s	%-7s	%s", name, strings.Join(r.Options, ","), strings.Join(r.Requires, ","), r.Description))
+	}
+	return lines
+}
+
+// registeredNames returns the sorted types of modules of the registry.
+// registryMu must be held.
+func registeredNames() []string {
+	names := make([]string, 0, len(registry))
+	for name := range registry {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// lookupRegistration returns the registration of the type of the module
+// named name, empty if it is not registered.
+func lookupRegistration(name string) Registration {
+	registryMu.RLock()
+	defer registryMu.RUnlock()
+	return registry[moduleType(name)]
+}
+
+// option returns the value of key in config, fallback if it is not set.
+func option(config map[string]string, key string, fallback string) string {
+	if value, ok := config[key]; ok {
+		return value
+	}
+	return fallback
+}
+
+// newArpLearn creates an arp-learn module.
+func newArpLearn(env *Env, config map[string]string) (Module, error) {
+	return NewAddressResolution(env.Clients)
+}
+
+// newDhcpModule creates a dhcp module.
+func newDhcpModule(env *Env, config map[string]string) (Module, error) {
+	n := env.Network
+	return NewDhcp(n.Subnet, n.GatewayIP, n.GatewayMAC, option(config, "range", n.RangeIP), option(config, "dns", n.DnsIP), n.MTU, env.Clients)
+}
+
+// newDnsModule creates a dns module.
+func newDnsModule(env *Env, config map[string]string) (Module, error) {
+	return NewDns(option(config, "ip", env.Network.DnsIP), option(config, "mac", env.Network.DnsMAC), env.Clients)
+}
+
+// newNatModule creates a nat module.
+func newNatModule(env *Env, config map[string]string) (Module, error) {
+	return NewNat(env.Network.GatewayIP, env.Network.GatewayMAC, env.Network.MTU, env.Clients, env.Output)
+}
+
+// newPortForwardModule creates a portforward module.
+func newPortForwardModule(env *Env, config map[string]string) (Module, error) {
+	for _, module := range env.Pipeline.Modules() {
+		if nat, ok := module.(*Nat); ok {
+			return NewPortForward(nat.Stack(), env.Clients)
+		}
+	}
+	return nil, errors.New("The module portforward requires a module nat")
+}
+
+// newAclModule creates an acl module.
+func newAclModule(env *Env, config map[string]string) (Module, error) {
+	return NewAcl(env.Clients)
+}
+
+// newSwitchModule creates a switch module.
+func newSwitchModule(env *Env, config map[string]string) (Module, error) {
+	return NewSwitch(env.Clients)
+}
+
+// newPluginModule creates a plugin module.
+func newPluginModule(env *Env, config map[string]string) (Module, error) {
+	timeout, err := time.ParseDuration(option(config, "timeout", DefaultPluginTimeout.String()))
+	if err != nil {
+		return nil, err
+	}
+	policy := option(config, "policy", "open")
+	if policy != "open" && policy != "closed" {
+		return nil, errors.New("Invalid plugin policy, expected open or closed")
+	}
+	return NewPlugin(config["socket"], env.Network.NetworkName, env.Network.MTU, timeout, policy == "closed", env.Clients)
+}
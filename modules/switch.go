@@ -3,8 +3,6 @@ package modules
 import (
 	"QemuUserNet/entities"
 	"QemuUserNet/tools"
-	"errors"
-	"fmt"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -22,17 +20,17 @@ func NewSwitch(clients *entities.Clients) (*Switch, error) {
 
 // Listen processes a network packet and determines its forwarding action based on the destination MAC address.
 // It extracts the Ethernet layer from the packet, checks if the destination MAC address is a broadcast address,
-// and retrieves the corresponding client if it is not. The function returns the packet data, a receiver type
-// (indicating how to forward the packet), the target client thread (if applicable), and any error encountered.
-func (s *Switch) Listen(packet gopacket.Packet) ([]byte, Receiver, *entities.Thread, error) {
+// and retrieves the corresponding client if it is not. Broadcast frames are sent to all clients, unicast frames
+// to the client owning the destination address, and the frames for unknown destinations are dropped.
+func (s *Switch) Listen(packet gopacket.Packet) Result {
 	// Extract the Ethernet layer from the packet
 	etherLayer := packet.Layer(layers.LayerTypeEthernet)
 	if etherLayer == nil {
-		return packet.Data(), Nobody, nil, errors.New("Ethernet layer is missing from the packet")
+		return Dropped()
 	}
 	eth, ok := etherLayer.(*layers.Ethernet)
 	if !ok {
-		return packet.Data(), Nobody, nil, errors.New("Ethernet layer is missing from the packet")
+		return Dropped()
 	}
 
 	// Get the destination MAC address from the Ethernet layer
@@ -41,22 +39,32 @@ func (s *Switch) Listen(packet gopacket.Packet) ([]byte, Receiver, *entities.Thr
 	// Check if the MAC address is a broadcast address
 	isBroadcast, err := tools.IsBroadcastMAC(mac)
 	if err != nil {
-		return packet.Data(), Nobody, nil, fmt.Errorf("Failed to check if MAC is broadcast: %v", err)
+		return Dropped()
 	}
 
 	// If the destination MAC is a broadcast address, return the packet to be sent to all clients
 	if isBroadcast {
-		return packet.Data(), All, nil, err
+		return Send(packet.Data(), All, nil)
 	}
 
 	// Find the client associated with the destination MAC address
-	client, err := s.clients.GetClientByMac(mac)
+	client, err := s.clients.GetPortByMac(mac)
 	if err != nil {
-		return packet.Data(), Nobody, nil, err
+		// The destination may be a host behind an uplink not learned yet
+		if s.clients.HasUplink() {
+			return Send(packet.Data(), Others, nil)
+		}
+		return Dropped()
 	}
 
 	// Return the packet to be sent to the specific client
-	return packet.Data(), Explicit, client, nil
+	return Send(packet.Data(), Explicit, client)
+}
+
+// Selects selects no frame, the frames no module selects are switched like
+// by Listen without going through the modules.
+func (s *Switch) Selects(frame *Frame) bool {
+	return false
 }
 
 // Quit handles any necessary cleanup for a client when it disconnects. Currently, it does nothing.
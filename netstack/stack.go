@@ -0,0 +1,478 @@
+// Package netstack provides a small user-space TCP/IP stack bound to a
+// single IPv4 address of a virtual network. It answers ARP requests and
+// pings for its address, terminates TCP connections and UDP datagrams sent
+// to it, and can open TCP connections to the VMs of the network. Frames are
+// exchanged with the network through an output function, so the stack can
+// be plugged into any module of the network chain.
+package netstack
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// OutputFunc sends an Ethernet frame to the network.
+type OutputFunc func([]byte) error
+
+// ResolveFunc returns the MAC address of a host of the network.
+type ResolveFunc func(net.IP) (net.HardwareAddr, error)
+
+// UDPHandler processes a datagram received on a UDP port of the stack.
+type UDPHandler func(src *net.UDPAddr, srcMAC net.HardwareAddr, payload []byte)
+
+// flowKey identifies a TCP connection from the point of view of the stack.
+type flowKey struct {
+	localPort  uint16
+	remoteIP   [4]byte
+	remotePort uint16
+}
+
+// Stack is a user-space TCP/IP stack bound to an IPv4 and a MAC address.
+type Stack struct {
+	ip       net.IP
+	mac      net.HardwareAddr
+	mtu      int
+	output   OutputFunc
+	resolve  ResolveFunc
+	mu       sync.Mutex
+	arp      map[[4]byte]net.HardwareAddr
+	conns    map[flowKey]*TCPConn
+	accept   map[uint16]func(*TCPConn)
+	udp      map[uint16]UDPHandler
+	nextPort uint16
+
+	idleTimeout     time.Duration // See defaultIdleTimeout
+	finWait2Timeout time.Duration // See defaultFinWait2Timeout
+}
+
+// NewStack creates a new Stack. mtu is the largest IP packet the network
+// carries, output sends frames to the network and resolve is used to find
+// the MAC address of hosts the stack has not heard from yet.
+func NewStack(ip net.IP, mac net.HardwareAddr, mtu int, output OutputFunc, resolve ResolveFunc) (*Stack, error) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, errors.New("Invalid IPv4 address")
+	}
+	if len(mac) != 6 {
+		return nil, errors.New("Invalid MAC address")
+	}
+	return &Stack{
+		ip:       ip4,
+		mac:      mac,
+		mtu:      mtu,
+		output:   output,
+		resolve:  resolve,
+		arp:      make(map[[4]byte]net.HardwareAddr),
+		conns:    make(map[flowKey]*TCPConn),
+		accept:   make(map[uint16]func(*TCPConn)),
+		udp:      make(map[uint16]UDPHandler),
+		nextPort: firstEphemeralPort,
+
+		idleTimeout:     defaultIdleTimeout,
+		finWait2Timeout: defaultFinWait2Timeout,
+	}, nil
+}
+
+// IP returns the address of the stack.
+func (s *Stack) IP() net.IP {
+	return s.ip
+}
+
+// Input processes a frame received from the network. It returns true when
+// the frame was addressed to the stack and consumed by it.
+func (s *Stack) Input(packet gopacket.Packet) bool {
+	etherLayer := packet.Layer(layers.LayerTypeEthernet)
+	if etherLayer == nil {
+		return false
+	}
+	eth, _ := etherLayer.(*layers.Ethernet)
+
+	if arpLayer := packet.Layer(layers.LayerTypeARP); arpLayer != nil {
+		return s.handleArp(arpLayer.(*layers.ARP))
+	}
+
+	ipLayer := packet.Layer(layers.LayerTypeIPv4)
+	if ipLayer == nil {
+		return false
+	}
+	ip, _ := ipLayer.(*layers.IPv4)
+	if !ip.DstIP.Equal(s.ip) {
+		return false
+	}
+	s.learn(ip.SrcIP, eth.SrcMAC)
+
+	switch ip.Protocol {
+	case layers.IPProtocolICMPv4:
+		if icmpLayer := packet.Layer(layers.LayerTypeICMPv4); icmpLayer != nil {
+			s.handleIcmp(ip, icmpLayer.(*layers.ICMPv4))
+		}
+	case layers.IPProtocolTCP:
+		if tcpLayer := packet.Layer(layers.LayerTypeTCP); tcpLayer != nil {
+			s.handleTcp(ip, tcpLayer.(*layers.TCP))
+		}
+	case layers.IPProtocolUDP:
+		if udpLayer := packet.Layer(layers.LayerTypeUDP); udpLayer != nil {
+			s.handleUdp(ip, eth.SrcMAC, udpLayer.(*layers.UDP))
+		}
+	}
+	return true
+}
+
+// Listen registers a function called for every TCP connection established
+// on a port of the stack.
+func (s *Stack) Listen(port uint16, accept func(*TCPConn)) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.accept[port]; ok {
+		return errors.New("Port already in use")
+	}
+	s.accept[port] = accept
+	return nil
+}
+
+// Unlisten stops accepting TCP connections on a port. Established
+// connections are not affected.
+func (s *Stack) Unlisten(port uint16) {
+	s.mu.Lock()
+	delete(s.accept, port)
+	s.mu.Unlock()
+}
+
+// HandleUDP registers the handler of a UDP port of the stack.
+func (s *Stack) HandleUDP(port uint16, handler UDPHandler) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.udp[port]; ok {
+		return errors.New("Port already in use")
+	}
+	s.udp[port] = handler
+	return nil
+}
+
+// UnhandleUDP removes the handler of a UDP port of the stack.
+func (s *Stack) UnhandleUDP(port uint16) {
+	s.mu.Lock()
+	delete(s.udp, port)
+	s.mu.Unlock()
+}
+
+// ErrNoPort is returned when every ephemeral port of the stack is used.
+var ErrNoPort = errors.New("No ephemeral port left")
+
+// Range of the ephemeral ports.
+const (
+	firstEphemeralPort = 49152
+	ephemeralPorts     = 65536 - firstEphemeralPort
+)
+
+// AllocatePort returns an ephemeral port that is not used by any TCP
+// connection or UDP handler of the stack, ErrNoPort if there is none.
+func (s *Stack) AllocatePort() (uint16, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.allocatePort()
+}
+
+// allocatePort returns a free ephemeral port, ErrNoPort after a full pass
+// over the range. The caller must hold the lock.
+func (s *Stack) allocatePort() (uint16, error) {
+	for i := 0; i < ephemeralPorts; i++ {
+		port := s.nextPort
+		s.nextPort++
+		if s.nextPort == 0 {
+			s.nextPort = firstEphemeralPort
+		}
+		if _, ok := s.udp[port]; ok {
+			continue
+		}
+		if _, ok := s.accept[port]; ok {
+			continue
+		}
+		used := false
+		for key := range s.conns {
+			if key.localPort == port {
+				used = true
+				break
+			}
+		}
+		if !used {
+			return port, nil
+		}
+	}
+	return 0, ErrNoPort
+}
+
+// SendUDP sends a datagram from a port of the stack.
+func (s *Stack) SendUDP(srcPort uint16, dst *net.UDPAddr, payload []byte) error {
+	mac, err := s.lookup(dst.IP)
+	if err != nil {
+		return err
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		SrcIP:    s.ip,
+		DstIP:    dst.IP.To4(),
+		Protocol: layers.IPProtocolUDP,
+	}
+	udp := &layers.UDP{SrcPort: layers.UDPPort(srcPort), DstPort: layers.UDPPort(dst.Port)}
+	udp.SetNetworkLayerForChecksum(ip)
+	return s.send(mac, ip, udp, gopacket.Payload(payload))
+}
+
+// Dial opens a TCP connection from the stack to a host of the network.
+func (s *Stack) Dial(ip net.IP, port uint16) (*TCPConn, error) {
+	mac, err := s.lookup(ip)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	local, err := s.allocatePort()
+	if err != nil {
+		s.mu.Unlock()
+		return nil, err
+	}
+	conn := newTCPConn(s, local, ip.To4(), port, mac)
+	s.conns[conn.key] = conn
+	s.mu.Unlock()
+
+	return conn, conn.connect()
+}
+
+// Close resets every TCP connection of the stack.
+func (s *Stack) Close() {
+	s.mu.Lock()
+	conns := make([]*TCPConn, 0, len(s.conns))
+	for _, conn := range s.conns {
+		conns = append(conns, conn)
+	}
+	s.mu.Unlock()
+	for _, conn := range conns {
+		conn.Abort()
+	}
+}
+
+// learn records the MAC address of a host of the network.
+func (s *Stack) learn(ip net.IP, mac net.HardwareAddr) {
+	ip4 := ip.To4()
+	if ip4 == nil || ip4.IsUnspecified() {
+		return
+	}
+	var key [4]byte
+	copy(key[:], ip4)
+	s.mu.Lock()
+	s.arp[key] = append(net.HardwareAddr{}, mac...)
+	s.mu.Unlock()
+}
+
+// Forget removes the MAC address of a host from the ARP cache.
+func (s *Stack) Forget(ip net.IP) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return
+	}
+	var key [4]byte
+	copy(key[:], ip4)
+	s.mu.Lock()
+	delete(s.arp, key)
+	s.mu.Unlock()
+}
+
+// lookup returns the MAC address of a host of the network.
+func (s *Stack) lookup(ip net.IP) (net.HardwareAddr, error) {
+	ip4 := ip.To4()
+	if ip4 == nil {
+		return nil, errors.New("Invalid IPv4 address")
+	}
+	var key [4]byte
+	copy(key[:], ip4)
+	s.mu.Lock()
+	mac, ok := s.arp[key]
+	s.mu.Unlock()
+	if ok {
+		return mac, nil
+	}
+	if s.resolve == nil {
+		return nil, errors.New("Host unreachable")
+	}
+	mac, err := s.resolve(ip4)
+	if err != nil {
+		return nil, err
+	}
+	s.learn(ip4, mac)
+	return mac, nil
+}
+
+// handleArp answers the ARP requests for the address of the stack.
+func (s *Stack) handleArp(arp *layers.ARP) bool {
+	s.learn(net.IP(arp.SourceProtAddress), net.HardwareAddr(arp.SourceHwAddress))
+	if !net.IP(arp.DstProtAddress).Equal(s.ip) {
+		return false
+	}
+	if arp.Operation != layers.ARPRequest {
+		return true
+	}
+
+	responseARP := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPReply,
+		SourceHwAddress:   s.mac,
+		SourceProtAddress: s.ip,
+		DstHwAddress:      arp.SourceHwAddress,
+		DstProtAddress:    arp.SourceProtAddress,
+	}
+	responseEthernet := &layers.Ethernet{
+		SrcMAC:       s.mac,
+		DstMAC:       net.HardwareAddr(arp.SourceHwAddress),
+		EthernetType: layers.EthernetTypeARP,
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, responseEthernet, responseARP); err == nil {
+		s.output(buf.Bytes())
+	}
+	return true
+}
+
+// handleIcmp answers the echo requests sent to the stack.
+func (s *Stack) handleIcmp(ip *layers.IPv4, icmp *layers.ICMPv4) {
+	if icmp.TypeCode.Type() != layers.ICMPv4TypeEchoRequest {
+		return
+	}
+	mac, err := s.lookup(ip.SrcIP)
+	if err != nil {
+		return
+	}
+	responseIP := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		SrcIP:    s.ip,
+		DstIP:    ip.SrcIP,
+		Protocol: layers.IPProtocolICMPv4,
+	}
+	responseICMP := &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0),
+		Id:       icmp.Id,
+		Seq:      icmp.Seq,
+	}
+	s.send(mac, responseIP, responseICMP, gopacket.Payload(icmp.Payload))
+}
+
+// handleUdp hands a datagram over to the handler of its destination port.
+func (s *Stack) handleUdp(ip *layers.IPv4, srcMAC net.HardwareAddr, udp *layers.UDP) {
+	s.mu.Lock()
+	handler, ok := s.udp[uint16(udp.DstPort)]
+	s.mu.Unlock()
+	if !ok {
+		return
+	}
+	src := &net.UDPAddr{IP: append(net.IP{}, ip.SrcIP.To4()...), Port: int(udp.SrcPort)}
+	handler(src, srcMAC, append([]byte{}, udp.Payload...))
+}
+
+// handleTcp hands a segment over to its connection, or creates the
+// connection when the segment opens a connection on a listening port.
+func (s *Stack) handleTcp(ip *layers.IPv4, tcp *layers.TCP) {
+	var key flowKey
+	key.localPort = uint16(tcp.DstPort)
+	copy(key.remoteIP[:], ip.SrcIP.To4())
+	key.remotePort = uint16(tcp.SrcPort)
+
+	s.mu.Lock()
+	conn, ok := s.conns[key]
+	if !ok && tcp.SYN && !tcp.ACK {
+		if accept, listening := s.accept[key.localPort]; listening {
+			mac := s.arp[key.remoteIP]
+			conn = newTCPConn(s, key.localPort, append(net.IP{}, ip.SrcIP.To4()...), key.remotePort, mac)
+			conn.onEstablished = accept
+			conn.state = stateListen
+			s.conns[key] = conn
+			ok = true
+		}
+	}
+	s.mu.Unlock()
+
+	if !ok {
+		if !tcp.RST {
+			s.reset(ip, tcp)
+		}
+		return
+	}
+	conn.input(tcp)
+}
+
+// remove deletes a connection from the connection table.
+func (s *Stack) remove(conn *TCPConn) {
+	s.mu.Lock()
+	if s.conns[conn.key] == conn {
+		delete(s.conns, conn.key)
+	}
+	s.mu.Unlock()
+}
+
+// reset answers a segment that does not belong to any connection.
+func (s *Stack) reset(ip *layers.IPv4, tcp *layers.TCP) {
+	mac, err := s.lookup(ip.SrcIP)
+	if err != nil {
+		return
+	}
+	responseIP := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		SrcIP:    s.ip,
+		DstIP:    ip.SrcIP,
+		Protocol: layers.IPProtocolTCP,
+	}
+	responseTCP := &layers.TCP{
+		SrcPort: tcp.DstPort,
+		DstPort: tcp.SrcPort,
+		RST:     true,
+	}
+	if tcp.ACK {
+		responseTCP.Seq = tcp.Ack
+	} else {
+		responseTCP.ACK = true
+		responseTCP.Ack = tcp.Seq + uint32(len(tcp.Payload))
+		if tcp.SYN || tcp.FIN {
+			responseTCP.Ack++
+		}
+	}
+	responseTCP.SetNetworkLayerForChecksum(responseIP)
+	s.send(mac, responseIP, responseTCP)
+}
+
+// send serializes and sends an IPv4 packet to a host of the network.
+func (s *Stack) send(dst net.HardwareAddr, ls ...gopacket.SerializableLayer) error {
+	frame, err := s.frame(dst, ls...)
+	if err != nil {
+		return err
+	}
+	return s.output(frame)
+}
+
+// frame serializes an IPv4 packet to a host of the network.
+func (s *Stack) frame(dst net.HardwareAddr, ls ...gopacket.SerializableLayer) ([]byte, error) {
+	eth := &layers.Ethernet{
+		SrcMAC:       s.mac,
+		DstMAC:       dst,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, append([]gopacket.SerializableLayer{eth}, ls...)...); err != nil {
+		return nil, errors.New("Packet serialization error")
+	}
+	return buf.Bytes(), nil
+}
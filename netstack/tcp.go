@@ -0,0 +1,659 @@
+package netstack
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// tcpState is the state of a TCP connection.
+type tcpState int
+
+// States of a TCP connection. TIME-WAIT is not modelled: a connection is
+// closed as soon as both FINs are acknowledged.
+const (
+	stateListen tcpState = iota
+	stateSynSent
+	stateSynReceived
+	stateEstablished
+	stateFinWait1
+	stateFinWait2
+	stateCloseWait
+	stateClosing
+	stateLastAck
+	stateClosed
+)
+
+// Flags of a TCP segment sent by the stack.
+const (
+	flagSYN = 1 << iota
+	flagACK
+	flagRST
+	flagFIN
+)
+
+// Tuning of the TCP connections.
+const (
+	receiveWindow  = 65535
+	sendBufferSize = 256 * 1024
+	minRTO         = 200 * time.Millisecond
+	maxRTO         = 8 * time.Second
+	maxRetries     = 10
+	connectTimeout = 10 * time.Second
+
+	// A connection is removed once nothing was sent or received on it for
+	// idleTimeout, or once it waited finWait2Timeout for the FIN of the peer
+	// after its own FIN was acknowledged.
+	defaultIdleTimeout     = 2 * time.Hour
+	defaultFinWait2Timeout = 60 * time.Second
+)
+
+// TCPConn is a TCP connection terminated by the stack. It implements
+// net.Conn without deadlines.
+type TCPConn struct {
+	stack         *Stack
+	key           flowKey
+	remoteIP      net.IP
+	remoteMAC     net.HardwareAddr
+	onEstablished func(*TCPConn)
+	established   chan struct{}
+	bytesIn       atomic.Uint64
+	bytesOut      atomic.Uint64
+
+	mu         sync.Mutex
+	cond       *sync.Cond
+	state      tcpState
+	err        error
+	iss        uint32
+	sndUna     uint32
+	sndNxt     uint32
+	sndWnd     uint32
+	sendBase   uint32
+	sendBuf    []byte
+	mss        int
+	finQueued  bool
+	finSent    bool
+	finSeq     uint32
+	rcvNxt     uint32
+	recvBuf    []byte
+	finRecv    bool
+	readClosed bool
+	rto        time.Duration
+	retries    int
+	lastSend   time.Time
+	lastInput  time.Time
+	finWait2   time.Time // Time the connection entered FIN-WAIT-2
+	timer      *time.Timer
+	expiry     *time.Timer // Runs expire
+	out        [][]byte    // Segments built under mu, sent by unlock
+}
+
+// newTCPConn creates a connection in the SYN-SENT state. Passive
+// connections are moved to the LISTEN state by the stack.
+func newTCPConn(s *Stack, localPort uint16, remoteIP net.IP, remotePort uint16, remoteMAC net.HardwareAddr) *TCPConn {
+	var iss [4]byte
+	rand.Read(iss[:])
+	c := &TCPConn{
+		stack:       s,
+		remoteIP:    remoteIP,
+		remoteMAC:   remoteMAC,
+		established: make(chan struct{}),
+		state:       stateSynSent,
+		iss:         binary.BigEndian.Uint32(iss[:]),
+		mss:         s.mtu - 40,
+		rto:         time.Second,
+		lastInput:   time.Now(),
+	}
+	c.key.localPort = localPort
+	copy(c.key.remoteIP[:], remoteIP.To4())
+	c.key.remotePort = remotePort
+	c.cond = sync.NewCond(&c.mu)
+	c.sndUna = c.iss
+	c.sndNxt = c.iss + 1
+	c.sendBase = c.iss + 1
+	c.expiry = time.AfterFunc(s.idleTimeout, c.expire)
+	return c
+}
+
+// connect sends the SYN of an active connection and waits until the
+// connection is established.
+func (c *TCPConn) connect() error {
+	c.mu.Lock()
+	c.sendSegment(c.iss, flagSYN, nil)
+	c.armTimer()
+	c.unlock()
+
+	select {
+	case <-c.established:
+		return nil
+	case <-time.After(connectTimeout):
+		c.Abort()
+		return errors.New("Connection timed out")
+	}
+}
+
+// unlock releases the connection lock, then sends the segments built while
+// it was held. Sending under the lock would deadlock when the output calls
+// back into the connection, e.g. when a failed write removes the port and
+// aborts its flows.
+func (c *TCPConn) unlock() {
+	out := c.out
+	c.out = nil
+	c.mu.Unlock()
+	for _, frame := range out {
+		c.stack.output(frame)
+	}
+}
+
+// wait waits for a change of the connection like c.cond.Wait. The segments
+// built before are sent first, and the caller checks its condition again.
+func (c *TCPConn) wait() {
+	if len(c.out) == 0 {
+		c.cond.Wait()
+		return
+	}
+	c.unlock()
+	c.mu.Lock()
+}
+
+// Read reads data received on the connection.
+func (c *TCPConn) Read(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.unlock()
+	for len(c.recvBuf) == 0 && !c.finRecv && c.err == nil && !c.readClosed && c.state != stateClosed {
+		c.wait()
+	}
+	if len(c.recvBuf) > 0 {
+		before := receiveWindow - len(c.recvBuf)
+		n := copy(b, c.recvBuf)
+		c.recvBuf = c.recvBuf[n:]
+		if before < c.mss && c.state != stateClosed {
+			c.sendAck()
+		}
+		return n, nil
+	}
+	if c.err != nil {
+		return 0, c.err
+	}
+	if c.readClosed {
+		return 0, net.ErrClosed
+	}
+	return 0, io.EOF
+}
+
+// Write queues data to be sent on the connection. It blocks while the send
+// buffer is full.
+func (c *TCPConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.unlock()
+	written := 0
+	for written < len(b) {
+		for len(c.sendBuf) >= sendBufferSize && c.err == nil && !c.finQueued && c.state != stateClosed {
+			c.wait()
+		}
+		if c.err != nil {
+			return written, c.err
+		}
+		if c.finQueued || c.state == stateClosed {
+			return written, net.ErrClosed
+		}
+		n := sendBufferSize - len(c.sendBuf)
+		if n > len(b)-written {
+			n = len(b) - written
+		}
+		c.sendBuf = append(c.sendBuf, b[written:written+n]...)
+		written += n
+		c.flush()
+	}
+	return written, nil
+}
+
+// CloseWrite sends a FIN once every queued byte has been sent.
+func (c *TCPConn) CloseWrite() error {
+	c.mu.Lock()
+	defer c.unlock()
+	if c.state == stateClosed {
+		return c.err
+	}
+	if !c.finQueued {
+		c.finQueued = true
+		c.cond.Broadcast()
+		c.flush()
+	}
+	return nil
+}
+
+// Close closes both directions of the connection.
+func (c *TCPConn) Close() error {
+	c.mu.Lock()
+	c.readClosed = true
+	c.cond.Broadcast()
+	c.unlock()
+	return c.CloseWrite()
+}
+
+// Abort resets the connection.
+func (c *TCPConn) Abort() {
+	c.mu.Lock()
+	defer c.unlock()
+	if c.state == stateClosed {
+		return
+	}
+	c.sendSegment(c.sndNxt, flagRST, nil)
+	c.err = syscall.ECONNRESET
+	c.closeLocked()
+}
+
+// LocalAddr returns the address of the stack side of the connection.
+func (c *TCPConn) LocalAddr() net.Addr {
+	return &net.TCPAddr{IP: c.stack.ip, Port: int(c.key.localPort)}
+}
+
+// RemoteAddr returns the address of the host side of the connection.
+func (c *TCPConn) RemoteAddr() net.Addr {
+	return &net.TCPAddr{IP: c.remoteIP, Port: int(c.key.remotePort)}
+}
+
+// SetDeadline is not supported and always returns an error.
+func (c *TCPConn) SetDeadline(t time.Time) error {
+	return errors.New("Deadlines are not supported")
+}
+
+// SetReadDeadline is not supported and always returns an error.
+func (c *TCPConn) SetReadDeadline(t time.Time) error {
+	return errors.New("Deadlines are not supported")
+}
+
+// SetWriteDeadline is not supported and always returns an error.
+func (c *TCPConn) SetWriteDeadline(t time.Time) error {
+	return errors.New("Deadlines are not supported")
+}
+
+// Stats returns the number of payload bytes received and sent.
+func (c *TCPConn) Stats() (uint64, uint64) {
+	return c.bytesIn.Load(), c.bytesOut.Load()
+}
+
+// input processes a segment received for the connection.
+func (c *TCPConn) input(tcp *layers.TCP) {
+	c.mu.Lock()
+	defer c.unlock()
+
+	if c.state == stateClosed {
+		return
+	}
+	c.lastInput = time.Now()
+	if tcp.RST {
+		c.err = syscall.ECONNRESET
+		c.closeLocked()
+		return
+	}
+
+	switch c.state {
+	case stateListen:
+		if tcp.SYN && !tcp.ACK {
+			c.rcvNxt = tcp.Seq + 1
+			c.sndWnd = uint32(tcp.Window)
+			c.readOptions(tcp)
+			c.state = stateSynReceived
+			c.sendSegment(c.iss, flagSYN|flagACK, nil)
+			c.armTimer()
+		}
+		return
+	case stateSynSent:
+		if tcp.SYN && tcp.ACK && tcp.Ack == c.iss+1 {
+			c.rcvNxt = tcp.Seq + 1
+			c.sndUna = tcp.Ack
+			c.sndWnd = uint32(tcp.Window)
+			c.readOptions(tcp)
+			c.state = stateEstablished
+			c.retries = 0
+			close(c.established)
+			c.sendAck()
+			c.flush()
+		}
+		return
+	case stateSynReceived:
+		if tcp.SYN {
+			c.sendSegment(c.iss, flagSYN|flagACK, nil)
+			return
+		}
+		if !tcp.ACK || tcp.Ack != c.iss+1 {
+			return
+		}
+		c.state = stateEstablished
+		c.retries = 0
+		close(c.established)
+		if c.onEstablished != nil {
+			go c.onEstablished(c)
+		}
+	}
+
+	if tcp.ACK {
+		c.processAck(tcp)
+	}
+
+	needAck := false
+	if len(tcp.Payload) > 0 {
+		needAck = true
+		if tcp.Seq == c.rcvNxt && !c.finRecv {
+			accepted := receiveWindow - len(c.recvBuf)
+			if accepted > len(tcp.Payload) {
+				accepted = len(tcp.Payload)
+			}
+			if accepted > 0 {
+				c.recvBuf = append(c.recvBuf, tcp.Payload[:accepted]...)
+				c.rcvNxt += uint32(accepted)
+				c.bytesIn.Add(uint64(accepted))
+				c.cond.Broadcast()
+			}
+		}
+	}
+
+	if tcp.FIN && tcp.Seq+uint32(len(tcp.Payload)) == c.rcvNxt && !c.finRecv {
+		needAck = true
+		c.rcvNxt++
+		c.finRecv = true
+		c.cond.Broadcast()
+		switch c.state {
+		case stateEstablished:
+			c.state = stateCloseWait
+		case stateFinWait1:
+			c.state = stateClosing
+		case stateFinWait2:
+			c.state = stateClosed
+		}
+	}
+
+	if needAck {
+		c.sendAck()
+	}
+	if c.state == stateClosed {
+		c.closeLocked()
+		return
+	}
+	c.flush()
+}
+
+// processAck releases the acknowledged data and updates the send window.
+func (c *TCPConn) processAck(tcp *layers.TCP) {
+	if seqLT(c.sndNxt, tcp.Ack) || seqLT(tcp.Ack, c.sndUna) {
+		return
+	}
+	c.sndWnd = uint32(tcp.Window)
+	if tcp.Ack == c.sndUna {
+		return
+	}
+	c.sndUna = tcp.Ack
+	c.retries = 0
+	c.rto = time.Second
+
+	if acked := int(tcp.Ack - c.sendBase); acked > 0 {
+		if acked > len(c.sendBuf) {
+			acked = len(c.sendBuf)
+		}
+		c.sendBuf = c.sendBuf[acked:]
+		c.sendBase += uint32(acked)
+		c.cond.Broadcast()
+	}
+
+	if c.finSent && seqLT(c.finSeq, tcp.Ack) {
+		switch c.state {
+		case stateFinWait1:
+			c.state = stateFinWait2
+			c.finWait2 = time.Now()
+			c.expiry.Reset(c.stack.finWait2Timeout)
+		case stateClosing, stateLastAck:
+			c.state = stateClosed
+		}
+	}
+}
+
+// flush sends the queued data allowed by the send window, then the FIN
+// once the connection is closing and every byte was sent.
+func (c *TCPConn) flush() {
+	if c.state != stateEstablished && c.state != stateCloseWait && c.state != stateFinWait1 && c.state != stateLastAck {
+		return
+	}
+	if c.finSent {
+		return
+	}
+	limit := c.sndUna + c.sndWnd
+	for {
+		offset := int(c.sndNxt - c.sendBase)
+		pending := len(c.sendBuf) - offset
+		if pending <= 0 {
+			break
+		}
+		room := int(limit - c.sndNxt)
+		if !seqLT(c.sndNxt, limit) {
+			room = 0
+		}
+		if room <= 0 {
+			break
+		}
+		n := pending
+		if n > c.mss {
+			n = c.mss
+		}
+		if n > room {
+			n = room
+		}
+		c.sendSegment(c.sndNxt, flagACK, c.sendBuf[offset:offset+n])
+		c.bytesOut.Add(uint64(n))
+		c.sndNxt += uint32(n)
+	}
+
+	if c.finQueued && int(c.sndNxt-c.sendBase) == len(c.sendBuf) {
+		c.finSeq = c.sndNxt
+		c.finSent = true
+		c.sendSegment(c.sndNxt, flagACK|flagFIN, nil)
+		c.sndNxt++
+		switch c.state {
+		case stateEstablished:
+			c.state = stateFinWait1
+		case stateCloseWait:
+			c.state = stateLastAck
+		}
+	}
+	if c.sndUna != c.sndNxt || len(c.sendBuf) > 0 {
+		c.armTimer()
+	}
+}
+
+// armTimer starts the retransmission timer if it is not running.
+func (c *TCPConn) armTimer() {
+	if c.timer == nil {
+		c.lastSend = time.Now()
+		c.timer = time.AfterFunc(minRTO, c.tick)
+	}
+}
+
+// tick retransmits the unacknowledged segments once the retransmission
+// timeout expired, and probes a zero send window.
+func (c *TCPConn) tick() {
+	c.mu.Lock()
+	defer c.unlock()
+	c.timer = nil
+	if c.state == stateClosed {
+		return
+	}
+
+	outstanding := c.sndUna != c.sndNxt
+	if !outstanding && len(c.sendBuf) == 0 {
+		return
+	}
+	if time.Since(c.lastSend) < c.rto {
+		// Not through armTimer, which would restart the timeout
+		c.timer = time.AfterFunc(minRTO, c.tick)
+		return
+	}
+
+	c.retries++
+	if c.retries > maxRetries {
+		c.err = errors.New("Connection timed out")
+		c.sendSegment(c.sndNxt, flagRST, nil)
+		c.closeLocked()
+		return
+	}
+	if c.rto *= 2; c.rto > maxRTO {
+		c.rto = maxRTO
+	}
+
+	switch c.state {
+	case stateSynSent:
+		c.sendSegment(c.iss, flagSYN, nil)
+	case stateSynReceived:
+		c.sendSegment(c.iss, flagSYN|flagACK, nil)
+	default:
+		if outstanding {
+			// Go back to the first unacknowledged byte, the FIN is sent
+			// again by flush once the data is
+			c.sndNxt = c.sndUna
+			if c.finSent {
+				c.finSent = false
+				switch c.state {
+				case stateFinWait1:
+					c.state = stateEstablished
+				case stateClosing, stateLastAck:
+					c.state = stateCloseWait
+				}
+			}
+			c.flush()
+		} else if c.sndWnd == 0 {
+			// Probe the zero window with one byte
+			offset := int(c.sndNxt - c.sendBase)
+			if offset < len(c.sendBuf) {
+				c.sendSegment(c.sndNxt, flagACK, c.sendBuf[offset:offset+1])
+			}
+		}
+	}
+	c.lastSend = time.Now()
+	c.armTimer()
+}
+
+// expire resets the connection once it stayed idle for the idle timeout of
+// the stack, or in FIN-WAIT-2 for its FIN-WAIT-2 timeout, and runs again at
+// the next of these deadlines otherwise.
+func (c *TCPConn) expire() {
+	c.mu.Lock()
+	defer c.unlock()
+	if c.state == stateClosed {
+		return
+	}
+	last := c.lastInput
+	if c.lastSend.After(last) {
+		last = c.lastSend
+	}
+	deadline := last.Add(c.stack.idleTimeout)
+	if c.state == stateFinWait2 {
+		if finDeadline := c.finWait2.Add(c.stack.finWait2Timeout); finDeadline.Before(deadline) {
+			deadline = finDeadline
+		}
+	}
+	if wait := time.Until(deadline); wait > 0 {
+		c.expiry.Reset(wait)
+		return
+	}
+	c.err = errors.New("Connection timed out")
+	c.sendSegment(c.sndNxt, flagRST, nil)
+	c.closeLocked()
+}
+
+// closeLocked moves the connection to the CLOSED state and removes it from
+// the stack. The caller must hold the connection lock.
+func (c *TCPConn) closeLocked() {
+	c.state = stateClosed
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	c.expiry.Stop()
+	select {
+	case <-c.established:
+	default:
+		close(c.established)
+	}
+	c.cond.Broadcast()
+	c.stack.remove(c)
+}
+
+// readOptions extracts the maximum segment size announced by the peer.
+func (c *TCPConn) readOptions(tcp *layers.TCP) {
+	for _, option := range tcp.Options {
+		if option.OptionType == layers.TCPOptionKindMSS && len(option.OptionData) == 2 {
+			if mss := int(binary.BigEndian.Uint16(option.OptionData)); mss > 0 && mss < c.mss {
+				c.mss = mss
+			}
+		}
+	}
+}
+
+// sendAck sends an empty segment acknowledging the received data.
+func (c *TCPConn) sendAck() {
+	c.sendSegment(c.sndNxt, flagACK, nil)
+}
+
+// sendSegment builds a segment of the connection, sent by unlock. The
+// caller must hold the connection lock.
+func (c *TCPConn) sendSegment(seq uint32, flags int, payload []byte) {
+	if c.remoteMAC == nil {
+		mac, err := c.stack.lookup(c.remoteIP)
+		if err != nil {
+			return
+		}
+		c.remoteMAC = mac
+	}
+	window := receiveWindow - len(c.recvBuf)
+	if window < 0 {
+		window = 0
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		SrcIP:    c.stack.ip,
+		DstIP:    c.remoteIP,
+		Protocol: layers.IPProtocolTCP,
+	}
+	tcp := &layers.TCP{
+		SrcPort: layers.TCPPort(c.key.localPort),
+		DstPort: layers.TCPPort(c.key.remotePort),
+		Seq:     seq,
+		SYN:     flags&flagSYN != 0,
+		ACK:     flags&flagACK != 0,
+		RST:     flags&flagRST != 0,
+		FIN:     flags&flagFIN != 0,
+		PSH:     len(payload) > 0,
+		Window:  uint16(window),
+	}
+	if tcp.ACK {
+		tcp.Ack = c.rcvNxt
+	}
+	if tcp.SYN {
+		mss := make([]byte, 2)
+		binary.BigEndian.PutUint16(mss, uint16(c.stack.mtu-40))
+		tcp.Options = []layers.TCPOption{{OptionType: layers.TCPOptionKindMSS, OptionLength: 4, OptionData: mss}}
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+	if len(payload) > 0 || tcp.SYN || tcp.FIN {
+		c.lastSend = time.Now()
+	}
+	if frame, err := c.stack.frame(c.remoteMAC, ip, tcp, gopacket.Payload(payload)); err == nil {
+		c.out = append(c.out, frame)
+	}
+}
+
+// seqLT reports whether sequence number a is before b.
+func seqLT(a, b uint32) bool {
+	return int32(a-b) < 0
+}
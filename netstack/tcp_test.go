@@ -0,0 +1,473 @@
+package netstack
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	stackIP  = net.IP{10, 0, 0, 1}
+	stackMAC = net.HardwareAddr{0x52, 0x54, 0, 0, 0, 1}
+	peerIP   = net.IP{10, 0, 0, 2}
+	peerMAC  = net.HardwareAddr{0x52, 0x54, 0, 0, 0, 2}
+)
+
+const (
+	peerPort = 40000
+	peerISS  = 1000
+)
+
+// harness drives a stack with crafted segments and collects the segments
+// it sends.
+type harness struct {
+	t        *testing.T
+	stack    *Stack
+	out      chan *layers.TCP
+	accepted chan *TCPConn
+	conn     *TCPConn
+}
+
+// newHarness creates a stack listening on port 80. onOutput is called with
+// every frame the stack sends, before the frame is collected.
+func newHarness(t *testing.T, onOutput func(*harness)) *harness {
+	h := &harness{t: t, out: make(chan *layers.TCP, 64), accepted: make(chan *TCPConn, 1)}
+	output := func(frame []byte) error {
+		packet := gopacket.NewPacket(frame, layers.LayerTypeEthernet, gopacket.Default)
+		if tcp, ok := packet.Layer(layers.LayerTypeTCP).(*layers.TCP); ok {
+			if onOutput != nil {
+				onOutput(h)
+			}
+			h.out <- tcp
+		}
+		return nil
+	}
+	resolve := func(net.IP) (net.HardwareAddr, error) { return peerMAC, nil }
+	stack, err := NewStack(stackIP, stackMAC, 1500, output, resolve)
+	if err != nil {
+		t.Fatal(err)
+	}
+	h.stack = stack
+	stack.Listen(80, func(c *TCPConn) { h.accepted <- c })
+	return h
+}
+
+// segment is a segment sent by the peer, or expected from the stack.
+type segment struct {
+	flags   int
+	seq     uint32 // Relative to the ISS of the sender
+	ack     uint32 // Relative to the ISS of the receiver
+	window  uint16
+	payload string
+}
+
+// input sends a segment of the peer to the stack.
+func (h *harness) input(seg segment, stackISS uint32) {
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, SrcIP: peerIP, DstIP: stackIP, Protocol: layers.IPProtocolTCP}
+	window := seg.window
+	if window == 0 {
+		window = 65535
+	}
+	tcp := &layers.TCP{
+		SrcPort: peerPort,
+		DstPort: 80,
+		Seq:     peerISS + seg.seq,
+		SYN:     seg.flags&flagSYN != 0,
+		ACK:     seg.flags&flagACK != 0,
+		RST:     seg.flags&flagRST != 0,
+		FIN:     seg.flags&flagFIN != 0,
+		Window:  window,
+	}
+	if tcp.ACK {
+		tcp.Ack = stackISS + seg.ack
+	}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	eth := &layers.Ethernet{SrcMAC: peerMAC, DstMAC: stackMAC, EthernetType: layers.EthernetTypeIPv4}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, tcp, gopacket.Payload(seg.payload)); err != nil {
+		h.t.Fatal(err)
+	}
+	h.stack.Input(gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default))
+}
+
+// expect checks the next segment sent by the stack. Returns the segment.
+func (h *harness) expect(want segment, stackISS uint32, timeout time.Duration) *layers.TCP {
+	h.t.Helper()
+	select {
+	case tcp := <-h.out:
+		flags := 0
+		for flag, set := range map[int]bool{flagSYN: tcp.SYN, flagACK: tcp.ACK, flagRST: tcp.RST, flagFIN: tcp.FIN} {
+			if set {
+				flags |= flag
+			}
+		}
+		if flags != want.flags {
+			h.t.Fatalf("flags %b, want %b", flags, want.flags)
+		}
+		if !tcp.SYN && tcp.Seq-stackISS != want.seq {
+			h.t.Fatalf("seq %d, want %d", tcp.Seq-stackISS, want.seq)
+		}
+		if tcp.ACK && tcp.Ack-peerISS != want.ack {
+			h.t.Fatalf("ack %d, want %d", tcp.Ack-peerISS, want.ack)
+		}
+		if string(tcp.Payload) != want.payload {
+			h.t.Fatalf("payload %q, want %q", tcp.Payload, want.payload)
+		}
+		return tcp
+	case <-time.After(timeout):
+		h.t.Fatalf("no segment, want %+v", want)
+	}
+	return nil
+}
+
+// expectNone checks that the stack sends nothing for a while.
+func (h *harness) expectNone(d time.Duration) {
+	h.t.Helper()
+	select {
+	case tcp := <-h.out:
+		h.t.Fatalf("unexpected segment seq %d ack %d payload %q", tcp.Seq, tcp.Ack, tcp.Payload)
+	case <-time.After(d):
+	}
+}
+
+// establish runs the passive handshake. Returns the ISS of the stack.
+func (h *harness) establish(window uint16) uint32 {
+	h.t.Helper()
+	h.input(segment{flags: flagSYN, window: window}, 0)
+	synAck := h.expect(segment{flags: flagSYN | flagACK, ack: 1}, 0, time.Second)
+	iss := synAck.Seq
+	h.input(segment{flags: flagACK, seq: 1, ack: 1, window: window}, iss)
+	select {
+	case h.conn = <-h.accepted:
+	case <-time.After(time.Second):
+		h.t.Fatal("connection not accepted")
+	}
+	return iss
+}
+
+// step is a step of a scenario: a segment sent by the peer, an action on
+// the connection, or a segment expected from the stack.
+type step struct {
+	in     *segment
+	action func(t *testing.T, c *TCPConn)
+	out    *segment
+	none   bool          // Expect no segment
+	wait   time.Duration // Time to wait for out
+}
+
+func in(s segment) step                             { return step{in: &s} }
+func out(s segment) step                            { return step{out: &s} }
+func do(action func(t *testing.T, c *TCPConn)) step { return step{action: action} }
+
+func TestTCPStateMachine(t *testing.T) {
+	tests := []struct {
+		name   string
+		window uint16
+		steps  []step
+	}{
+		{
+			name: "data received in order is acknowledged and read",
+			steps: []step{
+				in(segment{flags: flagACK, seq: 1, ack: 1, payload: "hello"}),
+				out(segment{flags: flagACK, seq: 1, ack: 6}),
+				do(func(t *testing.T, c *TCPConn) { readExactly(t, c, "hello") }),
+			},
+		},
+		{
+			name: "out of order data is not accepted",
+			steps: []step{
+				in(segment{flags: flagACK, seq: 10, ack: 1, payload: "later"}),
+				out(segment{flags: flagACK, seq: 1, ack: 1}),
+				in(segment{flags: flagACK, seq: 1, ack: 1, payload: "first"}),
+				out(segment{flags: flagACK, seq: 1, ack: 6}),
+				do(func(t *testing.T, c *TCPConn) { readExactly(t, c, "first") }),
+			},
+		},
+		{
+			name: "written data is sent and released by its ACK",
+			steps: []step{
+				do(func(t *testing.T, c *TCPConn) { c.Write([]byte("abc")) }),
+				out(segment{flags: flagACK, seq: 1, ack: 1, payload: "abc"}),
+				in(segment{flags: flagACK, seq: 1, ack: 4}),
+				{none: true, wait: 1500 * time.Millisecond},
+			},
+		},
+		{
+			name:   "the send window limits the data in flight",
+			window: 4,
+			steps: []step{
+				do(func(t *testing.T, c *TCPConn) { c.Write([]byte("abcdefgh")) }),
+				out(segment{flags: flagACK, seq: 1, ack: 1, payload: "abcd"}),
+				{none: true, wait: 100 * time.Millisecond},
+				in(segment{flags: flagACK, seq: 1, ack: 5, window: 4}),
+				out(segment{flags: flagACK, seq: 5, ack: 1, payload: "efgh"}),
+			},
+		},
+		{
+			name: "unacknowledged data is retransmitted",
+			steps: []step{
+				do(func(t *testing.T, c *TCPConn) { c.Write([]byte("lost")) }),
+				out(segment{flags: flagACK, seq: 1, ack: 1, payload: "lost"}),
+				{out: &segment{flags: flagACK, seq: 1, ack: 1, payload: "lost"}, wait: 2 * time.Second},
+				in(segment{flags: flagACK, seq: 1, ack: 5}),
+			},
+		},
+		{
+			name: "a FIN of the peer is acknowledged and ends the reads",
+			steps: []step{
+				in(segment{flags: flagACK | flagFIN, seq: 1, ack: 1}),
+				out(segment{flags: flagACK, seq: 1, ack: 2}),
+				do(func(t *testing.T, c *TCPConn) {
+					if _, err := c.Read(make([]byte, 1)); err != io.EOF {
+						t.Fatalf("read %v, want EOF", err)
+					}
+				}),
+				do(func(t *testing.T, c *TCPConn) { c.Close() }),
+				out(segment{flags: flagACK | flagFIN, seq: 1, ack: 2}),
+				in(segment{flags: flagACK, seq: 2, ack: 2}),
+				do(expectRemoved),
+			},
+		},
+		{
+			name: "a local close sends a FIN after the queued data",
+			steps: []step{
+				do(func(t *testing.T, c *TCPConn) { c.Write([]byte("bye")); c.CloseWrite() }),
+				out(segment{flags: flagACK, seq: 1, ack: 1, payload: "bye"}),
+				out(segment{flags: flagACK | flagFIN, seq: 4, ack: 1}),
+				in(segment{flags: flagACK | flagFIN, seq: 1, ack: 5}),
+				out(segment{flags: flagACK, seq: 5, ack: 2}),
+				do(expectRemoved),
+			},
+		},
+		{
+			name: "a RST resets the connection",
+			steps: []step{
+				in(segment{flags: flagRST, seq: 1}),
+				do(func(t *testing.T, c *TCPConn) {
+					if _, err := c.Read(make([]byte, 1)); !errors.Is(err, syscall.ECONNRESET) {
+						t.Fatalf("read %v, want ECONNRESET", err)
+					}
+				}),
+				do(expectRemoved),
+			},
+		},
+		{
+			name: "an abort sends a RST",
+			steps: []step{
+				do(func(t *testing.T, c *TCPConn) { c.Abort() }),
+				out(segment{flags: flagRST, seq: 1}),
+				do(expectRemoved),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newHarness(t, nil)
+			iss := h.establish(test.window)
+			for _, st := range test.steps {
+				switch {
+				case st.in != nil:
+					h.input(*st.in, iss)
+				case st.action != nil:
+					st.action(t, h.conn)
+				case st.none:
+					h.expectNone(st.wait)
+				case st.out != nil:
+					wait := st.wait
+					if wait == 0 {
+						wait = time.Second
+					}
+					h.expect(*st.out, iss, wait)
+				}
+			}
+			h.stack.Close()
+		})
+	}
+}
+
+// readExactly reads want from c.
+func readExactly(t *testing.T, c *TCPConn, want string) {
+	t.Helper()
+	got := make([]byte, len(want))
+	if _, err := io.ReadFull(c, got); err != nil || !bytes.Equal(got, []byte(want)) {
+		t.Fatalf("read %q %v, want %q", got, err, want)
+	}
+}
+
+// expectRemoved checks that a connection left the table of its stack.
+func expectRemoved(t *testing.T, c *TCPConn) {
+	t.Helper()
+	c.stack.mu.Lock()
+	defer c.stack.mu.Unlock()
+	if _, ok := c.stack.conns[c.key]; ok {
+		t.Fatal("connection still in the stack")
+	}
+}
+
+func TestTCPHandshake(t *testing.T) {
+	h := newHarness(t, nil)
+	h.input(segment{flags: flagSYN}, 0)
+	synAck := h.expect(segment{flags: flagSYN | flagACK, ack: 1}, 0, time.Second)
+	if len(synAck.Options) != 1 || synAck.Options[0].OptionType != layers.TCPOptionKindMSS {
+		t.Fatalf("no MSS option: %v", synAck.Options)
+	}
+	// The SYN is retransmitted by the peer: the SYN-ACK is sent again
+	h.input(segment{flags: flagSYN}, 0)
+	h.expect(segment{flags: flagSYN | flagACK, ack: 1}, 0, time.Second)
+	// Without the final ACK the SYN-ACK is retransmitted
+	h.expect(segment{flags: flagSYN | flagACK, ack: 1}, 0, 2*time.Second)
+	h.input(segment{flags: flagACK, seq: 1, ack: 1}, synAck.Seq)
+	select {
+	case <-h.accepted:
+	case <-time.After(time.Second):
+		t.Fatal("connection not accepted")
+	}
+	h.stack.Close()
+}
+
+func TestTCPClosedPort(t *testing.T) {
+	h := newHarness(t, nil)
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, SrcIP: peerIP, DstIP: stackIP, Protocol: layers.IPProtocolTCP}
+	tcp := &layers.TCP{SrcPort: peerPort, DstPort: 81, Seq: peerISS, SYN: true, Window: 65535}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	gopacket.SerializeLayers(buf, opts, &layers.Ethernet{SrcMAC: peerMAC, DstMAC: stackMAC, EthernetType: layers.EthernetTypeIPv4}, ip, tcp)
+	h.stack.Input(gopacket.NewPacket(buf.Bytes(), layers.LayerTypeEthernet, gopacket.Default))
+	h.expect(segment{flags: flagRST | flagACK, ack: 1}, 0, time.Second)
+}
+
+// TestTCPOutputReentrant checks that the output of a segment can abort the
+// connection, like the removal of a port whose socket failed does.
+func TestTCPOutputReentrant(t *testing.T) {
+	abort := make(chan struct{}, 1)
+	h := newHarness(t, func(h *harness) {
+		select {
+		case <-abort:
+			h.conn.Abort()
+		default:
+		}
+	})
+	iss := h.establish(0)
+	abort <- struct{}{}
+	done := make(chan struct{})
+	go func() {
+		h.input(segment{flags: flagACK, seq: 1, ack: 1, payload: "x"}, iss)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("deadlock: the output aborting the connection blocked the input")
+	}
+	// The abort runs in the output of the ACK, its RST is collected first
+	h.expect(segment{flags: flagRST, seq: 1}, iss, time.Second)
+	h.expect(segment{flags: flagACK, seq: 1, ack: 2}, iss, time.Second)
+}
+
+// TestTCPTimeouts checks that the connections left idle, or waiting for the
+// FIN of the peer, are reset and removed from the stack.
+func TestTCPTimeouts(t *testing.T) {
+	timedOut := func(t *testing.T, c *TCPConn) {
+		if _, err := c.Read(make([]byte, 1)); err == nil || err == io.EOF {
+			t.Fatalf("read %v, want a timeout", err)
+		}
+		expectRemoved(t, c)
+	}
+	tests := []struct {
+		name     string
+		idle     time.Duration
+		finWait2 time.Duration
+		steps    []step
+	}{
+		{
+			name:     "a connection in FIN-WAIT-2 is reset after its timeout",
+			idle:     time.Hour,
+			finWait2: 300 * time.Millisecond,
+			steps: []step{
+				do(func(t *testing.T, c *TCPConn) { c.CloseWrite() }),
+				out(segment{flags: flagACK | flagFIN, seq: 1, ack: 1}),
+				in(segment{flags: flagACK, seq: 1, ack: 2}),
+				{none: true, wait: 200 * time.Millisecond},
+				out(segment{flags: flagRST, seq: 2}),
+				do(timedOut),
+			},
+		},
+		{
+			name:     "an idle connection is reset",
+			idle:     300 * time.Millisecond,
+			finWait2: time.Hour,
+			steps: []step{
+				out(segment{flags: flagRST, seq: 1}),
+				do(timedOut),
+			},
+		},
+		{
+			name:     "a segment received postpones the idle timeout",
+			idle:     500 * time.Millisecond,
+			finWait2: time.Hour,
+			steps: []step{
+				{none: true, wait: 300 * time.Millisecond},
+				in(segment{flags: flagACK, seq: 1, ack: 1, payload: "ping"}),
+				out(segment{flags: flagACK, seq: 1, ack: 5}),
+				do(func(t *testing.T, c *TCPConn) { readExactly(t, c, "ping") }),
+				{none: true, wait: 400 * time.Millisecond},
+				out(segment{flags: flagRST, seq: 1}),
+				do(timedOut),
+			},
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			h := newHarness(t, nil)
+			h.stack.idleTimeout, h.stack.finWait2Timeout = test.idle, test.finWait2
+			iss := h.establish(0)
+			for _, st := range test.steps {
+				switch {
+				case st.in != nil:
+					h.input(*st.in, iss)
+				case st.action != nil:
+					st.action(t, h.conn)
+				case st.none:
+					h.expectNone(st.wait)
+				case st.out != nil:
+					h.expect(*st.out, iss, time.Second)
+				}
+			}
+			h.stack.Close()
+		})
+	}
+}
+
+// TestTCPNoPort checks that the connections are refused once every
+// ephemeral port is used.
+func TestTCPNoPort(t *testing.T) {
+	h := newHarness(t, nil)
+	for i := 0; i < ephemeralPorts; i++ {
+		port, err := h.stack.AllocatePort()
+		if err != nil {
+			t.Fatalf("port %d: %v", i, err)
+		}
+		h.stack.HandleUDP(port, func(*net.UDPAddr, net.HardwareAddr, []byte) {})
+	}
+	if _, err := h.stack.AllocatePort(); !errors.Is(err, ErrNoPort) {
+		t.Fatalf("allocation %v, want ErrNoPort", err)
+	}
+	if _, err := h.stack.Dial(peerIP, 80); !errors.Is(err, ErrNoPort) {
+		t.Fatalf("dial %v, want ErrNoPort", err)
+	}
+	h.stack.UnhandleUDP(firstEphemeralPort + 10)
+	if port, err := h.stack.AllocatePort(); err != nil || port != firstEphemeralPort+10 {
+		t.Fatalf("allocation %d %v, want the released port", port, err)
+	}
+}
@@ -0,0 +1,15 @@
+package network
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// sockaddrInet4 converts an IPv4 address and a port to a raw socket address.
+func sockaddrInet4(ip []byte, port int) syscall.RawSockaddrInet4 {
+	sa := syscall.RawSockaddrInet4{Family: syscall.AF_INET}
+	p := (*[2]byte)(unsafe.Pointer(&sa.Port))
+	p[0], p[1] = byte(port>>8), byte(port)
+	copy(sa.Addr[:], ip)
+	return sa
+}
@@ -0,0 +1,113 @@
+package network
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// mmsghdr is the struct mmsghdr of recvmmsg and sendmmsg.
+type mmsghdr struct {
+	hdr syscall.Msghdr
+	len uint32
+}
+
+// mmsgBuffers holds the message headers of a batch, reused from call to
+// call. It is used by one goroutine at a time.
+type mmsgBuffers struct {
+	hdrs  []mmsghdr
+	iovs  []syscall.Iovec
+	names []syscall.RawSockaddrInet4
+}
+
+// prepare points the headers to the buffers. With names, the addresses of
+// the messages are stored in m.names.
+func (m *mmsgBuffers) prepare(buffers [][]byte, names bool) {
+	if cap(m.hdrs) < len(buffers) {
+		m.hdrs = make([]mmsghdr, len(buffers))
+		m.iovs = make([]syscall.Iovec, len(buffers))
+		m.names = make([]syscall.RawSockaddrInet4, len(buffers))
+	}
+	m.hdrs = m.hdrs[:len(buffers)]
+	for i, buffer := range buffers {
+		m.iovs[i] = syscall.Iovec{}
+		if len(buffer) > 0 {
+			m.iovs[i].Base = &buffer[0]
+			m.iovs[i].SetLen(len(buffer))
+		}
+		m.hdrs[i] = mmsghdr{}
+		m.hdrs[i].hdr.Iov = &m.iovs[i]
+		m.hdrs[i].hdr.Iovlen = 1
+		if names {
+			m.hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(&m.names[i]))
+			m.hdrs[i].hdr.Namelen = syscall.SizeofSockaddrInet4
+		}
+	}
+}
+
+// recvmmsg reads up to len(buffers) datagrams from conn with one system call,
+// waiting for the first one, and stores their lengths in lengths, 0 for the
+// datagrams that do not fit in their buffer. With names, the source
+// addresses of IPv4 datagrams are stored in m.names. Returns the number of
+// datagrams read.
+func recvmmsg(conn syscall.Conn, m *mmsgBuffers, buffers [][]byte, lengths []int, names bool) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	m.prepare(buffers, names)
+	var count int
+	var errno syscall.Errno
+	err = raw.Read(func(fd uintptr) bool {
+		r, _, e := syscall.Syscall6(syscall.SYS_RECVMMSG, fd, uintptr(unsafe.Pointer(&m.hdrs[0])), uintptr(len(m.hdrs)), syscall.MSG_DONTWAIT, 0, 0)
+		if e == syscall.EAGAIN || e == syscall.EINTR {
+			return false
+		}
+		count, errno = int(r), e
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	for i := 0; i < count; i++ {
+		lengths[i] = int(m.hdrs[i].len)
+		// A datagram larger than its buffer is dropped rather than truncated
+		if m.hdrs[i].hdr.Flags&syscall.MSG_TRUNC != 0 {
+			lengths[i] = 0
+		}
+	}
+	return count, nil
+}
+
+// sendmmsg sends frames on conn with one system call, without waiting for
+// room in the queue of the socket, to the address name if set. Returns the
+// number of frames sent, syscall.EAGAIN if none could be queued.
+func sendmmsg(conn syscall.Conn, m *mmsgBuffers, frames [][]byte, name *syscall.RawSockaddrInet4) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	m.prepare(frames, false)
+	if name != nil {
+		for i := range m.hdrs {
+			m.hdrs[i].hdr.Name = (*byte)(unsafe.Pointer(name))
+			m.hdrs[i].hdr.Namelen = syscall.SizeofSockaddrInet4
+		}
+	}
+	var count int
+	var errno syscall.Errno
+	err = raw.Write(func(fd uintptr) bool {
+		r, _, e := syscall.Syscall6(sysSendmmsg, fd, uintptr(unsafe.Pointer(&m.hdrs[0])), uintptr(len(m.hdrs)), syscall.MSG_DONTWAIT, 0, 0)
+		count, errno = int(r), e
+		return e != syscall.EINTR
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != 0 {
+		return 0, errno
+	}
+	return count, nil
+}
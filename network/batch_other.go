@@ -0,0 +1,91 @@
+//go:build !linux
+
+package network
+
+import (
+	"syscall"
+	"unsafe"
+)
+
+// mmsgBuffers holds the source address of the datagram read by recvmmsg. It
+// is used by one goroutine at a time.
+type mmsgBuffers struct {
+	names []syscall.RawSockaddrInet4
+}
+
+// recvmmsg reads a datagram from conn into the first buffer, waiting for it,
+// the system having no recvmmsg, and stores its length in lengths, 0 if it
+// does not fit in the buffer. With names, its source address is stored in
+// m.names if it is an IPv4 one. Returns the number of datagrams read, 1.
+func recvmmsg(conn syscall.Conn, m *mmsgBuffers, buffers [][]byte, lengths []int, names bool) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	if len(m.names) == 0 {
+		m.names = make([]syscall.RawSockaddrInet4, 1)
+	}
+	var length, flags int
+	var from syscall.Sockaddr
+	var errno error
+	err = raw.Read(func(fd uintptr) bool {
+		length, _, flags, from, errno = syscall.Recvmsg(int(fd), buffers[0], nil, syscall.MSG_DONTWAIT)
+		return errno != syscall.EAGAIN && errno != syscall.EINTR
+	})
+	if err != nil {
+		return 0, err
+	}
+	if errno != nil {
+		return 0, errno
+	}
+	lengths[0] = length
+	// A datagram larger than its buffer is dropped rather than truncated
+	if flags&syscall.MSG_TRUNC != 0 {
+		lengths[0] = 0
+	}
+	if names {
+		m.names[0] = syscall.RawSockaddrInet4{}
+		if sa, ok := from.(*syscall.SockaddrInet4); ok {
+			m.names[0] = sockaddrInet4(sa.Addr[:], sa.Port)
+		}
+	}
+	return 1, nil
+}
+
+// sendmmsg sends frames on conn one per system call, the system having no
+// sendmmsg, without waiting for room in the queue of the socket, to the
+// address name if set. Returns the number of frames sent, syscall.EAGAIN if
+// none could be queued.
+func sendmmsg(conn syscall.Conn, m *mmsgBuffers, frames [][]byte, name *syscall.RawSockaddrInet4) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var to syscall.Sockaddr
+	if name != nil {
+		p := (*[2]byte)(unsafe.Pointer(&name.Port))
+		to = &syscall.SockaddrInet4{Port: int(p[0])<<8 | int(p[1]), Addr: name.Addr}
+	}
+	var count int
+	var errno error
+	err = raw.Write(func(fd uintptr) bool {
+		for count < len(frames) {
+			errno = syscall.Sendmsg(int(fd), frames[count], nil, to, syscall.MSG_DONTWAIT)
+			if errno == syscall.EINTR {
+				continue
+			}
+			if errno != nil {
+				break
+			}
+			count++
+		}
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	if count == 0 && errno != nil {
+		return 0, errno
+	}
+	return count, nil
+}
@@ -0,0 +1,103 @@
+package network
+
+import (
+	"QemuUserNet/entities"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"os/exec"
+	"sync"
+	"time"
+)
+
+// ExternalConfig describes the user-mode network stack process an external
+// port exchanges frames with. Exactly one of Socket and Command is set. The
+// command is trusted, it must come from the configuration of the daemon.
+type ExternalConfig struct {
+	Socket  string   // Path of the stream socket the helper listens on
+	Command []string // Command spawning the helper, {fd} is replaced by the descriptor of its socket
+}
+
+// AddExternal plugs a user-mode network stack process, such as passt, into
+// the network. The process speaks the framing of QEMU -netdev stream and is
+// seen by the network as an uplink: the addresses it uses are learned from
+// its frames. The port is removed with RemoveVM, and when the process closes
+// its socket.
+func (n *Network) AddExternal(id string, config ExternalConfig) (*entities.VM, error) {
+	if _, err := n.Clients.GetClientByID(id); err == nil {
+		return nil, errors.New("This ID is already used")
+	}
+
+	var vm entities.VM
+	var transport *externalTransport
+	var err error
+	switch {
+	case config.Socket != "" && len(config.Command) == 0:
+		vm = entities.VM{ID: id, Socket: config.Socket, Transport: entities.TransportExternal}
+		transport, err = dialExternal(config.Socket)
+	case config.Socket == "" && len(config.Command) > 0:
+		vm = entities.VM{ID: id, Socket: config.Command[0], Transport: entities.TransportExternal}
+		transport, err = spawnExternal(id, config.Command)
+	default:
+		return nil, errors.New("Expected either the socket of the process or the command spawning it")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	thread := entities.NewThread(vm, transport, true)
+	if err := n.Clients.Add(thread); err != nil {
+		transport.Close()
+		return nil, err
+	}
+
+	go func() {
+		if err := n.listen(thread); err != nil {
+			log.Printf("ERROR: failed to start listener for external port %s: %v", id, err)
+		}
+	}()
+
+	return &vm, nil
+}
+
+// externalTransport exchanges length-prefixed frames with a helper process
+// over a stream socket. If the daemon spawned the process, the process is
+// killed when the transport is closed.
+type externalTransport struct {
+	conn net.Conn
+	cmd  *exec.Cmd
+	mu   sync.Mutex
+}
+
+// dialExternal connects to the stream socket a helper listens on.
+func dialExternal(path string) (*externalTransport, error) {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to %s: %s", path, err.Error())
+	}
+	return &externalTransport{conn: conn}, nil
+}
+
+// ReadFrame reads a frame sent by the process.
+func (t *externalTransport) ReadFrame(buffer []byte) (int, error) {
+	return readStreamFrame(t.conn, buffer)
+}
+
+// WriteFrame sends a frame to the process. A process that stops reading
+// its socket fails the write once writeTimeout expires.
+func (t *externalTransport) WriteFrame(frame []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	return writeStreamFrame(t.conn, frame)
+}
+
+// Close closes the socket, and kills the process if the daemon spawned it.
+func (t *externalTransport) Close() error {
+	err := t.conn.Close()
+	if t.cmd != nil && t.cmd.Process != nil {
+		t.cmd.Process.Kill()
+	}
+	return err
+}
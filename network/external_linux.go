@@ -0,0 +1,56 @@
+package network
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"syscall"
+)
+
+// externalFd is the file descriptor of the socket given to a spawned helper.
+const externalFd = 3
+
+// spawnExternal starts a helper process, handing it one end of a socket
+// pair as file descriptor 3.
+func spawnExternal(id string, command []string) (*externalTransport, error) {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_STREAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("error during creation of socket: %s", err.Error())
+	}
+	local := os.NewFile(uintptr(fds[0]), "external-"+id)
+	remote := os.NewFile(uintptr(fds[1]), "external-"+id+"-helper")
+	defer remote.Close()
+
+	args := make([]string, len(command))
+	for i, arg := range command {
+		args[i] = strings.ReplaceAll(arg, "{fd}", fmt.Sprint(externalFd))
+	}
+	cmd := exec.Command(args[0], args[1:]...)
+	cmd.ExtraFiles = []*os.File{remote}
+	cmd.Env = append(os.Environ(), fmt.Sprintf("QEMUUSERNET_FD=%d", externalFd))
+	cmd.Stdout = os.Stderr
+	cmd.Stderr = os.Stderr
+	if err := cmd.Start(); err != nil {
+		local.Close()
+		return nil, fmt.Errorf("cannot start %s: %s", args[0], err.Error())
+	}
+	log.Printf("INFO: External process %d started for %s", cmd.Process.Pid, id)
+
+	conn, err := net.FileConn(local)
+	local.Close()
+	if err != nil {
+		cmd.Process.Kill()
+		cmd.Wait()
+		return nil, err
+	}
+	t := &externalTransport{conn: conn, cmd: cmd}
+	go func() {
+		// The socket of the port is closed with the process, which removes the port
+		err := cmd.Wait()
+		log.Printf("INFO: External process of %s exited: %v", id, err)
+	}()
+	return t, nil
+}
@@ -0,0 +1,11 @@
+//go:build !linux
+
+package network
+
+import "errors"
+
+// spawnExternal is not supported on this system, the helpers must be
+// started separately and reached through their socket.
+func spawnExternal(id string, command []string) (*externalTransport, error) {
+	return nil, errors.New("Spawning helpers is only supported on Linux")
+}
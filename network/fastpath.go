@@ -0,0 +1,210 @@
+package network
+
+import (
+	"QemuUserNet/entities"
+	"QemuUserNet/modules"
+	"bytes"
+	"log"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// The frames are read from a VM in batches, several at once when its
+// transport is an entities.BatchReader, into buffers reused from batch to
+// batch. The headers of every frame are decoded without allocation, and the
+// frames no module selects, see modules.Selector, are switched at once: the
+// unicast ones are queued by destination and sent in batches when their
+// transport is an entities.BatchWriter. The other frames are decoded fully
+// and go through the modules.
+const (
+	batchBytes = 64 * 1024 // Memory of the buffers of a batch
+	maxBatch   = 32        // Largest number of frames of a batch
+)
+
+// broadcastMAC is the destination of the frames flooded to every port.
+var broadcastMAC = []byte{0xff, 0xff, 0xff, 0xff, 0xff, 0xff}
+
+// frameBatch holds the buffers a listener reads frames into.
+type frameBatch struct {
+	buffers [][]byte
+	lengths []int
+}
+
+// getBatch returns buffers for a batch of frames, reused from the previous
+// batches of the network.
+func (n *Network) getBatch() *frameBatch {
+	if batch, ok := n.batches.Get().(*frameBatch); ok {
+		return batch
+	}
+	size := max(1, min(maxBatch, batchBytes/n.MTU))
+	batch := &frameBatch{buffers: make([][]byte, size), lengths: make([]int, size)}
+	for i := range batch.buffers {
+		batch.buffers[i] = make([]byte, n.MTU)
+	}
+	return batch
+}
+
+// putBatch gives back the buffers of a batch whose frames were all sent.
+func (n *Network) putBatch(batch *frameBatch) {
+	n.batches.Put(batch)
+}
+
+// frameDecoder decodes the headers of the frames of a listener.
+type frameDecoder struct {
+	parser  *gopacket.DecodingLayerParser
+	eth     layers.Ethernet
+	ip4     layers.IPv4
+	ip6     layers.IPv6
+	tcp     layers.TCP
+	udp     layers.UDP
+	decoded []gopacket.LayerType
+	frame   modules.Frame
+}
+
+// newFrameDecoder creates a frameDecoder.
+func newFrameDecoder() *frameDecoder {
+	d := &frameDecoder{decoded: make([]gopacket.LayerType, 0, 4)}
+	d.parser = gopacket.NewDecodingLayerParser(layers.LayerTypeEthernet, &d.eth, &d.ip4, &d.ip6, &d.tcp, &d.udp)
+	d.parser.IgnoreUnsupported = true
+	return d
+}
+
+// decode decodes the headers of a frame received from sender. Returns nil if
+// the frame is not an Ethernet frame. The result is valid until the next
+// call.
+func (d *frameDecoder) decode(data []byte, sender *entities.Thread) *modules.Frame {
+	// The layers decoded before an error are kept
+	d.parser.DecodeLayers(data, &d.decoded)
+	if len(d.decoded) == 0 {
+		return nil
+	}
+	f := &d.frame
+	*f = modules.Frame{Sender: sender}
+	for _, layer := range d.decoded {
+		switch layer {
+		case layers.LayerTypeEthernet:
+			f.SrcMAC, f.DstMAC, f.EtherType = d.eth.SrcMAC, d.eth.DstMAC, d.eth.EthernetType
+		case layers.LayerTypeIPv4:
+			f.SrcIP, f.DstIP, f.Protocol = d.ip4.SrcIP, d.ip4.DstIP, d.ip4.Protocol
+		case layers.LayerTypeIPv6:
+			f.SrcIP, f.DstIP, f.Protocol = d.ip6.SrcIP, d.ip6.DstIP, d.ip6.NextHeader
+		case layers.LayerTypeTCP:
+			f.SrcPort, f.DstPort = uint16(d.tcp.SrcPort), uint16(d.tcp.DstPort)
+		case layers.LayerTypeUDP:
+			f.SrcPort, f.DstPort = uint16(d.udp.SrcPort), uint16(d.udp.DstPort)
+		}
+	}
+	return f
+}
+
+// outbox queues the unicast frames of a batch by destination.
+type outbox struct {
+	ports  []*entities.Thread
+	frames [][][]byte
+}
+
+// add queues a frame for port.
+func (o *outbox) add(port *entities.Thread, frame []byte) {
+	for i, p := range o.ports {
+		if p == port {
+			o.frames[i] = append(o.frames[i], frame)
+			return
+		}
+	}
+	o.ports = append(o.ports, port)
+	if len(o.frames) < len(o.ports) {
+		o.frames = append(o.frames, nil)
+	}
+	last := len(o.ports) - 1
+	o.frames[last] = append(o.frames[last][:0], frame)
+}
+
+// process forwards a frame received from thread, on the fast path if no
+// module selects it. Without a switch in the pipeline, such a frame is
+// dropped.
+func (n *Network) process(thread *entities.Thread, data []byte, decoder *frameDecoder, out *outbox) {
+	if frame := decoder.decode(data, thread); frame != nil && !n.selected(frame) {
+		if n.Pipeline.Switches() {
+			n.switchFrame(thread, data, frame, out)
+		}
+		return
+	}
+	// The frames queued before are sent first, to keep the order of the frames
+	n.flush(out)
+	n.forward(thread, data)
+}
+
+// selected checks if a module of the chain may process a frame. The ARP
+// packets are always processed, the modules and the port security learn and
+// check the addresses of the VMs from them, and so are the ICMPv6 packets
+// when the port security checks their NDP messages.
+func (n *Network) selected(frame *modules.Frame) bool {
+	return frame.EtherType == layers.EthernetTypeARP || n.PortSecurity != nil && isIcmpv6(frame) || n.Pipeline.Selects(frame)
+}
+
+// isIcmpv6 checks if a frame may carry an ICMPv6 message, possibly behind a
+// hop-by-hop header as the multicast listener reports are.
+func isIcmpv6(frame *modules.Frame) bool {
+	return frame.EtherType == layers.EthernetTypeIPv6 && (frame.Protocol == layers.IPProtocolICMPv6 || frame.Protocol == layers.IPProtocolIPv6HopByHop)
+}
+
+// switchFrame forwards a frame selected by no module like the switch module
+// does. The unicast frames are queued in out.
+func (n *Network) switchFrame(thread *entities.Thread, data []byte, frame *modules.Frame, out *outbox) {
+	if thread.Uplink {
+		// The hosts behind an uplink are reached through it
+		if frame.SrcMAC[0]&0x01 == 0 {
+			n.Clients.Learn(frame.SrcMAC.String(), thread)
+		}
+	} else if n.PortSecurity != nil && !n.PortSecurity.CheckFrame(thread, frame) {
+		return
+	}
+
+	if bytes.Equal(frame.DstMAC, broadcastMAC) {
+		n.Pipeline.Switched(modules.VerdictForward)
+		n.flush(out)
+		n.dispatch(thread, data, modules.All, nil)
+		return
+	}
+	client, err := n.Clients.GetPortByAddr(frame.DstMAC)
+	if err != nil {
+		// The destination may be a host behind an uplink not learned yet
+		if n.Clients.HasUplink() {
+			n.Pipeline.Switched(modules.VerdictForward)
+			n.flush(out)
+			n.dispatch(thread, data, modules.Others, nil)
+		} else {
+			n.Pipeline.Switched(modules.VerdictDrop)
+		}
+		return
+	}
+	n.Pipeline.Switched(modules.VerdictForward)
+	out.add(client, data)
+}
+
+// flush sends the frames queued in out.
+func (n *Network) flush(out *outbox) {
+	for i, port := range out.ports {
+		if err := n.sendFrames(port, out.frames[i]); err != nil {
+			log.Println(err.Error())
+		}
+		out.ports[i] = nil
+		out.frames[i] = out.frames[i][:0]
+	}
+	out.ports = out.ports[:0]
+}
+
+// sendFrames sends frames to the specified client, with one system call if
+// its transport is an entities.BatchWriter.
+func (n *Network) sendFrames(client *entities.Thread, frames [][]byte) error {
+	if writer, ok := client.Transport.(entities.BatchWriter); ok && len(frames) > 1 {
+		return n.writeError(client, writer.WriteFrames(frames))
+	}
+	for _, frame := range frames {
+		if err := n.send(client, frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
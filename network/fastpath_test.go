@@ -0,0 +1,157 @@
+package network
+
+import (
+	"QemuUserNet/entities"
+	"QemuUserNet/modules"
+	"net"
+	"os"
+	"syscall"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// discardTransport drops the frames sent to a port.
+type discardTransport struct{}
+
+func (discardTransport) ReadFrame(buffer []byte) (int, error) { select {} }
+func (discardTransport) WriteFrame(frame []byte) error        { return nil }
+func (discardTransport) WriteFrames(frames [][]byte) error    { return nil }
+func (discardTransport) Close() error                         { return nil }
+
+// benchNetwork returns a network with an ACL and a switch, and two ports.
+func benchNetwork(b *testing.B) (*Network, *entities.Thread) {
+	_, subnet, _ := net.ParseCIDR("10.10.10.0/24")
+	n := &Network{
+		Name:       "net-a",
+		MTU:        entities.DefaultMTU + 14,
+		Subnet:     subnet,
+		GatewayIP:  net.IP{10, 10, 10, 1},
+		GatewayMAC: net.HardwareAddr{0x52, 0x54, 0, 0x12, 0x34, 0xff},
+		Clients:    &entities.Clients{},
+		Pipeline:   modules.NewPipeline(),
+	}
+	acl, _ := modules.NewAcl(n.Clients)
+	sw, _ := modules.NewSwitch(n.Clients)
+	n.Pipeline.Insert("acl", acl, -1)
+	n.Pipeline.Insert("switch", sw, -1)
+	sender := entities.NewThread(entities.VM{ID: "vm1", Mac: vmMAC.String()}, discardTransport{}, false)
+	receiver := entities.NewThread(entities.VM{ID: "vm2", Mac: otherMAC.String()}, discardTransport{}, false)
+	for _, thread := range []*entities.Thread{sender, receiver} {
+		if err := n.Clients.Add(thread); err != nil {
+			b.Fatal(err)
+		}
+	}
+	return n, sender
+}
+
+// udpFrame builds a unicast UDP frame from the first port to the second.
+func udpFrame(b *testing.B, size int) []byte {
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: net.IP{10, 10, 10, 11}, DstIP: net.IP{10, 10, 10, 12}}
+	udp := &layers.UDP{SrcPort: 5000, DstPort: 5000}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	eth := &layers.Ethernet{SrcMAC: vmMAC, DstMAC: otherMAC, EthernetType: layers.EthernetTypeIPv4}
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, udp, gopacket.Payload(make([]byte, size))); err != nil {
+		b.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// BenchmarkFastPath forwards frames selected by no module: their headers are
+// decoded without allocation and the switch is bypassed.
+func BenchmarkFastPath(b *testing.B) {
+	n, sender := benchNetwork(b)
+	data := udpFrame(b, 1000)
+	decoder, out := newFrameDecoder(), &outbox{}
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n.process(sender, data, decoder, out)
+		n.flush(out)
+	}
+}
+
+// BenchmarkDecodePath forwards the same frames through the pipeline, fully
+// decoded, the path of the frames a module selects.
+func BenchmarkDecodePath(b *testing.B) {
+	n, sender := benchNetwork(b)
+	data := udpFrame(b, 1000)
+	b.ReportAllocs()
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		n.forward(sender, data)
+	}
+}
+
+// datagramPair returns the two ends of a pair of connected Unix datagram
+// sockets. A goroutine writes frames of size bytes to the first one until
+// the end of the benchmark.
+func datagramPair(b *testing.B, size int) *net.UnixConn {
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		b.Fatal(err)
+	}
+	var conns [2]*net.UnixConn
+	for i, fd := range fds {
+		file := os.NewFile(uintptr(fd), "socketpair")
+		conn, err := net.FileConn(file)
+		file.Close()
+		if err != nil {
+			b.Fatal(err)
+		}
+		conns[i] = conn.(*net.UnixConn)
+	}
+	go func() {
+		frame := make([]byte, size)
+		for {
+			if _, err := conns[0].Write(frame); err != nil {
+				return
+			}
+		}
+	}()
+	b.Cleanup(func() {
+		conns[0].Close()
+		conns[1].Close()
+	})
+	return conns[1]
+}
+
+// BenchmarkReadFrame reads the frames one per system call, an operation
+// being a frame.
+func BenchmarkReadFrame(b *testing.B) {
+	conn := datagramPair(b, 1514)
+	buffer := make([]byte, 1514)
+	b.ReportAllocs()
+	b.SetBytes(1514)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := conn.Read(buffer); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// BenchmarkReadFrames reads the frames in batches with recvmmsg, an
+// operation being a frame.
+func BenchmarkReadFrames(b *testing.B) {
+	conn := datagramPair(b, 1514)
+	buffers, lengths := make([][]byte, maxBatch), make([]int, maxBatch)
+	for i := range buffers {
+		buffers[i] = make([]byte, 1514)
+	}
+	var m mmsgBuffers
+	b.ReportAllocs()
+	b.SetBytes(1514)
+	b.ResetTimer()
+	for read := 0; read < b.N; {
+		count, err := recvmmsg(conn, &m, buffers, lengths, false)
+		if err != nil {
+			b.Fatal(err)
+		}
+		read += count
+	}
+}
@@ -0,0 +1,236 @@
+package network
+
+import (
+	"QemuUserNet/entities"
+	"QemuUserNet/qmp"
+	"encoding/json"
+	"errors"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// livenessPoll is the interval between two checks of the process of a VM,
+// and between two attempts to reach its QMP socket.
+const livenessPoll = time.Second
+
+// LivenessConfig describes how the power state of a VM is watched. Exactly
+// one of Qmp, Pid and Pidfile is set.
+type LivenessConfig struct {
+	Qmp     string        // QMP socket of the VM, watched for the SHUTDOWN and POWERDOWN events
+	Pid     int           // PID of the QEMU process, 0 if unused
+	Pidfile string        // File containing the PID of the QEMU process
+	Grace   time.Duration // Time a powered off VM stays connected, in case it comes back
+}
+
+// powerState is the power state of a VM reported by a liveness source.
+type powerState int
+
+const (
+	poweredOn   powerState = iota // The VM is running, or paused
+	poweringOff                   // The VM was asked to power off
+	poweredOff                    // The VM is powered off, or QEMU exited
+)
+
+// livenessSource reports the power state of a VM, each time it changes,
+// until done is closed.
+type livenessSource func(done <-chan struct{}, report func(powerState))
+
+// Watch makes the power state of a VM decide when its network card leaves
+// the network, instead of the errors of its sockets. The port of the card is
+// stale as soon as the VM is seen powering off, and the card is removed once
+// the VM has been powered off for the grace period.
+func (n *Network) Watch(id string, index int, config LivenessConfig) error {
+	client, err := n.Clients.GetClientByNIC(id, index)
+	if err != nil {
+		return err
+	}
+
+	var source livenessSource
+	switch {
+	case config.Qmp != "" && config.Pid == 0 && config.Pidfile == "":
+		source = qmpSource(config.Qmp)
+	case config.Pid > 0 && config.Qmp == "" && config.Pidfile == "":
+		source = processSource(func() (int, error) { return config.Pid, nil })
+	case config.Pidfile != "" && config.Qmp == "" && config.Pid == 0:
+		source = processSource(func() (int, error) { return readPidfile(config.Pidfile) })
+	default:
+		return errors.New("Expected one of a QMP socket, a PID or a pidfile")
+	}
+	if config.Grace < 0 {
+		return errors.New("The grace period cannot be negative")
+	}
+
+	client.SetWatched()
+	go n.watch(client, source, config.Grace)
+	return nil
+}
+
+// watch applies the power states reported by source to the thread of a VM
+// until the thread is stopped.
+func (n *Network) watch(thread *entities.Thread, source livenessSource, grace time.Duration) {
+	states := make(chan powerState)
+	go source(thread.Done, func(state powerState) {
+		select {
+		case states <- state:
+		case <-thread.Done:
+		}
+	})
+
+	var removal <-chan time.Time
+	for {
+		select {
+		case <-thread.Done:
+			return
+		case state := <-states:
+			switch state {
+			case poweredOn:
+				// The port is active again with the next frame of the VM
+				if state, _ := thread.State(); state == entities.PortStale {
+					log.Println("INFO: VM running again: " + thread.VM.Name())
+					thread.SetState(entities.PortWaiting)
+				}
+				removal = nil
+			case poweringOff:
+				log.Println("INFO: VM powering off: " + thread.VM.Name())
+				thread.SetState(entities.PortStale)
+			case poweredOff:
+				if removal == nil {
+					log.Println("INFO: VM powered off: " + thread.VM.Name())
+					removal = time.After(grace)
+				}
+				thread.SetState(entities.PortStale)
+			}
+		case <-removal:
+			log.Println("INFO: VM removed after power off: " + thread.VM.Name())
+			n.removeThread(thread)
+			return
+		}
+	}
+}
+
+// qmpSource watches the QMP socket of a VM. The VM is powered off when QEMU
+// reports it, or when the socket cannot be reached.
+func qmpSource(path string) livenessSource {
+	return func(done <-chan struct{}, report func(powerState)) {
+		last := powerState(-1)
+		update := func(state powerState) {
+			if state != last {
+				last = state
+				report(state)
+			}
+		}
+		for {
+			if m, err := qmp.Open(path); err != nil {
+				update(poweredOff)
+			} else {
+				watchMonitor(m, done, update)
+				m.Release()
+			}
+			select {
+			case <-done:
+				return
+			case <-time.After(livenessPoll):
+			}
+		}
+	}
+}
+
+// watchMonitor reports the power state of a VM from the events of its
+// monitor, until the connection is closed or done is closed.
+func watchMonitor(m *qmp.Monitor, done <-chan struct{}, update func(powerState)) {
+	events, unsubscribe := m.Subscribe()
+	defer unsubscribe()
+
+	if result, err := m.Execute("query-status", nil); err == nil {
+		var status struct {
+			Status string `json:"status"`
+		}
+		if json.Unmarshal(result, &status) == nil && status.Status == "shutdown" {
+			update(poweredOff)
+		} else {
+			update(poweredOn)
+		}
+	}
+	for {
+		select {
+		case <-done:
+			return
+		case <-m.Done():
+			update(poweredOff)
+			return
+		case event := <-events:
+			switch event.Event {
+			case "POWERDOWN":
+				update(poweringOff)
+			case "SHUTDOWN":
+				update(poweredOff)
+			case "RESET", "RESUME":
+				update(poweredOn)
+			}
+		}
+	}
+}
+
+// processSource polls the process of a VM. The VM is powered off when the
+// process no longer exists, or when its PID was reused by another process.
+func processSource(pid func() (int, error)) livenessSource {
+	return func(done <-chan struct{}, report func(powerState)) {
+		last := powerState(-1)
+		watched, started := 0, ""
+		ticker := time.NewTicker(livenessPoll)
+		defer ticker.Stop()
+		for {
+			state := poweredOff
+			if p, err := pid(); err == nil {
+				if start, err := processStart(p); err == nil {
+					if p != watched {
+						watched, started = p, start
+					}
+					if start == started {
+						state = poweredOn
+					}
+				}
+			}
+			if state != last {
+				last = state
+				report(state)
+			}
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+			}
+		}
+	}
+}
+
+// readPidfile reads the PID written in a file by QEMU -pidfile.
+func readPidfile(path string) (int, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(data)))
+}
+
+// processStart returns the start time of a running process, which tells it
+// apart from a later process given the same PID. Zombies are not running.
+func processStart(pid int) (string, error) {
+	data, err := os.ReadFile("/proc/" + strconv.Itoa(pid) + "/stat")
+	if err != nil {
+		return "", err
+	}
+	// The name of the process is in parentheses and may contain spaces
+	stat := string(data)
+	fields := strings.Fields(stat[strings.LastIndexByte(stat, ')')+1:])
+	if len(fields) < 20 {
+		return "", errors.New("Invalid process status")
+	}
+	if fields[0] == "Z" || fields[0] == "X" {
+		return "", errors.New("The process exited")
+	}
+	return fields[19], nil
+}
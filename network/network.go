@@ -7,9 +7,11 @@ import (
 	"QemuUserNet/tools"
 	"errors"
 	"fmt"
+	"io"
 	"log"
 	"net"
-	"os"
+	"sync"
+	"time"
 
 	"github.com/google/gopacket"
 	"github.com/google/gopacket/layers"
@@ -19,23 +21,69 @@ import (
 // Network represents a virtual network.
 type Network struct {
 	Name                 string
-	MTU                  int
+	MTU                  int // Largest frame of the network, with its Ethernet header
+	Subnet               *net.IPNet
+	GatewayIP            net.IP
+	GatewayMAC           net.HardwareAddr
 	Clients              *entities.Clients
-	Modules              []modules.Module
+	Pipeline             *modules.Pipeline // Modules the frames go through, in order
 	DisconnectOnPowerOff bool
+	PortSecurity         *PortSecurity // Source address enforcement, nil when disabled
+	StaleTimeout         time.Duration // Time without frames after which a port is stale, 0 to never be
+	CleanupAfter         time.Duration // Time after which a stale or disconnected port is removed, 0 to keep it
+	done                 chan struct{} // Stops the supervision of the ports, see Start
+	batches              sync.Pool     // Buffers of the listeners, see getBatch
 }
 
-// AddVM adds a new virtual machine to the network.
-func (n *Network) AddVM(id string) (*entities.VM, error) {
-	// Check if the ID is already used
-	if _, err := n.Clients.GetClientByID(id); err == nil {
+// stopTimeout bounds the time a removal waits for the listener of a port to
+// return once its sockets are closed.
+const stopTimeout = 5 * time.Second
+
+// AddVM adds a network card of a virtual machine to the network. A negative
+// index selects the first index unused by the VM on this network, and empty
+// model and netdev id select the defaults. transport is the kind of sockets
+// used to exchange frames with QEMU, TransportDgram, TransportStream,
+// TransportUDP or TransportVhostUser.
+func (n *Network) AddVM(id string, nic entities.NIC, transport string) (*entities.VM, error) {
+	// Check if the card is already connected
+	if existing, err := n.Clients.GetClientByID(id); err == nil && existing.Uplink {
 		return nil, errors.New("This ID is already used")
 	}
+	if nic.Index < 0 {
+		nic.Index = 0
+		for _, client := range n.Clients.GetClientsByID(id) {
+			if client.VM.NIC.Index == nic.Index {
+				nic.Index++
+			}
+		}
+	}
+	if _, err := n.Clients.GetClientByNIC(id, nic.Index); err == nil {
+		return nil, errors.New("This NIC of the VM is already connected")
+	}
+	if nic.Model == "" {
+		nic.Model = entities.DefaultNICModel
+	}
 
 	// Generate unique socket identifiers
 	uuid := uuid.New().String()
+	if nic.NetdevID == "" {
+		// QEMU ids must start with a letter
+		nic.NetdevID = "net-" + uuid
+	} else if !validNetdevID(nic.NetdevID) {
+		return nil, errors.New("Invalid netdev id, expected a letter followed by letters, digits, '-', '.' or '_'")
+	} else if _, err := n.Clients.GetClientByNetdevID(nic.NetdevID); err == nil {
+		return nil, errors.New("This netdev id is already used")
+	}
 	var localSock = "/tmp/QemuUserNet_" + uuid + ".local"
 	var remoteSock = "/tmp/QemuUserNet_" + uuid + ".remote"
+	switch transport {
+	case entities.TransportStream, entities.TransportVhostUser:
+		// A stream socket carries the frames in both directions
+		localSock = ""
+	case entities.TransportUDP:
+		// The UDP addresses are chosen when the sockets are created
+		localSock, remoteSock = "", ""
+	}
 
 	// Generate a new MAC address
 	mac, err := n.getNewMac()
@@ -44,155 +92,374 @@ func (n *Network) AddVM(id string) (*entities.VM, error) {
 	}
 
 	// Create a new VM and its associated thread
-	vm := entities.VM{ID: id, Mac: mac, Socket: uuid, LocalSocket: localSock, RemoteSocket: remoteSock, Ip: nil, LocalSock: nil}
-	thread := &entities.Thread{VM: vm, Active: false, Done: make(chan struct{})}
-	n.Clients.Threads = append(n.Clients.Threads, thread)
+	vm := entities.VM{ID: id, NIC: nic, Mac: mac, Socket: uuid, LocalSocket: localSock, RemoteSocket: remoteSock, Transport: transport, Ip: nil}
+	thread, err := n.addVM(vm)
+	if err != nil {
+		return nil, err
+	}
+	// The UDP addresses are stored when the sockets are created
+	vm = thread.CurrentVM()
+	return &vm, nil
+}
+
+// addVM opens the sockets of a VM, adds its thread to the network and starts
+// listening for its frames. Returns the thread of the VM.
+func (n *Network) addVM(vm entities.VM) (*entities.Thread, error) {
+	sockets, err := newTransport(&vm)
+	if err != nil {
+		return nil, err
+	}
+	return n.addThread(vm, sockets)
+}
+
+// addThread adds the thread of a VM whose sockets are open to the network and
+// starts listening for its frames. The sockets are closed on error.
+func (n *Network) addThread(vm entities.VM, sockets entities.Transport) (*entities.Thread, error) {
+	thread := entities.NewThread(vm, sockets, false)
+	if err := n.Clients.Add(thread); err != nil {
+		// Another card was connected meanwhile
+		sockets.Close()
+		return nil, err
+	}
 
 	// Start the listener in a new goroutine
 	go func() {
 		if err := n.listen(thread); err != nil {
-			log.Printf("ERROR: failed to start listener for VM %s: %v", id, err)
+			log.Printf("ERROR: failed to start listener for VM %s: %v", vm.ID, err)
 		}
 	}()
+	return thread, nil
+}
 
-	return &vm, nil
+// validNetdevID checks that an id is accepted by QEMU for a netdev.
+func validNetdevID(id string) bool {
+	for i, c := range id {
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z':
+		case i > 0 && (c >= '0' && c <= '9' || c == '-' || c == '.' || c == '_'):
+		default:
+			return false
+		}
+	}
+	return id != ""
+}
+
+// BindIP statically binds an IP address of the subnet to a network card of a
+// VM. The card is then the only one allowed to use this address, and DHCP
+// offers it to the card.
+func (n *Network) BindIP(id string, index int, ip string) error {
+	addr := net.ParseIP(ip)
+	if addr == nil || addr.To4() == nil {
+		return errors.New("Invalid IP address")
+	}
+	if n.Subnet != nil && !n.Subnet.Contains(addr) {
+		return errors.New("The IP address is not in the subnet of the network")
+	}
+	if addr.Equal(n.GatewayIP) {
+		return errors.New("The IP address is used by the gateway")
+	}
+	client, err := n.Clients.GetClientByNIC(id, index)
+	if err != nil {
+		return err
+	}
+	if other, err := n.Clients.GetClientByIP(addr.String()); err == nil && other != client {
+		return errors.New("The IP address is already used by " + other.VM.Name())
+	}
+	return n.Clients.SetIP(client, addr.String(), true)
 }
 
-// RemoveVM removes a virtual machine from the network by its ID.
+// RemoveVM removes all the network cards of a virtual machine from the
+// network by its ID.
 func (n *Network) RemoveVM(id string) error {
-	client, err := n.Clients.GetClientByID(id)
+	clients := n.Clients.GetClientsByID(id)
+	if len(clients) == 0 {
+		return errors.New("VM not found")
+	}
+	for _, client := range clients {
+		if err := n.removeThread(client); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// RemoveNIC removes a network card of a virtual machine from the network.
+func (n *Network) RemoveNIC(id string, index int) error {
+	client, err := n.Clients.GetClientByNIC(id, index)
 	if err != nil {
 		return err
 	}
-	return n.stopThread(client)
+	return n.removeThread(client)
 }
 
-// Stop stops all running threads in the network.
+// Stop stops all running threads in the network, and the supervision of its
+// ports.
 func (n *Network) Stop() error {
+	if n.done != nil {
+		close(n.done)
+		n.done = nil
+	}
 	var stopErrors []error
-	for _, client := range n.Clients.Threads {
+	clients := n.Clients.Threads()
+	for _, client := range clients {
 		err := n.stopThread(client)
 		if err != nil {
 			stopErrors = append(stopErrors, err)
 		}
 	}
+	for _, client := range clients {
+		n.waitThread(client)
+	}
 	if len(stopErrors) > 0 {
 		return fmt.Errorf("WARNONG: failed to stop some threads: %v", stopErrors)
 	}
 	return nil
 }
 
-// listen starts listening for packets on the VM's remote socket.
+// listen starts listening for packets on the transport of the VM.
 func (n *Network) listen(thread *entities.Thread) error {
-	log.Println("INFO: Thread started : " + thread.VM.ID)
-	if _, err := os.Stat(thread.VM.RemoteSocket); err == nil {
-		os.Remove(thread.VM.RemoteSocket)
+	log.Println("INFO: Thread started : " + thread.VM.Name())
+	defer thread.Exit()
+	defer thread.Transport.Close()
+	if thread.Uplink {
+		thread.SetState(entities.PortActive)
+	} else {
+		thread.SetState(entities.PortWaiting)
 	}
 
-	recv, err := net.ListenUnixgram("unixgram", &net.UnixAddr{thread.VM.RemoteSocket, "unixgram"})
-	if err != nil {
-		log.Println("WARNING: error during creation of socket: ", err.Error())
-		return err
-	}
-
-	defer func() {
-		recv.Close()
-		os.Remove(thread.VM.RemoteSocket)
-	}()
-
+	reader, batched := thread.Transport.(entities.BatchReader)
+	decoder := newFrameDecoder()
+	var out outbox
 	for {
 		select {
 		case <-thread.Done:
 			log.Println("INFO: Thread stopped: " + thread.VM.Socket)
 			return nil
 		default:
-			data := make([]byte, n.MTU)
-			_, _, err := recv.ReadFromUnix(data)
+			batch := n.getBatch()
+			count := 1
+			var err error
+			if batched {
+				count, err = reader.ReadFrames(batch.buffers, batch.lengths)
+			} else {
+				batch.lengths[0], err = thread.Transport.ReadFrame(batch.buffers[0])
+			}
 
 			if err != nil {
-				log.Println("WARNING: error during reading: ", err.Error())
-			}
-			packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
-
-			var receiver modules.Receiver
-			var request []byte
-			var client *entities.Thread
-			for _, module := range n.Modules {
-				request, receiver, client, err = module.Listen(packet)
-				if err != nil {
+				n.putBatch(batch)
+				select {
+				case <-thread.Done:
 					continue
+				default:
 				}
-				break
-			}
-
-			switch receiver {
-			case modules.Nobody:
-			case modules.Explicit:
-				err = n.send(client, request)
-				if err != nil {
-					log.Println(err.Error())
+				// The stream of a VM is closed when QEMU exits
+				if errors.Is(err, io.EOF) && n.DisconnectOnPowerOff && !thread.Watched() {
+					log.Println("INFO: VM powered off: " + thread.VM.ID)
+					n.stopThread(thread)
+					continue
 				}
-			case modules.Himself:
-				err = n.send(thread, request)
-				if err != nil {
-					log.Println(err.Error())
+				// An uplink cannot connect again once its process exited
+				if errors.Is(err, io.EOF) && thread.Uplink {
+					log.Println("INFO: Uplink closed: " + thread.VM.ID)
+					n.stopThread(thread)
+					continue
 				}
-			case modules.All:
-				for _, x := range n.Clients.Threads {
-					err = n.send(x, request)
-					if err != nil {
-						log.Println(err.Error())
-					}
+				// The port is kept, QEMU may connect again
+				if errors.Is(err, io.EOF) {
+					log.Println("INFO: VM disconnected: " + thread.VM.Name())
+					thread.SetState(entities.PortDisconnected)
+					continue
 				}
-			default:
-				for _, x := range n.Clients.Threads {
-					if x.VM != thread.VM {
-						err = n.send(x, request)
-						if err != nil {
-							log.Println(err.Error())
-						}
-					}
+				log.Println("WARNING: error during reading: ", err.Error())
+				continue
+			}
+			thread.Received()
+			for i := 0; i < count; i++ {
+				if batch.lengths[i] > 0 {
+					n.process(thread, batch.buffers[i][:batch.lengths[i]], decoder, &out)
 				}
 			}
+			// The buffers are reused once their frames are sent
+			n.flush(&out)
+			n.putBatch(batch)
 		}
 	}
 }
 
-// send sends data to the specified client's local socket.
-func (n *Network) send(client *entities.Thread, data []byte) error {
-	if client.VM.LocalSock == nil {
-		sock, err := net.DialUnix("unixgram", nil, &net.UnixAddr{client.VM.LocalSocket, "unixgram"})
-		if err != nil {
-			return fmt.Errorf("WARNING: error during creation of socket: %s", err.Error())
+// forward passes a frame received from thread through the modules and
+// delivers it.
+func (n *Network) forward(thread *entities.Thread, data []byte) {
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	if thread.Uplink {
+		// The hosts behind an uplink are reached through it
+		if eth, ok := packet.Layer(layers.LayerTypeEthernet).(*layers.Ethernet); ok && eth.SrcMAC[0]&0x01 == 0 {
+			n.Clients.Learn(eth.SrcMAC.String(), thread)
 		}
-		client.VM.LocalSock = sock
-		log.Println("INFO: Opened LocalSocket for ", client.VM.ID)
+	} else if n.PortSecurity != nil && !n.PortSecurity.Check(thread, packet) {
+		return
+	}
+
+	if result := n.Pipeline.Process(packet); result.Verdict == modules.VerdictForward {
+		n.dispatch(thread, result.Data, result.Receiver, result.Client)
 	}
-	length, err := client.VM.LocalSock.Write(data)
+}
+
+// dispatch delivers data to the clients selected by receiver. sender is the
+// thread the frame came from, and client the target of an Explicit receiver.
+func (n *Network) dispatch(sender *entities.Thread, data []byte, receiver modules.Receiver, client *entities.Thread) {
+	switch receiver {
+	case modules.Nobody:
+	case modules.Explicit:
+		if err := n.send(client, data); err != nil {
+			log.Println(err.Error())
+		}
+	case modules.Himself:
+		if err := n.send(sender, data); err != nil {
+			log.Println(err.Error())
+		}
+	case modules.All:
+		for _, x := range n.Clients.Threads() {
+			// A frame is never sent back to the uplink it came from
+			if x == sender && x.Uplink {
+				continue
+			}
+			if err := n.send(x, data); err != nil {
+				log.Println(err.Error())
+			}
+		}
+	default:
+		for _, x := range n.Clients.Threads() {
+			if x != sender {
+				if err := n.send(x, data); err != nil {
+					log.Println(err.Error())
+				}
+			}
+		}
+	}
+}
+
+// Inject delivers a frame that does not come from a VM of the network, such
+// as a frame emitted by a router. The destination is chosen from the
+// Ethernet destination address: broadcast and multicast frames reach every
+// client, unicast frames reach the client owning the MAC address. The frames
+// denied by an ACL of the network are dropped.
+func (n *Network) Inject(data []byte) error {
+	if len(data) < 14 {
+		return errors.New("Frame too short")
+	}
+	if !n.filter(data) {
+		return nil
+	}
+	dst := net.HardwareAddr(data[0:6])
+	if dst[0]&0x01 == 1 {
+		n.dispatch(nil, data, modules.All, nil)
+		return nil
+	}
+	client, err := n.Clients.GetPortByAddr(dst)
 	if err != nil {
-		if n.DisconnectOnPowerOff {
-			return n.stopThread(client)
+		return err
+	}
+	n.dispatch(nil, data, modules.Explicit, client)
+	return nil
+}
+
+// filter checks if the ACLs of the network let an injected frame through.
+func (n *Network) filter(data []byte) bool {
+	for _, module := range n.Pipeline.Modules() {
+		if acl, ok := module.(*modules.Acl); ok && !acl.Filter(data) {
+			return false
 		}
-		return fmt.Errorf("WARNING: error during writing : %s", err.Error())
 	}
-	if length != len(data) {
-		return errors.New("Package not send completely")
+	return true
+}
+
+// Receive passes a frame received from a peer daemon through the port
+// security and the modules like the frames of the ports, then delivers it.
+// The answers of the modules to the sender of the frame cannot reach it and
+// are dropped: the peer answers its own VMs.
+func (n *Network) Receive(data []byte) {
+	packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+	if n.PortSecurity != nil && !n.PortSecurity.CheckRemote(packet, n.Clients, n.GatewayIP, n.GatewayMAC) {
+		return
+	}
+	if result := n.Pipeline.Process(packet); result.Verdict == modules.VerdictForward && result.Receiver != modules.Himself {
+		n.dispatch(nil, result.Data, result.Receiver, result.Client)
 	}
+}
 
-	return nil
+// InsertModule adds a module named name to the network, just before the
+// switch so that it sees frames before they are forwarded, or at the end of
+// the pipeline if there is no switch.
+func (n *Network) InsertModule(name string, module modules.Module) error {
+	return n.Pipeline.Insert(name, module, n.Pipeline.Index("switch"))
+}
+
+// RemoveModule removes a module previously added with InsertModule.
+func (n *Network) RemoveModule(module modules.Module) {
+	n.Pipeline.RemoveModule(module)
+}
+
+// ModuleChain returns the modules of the network, in order. The slice must
+// not be modified.
+func (n *Network) ModuleChain() []modules.Module {
+	return n.Pipeline.Modules()
+}
+
+// send sends data to the specified client through its transport.
+func (n *Network) send(client *entities.Thread, data []byte) error {
+	return n.writeError(client, client.Transport.WriteFrame(data))
+}
+
+// writeError handles the error of a write to client, nil if the write
+// succeeded.
+func (n *Network) writeError(client *entities.Thread, err error) error {
+	if err == nil {
+		return nil
+	}
+	// A VM that is not started yet is not powered off, and the power state of
+	// a watched VM is known
+	if n.DisconnectOnPowerOff && !client.Watched() && !errors.Is(err, errNotConnected) {
+		return n.stopThread(client)
+	}
+	if peerGone(err) {
+		client.SetState(entities.PortDisconnected)
+	}
+	return fmt.Errorf("WARNING: error during writing : %s", err.Error())
 }
 
 // stopThread stops the specified client's thread and cleans up resources.
 func (n *Network) stopThread(client *entities.Thread) error {
-	var err error
-	client.Stop()
-	for _, module := range n.Modules {
+	// The port may be removed at once by its VM, the supervision and a command
+	if !client.Stop() {
+		return errors.New("VM not found")
+	}
+	client.SetState(entities.PortDisconnected)
+	for _, module := range n.ModuleChain() {
 		module.Quit(client)
 	}
-	*n.Clients, err = n.Clients.RemoveClient(client)
+	if n.PortSecurity != nil {
+		n.PortSecurity.Forget(client.VM.Name())
+	}
+	return n.Clients.RemoveClient(client)
+}
+
+// removeThread stops a thread like stopThread, then waits for its listener to
+// return, so that the sockets of the VM are closed and their files removed
+// when the removal is reported. It is never called by a listener, which
+// would wait for itself, or for a listener waiting for it.
+func (n *Network) removeThread(client *entities.Thread) error {
+	err := n.stopThread(client)
+	n.waitThread(client)
 	return err
 }
 
+// waitThread waits for the listener of a stopped thread to return.
+func (n *Network) waitThread(client *entities.Thread) {
+	if !client.WaitExit(stopTimeout) {
+		log.Println("WARNING: the listener of " + client.VM.Name() + " did not stop")
+	}
+}
+
 // getNewMac generates a new unique MAC address for a VM.
 func (n *Network) getNewMac() (string, error) {
 	for {
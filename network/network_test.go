@@ -0,0 +1,97 @@
+package network
+
+import (
+	"QemuUserNet/entities"
+	"QemuUserNet/modules"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// countTransport counts the frames sent to a port.
+type countTransport struct {
+	frames atomic.Int32
+}
+
+func (c *countTransport) ReadFrame(buffer []byte) (int, error) { select {} }
+func (c *countTransport) WriteFrame(frame []byte) error        { c.frames.Add(1); return nil }
+func (c *countTransport) Close() error                         { return nil }
+
+// tcpFrame builds a TCP segment between two hosts.
+func tcpFrame(t *testing.T, srcMAC, dstMAC net.HardwareAddr, src, dst net.IP, srcPort, dstPort layers.TCPPort) []byte {
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolTCP, SrcIP: src, DstIP: dst}
+	tcp := &layers.TCP{SrcPort: srcPort, DstPort: dstPort, SYN: true, Window: 65535}
+	tcp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	eth := &layers.Ethernet{SrcMAC: srcMAC, DstMAC: dstMAC, EthernetType: layers.EthernetTypeIPv4}
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, tcp); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+// TestInjectAcl checks that the frames injected by the NAT, the port
+// forwards and the routers go through the ACL of the network.
+func TestInjectAcl(t *testing.T) {
+	_, subnet, _ := net.ParseCIDR("10.10.10.0/24")
+	n := &Network{
+		Name:       "net-a",
+		MTU:        entities.DefaultMTU + 14,
+		Subnet:     subnet,
+		GatewayIP:  net.IP{10, 10, 10, 1},
+		GatewayMAC: net.HardwareAddr{0x52, 0x54, 0, 0x12, 0x34, 0xff},
+		Clients:    &entities.Clients{},
+		Pipeline:   modules.NewPipeline(),
+	}
+	acl, _ := modules.NewAcl(n.Clients)
+	n.Pipeline.Insert("acl", acl, -1)
+	vm, other := &countTransport{}, &countTransport{}
+	sender := entities.NewThread(entities.VM{ID: "vm1", Mac: vmMAC.String()}, vm, false)
+	for _, thread := range []*entities.Thread{sender, entities.NewThread(entities.VM{ID: "vm2", Mac: otherMAC.String()}, other, false)} {
+		if err := n.Clients.Add(thread); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	vmIP, remote := net.IP{10, 10, 10, 11}, net.IP{192, 0, 2, 1}
+	rules := []modules.AclRule{
+		{Action: modules.AclAllow, Src: "vm:vm1", Protocol: "tcp", DstPort: "443", Stateful: true},
+		{Action: modules.AclDeny, Dst: "vm:vm1"},
+	}
+	for _, rule := range rules {
+		if _, err := acl.Add(rule); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name    string
+		opened  bool // The VM opens the connection first
+		dstMAC  net.HardwareAddr
+		srcPort layers.TCPPort
+		port    *countTransport
+		allow   bool
+	}{
+		{"denied", false, vmMAC, 443, vm, false},
+		{"other vm", false, otherMAC, 443, other, true},
+		{"answer", true, vmMAC, 443, vm, true},
+		{"other connection", true, vmMAC, 80, vm, false},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if test.opened {
+				n.forward(sender, tcpFrame(t, vmMAC, n.GatewayMAC, vmIP, remote, 40000, test.srcPort))
+			}
+			before := test.port.frames.Load()
+			if err := n.Inject(tcpFrame(t, n.GatewayMAC, test.dstMAC, remote, vmIP, test.srcPort, 40000)); err != nil {
+				t.Fatal(err)
+			}
+			if allowed := test.port.frames.Load() > before; allowed != test.allow {
+				t.Fatalf("delivered %v, want %v", allowed, test.allow)
+			}
+		})
+	}
+}
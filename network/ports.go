@@ -0,0 +1,84 @@
+package network
+
+import (
+	"QemuUserNet/entities"
+	"errors"
+	"log"
+	"syscall"
+	"time"
+)
+
+// supervisePeriod is the interval between two checks of the ports.
+const supervisePeriod = time.Second
+
+// Start starts the supervision of the ports of the network: the ports idle
+// for StaleTimeout become stale, and the ports stale or disconnected for
+// CleanupAfter are removed. The supervision is stopped by Stop.
+func (n *Network) Start() {
+	n.done = make(chan struct{})
+	go n.supervise(n.done)
+}
+
+// supervise checks the ports periodically until done is closed.
+func (n *Network) supervise(done chan struct{}) {
+	ticker := time.NewTicker(supervisePeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			n.checkPorts()
+		}
+	}
+}
+
+// checkPorts applies the idle timeout and the automatic cleanup to the ports
+// of the VMs. The uplinks are never stale.
+func (n *Network) checkPorts() {
+	threads := n.Clients.Threads()
+	for _, thread := range threads {
+		if thread.Uplink {
+			continue
+		}
+		if n.StaleTimeout > 0 && thread.ExpireIdle(n.StaleTimeout) {
+			log.Println("INFO: Port stale: " + thread.VM.Name())
+		}
+		state, since := thread.State()
+		if n.CleanupAfter > 0 && (state == entities.PortStale || state == entities.PortDisconnected) && time.Since(since) >= n.CleanupAfter {
+			log.Println("INFO: Port removed after being " + string(state) + ": " + thread.VM.Name())
+			n.removeThread(thread)
+		}
+	}
+}
+
+// PrunedPort is a port removed by Prune.
+type PrunedPort struct {
+	Name  string             // Name of the network card of the port
+	State entities.PortState // State of the port when it was removed
+}
+
+// Prune removes the ports of the VMs that are stale or disconnected.
+// Returns the removed ports.
+func (n *Network) Prune() []PrunedPort {
+	var removed []PrunedPort
+	threads := n.Clients.Threads()
+	for _, thread := range threads {
+		if thread.Uplink {
+			continue
+		}
+		if state, _ := thread.State(); state == entities.PortStale || state == entities.PortDisconnected {
+			if err := n.removeThread(thread); err == nil {
+				removed = append(removed, PrunedPort{Name: thread.VM.Name(), State: state})
+			}
+		}
+	}
+	return removed
+}
+
+// peerGone checks if a write error means that QEMU closed the sockets of the
+// VM, rather than a transient failure.
+func peerGone(err error) bool {
+	return errors.Is(err, syscall.ECONNREFUSED) || errors.Is(err, syscall.ECONNRESET) ||
+		errors.Is(err, syscall.EPIPE) || errors.Is(err, syscall.ENOENT)
+}
@@ -0,0 +1,308 @@
+package network
+
+import (
+	"QemuUserNet/entities"
+	"QemuUserNet/modules"
+	"QemuUserNet/tools"
+	"bytes"
+	"fmt"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// maxPortSecurityEvents is the number of drop events kept for inspection.
+const maxPortSecurityEvents = 32
+
+// PortSecurity drops the frames a VM sends with a source address it does not
+// own: the source MAC must be the MAC assigned to the VM, and the source IP
+// the address leased by DHCP or bound when the VM was connected, or for
+// IPv6 the link-local address derived from the MAC. ARP packets and NDP
+// messages must announce the same addresses, which prevents gratuitous ARP
+// and neighbor advertisement spoofing.
+type PortSecurity struct {
+	mu     sync.Mutex
+	drops  map[string]map[string]uint64
+	events []string
+}
+
+// NewPortSecurity creates a new PortSecurity instance.
+func NewPortSecurity() *PortSecurity {
+	return &PortSecurity{drops: make(map[string]map[string]uint64)}
+}
+
+// Check returns false if the frame must be dropped because it was sent
+// from thread with addresses the VM does not own.
+func (p *PortSecurity) Check(thread *entities.Thread, packet gopacket.Packet) bool {
+	ethLayer := packet.Layer(layers.LayerTypeEthernet)
+	if ethLayer == nil {
+		return p.drop(thread.VM.Name(), "malformed", "not an Ethernet frame")
+	}
+	eth := ethLayer.(*layers.Ethernet)
+	if eth.SrcMAC.String() != thread.VM.Mac {
+		return p.drop(thread.VM.Name(), "mac", "source MAC "+eth.SrcMAC.String())
+	}
+
+	if arpLayer := packet.Layer(layers.LayerTypeARP); arpLayer != nil {
+		arp := arpLayer.(*layers.ARP)
+		if net.HardwareAddr(arp.SourceHwAddress).String() != thread.VM.Mac {
+			return p.drop(thread.VM.Name(), "arp", "ARP sender MAC "+net.HardwareAddr(arp.SourceHwAddress).String())
+		}
+		// Probes announce no address, see RFC 5227
+		ip := net.IP(arp.SourceProtAddress)
+		if !ip.Equal(net.IPv4zero) && !ownsIP(thread, ip) {
+			return p.drop(thread.VM.Name(), "arp", "ARP sender IP "+ip.String())
+		}
+		return true
+	}
+
+	if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
+		ip := ipLayer.(*layers.IPv4)
+		if ownsIP(thread, ip.SrcIP) || isDhcpRequest(packet, ip) {
+			return true
+		}
+		return p.drop(thread.VM.Name(), "ip", "source IP "+ip.SrcIP.String())
+	}
+
+	if ipLayer := packet.Layer(layers.LayerTypeIPv6); ipLayer != nil {
+		ip := ipLayer.(*layers.IPv6)
+		if !p.checkNdp(thread, eth.SrcMAC, packet) {
+			return false
+		}
+		if ownsIPv6(thread, eth.SrcMAC, ip.SrcIP) || ip.SrcIP.Equal(net.IPv6unspecified) && isUnspecifiedAllowed(packet) {
+			return true
+		}
+		return p.drop(thread.VM.Name(), "ip", "source IP "+ip.SrcIP.String())
+	}
+	return true
+}
+
+// checkNdp returns false if the packet is an NDP message announcing
+// addresses the VM does not own, or a message only routers send. mac is the
+// source MAC of the frame, already checked.
+func (p *PortSecurity) checkNdp(thread *entities.Thread, mac net.HardwareAddr, packet gopacket.Packet) bool {
+	if layer := packet.Layer(layers.LayerTypeICMPv6NeighborSolicitation); layer != nil {
+		return p.checkNdpOptions(thread, mac, layer.(*layers.ICMPv6NeighborSolicitation).Options, layers.ICMPv6OptSourceAddress)
+	}
+	if layer := packet.Layer(layers.LayerTypeICMPv6NeighborAdvertisement); layer != nil {
+		na := layer.(*layers.ICMPv6NeighborAdvertisement)
+		if !ownsIPv6(thread, mac, na.TargetAddress) {
+			return p.drop(thread.VM.Name(), "ndp", "NDP target "+na.TargetAddress.String())
+		}
+		return p.checkNdpOptions(thread, mac, na.Options, layers.ICMPv6OptTargetAddress)
+	}
+	if layer := packet.Layer(layers.LayerTypeICMPv6RouterSolicitation); layer != nil {
+		return p.checkNdpOptions(thread, mac, layer.(*layers.ICMPv6RouterSolicitation).Options, layers.ICMPv6OptSourceAddress)
+	}
+	if packet.Layer(layers.LayerTypeICMPv6RouterAdvertisement) != nil {
+		return p.drop(thread.VM.Name(), "ndp", "router advertisement")
+	}
+	if packet.Layer(layers.LayerTypeICMPv6Redirect) != nil {
+		return p.drop(thread.VM.Name(), "ndp", "redirect")
+	}
+	return true
+}
+
+// checkNdpOptions returns false if an option of type kind of an NDP message
+// announces another link-layer address than mac.
+func (p *PortSecurity) checkNdpOptions(thread *entities.Thread, mac net.HardwareAddr, options layers.ICMPv6Options, kind layers.ICMPv6Opt) bool {
+	for _, option := range options {
+		if option.Type == kind && !bytes.Equal(option.Data, mac) {
+			return p.drop(thread.VM.Name(), "ndp", "NDP link-layer address "+net.HardwareAddr(option.Data).String())
+		}
+	}
+	return true
+}
+
+// CheckFrame is Check for a frame whose headers are decoded in frame. ARP
+// and ICMPv6 packets are checked with Check.
+func (p *PortSecurity) CheckFrame(thread *entities.Thread, frame *modules.Frame) bool {
+	var mac [17]byte
+	if string(tools.FormatMAC(&mac, frame.SrcMAC)) != thread.VM.Mac {
+		return p.drop(thread.VM.Name(), "mac", "source MAC "+frame.SrcMAC.String())
+	}
+	if frame.SrcIP == nil {
+		return true
+	}
+	switch frame.EtherType {
+	case layers.EthernetTypeIPv4:
+		if ownsIP(thread, frame.SrcIP) || frame.SrcIP.Equal(net.IPv4zero) && frame.Protocol == layers.IPProtocolUDP && frame.SrcPort == 68 && frame.DstPort == 67 {
+			return true
+		}
+	case layers.EthernetTypeIPv6:
+		if ownsIPv6(thread, frame.SrcMAC, frame.SrcIP) {
+			return true
+		}
+	default:
+		return true
+	}
+	return p.drop(thread.VM.Name(), "ip", "source IP "+frame.SrcIP.String())
+}
+
+// remotePort is the name the frames received from the peers are counted
+// under.
+const remotePort = "peers"
+
+// CheckRemote returns false if a frame received from a peer daemon must be
+// dropped because it claims the address of a local port or of the gateway.
+// The senders of such frames are checked by their own daemon.
+func (p *PortSecurity) CheckRemote(packet gopacket.Packet, clients *entities.Clients, gatewayIP net.IP, gatewayMAC net.HardwareAddr) bool {
+	local := func(ip net.IP) bool {
+		if ip.Equal(gatewayIP) {
+			return true
+		}
+		_, err := clients.GetClientByIP(ip.String())
+		return err == nil
+	}
+
+	if arpLayer := packet.Layer(layers.LayerTypeARP); arpLayer != nil {
+		arp := arpLayer.(*layers.ARP)
+		mac := net.HardwareAddr(arp.SourceHwAddress)
+		if _, err := clients.GetPortByAddr(mac); err == nil || bytes.Equal(mac, gatewayMAC) {
+			return p.drop(remotePort, "arp", "ARP sender MAC "+mac.String())
+		}
+		if ip := net.IP(arp.SourceProtAddress); local(ip) {
+			return p.drop(remotePort, "arp", "ARP sender IP "+ip.String())
+		}
+		return true
+	}
+	if ipLayer := packet.Layer(layers.LayerTypeIPv4); ipLayer != nil {
+		if ip := ipLayer.(*layers.IPv4); local(ip.SrcIP) {
+			return p.drop(remotePort, "ip", "source IP "+ip.SrcIP.String())
+		}
+		return true
+	}
+	if layer := packet.Layer(layers.LayerTypeICMPv6NeighborAdvertisement); layer != nil {
+		target := layer.(*layers.ICMPv6NeighborAdvertisement).TargetAddress
+		if mac := linkLocalMAC(target); mac != nil {
+			if _, err := clients.GetPortByAddr(mac); err == nil {
+				return p.drop(remotePort, "ndp", "NDP target "+target.String())
+			}
+		}
+	}
+	return true
+}
+
+// Forget removes the counters of a VM.
+func (p *PortSecurity) Forget(id string) {
+	p.mu.Lock()
+	delete(p.drops, id)
+	p.mu.Unlock()
+}
+
+// Describe returns a human readable description of the drop counters and
+// of the last drop events.
+func (p *PortSecurity) Describe() []string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	lines := []string{"PORT SECURITY ID	MAC	IP	ARP	NDP	MALFORMED"}
+	var ids []string
+	for id := range p.drops {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		drops := p.drops[id]
+		lines = append(lines, fmt.Sprintf("%s			%d	%d	%d	%d	%d", id, drops["mac"], drops["ip"], drops["arp"], drops["ndp"], drops["malformed"]))
+	}
+	if len(p.events) > 0 {
+		lines = append(lines, "PORT SECURITY EVENTS")
+		lines = append(lines, p.events...)
+	}
+	return lines
+}
+
+// drop counts and records a frame dropped from the port named name. It
+// always returns false.
+func (p *PortSecurity) drop(name string, reason string, detail string) bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	drops, ok := p.drops[name]
+	if !ok {
+		drops = make(map[string]uint64)
+		p.drops[name] = drops
+	}
+	drops[reason]++
+	// Only the first drop of each kind is logged to avoid flooding the logs
+	if drops[reason] == 1 {
+		log.Println("WARNING: port security: dropped frame from ", name, ": ", detail)
+	}
+
+	event := time.Now().Format(time.RFC3339) + "	" + name + "	" + reason + "	" + detail
+	p.events = append(p.events, event)
+	if len(p.events) > maxPortSecurityEvents {
+		p.events = p.events[len(p.events)-maxPortSecurityEvents:]
+	}
+	return false
+}
+
+// ownsIP checks if ip is the address leased or bound to the VM of thread.
+func ownsIP(thread *entities.Thread, ip net.IP) bool {
+	leased := thread.IP()
+	return leased != nil && net.ParseIP(*leased).Equal(ip)
+}
+
+// ownsIPv6 checks if ip is the link-local address of the VM of thread, made
+// from its MAC address mac as in RFC 4291, or the address leased or bound
+// to it.
+func ownsIPv6(thread *entities.Thread, mac net.HardwareAddr, ip net.IP) bool {
+	if len(mac) == 6 {
+		linkLocal := [net.IPv6len]byte{0: 0xfe, 1: 0x80, 8: mac[0] ^ 0x02, 9: mac[1], 10: mac[2], 11: 0xff, 12: 0xfe, 13: mac[3], 14: mac[4], 15: mac[5]}
+		if bytes.Equal(ip, linkLocal[:]) {
+			return true
+		}
+	}
+	return ownsIP(thread, ip)
+}
+
+// linkLocalMAC returns the MAC address a link-local address was made from,
+// or nil if it was not made from one.
+func linkLocalMAC(ip net.IP) net.HardwareAddr {
+	if len(ip) != net.IPv6len || !ip.IsLinkLocalUnicast() || ip[11] != 0xff || ip[12] != 0xfe {
+		return nil
+	}
+	return net.HardwareAddr{ip[8] ^ 0x02, ip[9], ip[10], ip[13], ip[14], ip[15]}
+}
+
+// isUnspecifiedAllowed checks if the packet is a message sent from the
+// unspecified address before the VM has an address: a neighbor solicitation
+// of the duplicate address detection, without link-layer address, or a
+// multicast listener report, see RFC 4862.
+func isUnspecifiedAllowed(packet gopacket.Packet) bool {
+	if layer := packet.Layer(layers.LayerTypeICMPv6NeighborSolicitation); layer != nil {
+		for _, option := range layer.(*layers.ICMPv6NeighborSolicitation).Options {
+			if option.Type == layers.ICMPv6OptSourceAddress {
+				return false
+			}
+		}
+		return true
+	}
+	if layer := packet.Layer(layers.LayerTypeICMPv6); layer != nil {
+		switch layer.(*layers.ICMPv6).TypeCode.Type() {
+		case layers.ICMPv6TypeMLDv1MulticastListenerReportMessage, layers.ICMPv6TypeMLDv2MulticastListenerReportMessageV2:
+			return true
+		}
+	}
+	return false
+}
+
+// isDhcpRequest checks if the packet is a DHCP request of a VM that has no
+// address yet.
+func isDhcpRequest(packet gopacket.Packet, ip *layers.IPv4) bool {
+	if !ip.SrcIP.Equal(net.IPv4zero) {
+		return false
+	}
+	udpLayer := packet.Layer(layers.LayerTypeUDP)
+	if udpLayer == nil {
+		return false
+	}
+	udp := udpLayer.(*layers.UDP)
+	return udp.SrcPort == 68 && udp.DstPort == 67
+}
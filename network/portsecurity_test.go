@@ -0,0 +1,109 @@
+package network
+
+import (
+	"QemuUserNet/entities"
+	"net"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	vmMAC       = net.HardwareAddr{0x52, 0x54, 0, 0x12, 0x34, 0x56}
+	otherMAC    = net.HardwareAddr{0x52, 0x54, 0, 0x12, 0x34, 0x57}
+	vmLinkLocal = net.ParseIP("fe80::5054:ff:fe12:3456")
+	otherIPv6   = net.ParseIP("fe80::5054:ff:fe12:3457")
+	allNodes    = net.ParseIP("ff02::1")
+)
+
+// ipv6Frame builds an IPv6 frame sent by the VM from src, carrying the
+// ICMPv6 message msg if not nil.
+func ipv6Frame(t *testing.T, src net.IP, typ uint8, msg gopacket.SerializableLayer) []byte {
+	ip := &layers.IPv6{Version: 6, HopLimit: 255, SrcIP: src, DstIP: allNodes}
+	ls := []gopacket.SerializableLayer{&layers.Ethernet{SrcMAC: vmMAC, DstMAC: net.HardwareAddr{0x33, 0x33, 0, 0, 0, 1}, EthernetType: layers.EthernetTypeIPv6}, ip}
+	if msg == nil {
+		ip.NextHeader = layers.IPProtocolUDP
+		udp := &layers.UDP{SrcPort: 5000, DstPort: 5000}
+		udp.SetNetworkLayerForChecksum(ip)
+		ls = append(ls, udp, gopacket.Payload("x"))
+	} else {
+		ip.NextHeader = layers.IPProtocolICMPv6
+		icmp := &layers.ICMPv6{TypeCode: layers.CreateICMPv6TypeCode(typ, 0)}
+		icmp.SetNetworkLayerForChecksum(ip)
+		ls = append(ls, icmp, msg)
+	}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, ls...); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func sourceOption(mac net.HardwareAddr) layers.ICMPv6Options {
+	return layers.ICMPv6Options{{Type: layers.ICMPv6OptSourceAddress, Data: mac}}
+}
+
+func TestPortSecurityIPv6(t *testing.T) {
+	tests := []struct {
+		name  string
+		src   net.IP
+		typ   uint8
+		msg   gopacket.SerializableLayer
+		allow bool
+	}{
+		{"link-local source", vmLinkLocal, 0, nil, true},
+		{"spoofed source", otherIPv6, 0, nil, false},
+		{"global source", net.ParseIP("2001:db8::1"), 0, nil, false},
+		{"unspecified source", net.IPv6unspecified, 0, nil, false},
+		{"solicitation", vmLinkLocal, layers.ICMPv6TypeNeighborSolicitation,
+			&layers.ICMPv6NeighborSolicitation{TargetAddress: otherIPv6, Options: sourceOption(vmMAC)}, true},
+		{"solicitation with a spoofed link-layer address", vmLinkLocal, layers.ICMPv6TypeNeighborSolicitation,
+			&layers.ICMPv6NeighborSolicitation{TargetAddress: otherIPv6, Options: sourceOption(otherMAC)}, false},
+		{"duplicate address detection", net.IPv6unspecified, layers.ICMPv6TypeNeighborSolicitation,
+			&layers.ICMPv6NeighborSolicitation{TargetAddress: vmLinkLocal}, true},
+		{"solicitation from the unspecified address with a link-layer address", net.IPv6unspecified, layers.ICMPv6TypeNeighborSolicitation,
+			&layers.ICMPv6NeighborSolicitation{TargetAddress: vmLinkLocal, Options: sourceOption(vmMAC)}, false},
+		{"advertisement", vmLinkLocal, layers.ICMPv6TypeNeighborAdvertisement,
+			&layers.ICMPv6NeighborAdvertisement{TargetAddress: vmLinkLocal, Options: layers.ICMPv6Options{{Type: layers.ICMPv6OptTargetAddress, Data: vmMAC}}}, true},
+		{"advertisement of another address", vmLinkLocal, layers.ICMPv6TypeNeighborAdvertisement,
+			&layers.ICMPv6NeighborAdvertisement{TargetAddress: otherIPv6, Options: layers.ICMPv6Options{{Type: layers.ICMPv6OptTargetAddress, Data: vmMAC}}}, false},
+		{"advertisement of another link-layer address", vmLinkLocal, layers.ICMPv6TypeNeighborAdvertisement,
+			&layers.ICMPv6NeighborAdvertisement{TargetAddress: vmLinkLocal, Options: layers.ICMPv6Options{{Type: layers.ICMPv6OptTargetAddress, Data: otherMAC}}}, false},
+		{"router solicitation", vmLinkLocal, layers.ICMPv6TypeRouterSolicitation,
+			&layers.ICMPv6RouterSolicitation{Options: sourceOption(vmMAC)}, true},
+		{"router advertisement", vmLinkLocal, layers.ICMPv6TypeRouterAdvertisement,
+			&layers.ICMPv6RouterAdvertisement{HopLimit: 64, RouterLifetime: 1800}, false},
+	}
+
+	vm := entities.VM{ID: "vm1", Mac: vmMAC.String()}
+	thread := entities.NewThread(vm, nil, false)
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			data := ipv6Frame(t, test.src, test.typ, test.msg)
+			packet := gopacket.NewPacket(data, layers.LayerTypeEthernet, gopacket.Default)
+			if allowed := NewPortSecurity().Check(thread, packet); allowed != test.allow {
+				t.Fatalf("Check %v, want %v", allowed, test.allow)
+			}
+			decoder := newFrameDecoder()
+			frame := decoder.decode(data, thread)
+			if test.msg == nil {
+				if allowed := NewPortSecurity().CheckFrame(thread, frame); allowed != test.allow {
+					t.Fatalf("CheckFrame %v, want %v", allowed, test.allow)
+				}
+			} else if !isIcmpv6(frame) {
+				t.Fatal("ICMPv6 message on the fast path")
+			}
+		})
+	}
+}
+
+func TestPortSecurityLeasedIPv6(t *testing.T) {
+	leased := "2001:db8::10"
+	vm := entities.VM{ID: "vm1", Mac: vmMAC.String(), Ip: &leased}
+	thread := entities.NewThread(vm, nil, false)
+	data := ipv6Frame(t, net.ParseIP(leased), 0, nil)
+	if !NewPortSecurity().CheckFrame(thread, newFrameDecoder().decode(data, thread)) {
+		t.Fatal("leased address dropped")
+	}
+}
@@ -0,0 +1,5 @@
+package network
+
+// sysSendmmsg is the number of the sendmmsg system call, missing from the
+// syscall package.
+const sysSendmmsg = 307
@@ -0,0 +1,8 @@
+//go:build !linux || (!amd64 && !arm64)
+
+package network
+
+// sysSendmmsg is 0 on the systems without sendmmsg and on the architectures
+// whose number of the system call is not known, the frames are then sent one
+// by one.
+const sysSendmmsg = 0
@@ -0,0 +1,112 @@
+package network
+
+import (
+	"QemuUserNet/entities"
+	"errors"
+	"log"
+	"os"
+)
+
+// detachable is implemented by the transports whose sockets include a socket
+// file of QEMU. A detached transport keeps this file when it is closed, so
+// that QEMU can be reached again once its port is restored.
+type detachable interface {
+	Detach()
+}
+
+// Suspend stops the network like Stop, keeping the socket files of QEMU so
+// that the ports of the VMs can be restored with RestoreVM by another daemon
+// process. The hot-plugged cards stay in their VMs.
+func (n *Network) Suspend() error {
+	for _, client := range n.Clients.Threads() {
+		if transport, ok := client.Transport.(detachable); ok {
+			transport.Detach()
+		}
+	}
+	return n.Stop()
+}
+
+// handoffable is implemented by the transports whose socket can be handed
+// off to another daemon process, which then receives the frames of the VM
+// without any of them being lost.
+type handoffable interface {
+	Handoff() (*os.File, error)
+}
+
+// Handoff stops the network like Suspend, and returns the cards of its VMs,
+// uplinks excepted, with the sockets of the ones that can be handed off to
+// another daemon process by their Socket. The frames sent by QEMU meanwhile
+// are queued in these sockets until the other process reads them. The other
+// cards are restored like suspended ones.
+func (n *Network) Handoff() ([]entities.VM, map[string]*os.File, error) {
+	threads := n.Clients.Threads()
+	files := make(map[string]*os.File)
+	for _, client := range threads {
+		if client.Uplink {
+			continue
+		}
+		if transport, ok := client.Transport.(handoffable); ok {
+			file, err := transport.Handoff()
+			if err == nil {
+				files[client.VM.Socket] = file
+				continue
+			}
+			log.Println("WARNING: the socket of " + client.VM.Name() + " cannot be handed off: " + err.Error())
+		}
+		if transport, ok := client.Transport.(detachable); ok {
+			transport.Detach()
+		}
+	}
+	err := n.Stop()
+
+	// The addresses are final once the listeners stopped
+	var vms []entities.VM
+	for _, client := range threads {
+		if !client.Uplink {
+			vms = append(vms, client.CurrentVM())
+		}
+	}
+	return vms, files, err
+}
+
+// RestoreVM adds back the network card of a VM saved by a previous daemon
+// process, with the same sockets, MAC address and IP address, so that its
+// running QEMU keeps using the card. file is the socket handed off by the
+// previous process, nil to create the sockets again.
+func (n *Network) RestoreVM(vm entities.VM, file *os.File) error {
+	if vm.ID == "" || vm.Mac == "" || vm.Socket == "" {
+		if file != nil {
+			file.Close()
+		}
+		return errors.New("Invalid saved VM")
+	}
+	if !validNetdevID(vm.NIC.NetdevID) {
+		if file != nil {
+			file.Close()
+		}
+		return errors.New("Invalid netdev id, expected a letter followed by letters, digits, '-', '.' or '_'")
+	}
+	ip, static := vm.Ip, vm.StaticIp
+	vm.Ip, vm.StaticIp = nil, false
+	var thread *entities.Thread
+	var err error
+	if file != nil {
+		var sockets entities.Transport
+		if sockets, err = adoptTransport(&vm, file); err != nil {
+			return err
+		}
+		thread, err = n.addThread(vm, sockets)
+	} else {
+		thread, err = n.addVM(vm)
+	}
+	if err != nil {
+		return err
+	}
+	if ip != nil {
+		if err := n.Clients.SetIP(thread, *ip, static); err != nil {
+			n.removeThread(thread)
+			return err
+		}
+	}
+	return nil
+}
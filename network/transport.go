@@ -0,0 +1,496 @@
+package network
+
+import (
+	"QemuUserNet/entities"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// errNotConnected is returned when a frame is sent to a VM whose QEMU has not
+// opened its socket yet.
+var errNotConnected = errors.New("The VM is not connected")
+
+// writeTimeout bounds the time a frame waits for room in the stream of a VM.
+// A VM that does not read its frames must not block the senders, nor the
+// removal of its port.
+const writeTimeout = 100 * time.Millisecond
+
+// newTransport creates the sockets of a VM, according to the transport of
+// the VM. The daemon listens on the remote socket before QEMU is started.
+// For the UDP transport, the addresses of both sockets are stored in the VM.
+func newTransport(vm *entities.VM) (entities.Transport, error) {
+	if vm.Transport != entities.TransportUDP {
+		if _, err := os.Stat(vm.RemoteSocket); err == nil {
+			os.Remove(vm.RemoteSocket)
+		}
+	}
+
+	switch vm.Transport {
+	case entities.TransportUDP:
+		return newUDPTransport(vm)
+	case entities.TransportVhostUser:
+		return newVhostUserTransport(vm)
+	case entities.TransportDgram:
+		remote, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: vm.RemoteSocket, Net: "unixgram"})
+		if err != nil {
+			return nil, fmt.Errorf("error during creation of socket: %s", err.Error())
+		}
+		return &dgramTransport{id: vm.ID, remote: remote, remotePath: vm.RemoteSocket, localPath: vm.LocalSocket}, nil
+	case entities.TransportStream:
+		listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: vm.RemoteSocket, Net: "unix"})
+		if err != nil {
+			return nil, fmt.Errorf("error during creation of socket: %s", err.Error())
+		}
+		return &streamTransport{id: vm.ID, listener: listener, path: vm.RemoteSocket}, nil
+	default:
+		return nil, errors.New("Unknown transport, expected dgram, stream, udp or vhost-user")
+	}
+}
+
+// adoptTransport creates the transport of a VM around the socket handed off
+// by another daemon process, see Network.Handoff. Only the dgram and udp
+// transports can be handed off. The file is closed.
+func adoptTransport(vm *entities.VM, file *os.File) (entities.Transport, error) {
+	conn, err := net.FileConn(file)
+	file.Close()
+	if err != nil {
+		return nil, fmt.Errorf("error during adoption of socket: %s", err.Error())
+	}
+
+	switch vm.Transport {
+	case entities.TransportDgram:
+		if remote, ok := conn.(*net.UnixConn); ok {
+			return &dgramTransport{id: vm.ID, remote: remote, remotePath: vm.RemoteSocket, localPath: vm.LocalSocket}, nil
+		}
+	case entities.TransportUDP:
+		peer, err := net.ResolveUDPAddr("udp4", vm.LocalSocket)
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+		if udp, ok := conn.(*net.UDPConn); ok {
+			return newUDPTransportOn(udp, peer), nil
+		}
+	}
+	conn.Close()
+	return nil, errors.New("The handed off socket does not match the transport of the VM")
+}
+
+// dgramTransport exchanges frames with QEMU -netdev dgram: the VM sends to
+// the remote socket bound by the daemon, and receives on the local socket
+// bound by QEMU.
+type dgramTransport struct {
+	id         string
+	remote     *net.UnixConn
+	remotePath string
+	localPath  string
+	mu         sync.Mutex
+	local      *net.UnixConn
+	detached   bool        // Keeps the local socket file on Close, see Detach
+	handedOff  bool        // Keeps the remote socket file on Close, see Handoff
+	reads      mmsgBuffers // Headers of ReadFrames, used by the listener only
+	writes     mmsgBuffers // Headers of WriteFrames, guarded by mu
+}
+
+// ReadFrame reads a datagram sent by the VM.
+func (t *dgramTransport) ReadFrame(buffer []byte) (int, error) {
+	l, _, err := t.remote.ReadFromUnix(buffer)
+	return l, err
+}
+
+// ReadFrames reads the datagrams sent by the VM, several at once.
+func (t *dgramTransport) ReadFrames(buffers [][]byte, lengths []int) (int, error) {
+	return recvmmsg(t.remote, &t.reads, buffers, lengths, false)
+}
+
+// open opens the local socket of the VM if needed. t.mu must be held.
+func (t *dgramTransport) open() error {
+	if t.local == nil {
+		sock, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: t.localPath, Net: "unixgram"})
+		if err != nil {
+			return fmt.Errorf("%w: %s", errNotConnected, err.Error())
+		}
+		t.local = sock
+		log.Println("INFO: Opened LocalSocket for ", t.id)
+	}
+	return nil
+}
+
+// WriteFrames sends datagrams to the local socket of the VM, several at
+// once.
+func (t *dgramTransport) WriteFrames(frames [][]byte) error {
+	if sysSendmmsg == 0 {
+		return writeFrames(t, frames)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.open(); err != nil {
+		return err
+	}
+	sent, err := sendmmsg(t.local, &t.writes, frames, nil)
+	if errors.Is(err, syscall.EAGAIN) || err == nil && sent < len(frames) {
+		return fmt.Errorf("%w: the VM does not read its frames", errNotConnected)
+	}
+	if err != nil {
+		t.local.Close()
+		t.local = nil
+		return err
+	}
+	return nil
+}
+
+// WriteFrame sends a datagram to the local socket of the VM, which is
+// opened on the first write.
+func (t *dgramTransport) WriteFrame(frame []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err := t.open(); err != nil {
+		return err
+	}
+	length, err := writeNonBlocking(t.local, frame)
+	if errors.Is(err, syscall.EAGAIN) {
+		// The queue of the socket is full, the frame is dropped as a full
+		// ring of a network card would
+		return fmt.Errorf("%w: the VM does not read its frames", errNotConnected)
+	}
+	if err != nil {
+		// QEMU may bind the socket again when it restarts
+		t.local.Close()
+		t.local = nil
+		return err
+	}
+	if length != len(frame) {
+		return errors.New("Package not send completely")
+	}
+	return nil
+}
+
+// writeNonBlocking writes a datagram without waiting for room in the queue of
+// the socket. Returns syscall.EAGAIN if the queue is full.
+func writeNonBlocking(conn *net.UnixConn, frame []byte) (int, error) {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return 0, err
+	}
+	var length int
+	var writeErr error
+	err = raw.Write(func(fd uintptr) bool {
+		length, writeErr = syscall.Write(int(fd), frame)
+		return true
+	})
+	if err != nil {
+		return 0, err
+	}
+	return length, writeErr
+}
+
+// Detach keeps the local socket file of QEMU when the transport is closed.
+func (t *dgramTransport) Detach() {
+	t.mu.Lock()
+	t.detached = true
+	t.mu.Unlock()
+}
+
+// Handoff returns a duplicate of the remote socket, for another daemon
+// process to receive the frames of the VM, the ones queued meanwhile
+// included. Both socket files are kept when the transport is closed.
+func (t *dgramTransport) Handoff() (*os.File, error) {
+	file, err := t.remote.File()
+	if err != nil {
+		return nil, err
+	}
+	t.mu.Lock()
+	t.detached = true
+	t.handedOff = true
+	t.mu.Unlock()
+	return file, nil
+}
+
+// Close closes both sockets and removes their files. The local socket of a
+// VM is of no use once its card is removed, even if QEMU is still running,
+// unless the transport was detached.
+func (t *dgramTransport) Close() error {
+	t.mu.Lock()
+	if t.local != nil {
+		t.local.Close()
+		t.local = nil
+	}
+	detached, handedOff := t.detached, t.handedOff
+	t.mu.Unlock()
+	err := t.remote.Close()
+	if !handedOff {
+		os.Remove(t.remotePath)
+	}
+	if !detached {
+		os.Remove(t.localPath)
+	}
+	return err
+}
+
+// streamTransport exchanges frames with QEMU -netdev stream: QEMU connects to
+// the stream socket listened on by the daemon, and every frame is prefixed by
+// its length as a 4-byte big-endian integer. The VM can connect again after
+// a disconnection.
+type streamTransport struct {
+	id       string
+	listener *net.UnixListener
+	path     string
+	mu       sync.Mutex
+	conn     net.Conn
+}
+
+// ReadFrame reads a frame sent by the VM, waiting for the VM to connect if
+// needed. Frames larger than buffer are discarded.
+func (t *streamTransport) ReadFrame(buffer []byte) (int, error) {
+	t.mu.Lock()
+	conn := t.conn
+	t.mu.Unlock()
+
+	if conn == nil {
+		c, err := t.listener.Accept()
+		if err != nil {
+			return 0, err
+		}
+		log.Println("INFO: Stream connected for ", t.id)
+		t.mu.Lock()
+		t.conn = c
+		t.mu.Unlock()
+		conn = c
+	}
+
+	length, err := readStreamFrame(conn, buffer)
+	if err != nil && !errors.Is(err, errFrameTooLarge) {
+		t.disconnect(conn)
+	}
+	return length, err
+}
+
+// WriteFrame sends a length-prefixed frame to the VM.
+func (t *streamTransport) WriteFrame(frame []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.conn == nil {
+		return errNotConnected
+	}
+	// A partially written frame breaks the stream, which is closed
+	t.conn.SetWriteDeadline(time.Now().Add(writeTimeout))
+	if err := writeStreamFrame(t.conn, frame); err != nil {
+		t.conn.Close()
+		t.conn = nil
+		return err
+	}
+	return nil
+}
+
+// Close closes the connection of the VM and the listening socket, and
+// removes the socket file.
+func (t *streamTransport) Close() error {
+	t.mu.Lock()
+	if t.conn != nil {
+		t.conn.Close()
+		t.conn = nil
+	}
+	t.mu.Unlock()
+	err := t.listener.Close()
+	os.Remove(t.path)
+	return err
+}
+
+// disconnect forgets the connection of the VM after an error, so that the
+// next read waits for the VM to connect again.
+func (t *streamTransport) disconnect(conn net.Conn) {
+	conn.Close()
+	t.mu.Lock()
+	if t.conn == conn {
+		t.conn = nil
+	}
+	t.mu.Unlock()
+}
+
+// errFrameTooLarge is returned when a stream frame does not fit in the buffer.
+// The frame is discarded and the stream stays usable.
+var errFrameTooLarge = errors.New("frame discarded")
+
+// readStreamFrame reads a frame prefixed by its length as a 4-byte big-endian
+// integer, the framing of QEMU -netdev stream.
+func readStreamFrame(conn io.Reader, buffer []byte) (int, error) {
+	var header [4]byte
+	if _, err := io.ReadFull(conn, header[:]); err != nil {
+		return 0, err
+	}
+	length := int64(binary.BigEndian.Uint32(header[:]))
+	if length > int64(len(buffer)) {
+		if _, err := io.CopyN(io.Discard, conn, length); err != nil {
+			return 0, err
+		}
+		return 0, fmt.Errorf("%w: %d bytes", errFrameTooLarge, length)
+	}
+	if _, err := io.ReadFull(conn, buffer[:length]); err != nil {
+		return 0, err
+	}
+	return int(length), nil
+}
+
+// writeStreamFrame writes a frame prefixed by its length in a single write.
+func writeStreamFrame(conn io.Writer, frame []byte) error {
+	packet := make([]byte, 4+len(frame))
+	binary.BigEndian.PutUint32(packet, uint32(len(frame)))
+	copy(packet[4:], frame)
+	_, err := conn.Write(packet)
+	return err
+}
+
+// udpTransport exchanges frames with QEMU -netdev socket,udp=...: the daemon
+// and QEMU each bind a UDP port on localhost and send the frames to the port
+// of the other. Datagrams coming from another address are ignored.
+type udpTransport struct {
+	conn    *net.UDPConn
+	peer    *net.UDPAddr
+	rawPeer syscall.RawSockaddrInet4 // peer, for recvmmsg and sendmmsg
+	reads   mmsgBuffers              // Headers of ReadFrames, used by the listener only
+	mu      sync.Mutex               // Guards writes
+	writes  mmsgBuffers              // Headers of WriteFrames
+}
+
+// newUDPTransport binds the UDP socket of the daemon and chooses a free
+// port for QEMU.
+func newUDPTransport(vm *entities.VM) (*udpTransport, error) {
+	loopback := net.IPv4(127, 0, 0, 1)
+	if vm.RemoteSocket != "" && vm.LocalSocket != "" {
+		// The addresses of a restored port are kept, QEMU still uses them
+		return restoreUDPTransport(vm)
+	}
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: loopback})
+	if err != nil {
+		return nil, fmt.Errorf("error during creation of socket: %s", err.Error())
+	}
+	// The port is released for QEMU to bind it
+	probe, err := net.ListenUDP("udp4", &net.UDPAddr{IP: loopback})
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("error during creation of socket: %s", err.Error())
+	}
+	peer := probe.LocalAddr().(*net.UDPAddr)
+	probe.Close()
+
+	vm.RemoteSocket = conn.LocalAddr().String()
+	vm.LocalSocket = peer.String()
+	return newUDPTransportOn(conn, peer), nil
+}
+
+// newUDPTransportOn creates the transport of the UDP socket of the daemon,
+// exchanging frames with the port peer of the VM.
+func newUDPTransportOn(conn *net.UDPConn, peer *net.UDPAddr) *udpTransport {
+	return &udpTransport{conn: conn, peer: peer, rawPeer: sockaddrInet4(peer.IP.To4(), peer.Port)}
+}
+
+// restoreUDPTransport binds the addresses of the UDP sockets stored in a VM.
+func restoreUDPTransport(vm *entities.VM) (*udpTransport, error) {
+	local, err := net.ResolveUDPAddr("udp4", vm.RemoteSocket)
+	if err != nil {
+		return nil, err
+	}
+	peer, err := net.ResolveUDPAddr("udp4", vm.LocalSocket)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp4", local)
+	if err != nil {
+		return nil, fmt.Errorf("error during creation of socket: %s", err.Error())
+	}
+	return newUDPTransportOn(conn, peer), nil
+}
+
+// ReadFrame reads a datagram sent by the VM.
+func (t *udpTransport) ReadFrame(buffer []byte) (int, error) {
+	for {
+		l, src, err := t.conn.ReadFromUDP(buffer)
+		if err != nil {
+			return 0, err
+		}
+		if src.Port == t.peer.Port && src.IP.Equal(t.peer.IP) {
+			return l, nil
+		}
+	}
+}
+
+// ReadFrames reads the datagrams sent by the VM, several at once.
+func (t *udpTransport) ReadFrames(buffers [][]byte, lengths []int) (int, error) {
+	for {
+		count, err := recvmmsg(t.conn, &t.reads, buffers, lengths, true)
+		if err != nil {
+			return 0, err
+		}
+		// The datagrams coming from another address are left out
+		kept := 0
+		for i := 0; i < count; i++ {
+			if t.reads.names[i] == t.rawPeer {
+				buffers[kept], buffers[i] = buffers[i], buffers[kept]
+				lengths[kept] = lengths[i]
+				kept++
+			}
+		}
+		if kept > 0 {
+			return kept, nil
+		}
+	}
+}
+
+// WriteFrames sends datagrams to the port of the VM, several at once.
+func (t *udpTransport) WriteFrames(frames [][]byte) error {
+	if sysSendmmsg == 0 {
+		return writeFrames(t, frames)
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	sent, err := sendmmsg(t.conn, &t.writes, frames, &t.rawPeer)
+	if errors.Is(err, syscall.EAGAIN) || err == nil && sent < len(frames) {
+		return errors.New("Package not send completely")
+	}
+	return err
+}
+
+// writeFrames sends frames one by one, for the architectures without
+// sendmmsg.
+func writeFrames(t entities.Transport, frames [][]byte) error {
+	for _, frame := range frames {
+		if err := t.WriteFrame(frame); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// WriteFrame sends a datagram to the port of the VM.
+func (t *udpTransport) WriteFrame(frame []byte) error {
+	length, err := t.conn.WriteToUDP(frame, t.peer)
+	if err != nil {
+		return err
+	}
+	if length != len(frame) {
+		return errors.New("Package not send completely")
+	}
+	return nil
+}
+
+// Handoff returns a duplicate of the socket of the daemon, for another daemon
+// process to receive the frames of the VM.
+func (t *udpTransport) Handoff() (*os.File, error) {
+	return t.conn.File()
+}
+
+// Close closes the socket of the daemon.
+func (t *udpTransport) Close() error {
+	return t.conn.Close()
+}
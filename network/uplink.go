@@ -0,0 +1,114 @@
+package network
+
+import (
+	"QemuUserNet/entities"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"syscall"
+)
+
+// UplinkConfig describes the host device an uplink is bridged to. Exactly
+// one of Tap, TapFd and Veth is set.
+type UplinkConfig struct {
+	Tap      string // Name of the TAP device to open, created if it does not exist
+	TapFd    int    // File descriptor of an opened TAP device, owned by the uplink, -1 if unused
+	Veth     string // Name of the interface to attach, created if PeerName is set
+	PeerName string // Name of the other end of the veth pair to create
+	Netns    string // Network namespace receiving the other end, name or PID
+}
+
+// AddUplink bridges the network to a device of the host. The uplink is a port
+// of the switch like the VMs, except that it has no MAC address of its own:
+// the addresses of the hosts behind it are learned from the frames it sends.
+// It is removed like a VM, with RemoveVM. The file descriptor TapFd is closed
+// if the uplink cannot be added.
+func (n *Network) AddUplink(id string, config UplinkConfig) (*entities.VM, error) {
+	if _, err := n.Clients.GetClientByID(id); err == nil {
+		if config.TapFd >= 0 {
+			syscall.Close(config.TapFd)
+		}
+		return nil, errors.New("This ID is already used")
+	}
+
+	var vm entities.VM
+	var transport entities.Transport
+	var err error
+	switch {
+	case config.Tap != "" && config.TapFd < 0 && config.Veth == "":
+		vm = entities.VM{ID: id, Socket: config.Tap, Transport: entities.TransportTap}
+		transport, err = openTap(config.Tap)
+	case config.TapFd >= 0 && config.Tap == "" && config.Veth == "":
+		var name string
+		transport, name, err = openTapFd(config.TapFd)
+		vm = entities.VM{ID: id, Socket: name, Transport: entities.TransportTap}
+	case config.Veth != "" && config.Tap == "" && config.TapFd < 0:
+		vm = entities.VM{ID: id, Socket: config.Veth, Transport: entities.TransportVeth}
+		transport, err = openVeth(config.Veth, config.PeerName, config.Netns)
+	default:
+		if config.TapFd >= 0 {
+			syscall.Close(config.TapFd)
+		}
+		return nil, errors.New("Expected one of a TAP device name, a TAP file descriptor or an interface name")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	thread := entities.NewThread(vm, transport, true)
+	if err := n.Clients.Add(thread); err != nil {
+		transport.Close()
+		return nil, err
+	}
+
+	go func() {
+		if err := n.listen(thread); err != nil {
+			log.Printf("ERROR: failed to start listener for uplink %s: %v", id, err)
+		}
+	}()
+
+	return &vm, nil
+}
+
+// fileTransport exchanges frames with a TAP device or a packet socket, which
+// both read and write one frame per call.
+type fileTransport struct {
+	file    *os.File
+	cleanup func()
+}
+
+// newFileTransport wraps a file descriptor in a transport. The descriptor is
+// made non-blocking so that Close interrupts a pending read.
+func newFileTransport(fd int) (*fileTransport, error) {
+	if err := syscall.SetNonblock(fd, true); err != nil {
+		return nil, fmt.Errorf("invalid file descriptor %d: %s", fd, err.Error())
+	}
+	return &fileTransport{file: os.NewFile(uintptr(fd), fmt.Sprintf("fd:%d", fd))}, nil
+}
+
+// ReadFrame reads a frame from the device.
+func (t *fileTransport) ReadFrame(buffer []byte) (int, error) {
+	return t.file.Read(buffer)
+}
+
+// WriteFrame writes a frame to the device.
+func (t *fileTransport) WriteFrame(frame []byte) error {
+	length, err := t.file.Write(frame)
+	if err != nil {
+		return err
+	}
+	if length != len(frame) {
+		return errors.New("Package not send completely")
+	}
+	return nil
+}
+
+// Close closes the device, and deletes the interfaces created for it.
+func (t *fileTransport) Close() error {
+	err := t.file.Close()
+	if t.cleanup != nil {
+		t.cleanup()
+	}
+	return err
+}
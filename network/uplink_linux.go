@@ -0,0 +1,158 @@
+package network
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"net"
+	"os/exec"
+	"strings"
+	"syscall"
+	"unsafe"
+)
+
+// Constants of the Linux TUN/TAP and packet socket interfaces.
+const (
+	tunSetIff            = 0x400454ca
+	tunGetIff            = 0x800454d2
+	iffTap               = 0x0002
+	iffNoPi              = 0x1000
+	ethPAll              = 0x0003
+	solPacket            = 263
+	packetIgnoreOutgoing = 23
+)
+
+// ifreq is the prefix of struct ifreq used by the TUNSETIFF request.
+type ifreq struct {
+	name  [syscall.IFNAMSIZ]byte
+	flags uint16
+	_     [22]byte
+}
+
+// openTap opens the TAP device name, creating it if it does not exist, and
+// brings it up. A device created here disappears when it is closed.
+func openTap(name string) (*fileTransport, error) {
+	if len(name) >= syscall.IFNAMSIZ {
+		return nil, errors.New("Interface name too long")
+	}
+	fd, err := syscall.Open("/dev/net/tun", syscall.O_RDWR|syscall.O_CLOEXEC, 0)
+	if err != nil {
+		return nil, fmt.Errorf("cannot open /dev/net/tun: %s", err.Error())
+	}
+	var req ifreq
+	copy(req.name[:], name)
+	req.flags = iffTap | iffNoPi
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tunSetIff, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		syscall.Close(fd)
+		return nil, fmt.Errorf("cannot attach TAP device %s: %s", name, errno.Error())
+	}
+	if err := setLinkUp(name); err != nil {
+		syscall.Close(fd)
+		return nil, err
+	}
+	return newFileTransport(fd)
+}
+
+// openTapFd wraps fd, which must be an opened TAP device, in a transport
+// and returns the name of the device. fd is closed if it is not a TAP device.
+func openTapFd(fd int) (*fileTransport, string, error) {
+	var req ifreq
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), tunGetIff, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		syscall.Close(fd)
+		return nil, "", fmt.Errorf("not a TAP device: %s", errno.Error())
+	}
+	if req.flags&iffTap == 0 {
+		syscall.Close(fd)
+		return nil, "", errors.New("not a TAP device: a TUN device")
+	}
+	transport, err := newFileTransport(fd)
+	if err != nil {
+		syscall.Close(fd)
+		return nil, "", err
+	}
+	return transport, string(bytes.TrimRight(req.name[:], "\x00")), nil
+}
+
+// openVeth attaches a packet socket to the interface name. If peer is set,
+// a veth pair is created first, its other end named peer and moved to the
+// network namespace netns, and the pair is deleted when the socket is closed.
+func openVeth(name string, peer string, netns string) (*fileTransport, error) {
+	created := false
+	if peer != "" {
+		args := []string{"link", "add", name, "type", "veth", "peer", "name", peer}
+		if netns != "" {
+			args = append(args, "netns", netns)
+		}
+		if out, err := exec.Command("ip", args...).CombinedOutput(); err != nil {
+			return nil, fmt.Errorf("cannot create veth pair: %s", strings.TrimSpace(string(out)))
+		}
+		created = true
+	} else if netns != "" {
+		return nil, errors.New("A network namespace needs the name of the other end of the veth pair")
+	}
+	deleteLink := func() {
+		if created {
+			exec.Command("ip", "link", "del", name).Run()
+		}
+	}
+
+	iface, err := net.InterfaceByName(name)
+	if err != nil {
+		deleteLink()
+		return nil, err
+	}
+	if err := setLinkUp(name); err != nil {
+		deleteLink()
+		return nil, err
+	}
+
+	fd, err := syscall.Socket(syscall.AF_PACKET, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, int(htons(ethPAll)))
+	if err != nil {
+		deleteLink()
+		return nil, fmt.Errorf("cannot open packet socket: %s", err.Error())
+	}
+	// The frames the daemon writes must not be read back
+	if err := syscall.SetsockoptInt(fd, solPacket, packetIgnoreOutgoing, 1); err != nil {
+		syscall.Close(fd)
+		deleteLink()
+		return nil, fmt.Errorf("cannot configure packet socket: %s", err.Error())
+	}
+	if err := syscall.Bind(fd, &syscall.SockaddrLinklayer{Protocol: htons(ethPAll), Ifindex: iface.Index}); err != nil {
+		syscall.Close(fd)
+		deleteLink()
+		return nil, fmt.Errorf("cannot bind packet socket to %s: %s", name, err.Error())
+	}
+	transport, err := newFileTransport(fd)
+	if err != nil {
+		syscall.Close(fd)
+		deleteLink()
+		return nil, err
+	}
+	transport.cleanup = deleteLink
+	return transport, nil
+}
+
+// setLinkUp brings the interface name up.
+func setLinkUp(name string) error {
+	fd, err := syscall.Socket(syscall.AF_INET, syscall.SOCK_DGRAM|syscall.SOCK_CLOEXEC, 0)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+
+	var req ifreq
+	copy(req.name[:], name)
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCGIFFLAGS, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return fmt.Errorf("cannot get the flags of %s: %s", name, errno.Error())
+	}
+	req.flags |= syscall.IFF_UP
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), syscall.SIOCSIFFLAGS, uintptr(unsafe.Pointer(&req))); errno != 0 {
+		return fmt.Errorf("cannot bring %s up: %s", name, errno.Error())
+	}
+	return nil
+}
+
+// htons converts a short from host to network byte order.
+func htons(v uint16) uint16 {
+	return v<<8 | v>>8
+}
@@ -0,0 +1,28 @@
+//go:build !linux
+
+package network
+
+import (
+	"errors"
+	"syscall"
+)
+
+// errUplinkUnsupported is returned by the uplinks, which bridge the networks
+// to the TAP devices and the interfaces of Linux.
+var errUplinkUnsupported = errors.New("Uplinks are only supported on Linux")
+
+// openTap is not supported on this system.
+func openTap(name string) (*fileTransport, error) {
+	return nil, errUplinkUnsupported
+}
+
+// openTapFd is not supported on this system, fd is closed.
+func openTapFd(fd int) (*fileTransport, string, error) {
+	syscall.Close(fd)
+	return nil, "", errUplinkUnsupported
+}
+
+// openVeth is not supported on this system.
+func openVeth(name string, peer string, netns string) (*fileTransport, error) {
+	return nil, errUplinkUnsupported
+}
@@ -0,0 +1,697 @@
+package network
+
+import (
+	"QemuUserNet/entities"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"os"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// Requests of the vhost-user protocol handled by the daemon.
+const (
+	vhostUserGetFeatures         = 1
+	vhostUserSetFeatures         = 2
+	vhostUserSetOwner            = 3
+	vhostUserResetOwner          = 4
+	vhostUserSetMemTable         = 5
+	vhostUserSetLogBase          = 6
+	vhostUserSetLogFd            = 7
+	vhostUserSetVringNum         = 8
+	vhostUserSetVringAddr        = 9
+	vhostUserSetVringBase        = 10
+	vhostUserGetVringBase        = 11
+	vhostUserSetVringKick        = 12
+	vhostUserSetVringCall        = 13
+	vhostUserSetVringErr         = 14
+	vhostUserGetProtocolFeatures = 15
+	vhostUserSetProtocolFeatures = 16
+	vhostUserGetQueueNum         = 17
+	vhostUserSetVringEnable      = 18
+)
+
+const (
+	vhostUserVersion    = 0x1
+	vhostUserReplyFlag  = 0x4
+	vhostUserHeaderSize = 12
+	vhostUserMaxRegions = 8
+	vhostUserNoFdFlag   = 0x100
+
+	virtioFVersion1        = uint64(1) << 32
+	virtioNetFMq           = uint64(1) << 22
+	vhostUserFProtocolFeat = uint64(1) << 30
+	vhostUserProtocolFMq   = uint64(1) << 0
+	vringDescFNext         = 1
+	vringDescFWrite        = 2
+	vringAvailFNoInterrupt = 1
+
+	// Index of the queues of the first queue pair of a virtio-net device,
+	// the queues of the pair i are 2i and 2i+1
+	vhostRxQueue = 0
+	vhostTxQueue = 1
+
+	// VhostUserMaxQueues is the largest number of queue pairs of a VM
+	VhostUserMaxQueues = 16
+)
+
+// vhostRegion is a region of the guest memory shared by QEMU.
+type vhostRegion struct {
+	guestAddr uint64
+	userAddr  uint64
+	size      uint64
+	mapping   []byte
+	data      []byte
+}
+
+// vring is a split virtqueue living in the guest memory.
+type vring struct {
+	num       uint16
+	descAddr  uint64
+	availAddr uint64
+	usedAddr  uint64
+	desc      []byte
+	avail     []byte
+	used      []byte
+	lastAvail uint16
+	usedIdx   uint16
+	kick      *os.File
+	call      *os.File
+	disabled  bool
+}
+
+// ready checks if the addresses of the ring are known and the ring started.
+func (r *vring) ready() bool {
+	return r.desc != nil && r.kick != nil && !r.disabled
+}
+
+// availIdx returns the index of the next descriptor the driver will make
+// available. The flags and the index are loaded at once, the host is
+// expected to be little-endian like the rings.
+func (r *vring) availIdx() uint16 {
+	return uint16(atomic.LoadUint32((*uint32)(unsafe.Pointer(&r.avail[0]))) >> 16)
+}
+
+// availFlags returns the flags of the available ring.
+func (r *vring) availFlags() uint16 {
+	return uint16(atomic.LoadUint32((*uint32)(unsafe.Pointer(&r.avail[0]))))
+}
+
+// availHead returns the head of the descriptor chain made available at
+// position i.
+func (r *vring) availHead(i uint16) uint16 {
+	off := 4 + 2*int(i%r.num)
+	return binary.LittleEndian.Uint16(r.avail[off:])
+}
+
+// descriptor returns the address, length, flags and next field of a
+// descriptor.
+func (r *vring) descriptor(i uint16) (uint64, uint32, uint16, uint16) {
+	d := r.desc[16*int(i%r.num):]
+	return binary.LittleEndian.Uint64(d), binary.LittleEndian.Uint32(d[8:]), binary.LittleEndian.Uint16(d[12:]), binary.LittleEndian.Uint16(d[14:])
+}
+
+// pushUsed returns a descriptor chain to the driver.
+func (r *vring) pushUsed(head uint16, length int) {
+	off := 4 + 8*int(r.usedIdx%r.num)
+	binary.LittleEndian.PutUint32(r.used[off:], uint32(head))
+	binary.LittleEndian.PutUint32(r.used[off+4:], uint32(length))
+	r.usedIdx++
+	// The used flags are only written by the device
+	atomic.StoreUint32((*uint32)(unsafe.Pointer(&r.used[0])), uint32(r.usedIdx)<<16)
+}
+
+// notify interrupts the guest, unless the driver asked not to be.
+func (r *vring) notify() {
+	if r.call == nil || r.availFlags()&vringAvailFNoInterrupt != 0 {
+		return
+	}
+	var one [8]byte
+	binary.LittleEndian.PutUint64(one[:], 1)
+	r.call.Write(one[:])
+}
+
+// stop closes the eventfds of the ring.
+func (r *vring) stop() {
+	if r.kick != nil {
+		r.kick.Close()
+		r.kick = nil
+	}
+	if r.call != nil {
+		r.call.Close()
+		r.call = nil
+	}
+}
+
+// vhostUserTransport exchanges frames with QEMU -netdev vhost-user: QEMU
+// connects to the Unix socket listened on by the daemon and shares the guest
+// memory, and the frames are read from and written to the virtqueues of the
+// virtio-net device directly. The guest memory must be shared, for instance
+// with -object memory-backend-memfd,share=on. With several queue pairs, the
+// frames are read from every transmit queue and written to the first
+// receive queue with buffers available.
+type vhostUserTransport struct {
+	id        string
+	listener  *net.UnixListener
+	path      string
+	frames    chan []byte
+	done      chan struct{}
+	closeOnce sync.Once
+	mu        sync.Mutex
+	conn      *net.UnixConn
+	features  uint64
+	regions   []*vhostRegion
+	queues    int
+	rings     []*vring
+}
+
+// newVhostUserTransport listens on the vhost-user socket of a VM.
+func newVhostUserTransport(vm *entities.VM) (*vhostUserTransport, error) {
+	listener, err := net.ListenUnix("unix", &net.UnixAddr{Name: vm.RemoteSocket, Net: "unix"})
+	if err != nil {
+		return nil, fmt.Errorf("error during creation of socket: %s", err.Error())
+	}
+	queues := vm.NIC.Queues
+	if queues < 1 {
+		queues = 1
+	}
+	t := &vhostUserTransport{
+		id:       vm.ID,
+		listener: listener,
+		path:     vm.RemoteSocket,
+		frames:   make(chan []byte, 256),
+		done:     make(chan struct{}),
+		queues:   queues,
+		rings:    make([]*vring, 2*queues),
+	}
+	for i := range t.rings {
+		t.rings[i] = &vring{}
+	}
+	go t.serve()
+	return t, nil
+}
+
+// ReadFrame returns a frame sent by the guest on the transmit queue.
+func (t *vhostUserTransport) ReadFrame(buffer []byte) (int, error) {
+	select {
+	case frame := <-t.frames:
+		if len(frame) > len(buffer) {
+			return 0, fmt.Errorf("frame of %d bytes discarded", len(frame))
+		}
+		return copy(buffer, frame), nil
+	case <-t.done:
+		return 0, net.ErrClosed
+	}
+}
+
+// WriteFrame copies a frame into the next buffer the guest made available
+// on a receive queue.
+func (t *vhostUserTransport) WriteFrame(frame []byte) error {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	var ring *vring
+	started := false
+	for i := vhostRxQueue; i < len(t.rings); i += 2 {
+		if r := t.rings[i]; r.ready() {
+			started = true
+			if r.lastAvail != r.availIdx() {
+				ring = r
+				break
+			}
+		}
+	}
+	if !started {
+		return errNotConnected
+	}
+	if ring == nil {
+		return fmt.Errorf("%w: no receive buffer available", errNotConnected)
+	}
+	head := ring.availHead(ring.lastAvail)
+	ring.lastAvail++
+
+	// The virtio-net header announces a frame without offloads
+	data := make([]byte, t.headerLength()+len(frame))
+	if t.headerLength() == 12 {
+		binary.LittleEndian.PutUint16(data[10:], 1)
+	}
+	copy(data[t.headerLength():], frame)
+
+	written := 0
+	i := head
+	for n := uint16(0); n < ring.num && written < len(data); n++ {
+		addr, length, flags, next := ring.descriptor(i)
+		if flags&vringDescFWrite == 0 {
+			break
+		}
+		buffer, err := t.translate(addr, uint64(length), false)
+		if err != nil {
+			break
+		}
+		written += copy(buffer, data[written:])
+		if flags&vringDescFNext == 0 {
+			break
+		}
+		i = next
+	}
+	ring.pushUsed(head, written)
+	ring.notify()
+
+	if written < len(data) {
+		return errors.New("Package not send completely")
+	}
+	return nil
+}
+
+// Close closes the vhost-user socket, unmaps the guest memory and removes
+// the socket file.
+func (t *vhostUserTransport) Close() error {
+	t.closeOnce.Do(func() { close(t.done) })
+	err := t.listener.Close()
+	t.mu.Lock()
+	if t.conn != nil {
+		t.conn.Close()
+	}
+	t.mu.Unlock()
+	os.Remove(t.path)
+	return err
+}
+
+// headerLength returns the length of the virtio-net header preceding the
+// frames, which depends on the negotiated features.
+func (t *vhostUserTransport) headerLength() int {
+	if t.features&virtioFVersion1 != 0 {
+		return 12
+	}
+	return 10
+}
+
+// serve handles the connections of QEMU. QEMU may connect again after a
+// restart.
+func (t *vhostUserTransport) serve() {
+	for {
+		conn, err := t.listener.AcceptUnix()
+		if err != nil {
+			return
+		}
+		log.Println("INFO: vhost-user connected for ", t.id)
+		t.mu.Lock()
+		t.conn = conn
+		t.mu.Unlock()
+
+		for {
+			if err := t.handleMessage(conn); err != nil {
+				if err != io.EOF {
+					select {
+					case <-t.done:
+					default:
+						log.Println("WARNING: vhost-user: ", t.id, ": ", err.Error())
+					}
+				}
+				break
+			}
+		}
+		conn.Close()
+		t.reset()
+	}
+}
+
+// reset forgets the state negotiated with QEMU.
+func (t *vhostUserTransport) reset() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.conn = nil
+	for i, ring := range t.rings {
+		ring.stop()
+		t.rings[i] = &vring{}
+	}
+	t.unmap()
+}
+
+// unmap unmaps the guest memory.
+func (t *vhostUserTransport) unmap() {
+	for _, region := range t.regions {
+		syscall.Munmap(region.mapping)
+	}
+	t.regions = nil
+}
+
+// translate returns the guest memory at a guest physical address, or at a
+// QEMU virtual address if user is set.
+func (t *vhostUserTransport) translate(addr uint64, length uint64, user bool) ([]byte, error) {
+	for _, region := range t.regions {
+		start := region.guestAddr
+		if user {
+			start = region.userAddr
+		}
+		if addr >= start && addr-start+length <= region.size {
+			return region.data[addr-start : addr-start+length], nil
+		}
+	}
+	return nil, fmt.Errorf("address %#x is not in the guest memory", addr)
+}
+
+// handleMessage reads a message of QEMU, applies it and sends the reply if
+// the request expects one.
+func (t *vhostUserTransport) handleMessage(conn *net.UnixConn) error {
+	request, payload, fds, err := readVhostUserMessage(conn)
+	if err != nil {
+		return err
+	}
+
+	t.mu.Lock()
+	reply, err := t.apply(request, payload, fds)
+	t.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if reply == nil {
+		return nil
+	}
+
+	message := make([]byte, vhostUserHeaderSize+len(reply))
+	binary.LittleEndian.PutUint32(message[0:], request)
+	binary.LittleEndian.PutUint32(message[4:], vhostUserVersion|vhostUserReplyFlag)
+	binary.LittleEndian.PutUint32(message[8:], uint32(len(reply)))
+	copy(message[vhostUserHeaderSize:], reply)
+	_, err = conn.Write(message)
+	return err
+}
+
+// apply applies a request of QEMU and returns the payload of the reply, or
+// nil if the request expects no reply. The file descriptors that are not
+// kept are closed.
+func (t *vhostUserTransport) apply(request uint32, payload []byte, fds []int) ([]byte, error) {
+	kept := false
+	defer func() {
+		if !kept {
+			for _, fd := range fds {
+				syscall.Close(fd)
+			}
+		}
+	}()
+
+	u64 := func(v uint64) []byte {
+		b := make([]byte, 8)
+		binary.LittleEndian.PutUint64(b, v)
+		return b
+	}
+	if len(payload) < 8 && request != vhostUserGetFeatures && request != vhostUserSetOwner &&
+		request != vhostUserResetOwner && request != vhostUserGetProtocolFeatures && request != vhostUserGetQueueNum {
+		return nil, fmt.Errorf("request %d too short", request)
+	}
+	ring := func() (*vring, error) {
+		index := binary.LittleEndian.Uint32(payload) & 0xff
+		if index >= uint32(len(t.rings)) {
+			return nil, fmt.Errorf("invalid queue %d", index)
+		}
+		return t.rings[index], nil
+	}
+
+	switch request {
+	case vhostUserGetFeatures:
+		if t.queues > 1 {
+			return u64(virtioFVersion1 | virtioNetFMq | vhostUserFProtocolFeat), nil
+		}
+		return u64(virtioFVersion1), nil
+	case vhostUserSetFeatures:
+		t.features = binary.LittleEndian.Uint64(payload)
+		// The rings start disabled once the protocol features are negotiated
+		if t.features&vhostUserFProtocolFeat != 0 {
+			for _, r := range t.rings {
+				if r.kick == nil {
+					r.disabled = true
+				}
+			}
+		}
+	case vhostUserSetOwner, vhostUserResetOwner, vhostUserSetProtocolFeatures, vhostUserSetLogBase, vhostUserSetLogFd:
+	case vhostUserGetProtocolFeatures:
+		if t.queues > 1 {
+			return u64(vhostUserProtocolFMq), nil
+		}
+		return u64(0), nil
+	case vhostUserGetQueueNum:
+		return u64(uint64(t.queues)), nil
+	case vhostUserSetVringEnable:
+		r, err := ring()
+		if err != nil {
+			return nil, err
+		}
+		r.disabled = binary.LittleEndian.Uint32(payload[4:]) == 0
+	case vhostUserSetMemTable:
+		kept = true
+		return nil, t.setMemTable(payload, fds)
+	case vhostUserSetVringNum:
+		r, err := ring()
+		if err != nil {
+			return nil, err
+		}
+		num := binary.LittleEndian.Uint32(payload[4:])
+		if num == 0 || num > 32768 || num&(num-1) != 0 {
+			return nil, fmt.Errorf("invalid queue size %d", num)
+		}
+		r.num = uint16(num)
+	case vhostUserSetVringBase:
+		r, err := ring()
+		if err != nil {
+			return nil, err
+		}
+		r.lastAvail = uint16(binary.LittleEndian.Uint32(payload[4:]))
+	case vhostUserSetVringAddr:
+		if len(payload) < 40 {
+			return nil, errors.New("request SET_VRING_ADDR too short")
+		}
+		r, err := ring()
+		if err != nil {
+			return nil, err
+		}
+		r.descAddr = binary.LittleEndian.Uint64(payload[8:])
+		r.usedAddr = binary.LittleEndian.Uint64(payload[16:])
+		r.availAddr = binary.LittleEndian.Uint64(payload[24:])
+		if err := t.mapRing(r); err != nil {
+			return nil, err
+		}
+		r.usedIdx = uint16(atomic.LoadUint32((*uint32)(unsafe.Pointer(&r.used[0]))) >> 16)
+	case vhostUserGetVringBase:
+		r, err := ring()
+		if err != nil {
+			return nil, err
+		}
+		r.stop()
+		reply := make([]byte, 8)
+		copy(reply, payload[:4])
+		binary.LittleEndian.PutUint32(reply[4:], uint32(r.lastAvail))
+		return reply, nil
+	case vhostUserSetVringKick, vhostUserSetVringCall, vhostUserSetVringErr:
+		r, err := ring()
+		if err != nil {
+			return nil, err
+		}
+		if request == vhostUserSetVringErr || binary.LittleEndian.Uint64(payload)&vhostUserNoFdFlag != 0 || len(fds) != 1 {
+			return nil, nil
+		}
+		syscall.SetNonblock(fds[0], true)
+		file := os.NewFile(uintptr(fds[0]), "vring")
+		kept = true
+		if request == vhostUserSetVringCall {
+			if r.call != nil {
+				r.call.Close()
+			}
+			r.call = file
+			return nil, nil
+		}
+		if r.kick != nil {
+			r.kick.Close()
+		}
+		r.kick = file
+		for i := vhostTxQueue; i < len(t.rings); i += 2 {
+			if r == t.rings[i] {
+				go t.watchKick(r, file)
+			}
+		}
+	default:
+		log.Println("WARNING: vhost-user: ", t.id, ": unsupported request ", request)
+	}
+	return nil, nil
+}
+
+// setMemTable maps the regions of the guest memory shared by QEMU.
+func (t *vhostUserTransport) setMemTable(payload []byte, fds []int) error {
+	defer func() {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+	}()
+	count := int(binary.LittleEndian.Uint32(payload))
+	if count > vhostUserMaxRegions || count != len(fds) || len(payload) < 8+32*count {
+		return errors.New("invalid memory table")
+	}
+
+	t.unmap()
+	for i := 0; i < count; i++ {
+		entry := payload[8+32*i:]
+		region := &vhostRegion{
+			guestAddr: binary.LittleEndian.Uint64(entry),
+			size:      binary.LittleEndian.Uint64(entry[8:]),
+			userAddr:  binary.LittleEndian.Uint64(entry[16:]),
+		}
+		offset := binary.LittleEndian.Uint64(entry[24:])
+		mapping, err := syscall.Mmap(fds[i], 0, int(region.size+offset), syscall.PROT_READ|syscall.PROT_WRITE, syscall.MAP_SHARED)
+		if err != nil {
+			t.unmap()
+			return err
+		}
+		region.mapping = mapping
+		region.data = mapping[offset:]
+		t.regions = append(t.regions, region)
+	}
+
+	// The rings may have moved
+	for _, r := range t.rings {
+		if r.desc != nil {
+			if err := t.mapRing(r); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// mapRing locates the parts of a ring in the guest memory.
+func (t *vhostUserTransport) mapRing(r *vring) error {
+	if r.num == 0 {
+		return errors.New("the size of the queue is unknown")
+	}
+	num := uint64(r.num)
+	desc, err := t.translate(r.descAddr, 16*num, true)
+	if err != nil {
+		return err
+	}
+	avail, err := t.translate(r.availAddr, 6+2*num, true)
+	if err != nil {
+		return err
+	}
+	used, err := t.translate(r.usedAddr, 6+8*num, true)
+	if err != nil {
+		return err
+	}
+	r.desc, r.avail, r.used = desc, avail, used
+	return nil
+}
+
+// watchKick drains a transmit queue every time the guest kicks it, until
+// the eventfd is closed.
+func (t *vhostUserTransport) watchKick(ring *vring, kick *os.File) {
+	buffer := make([]byte, 8)
+	for {
+		t.drainTx(ring)
+		if _, err := kick.Read(buffer); err != nil {
+			return
+		}
+	}
+}
+
+// drainTx collects the frames made available by the guest on a transmit
+// queue and hands them over to ReadFrame.
+func (t *vhostUserTransport) drainTx(ring *vring) {
+	t.mu.Lock()
+	var frames [][]byte
+	if ring.ready() {
+		for ring.lastAvail != ring.availIdx() {
+			head := ring.availHead(ring.lastAvail)
+			ring.lastAvail++
+			if frame := t.readChain(ring, head); frame != nil {
+				frames = append(frames, frame)
+			}
+			ring.pushUsed(head, 0)
+		}
+		if len(frames) > 0 {
+			ring.notify()
+		}
+	}
+	t.mu.Unlock()
+
+	for _, frame := range frames {
+		select {
+		case t.frames <- frame:
+		case <-t.done:
+			return
+		}
+	}
+}
+
+// readChain concatenates the buffers of a descriptor chain and strips the
+// virtio-net header.
+func (t *vhostUserTransport) readChain(ring *vring, head uint16) []byte {
+	var data []byte
+	i := head
+	for n := uint16(0); n < ring.num; n++ {
+		addr, length, flags, next := ring.descriptor(i)
+		buffer, err := t.translate(addr, uint64(length), false)
+		if err != nil {
+			return nil
+		}
+		data = append(data, buffer...)
+		if flags&vringDescFNext == 0 {
+			break
+		}
+		i = next
+	}
+	if len(data) <= t.headerLength() {
+		return nil
+	}
+	return data[t.headerLength():]
+}
+
+// readVhostUserMessage reads a message of QEMU with the file descriptors
+// sent along.
+func readVhostUserMessage(conn *net.UnixConn) (uint32, []byte, []int, error) {
+	header := make([]byte, vhostUserHeaderSize)
+	oob := make([]byte, syscall.CmsgSpace(4*vhostUserMaxRegions))
+	n, oobn, _, _, err := conn.ReadMsgUnix(header, oob)
+	if err != nil {
+		return 0, nil, nil, err
+	}
+	if n == 0 {
+		return 0, nil, nil, io.EOF
+	}
+
+	var fds []int
+	if oobn > 0 {
+		messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+		if err == nil {
+			for _, message := range messages {
+				if rights, err := syscall.ParseUnixRights(&message); err == nil {
+					fds = append(fds, rights...)
+				}
+			}
+		}
+	}
+	closeFds := func() {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+	}
+
+	if _, err := io.ReadFull(conn, header[n:]); err != nil {
+		closeFds()
+		return 0, nil, nil, err
+	}
+	size := binary.LittleEndian.Uint32(header[8:])
+	if size > 4096 {
+		closeFds()
+		return 0, nil, nil, fmt.Errorf("message of %d bytes too large", size)
+	}
+	payload := make([]byte, size)
+	if _, err := io.ReadFull(conn, payload); err != nil {
+		closeFds()
+		return 0, nil, nil, err
+	}
+	return binary.LittleEndian.Uint32(header), payload, fds, nil
+}
@@ -0,0 +1,211 @@
+// Package overlay extends QemuUserNet networks across several hosts. The
+// frames of a network are encapsulated in VXLAN and sent over UDP to the
+// daemons running the same-named network, and the frames received from them
+// are delivered to the local VMs. The MAC addresses of the remote VMs are
+// learned from the received frames.
+package overlay
+
+import (
+	"QemuUserNet/network"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"net"
+	"sync"
+	"time"
+)
+
+const (
+	// DefaultPort is the UDP port assigned to VXLAN by IANA.
+	DefaultPort = 4789
+	// headerLength is the length of the VXLAN header.
+	headerLength = 8
+	// keepaliveInterval is the interval between two keepalives sent to a peer.
+	keepaliveInterval = 5 * time.Second
+	// peerTimeout is the time after which a silent peer is reported down.
+	peerTimeout = 3 * keepaliveInterval
+	// fdbTimeout is the time after which a remote MAC address is forgotten.
+	fdbTimeout = 5 * time.Minute
+	// MaxVNI is the largest VXLAN network identifier.
+	MaxVNI = 1<<24 - 1
+)
+
+// Overlay is the VXLAN endpoint of the daemon. It is shared by the segments
+// of every peered network, which are told apart by their VNI.
+type Overlay struct {
+	conn     *net.UDPConn
+	mu       sync.RWMutex
+	segments map[uint32]*Segment
+	done     chan struct{}
+}
+
+// NewOverlay creates a new Overlay listening on the UDP address addr.
+func NewOverlay(addr string) (*Overlay, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	o := &Overlay{conn: conn, segments: make(map[uint32]*Segment), done: make(chan struct{})}
+	go o.serve()
+	go o.keepalive()
+	return o, nil
+}
+
+// Addr returns the UDP address of the endpoint.
+func (o *Overlay) Addr() net.Addr {
+	return o.conn.LocalAddr()
+}
+
+// Close stops the endpoint.
+func (o *Overlay) Close() {
+	close(o.done)
+	o.conn.Close()
+}
+
+// Attach inserts a segment with the VXLAN network identifier vni in the
+// module chain of a network, or returns the segment already attached to it.
+// A vni of 0 keeps the VNI of the attached segment, or derives it from the
+// name of the network.
+func (o *Overlay) Attach(n *network.Network, vni uint32) (*Segment, error) {
+	if vni > MaxVNI {
+		return nil, fmt.Errorf("The VNI must be lower than %d", MaxVNI+1)
+	}
+
+	o.mu.Lock()
+	if segment := o.find(n); segment != nil {
+		o.mu.Unlock()
+		if vni != 0 && vni != segment.vni {
+			return nil, fmt.Errorf("The network is peered with the VNI %d", segment.vni)
+		}
+		return segment, nil
+	}
+	if vni == 0 {
+		vni = VNI(n.Name)
+	}
+	if segment, ok := o.segments[vni]; ok {
+		o.mu.Unlock()
+		return nil, errors.New("The VNI of this network is used by the network " + segment.network.Name)
+	}
+	segment := newSegment(o, n, vni)
+	if err := n.InsertModule("overlay", segment); err != nil {
+		o.mu.Unlock()
+		return nil, err
+	}
+	o.segments[vni] = segment
+	o.mu.Unlock()
+	return segment, nil
+}
+
+// Detach removes the segment of a network and forgets its peers.
+func (o *Overlay) Detach(n *network.Network) error {
+	o.mu.Lock()
+	segment := o.find(n)
+	if segment == nil {
+		o.mu.Unlock()
+		return errors.New("The network has no peer")
+	}
+	delete(o.segments, segment.vni)
+	o.mu.Unlock()
+
+	n.RemoveModule(segment)
+	return nil
+}
+
+// Segment returns the segment attached to a network, or nil.
+func (o *Overlay) Segment(n *network.Network) *Segment {
+	o.mu.RLock()
+	defer o.mu.RUnlock()
+	return o.find(n)
+}
+
+// find returns the segment attached to a network, or nil. The caller must
+// hold the lock.
+func (o *Overlay) find(n *network.Network) *Segment {
+	for _, segment := range o.segments {
+		if segment.network == n {
+			return segment
+		}
+	}
+	return nil
+}
+
+// VNI returns the default VXLAN network identifier of a network. It is
+// derived from the name of the network, so that same-named networks share it.
+func VNI(name string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(name))
+	return h.Sum32() & 0xffffff
+}
+
+// send encapsulates a frame and sends it to a peer. An empty frame is a
+// keepalive.
+func (o *Overlay) send(vni uint32, addr *net.UDPAddr, frame []byte) error {
+	packet := make([]byte, headerLength+len(frame))
+	packet[0] = 0x08 // The VNI is valid
+	binary.BigEndian.PutUint32(packet[4:8], vni<<8)
+	copy(packet[headerLength:], frame)
+	_, err := o.conn.WriteToUDP(packet, addr)
+	return err
+}
+
+// serve decapsulates the packets received from the peers and hands them over
+// to the segments.
+func (o *Overlay) serve() {
+	buffer := make([]byte, 65535)
+	for {
+		l, src, err := o.conn.ReadFromUDP(buffer)
+		if err != nil {
+			select {
+			case <-o.done:
+				return
+			default:
+			}
+			log.Println("WARNING: overlay: error during reading: ", err.Error())
+			continue
+		}
+		if l < headerLength || buffer[0]&0x08 == 0 {
+			continue
+		}
+		vni := binary.BigEndian.Uint32(buffer[4:8]) >> 8
+
+		o.mu.RLock()
+		segment, ok := o.segments[vni]
+		o.mu.RUnlock()
+		if !ok {
+			continue
+		}
+		frame := make([]byte, l-headerLength)
+		copy(frame, buffer[headerLength:l])
+		segment.receive(src, frame)
+	}
+}
+
+// keepalive periodically sends a keepalive to every peer, and ages the
+// remote MAC addresses out.
+func (o *Overlay) keepalive() {
+	ticker := time.NewTicker(keepaliveInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-o.done:
+			return
+		case <-ticker.C:
+		}
+		o.mu.RLock()
+		var segments []*Segment
+		for _, segment := range o.segments {
+			segments = append(segments, segment)
+		}
+		o.mu.RUnlock()
+
+		for _, segment := range segments {
+			segment.tick()
+		}
+	}
+}
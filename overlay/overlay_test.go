@@ -0,0 +1,231 @@
+package overlay
+
+import (
+	"QemuUserNet/entities"
+	"QemuUserNet/modules"
+	"QemuUserNet/network"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// daemon is the overlay endpoint and the network of a daemon of the test.
+type daemon struct {
+	overlay *Overlay
+	network *network.Network
+	acl     *modules.Acl
+}
+
+// newDaemon starts an overlay endpoint on the loopback interface and
+// creates the network named net-a, with an ACL and a switch.
+func newDaemon(t *testing.T, portSecurity bool) *daemon {
+	o, err := NewOverlay("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, subnet, _ := net.ParseCIDR("10.10.10.0/24")
+	gatewayMAC, _ := net.ParseMAC("52:54:00:12:34:ff")
+	n := &network.Network{
+		Name:       "net-a",
+		MTU:        entities.DefaultMTU + 14,
+		Subnet:     subnet,
+		GatewayIP:  net.IP{10, 10, 10, 1},
+		GatewayMAC: gatewayMAC,
+		Clients:    &entities.Clients{},
+		Pipeline:   modules.NewPipeline(),
+	}
+	if portSecurity {
+		n.PortSecurity = network.NewPortSecurity()
+	}
+	acl, _ := modules.NewAcl(n.Clients)
+	sw, _ := modules.NewSwitch(n.Clients)
+	n.Pipeline.Insert("acl", acl, -1)
+	n.Pipeline.Insert("switch", sw, -1)
+	n.Start()
+	if _, err := o.Attach(n, 0); err != nil {
+		t.Fatal(err)
+	}
+	d := &daemon{overlay: o, network: n, acl: acl}
+	t.Cleanup(func() {
+		n.Stop()
+		o.Close()
+	})
+	return d
+}
+
+// vm is the QEMU side of a card connected to a network of the test.
+type vm struct {
+	conn   *net.UnixConn
+	remote *net.UnixAddr
+	mac    net.HardwareAddr
+	ip     net.IP
+}
+
+// connect connects a VM to the network of d, with a static address.
+func (d *daemon) connect(t *testing.T, id string, ip net.IP) *vm {
+	card, err := d.network.AddVM(id, entities.NIC{Index: -1}, entities.TransportDgram)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := d.network.BindIP(id, card.NIC.Index, ip.String()); err != nil {
+		t.Fatal(err)
+	}
+	os.Remove(card.LocalSocket)
+	conn, err := net.ListenUnixgram("unixgram", &net.UnixAddr{Name: card.LocalSocket, Net: "unixgram"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		conn.Close()
+		os.Remove(card.LocalSocket)
+	})
+	mac, _ := net.ParseMAC(card.Mac)
+	return &vm{conn: conn, remote: &net.UnixAddr{Name: card.RemoteSocket, Net: "unixgram"}, mac: mac, ip: ip}
+}
+
+// sendUDP sends a UDP datagram from v to the VM owning dst and dstIP, from
+// the source address src.
+func (v *vm) sendUDP(t *testing.T, dst net.HardwareAddr, src net.IP, dstIP net.IP, payload string) {
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: 64, Protocol: layers.IPProtocolUDP, SrcIP: src, DstIP: dstIP}
+	udp := &layers.UDP{SrcPort: 5000, DstPort: 5000}
+	udp.SetNetworkLayerForChecksum(ip)
+	buf := gopacket.NewSerializeBuffer()
+	eth := &layers.Ethernet{SrcMAC: v.mac, DstMAC: dst, EthernetType: layers.EthernetTypeIPv4}
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, udp, gopacket.Payload(payload)); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := v.conn.WriteToUnix(buf.Bytes(), v.remote); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// receive returns the payload of the next UDP datagram received by v, or
+// an empty string if none arrives within d.
+func (v *vm) receive(d time.Duration) string {
+	buf := make([]byte, 65536)
+	deadline := time.Now().Add(d)
+	for {
+		v.conn.SetReadDeadline(deadline)
+		n, _, err := v.conn.ReadFromUnix(buf)
+		if err != nil {
+			return ""
+		}
+		packet := gopacket.NewPacket(buf[:n], layers.LayerTypeEthernet, gopacket.Default)
+		if udp, ok := packet.Layer(layers.LayerTypeUDP).(*layers.UDP); ok {
+			return string(udp.Payload)
+		}
+	}
+}
+
+// TestOverlayLoopback peers two daemons on the loopback interface and checks
+// that the frames of the peers go through the ACL and the port security of
+// the receiving network.
+func TestOverlayLoopback(t *testing.T) {
+	// The VMs of a may spoof addresses, b must not trust them
+	a, b := newDaemon(t, false), newDaemon(t, true)
+	segmentA, segmentB := a.overlay.Segment(a.network), b.overlay.Segment(b.network)
+	if err := segmentA.AddPeer(b.overlay.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	if err := segmentB.AddPeer(a.overlay.Addr().String()); err != nil {
+		t.Fatal(err)
+	}
+	vm1 := a.connect(t, "vm1", net.IP{10, 10, 10, 11})
+	vm2 := b.connect(t, "vm2", net.IP{10, 10, 10, 12})
+	vm3 := b.connect(t, "vm3", net.IP{10, 10, 10, 13})
+
+	// Unknown unicast frames are flooded to the peer, which learns vm1
+	vm1.sendUDP(t, vm2.mac, vm1.ip, vm2.ip, "hello")
+	if got := vm2.receive(time.Second); got != "hello" {
+		t.Fatalf("vm2 received %q, want hello", got)
+	}
+	if got := vm3.receive(200 * time.Millisecond); got != "" {
+		t.Fatalf("vm3 received %q", got)
+	}
+	vm2.sendUDP(t, vm1.mac, vm2.ip, vm1.ip, "back")
+	if got := vm1.receive(time.Second); got != "back" {
+		t.Fatalf("vm1 received %q, want back", got)
+	}
+
+	// The ACL of the receiving network filters the frames of the peer
+	id, err := b.acl.Add(modules.AclRule{Action: modules.AclDeny, Src: vm1.ip.String(), Protocol: "udp"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	vm1.sendUDP(t, vm2.mac, vm1.ip, vm2.ip, "denied")
+	if got := vm2.receive(300 * time.Millisecond); got != "" {
+		t.Fatalf("vm2 received %q through the ACL", got)
+	}
+	b.acl.Remove(id)
+
+	// A peer cannot claim the address of a local VM or of the gateway
+	vm1.sendUDP(t, vm2.mac, vm3.ip, vm2.ip, "spoofed")
+	vm1.sendUDP(t, vm2.mac, b.network.GatewayIP, vm2.ip, "gateway")
+	vm1.sendUDP(t, vm2.mac, vm1.ip, vm2.ip, "allowed")
+	if got := vm2.receive(time.Second); got != "allowed" {
+		t.Fatalf("vm2 received %q, want allowed", got)
+	}
+}
+
+// TestOverlayVNI checks the VNI the segments of the networks are attached
+// with.
+func TestOverlayVNI(t *testing.T) {
+	o, err := NewOverlay("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer o.Close()
+	networks := make(map[string]*network.Network)
+	for _, name := range []string{"net-a", "net-b", "net-c"} {
+		networks[name] = &network.Network{Name: name, Clients: &entities.Clients{}, Pipeline: modules.NewPipeline()}
+	}
+
+	tests := []struct {
+		name    string
+		network string
+		vni     uint32
+		want    uint32 // VNI of the segment, 0 if refused
+	}{
+		{"derived from the name", "net-a", 0, VNI("net-a")},
+		{"attached again", "net-a", 0, VNI("net-a")},
+		{"same VNI", "net-a", VNI("net-a"), VNI("net-a")},
+		{"other VNI", "net-a", 4242, 0},
+		{"VNI of another network", "net-b", VNI("net-a"), 0},
+		{"explicit", "net-b", 4242, 4242},
+		{"explicit VNI used", "net-c", 4242, 0},
+		{"too large", "net-c", MaxVNI + 1, 0},
+		{"largest", "net-c", MaxVNI, MaxVNI},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			segment, err := o.Attach(networks[test.network], test.vni)
+			if test.want == 0 {
+				if err == nil {
+					t.Fatalf("attached with the VNI %d", segment.vni)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if segment.vni != test.want || o.Segment(networks[test.network]) != segment {
+				t.Fatalf("attached with the VNI %d, want %d", segment.vni, test.want)
+			}
+		})
+	}
+
+	// The VNI of a detached network is free again, and a detached network
+	// can be attached with another VNI
+	for _, name := range []string{"net-b", "net-c"} {
+		if err := o.Detach(networks[name]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if segment, err := o.Attach(networks["net-c"], 4242); err != nil || segment.vni != 4242 {
+		t.Fatalf("cannot attach with the VNI of a detached network: %v", err)
+	}
+}
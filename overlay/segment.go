@@ -0,0 +1,283 @@
+package overlay
+
+import (
+	"QemuUserNet/entities"
+	"QemuUserNet/modules"
+	"QemuUserNet/network"
+	"errors"
+	"fmt"
+	"net"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Peer is a remote daemon running the same network.
+type Peer struct {
+	Addr      *net.UDPAddr
+	added     time.Time
+	lastSeen  time.Time
+	txPackets uint64
+	txBytes   uint64
+	rxPackets uint64
+	rxBytes   uint64
+}
+
+// State returns the health of the tunnel to the peer: "up" if a packet was
+// received recently, "down" if the peer went silent and "unknown" if it
+// never answered.
+func (p *Peer) State() string {
+	switch {
+	case p.lastSeen.IsZero():
+		return "unknown"
+	case time.Since(p.lastSeen) > peerTimeout:
+		return "down"
+	default:
+		return "up"
+	}
+}
+
+// fdbEntry is a remote MAC address learned from a peer.
+type fdbEntry struct {
+	peer     *Peer
+	lastSeen time.Time
+}
+
+// Segment is the module inserted in the chain of a peered network. It sends
+// the frames of the local VMs to the peers owning the destination, and
+// floods broadcast and unknown unicast frames to every peer. Frames received
+// from a peer go through the port security and the modules of the network
+// like the frames of the local VMs, and are never sent to another peer, so
+// the peers of a network must form a full mesh.
+type Segment struct {
+	overlay *Overlay
+	network *network.Network
+	vni     uint32
+	mu      sync.Mutex
+	peers   map[string]*Peer
+	fdb     map[string]*fdbEntry
+}
+
+// newSegment creates a new Segment without any peer.
+func newSegment(o *Overlay, n *network.Network, vni uint32) *Segment {
+	return &Segment{overlay: o, network: n, vni: vni, peers: make(map[string]*Peer), fdb: make(map[string]*fdbEntry)}
+}
+
+// AddPeer adds a peer in the format host:port. The port defaults to the
+// VXLAN port.
+func (s *Segment) AddPeer(addr string) error {
+	udpAddr, err := resolvePeer(addr)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	if _, ok := s.peers[udpAddr.String()]; ok {
+		s.mu.Unlock()
+		return errors.New("This peer already exists")
+	}
+	peer := &Peer{Addr: udpAddr, added: time.Now()}
+	s.peers[udpAddr.String()] = peer
+	s.mu.Unlock()
+
+	// Announce ourselves right away so that the peer reports the tunnel up
+	s.overlay.send(s.vni, udpAddr, nil)
+	return nil
+}
+
+// RemovePeer removes a peer and the MAC addresses learned from it.
+func (s *Segment) RemovePeer(addr string) error {
+	udpAddr, err := resolvePeer(addr)
+	if err != nil {
+		return err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	peer, ok := s.peers[udpAddr.String()]
+	if !ok {
+		return errors.New("Peer not found")
+	}
+	delete(s.peers, udpAddr.String())
+	for mac, entry := range s.fdb {
+		if entry.peer == peer {
+			delete(s.fdb, mac)
+		}
+	}
+	return nil
+}
+
+// Empty checks if the segment has no peer left.
+func (s *Segment) Empty() bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return len(s.peers) == 0
+}
+
+// Describe returns a human readable description of the peers and of the
+// health of their tunnels.
+func (s *Segment) Describe() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	macs := make(map[*Peer]int)
+	for _, entry := range s.fdb {
+		macs[entry.peer]++
+	}
+	var addrs []string
+	for addr := range s.peers {
+		addrs = append(addrs, addr)
+	}
+	sort.Strings(addrs)
+
+	lines := []string{"PEER			VNI		STATE	LAST SEEN	TX	RX	MACS"}
+	for _, addr := range addrs {
+		peer := s.peers[addr]
+		lastSeen := "never"
+		if !peer.lastSeen.IsZero() {
+			lastSeen = time.Since(peer.lastSeen).Truncate(time.Second).String()
+		}
+		lines = append(lines, fmt.Sprintf("%s		%d	%s	%s		%d	%d	%d",
+			addr, s.vni, peer.State(), lastSeen, peer.txPackets, peer.rxPackets, macs[peer]))
+	}
+	return lines
+}
+
+// Listen sends the frames of the local VMs to the peers. Broadcast and
+// multicast frames are also left to the next modules so that they reach the
+// local VMs, and so are the frames received from the peers.
+func (s *Segment) Listen(packet gopacket.Packet) modules.Result {
+	etherLayer := packet.Layer(layers.LayerTypeEthernet)
+	if etherLayer == nil {
+		return modules.Pass()
+	}
+	eth, _ := etherLayer.(*layers.Ethernet)
+	// The frames of the peers never come from a local port, see receive
+	if _, err := s.network.Clients.GetPortByAddr(eth.SrcMAC); err != nil {
+		return modules.Pass()
+	}
+
+	if eth.DstMAC[0]&0x01 == 1 {
+		s.flood(packet.Data())
+		return modules.Pass()
+	}
+	if _, err := s.network.Clients.GetPortByMac(eth.DstMAC.String()); err == nil {
+		return modules.Pass()
+	}
+
+	s.mu.Lock()
+	entry, ok := s.fdb[eth.DstMAC.String()]
+	s.mu.Unlock()
+	if ok {
+		s.sendTo(entry.peer, packet.Data())
+	} else {
+		s.flood(packet.Data())
+	}
+	return modules.Consumed()
+}
+
+// Selects checks if a frame is flooded or addressed to a MAC address that is
+// not local.
+func (s *Segment) Selects(frame *modules.Frame) bool {
+	if frame.DstMAC[0]&0x01 == 1 {
+		return true
+	}
+	_, err := s.network.Clients.GetPortByAddr(frame.DstMAC)
+	return err != nil
+}
+
+// Quit handles any necessary cleanup for a client when it disconnects. Currently, it does nothing.
+func (s *Segment) Quit(client *entities.Thread) error {
+	return nil
+}
+
+// receive passes a frame received from a peer through the modules of the
+// network, and learns the MAC address of its sender.
+func (s *Segment) receive(src *net.UDPAddr, frame []byte) {
+	s.mu.Lock()
+	peer, ok := s.peers[src.String()]
+	if !ok {
+		s.mu.Unlock()
+		return
+	}
+	peer.lastSeen = time.Now()
+	if len(frame) < 14 {
+		// Keepalive
+		s.mu.Unlock()
+		return
+	}
+	peer.rxPackets++
+	peer.rxBytes += uint64(len(frame))
+
+	srcMAC := net.HardwareAddr(frame[6:12])
+	if srcMAC[0]&0x01 == 1 {
+		s.mu.Unlock()
+		return
+	}
+	if _, err := s.network.Clients.GetPortByMac(srcMAC.String()); err == nil {
+		// A remote frame must not impersonate a local VM
+		s.mu.Unlock()
+		return
+	}
+	s.fdb[srcMAC.String()] = &fdbEntry{peer: peer, lastSeen: time.Now()}
+	s.mu.Unlock()
+
+	s.network.Receive(frame)
+}
+
+// flood sends a frame to every peer.
+func (s *Segment) flood(frame []byte) {
+	s.mu.Lock()
+	peers := make([]*Peer, 0, len(s.peers))
+	for _, peer := range s.peers {
+		peers = append(peers, peer)
+	}
+	s.mu.Unlock()
+
+	for _, peer := range peers {
+		s.sendTo(peer, frame)
+	}
+}
+
+// sendTo sends a frame to a peer.
+func (s *Segment) sendTo(peer *Peer, frame []byte) {
+	if err := s.overlay.send(s.vni, peer.Addr, frame); err != nil {
+		return
+	}
+	s.mu.Lock()
+	peer.txPackets++
+	peer.txBytes += uint64(len(frame))
+	s.mu.Unlock()
+}
+
+// tick sends a keepalive to every peer and forgets the remote MAC addresses
+// that were not seen recently.
+func (s *Segment) tick() {
+	s.mu.Lock()
+	var addrs []*net.UDPAddr
+	for _, peer := range s.peers {
+		addrs = append(addrs, peer.Addr)
+	}
+	for mac, entry := range s.fdb {
+		if time.Since(entry.lastSeen) > fdbTimeout {
+			delete(s.fdb, mac)
+		}
+	}
+	s.mu.Unlock()
+
+	for _, addr := range addrs {
+		s.overlay.send(s.vni, addr, nil)
+	}
+}
+
+// resolvePeer parses the address of a peer in the format host[:port].
+func resolvePeer(addr string) (*net.UDPAddr, error) {
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(addr, strconv.Itoa(DefaultPort))
+	}
+	return net.ResolveUDPAddr("udp", addr)
+}
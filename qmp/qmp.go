@@ -0,0 +1,309 @@
+// Package qmp speaks the QEMU Machine Protocol with the monitor of a running
+// VM, to hot-plug its network cards and to unplug them.
+package qmp
+
+import (
+	"QemuUserNet/tools"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// timeout bounds the connection to a monitor and every command.
+	timeout = 5 * time.Second
+	// unplugTimeout is the time the guest is given to release a device.
+	unplugTimeout = 10 * time.Second
+)
+
+// Event is an asynchronous event sent by QEMU.
+type Event struct {
+	Event string          `json:"event"` // Name of the event
+	Data  json.RawMessage `json:"data"`  // Data of the event
+}
+
+// message is any of the messages sent by QEMU: the greeting, the response
+// to a command or an event.
+type message struct {
+	QMP    json.RawMessage `json:"QMP"`
+	ID     uint64          `json:"id"`
+	Return json.RawMessage `json:"return"`
+	Error  *struct {
+		Class string `json:"class"`
+		Desc  string `json:"desc"`
+	} `json:"error"`
+	Event string          `json:"event"`
+	Data  json.RawMessage `json:"data"`
+}
+
+// Monitor is a connection to the QMP socket of a VM. A QMP socket accepts a
+// single client, so the connection is shared by everyone using the socket:
+// see Open.
+type Monitor struct {
+	path        string
+	refs        int // Number of users of the connection, guarded by monitorsMu
+	conn        net.Conn
+	mu          sync.Mutex // Serialises the commands
+	id          uint64
+	responses   chan message
+	subscribers map[chan Event]struct{}
+	eventsMu    sync.Mutex
+	done        chan struct{}
+}
+
+var (
+	monitorsMu sync.Mutex
+	monitors   = make(map[string]*Monitor)
+)
+
+// Open returns the monitor of the QMP socket at path, connecting to it unless
+// a connection is already open. Every call must be followed by a call to
+// Release.
+func Open(path string) (*Monitor, error) {
+	monitorsMu.Lock()
+	defer monitorsMu.Unlock()
+	if m, ok := monitors[path]; ok {
+		select {
+		case <-m.done:
+			// QEMU closed the connection, it may have been restarted
+		default:
+			m.refs++
+			return m, nil
+		}
+	}
+	m, err := dial(path)
+	if err != nil {
+		return nil, err
+	}
+	m.refs = 1
+	monitors[path] = m
+	return m, nil
+}
+
+// Release gives a monitor obtained with Open back. The connection is closed
+// when its last user releases it.
+func (m *Monitor) Release() {
+	monitorsMu.Lock()
+	defer monitorsMu.Unlock()
+	m.refs--
+	if m.refs > 0 {
+		return
+	}
+	if monitors[m.path] == m {
+		delete(monitors, m.path)
+	}
+	m.conn.Close()
+}
+
+// dial connects to the QMP socket at path and enters the command mode.
+func dial(path string) (*Monitor, error) {
+	conn, err := net.DialTimeout("unix", path, timeout)
+	if err != nil {
+		return nil, fmt.Errorf("cannot connect to the QMP socket %s: %s", path, err.Error())
+	}
+	decoder := json.NewDecoder(conn)
+	var greeting message
+	conn.SetReadDeadline(time.Now().Add(timeout))
+	if err := decoder.Decode(&greeting); err != nil || greeting.QMP == nil {
+		conn.Close()
+		return nil, fmt.Errorf("no QMP greeting on %s", path)
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	m := &Monitor{
+		path:        path,
+		conn:        conn,
+		responses:   make(chan message, 16),
+		subscribers: make(map[chan Event]struct{}),
+		done:        make(chan struct{}),
+	}
+	go m.read(decoder)
+	if _, err := m.Execute("qmp_capabilities", nil); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return m, nil
+}
+
+// read dispatches the messages sent by QEMU until the connection is closed.
+// Responses nobody waits for any more and events a subscriber does not read
+// in time are dropped.
+func (m *Monitor) read(decoder *json.Decoder) {
+	defer close(m.done)
+	for {
+		var msg message
+		if err := decoder.Decode(&msg); err != nil {
+			return
+		}
+		if msg.Event != "" {
+			event := Event{Event: msg.Event, Data: msg.Data}
+			m.eventsMu.Lock()
+			for subscriber := range m.subscribers {
+				select {
+				case subscriber <- event:
+				default:
+				}
+			}
+			m.eventsMu.Unlock()
+			continue
+		}
+		select {
+		case m.responses <- msg:
+		default:
+		}
+	}
+}
+
+// Execute runs a command and returns its result, or the error reported by
+// QEMU.
+func (m *Monitor) Execute(command string, arguments interface{}) (json.RawMessage, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.id++
+	request, err := json.Marshal(struct {
+		Execute   string      `json:"execute"`
+		Arguments interface{} `json:"arguments,omitempty"`
+		ID        uint64      `json:"id"`
+	}{command, arguments, m.id})
+	if err != nil {
+		return nil, err
+	}
+	m.conn.SetWriteDeadline(time.Now().Add(timeout))
+	if _, err := m.conn.Write(append(request, '\n')); err != nil {
+		return nil, fmt.Errorf("%s: %s", command, err.Error())
+	}
+
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	for {
+		select {
+		case msg := <-m.responses:
+			if msg.ID != m.id {
+				// Late response to a command that timed out
+				continue
+			}
+			if msg.Error != nil {
+				return nil, fmt.Errorf("%s: %s", command, msg.Error.Desc)
+			}
+			return msg.Return, nil
+		case <-m.done:
+			return nil, fmt.Errorf("%s: QMP connection closed", command)
+		case <-timer.C:
+			return nil, fmt.Errorf("%s: no response from QEMU", command)
+		}
+	}
+}
+
+// Subscribe returns a channel receiving the events sent by QEMU from now
+// on, and the function to call once they are not read any more.
+func (m *Monitor) Subscribe() (<-chan Event, func()) {
+	events := make(chan Event, 16)
+	m.eventsMu.Lock()
+	m.subscribers[events] = struct{}{}
+	m.eventsMu.Unlock()
+	return events, func() {
+		m.eventsMu.Lock()
+		delete(m.subscribers, events)
+		m.eventsMu.Unlock()
+	}
+}
+
+// Done returns a channel closed when the connection is closed, by QEMU
+// exiting for instance.
+func (m *Monitor) Done() <-chan struct{} {
+	return m.done
+}
+
+// waitDeviceDeleted waits for the guest to release the device id. events
+// must have been subscribed to before the device was deleted.
+func (m *Monitor) waitDeviceDeleted(events <-chan Event, id string, wait time.Duration) error {
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	for {
+		select {
+		case <-m.done:
+			return errors.New("QMP connection closed")
+		case event := <-events:
+			if event.Event != "DEVICE_DELETED" {
+				continue
+			}
+			var data struct {
+				Device string `json:"device"`
+			}
+			if json.Unmarshal(event.Data, &data) == nil && data.Device == id {
+				return nil
+			}
+		case <-timer.C:
+			return fmt.Errorf("the guest did not release %s", id)
+		}
+	}
+}
+
+// HotPlug adds the netdev and the network card of nic to the running VM
+// whose QMP socket is at path. If a command fails, the objects already added
+// are removed.
+func HotPlug(path string, nic tools.QemuNIC) error {
+	commands, err := tools.QmpAddCommands(nic)
+	if err != nil {
+		return err
+	}
+	m, err := Open(path)
+	if err != nil {
+		return err
+	}
+	defer m.Release()
+
+	for i, command := range commands {
+		if _, err := m.Execute(command.Execute, command.Arguments); err != nil {
+			for j := i - 1; j >= 0; j-- {
+				switch commands[j].Execute {
+				case "netdev_add":
+					m.Execute("netdev_del", map[string]string{"id": nic.NetdevID})
+				case "chardev-add":
+					m.Execute("chardev-remove", map[string]string{"id": tools.ChardevID(nic.NetdevID)})
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// HotUnplug removes the network card of nic and its netdev from the running
+// VM whose QMP socket is at path. The netdev is removed once the guest has
+// released the card, or after a timeout.
+func HotUnplug(path string, nic tools.QemuNIC) error {
+	m, err := Open(path)
+	if err != nil {
+		return err
+	}
+	defer m.Release()
+
+	events, unsubscribe := m.Subscribe()
+	defer unsubscribe()
+
+	var errs []string
+	id := tools.DeviceID(nic.NetdevID)
+	if _, err := m.Execute("device_del", map[string]string{"id": id}); err != nil {
+		errs = append(errs, err.Error())
+	} else if err := m.waitDeviceDeleted(events, id, unplugTimeout); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if _, err := m.Execute("netdev_del", map[string]string{"id": nic.NetdevID}); err != nil {
+		errs = append(errs, err.Error())
+	}
+	if nic.Transport == "vhost-user" {
+		if _, err := m.Execute("chardev-remove", map[string]string{"id": tools.ChardevID(nic.NetdevID)}); err != nil {
+			errs = append(errs, err.Error())
+		}
+	}
+	if len(errs) > 0 {
+		return errors.New(strings.Join(errs, ", "))
+	}
+	return nil
+}
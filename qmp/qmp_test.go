@@ -0,0 +1,266 @@
+package qmp
+
+import (
+	"QemuUserNet/tools"
+	"encoding/json"
+	"net"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// request is a command received by the fake QEMU.
+type request struct {
+	Execute   string                 `json:"execute"`
+	Arguments map[string]interface{} `json:"arguments"`
+	ID        json.RawMessage        `json:"id"`
+}
+
+// fakeQemu is a QMP server answering the commands with reply.
+type fakeQemu struct {
+	path     string
+	listener net.Listener
+	mu       sync.Mutex
+	commands []request
+	conn     net.Conn
+	// reply returns the error of a command, empty on success, and the
+	// events sent after the response.
+	reply func(request) (string, []string)
+}
+
+// newFakeQemu starts a QMP server accepting a single client at a time.
+func newFakeQemu(t *testing.T, reply func(request) (string, []string)) *fakeQemu {
+	path := filepath.Join(t.TempDir(), "qmp.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	q := &fakeQemu{path: path, listener: listener, reply: reply}
+	go q.serve()
+	t.Cleanup(func() {
+		listener.Close()
+		q.mu.Lock()
+		if q.conn != nil {
+			q.conn.Close()
+		}
+		q.mu.Unlock()
+	})
+	return q
+}
+
+func (q *fakeQemu) serve() {
+	for {
+		conn, err := q.listener.Accept()
+		if err != nil {
+			return
+		}
+		q.mu.Lock()
+		q.conn = conn
+		q.mu.Unlock()
+		q.session(conn)
+	}
+}
+
+// session talks to a client: greeting, then the capabilities negotiation
+// and the commands.
+func (q *fakeQemu) session(conn net.Conn) {
+	defer conn.Close()
+	encoder := json.NewEncoder(conn)
+	decoder := json.NewDecoder(conn)
+	encoder.Encode(map[string]interface{}{"QMP": map[string]interface{}{"version": map[string]interface{}{}, "capabilities": []string{"oob"}}})
+	negotiated := false
+	for {
+		var req request
+		if err := decoder.Decode(&req); err != nil {
+			return
+		}
+		q.mu.Lock()
+		q.commands = append(q.commands, req)
+		q.mu.Unlock()
+
+		desc, events := "", []string(nil)
+		switch {
+		case req.Execute == "qmp_capabilities":
+			negotiated = true
+		case !negotiated:
+			desc = "Expecting capabilities negotiation with 'qmp_capabilities'"
+		default:
+			desc, events = q.reply(req)
+		}
+		if desc != "" {
+			encoder.Encode(map[string]interface{}{"error": map[string]string{"class": "GenericError", "desc": desc}, "id": req.ID})
+		} else {
+			encoder.Encode(map[string]interface{}{"return": map[string]string{}, "id": req.ID})
+		}
+		for _, event := range events {
+			conn.Write([]byte(event + "\n"))
+		}
+	}
+}
+
+// executed returns the names of the commands received, in order.
+func (q *fakeQemu) executed() []string {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+	var names []string
+	for _, req := range q.commands {
+		names = append(names, req.Execute)
+	}
+	return names
+}
+
+// deviceDeleted is the event sent once the guest released the device id.
+func deviceDeleted(id string) string {
+	return `{"event": "DEVICE_DELETED", "data": {"device": "` + id + `", "path": "/machine/peripheral/` + id + `"}, "timestamp": {"seconds": 1, "microseconds": 0}}`
+}
+
+func testNIC(transport string) tools.QemuNIC {
+	return tools.QemuNIC{Transport: transport, NetdevID: "net-test", RemoteSocket: "/tmp/remote.sock", LocalSocket: "/tmp/local.sock", Mac: "52:54:00:12:34:56", Model: "virtio-net-pci"}
+}
+
+func TestCapabilitiesNegotiation(t *testing.T) {
+	q := newFakeQemu(t, func(request) (string, []string) { return "", nil })
+	m, err := Open(q.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer m.Release()
+	if _, err := m.Execute("query-status", nil); err != nil {
+		t.Fatal(err)
+	}
+	if got := strings.Join(q.executed(), ","); got != "qmp_capabilities,query-status" {
+		t.Fatalf("commands %s", got)
+	}
+
+	// The connection is shared by the users of the socket
+	other, err := Open(q.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if other != m {
+		t.Fatal("a second connection was opened")
+	}
+	other.Release()
+}
+
+func TestNoGreeting(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "qmp.sock")
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			conn.Write([]byte("{\"return\": {}}\n"))
+			defer conn.Close()
+			time.Sleep(time.Second)
+		}
+	}()
+	if _, err := Open(path); err == nil || !strings.Contains(err.Error(), "no QMP greeting") {
+		t.Fatalf("error %v, want no QMP greeting", err)
+	}
+}
+
+func TestHotPlug(t *testing.T) {
+	tests := []struct {
+		name      string
+		transport string
+		fail      string // Command failing
+		want      string // Commands executed after the negotiation
+		err       string
+	}{
+		{"dgram", "dgram", "", "netdev_add,device_add", ""},
+		{"vhost-user", "vhost-user", "", "chardev-add,netdev_add,device_add", ""},
+		{"device error", "dgram", "device_add", "netdev_add,device_add,netdev_del", "device_add: Bus 'pci.1' not found"},
+		{"vhost-user device error", "vhost-user", "device_add", "chardev-add,netdev_add,device_add,netdev_del,chardev-remove", "device_add: Bus 'pci.1' not found"},
+		{"netdev error", "dgram", "netdev_add", "netdev_add", "netdev_add: Duplicate ID 'net-test' for netdev"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			q := newFakeQemu(t, func(req request) (string, []string) {
+				switch {
+				case req.Execute != test.fail:
+					return "", nil
+				case req.Execute == "device_add":
+					return "Bus 'pci.1' not found", nil
+				default:
+					return "Duplicate ID 'net-test' for netdev", nil
+				}
+			})
+			err := HotPlug(q.path, testNIC(test.transport))
+			if test.err == "" && err != nil || test.err != "" && (err == nil || err.Error() != test.err) {
+				t.Fatalf("error %v, want %q", err, test.err)
+			}
+			if got := strings.Join(q.executed()[1:], ","); got != test.want {
+				t.Fatalf("commands %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestHotUnplug(t *testing.T) {
+	nic := testNIC("vhost-user")
+	id := tools.DeviceID(nic.NetdevID)
+	q := newFakeQemu(t, func(req request) (string, []string) {
+		if req.Execute == "device_del" {
+			// Events of other devices are skipped
+			return "", []string{deviceDeleted("other"), `{"event": "NIC_RX_FILTER_CHANGED", "data": {}}`, deviceDeleted(id)}
+		}
+		return "", nil
+	})
+	start := time.Now()
+	if err := HotUnplug(q.path, nic); err != nil {
+		t.Fatal(err)
+	}
+	if time.Since(start) > time.Second {
+		t.Fatal("the DEVICE_DELETED event was not seen")
+	}
+	if got := strings.Join(q.executed()[1:], ","); got != "device_del,netdev_del,chardev-remove" {
+		t.Fatalf("commands %s", got)
+	}
+}
+
+func TestHotUnplugErrors(t *testing.T) {
+	q := newFakeQemu(t, func(req request) (string, []string) {
+		switch req.Execute {
+		case "device_del":
+			return "Device 'dev-net-test' not found", nil
+		case "netdev_del":
+			return "Device 'net-test' not found", nil
+		}
+		return "", nil
+	})
+	err := HotUnplug(q.path, testNIC("dgram"))
+	if err == nil || err.Error() != "device_del: Device 'dev-net-test' not found, netdev_del: Device 'net-test' not found" {
+		t.Fatalf("error %v", err)
+	}
+}
+
+func TestWaitDeviceDeleted(t *testing.T) {
+	q := newFakeQemu(t, func(request) (string, []string) { return "", nil })
+	m, err := Open(q.path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	events, unsubscribe := m.Subscribe()
+	defer unsubscribe()
+	if err := m.waitDeviceDeleted(events, "dev", 100*time.Millisecond); err == nil || !strings.Contains(err.Error(), "did not release") {
+		t.Fatalf("error %v, want a timeout", err)
+	}
+
+	// QEMU exiting ends the wait
+	q.mu.Lock()
+	q.conn.Close()
+	q.mu.Unlock()
+	if err := m.waitDeviceDeleted(events, "dev", 5*time.Second); err == nil || !strings.Contains(err.Error(), "closed") {
+		t.Fatalf("error %v, want the connection closed", err)
+	}
+	if _, err := m.Execute("query-status", nil); err == nil {
+		t.Fatal("command executed on a closed connection")
+	}
+	m.Release()
+}
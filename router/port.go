@@ -0,0 +1,147 @@
+package router
+
+import (
+	"QemuUserNet/entities"
+	"QemuUserNet/modules"
+	"bytes"
+	"errors"
+	"net"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// port is the module inserted in the chain of an attached network. It
+// answers ARP requests and pings for the router address and hands the
+// frames sent to the router MAC address over to the router.
+type port struct {
+	router *Router
+	iface  *Interface
+}
+
+// Listen processes a network packet seen on the attached network.
+func (p *port) Listen(packet gopacket.Packet) modules.Result {
+	etherLayer := packet.Layer(layers.LayerTypeEthernet)
+	if etherLayer == nil {
+		return modules.Pass()
+	}
+	eth, _ := etherLayer.(*layers.Ethernet)
+
+	if arpLayer := packet.Layer(layers.LayerTypeARP); arpLayer != nil {
+		return p.handleArp(packet, eth, arpLayer.(*layers.ARP))
+	}
+
+	if !bytes.Equal(eth.DstMAC, p.iface.MAC) {
+		return modules.Pass()
+	}
+
+	// The router only routes IPv4
+	ipLayer := packet.Layer(layers.LayerTypeIPv4)
+	if ipLayer == nil {
+		return modules.Dropped()
+	}
+	ip, _ := ipLayer.(*layers.IPv4)
+	p.router.learn(p.iface, ip.SrcIP, eth.SrcMAC)
+
+	if p.router.isLocal(ip.DstIP) {
+		if reply, err := p.handleEcho(eth, ip, packet); err == nil {
+			return modules.Send(reply, modules.Himself, nil)
+		}
+		return modules.Dropped()
+	}
+
+	if err := p.router.forward(p.iface, packet.Data()); err != nil {
+		logForwardError(err)
+	}
+	return modules.Consumed()
+}
+
+// handleArp answers ARP requests for the router address and learns the
+// neighbours from the ARP traffic of the network.
+func (p *port) handleArp(packet gopacket.Packet, eth *layers.Ethernet, arp *layers.ARP) modules.Result {
+	sender := net.IP(arp.SourceProtAddress)
+	p.router.learn(p.iface, sender, net.HardwareAddr(arp.SourceHwAddress))
+
+	target := net.IP(arp.DstProtAddress)
+	if arp.Operation == layers.ARPReply && target.Equal(p.iface.IP) {
+		return modules.Consumed()
+	}
+	if arp.Operation != layers.ARPRequest || !target.Equal(p.iface.IP) {
+		return modules.Pass()
+	}
+
+	responseARP := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPReply,
+		SourceHwAddress:   p.iface.MAC,
+		SourceProtAddress: arp.DstProtAddress,
+		DstHwAddress:      arp.SourceHwAddress,
+		DstProtAddress:    arp.SourceProtAddress,
+	}
+	responseEthernet := &layers.Ethernet{
+		SrcMAC:       p.iface.MAC,
+		DstMAC:       eth.SrcMAC,
+		EthernetType: layers.EthernetTypeARP,
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, responseEthernet, responseARP); err != nil {
+		return modules.Pass()
+	}
+	return modules.Send(buf.Bytes(), modules.Himself, nil)
+}
+
+// handleEcho answers the ICMP echo requests sent to a router address.
+func (p *port) handleEcho(eth *layers.Ethernet, ip *layers.IPv4, packet gopacket.Packet) ([]byte, error) {
+	icmpLayer := packet.Layer(layers.LayerTypeICMPv4)
+	if icmpLayer == nil {
+		return nil, errors.New("Not an ICMP packet")
+	}
+	icmp, _ := icmpLayer.(*layers.ICMPv4)
+	if icmp.TypeCode.Type() != layers.ICMPv4TypeEchoRequest {
+		return nil, errors.New("Not an echo request")
+	}
+
+	responseEther := &layers.Ethernet{
+		SrcMAC:       p.iface.MAC,
+		DstMAC:       eth.SrcMAC,
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	responseIP := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		SrcIP:    ip.DstIP,
+		DstIP:    ip.SrcIP,
+		Protocol: layers.IPProtocolICMPv4,
+	}
+	responseICMP := &layers.ICMPv4{
+		TypeCode: layers.CreateICMPv4TypeCode(layers.ICMPv4TypeEchoReply, 0),
+		Id:       icmp.Id,
+		Seq:      icmp.Seq,
+	}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, responseEther, responseIP, responseICMP, gopacket.Payload(icmp.Payload)); err != nil {
+		return nil, errors.New("Packet serialization error")
+	}
+	return buf.Bytes(), nil
+}
+
+// Selects checks if a frame is an ARP packet or is addressed to the router.
+func (p *port) Selects(frame *modules.Frame) bool {
+	return frame.EtherType == layers.EthernetTypeARP || bytes.Equal(frame.DstMAC, p.iface.MAC)
+}
+
+// Quit removes the ARP entry of a client when it disconnects.
+func (p *port) Quit(client *entities.Thread) error {
+	if ip := client.IP(); ip != nil {
+		p.router.forget(p.iface, *ip)
+	}
+	return nil
+}
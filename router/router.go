@@ -0,0 +1,389 @@
+// Package router provides a layer 3 router that forwards IPv4 packets
+// between several QemuUserNet networks. The router is attached to each
+// network through the gateway address of the network, so VMs configured by
+// the DHCP module use it as their default route without further setup.
+package router
+
+import (
+	"QemuUserNet/network"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"sync"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+// Interface represents the attachment of a router to a network.
+type Interface struct {
+	Network *network.Network
+	IP      net.IP
+	MAC     net.HardwareAddr
+	Subnet  *net.IPNet
+	port    *port
+	arp     map[string]net.HardwareAddr
+}
+
+// Route is a static route of the routing table.
+type Route struct {
+	Destination *net.IPNet
+	NextHop     net.IP
+}
+
+// Router forwards packets between the networks it is attached to.
+type Router struct {
+	Name       string
+	mu         sync.Mutex
+	interfaces []*Interface
+	routes     []Route
+}
+
+// NewRouter creates a new Router without any interface or route.
+func NewRouter(name string) (*Router, error) {
+	if name == "" {
+		return nil, errors.New("Invalid router name")
+	}
+	return &Router{Name: name}, nil
+}
+
+// Attach connects the router to a network using the gateway IP and MAC
+// addresses of the network. The router answers ARP requests for the gateway
+// and forwards the packets that VMs send to it.
+func (r *Router) Attach(n *network.Network) error {
+	if n.GatewayIP == nil || n.GatewayMAC == nil || n.Subnet == nil {
+		return errors.New("The network has no gateway")
+	}
+
+	r.mu.Lock()
+	for _, iface := range r.interfaces {
+		if iface.Network == n {
+			r.mu.Unlock()
+			return errors.New("The router is already attached to this network")
+		}
+		if iface.Subnet.Contains(n.GatewayIP) || n.Subnet.Contains(iface.IP) {
+			r.mu.Unlock()
+			return fmt.Errorf("The subnet %s overlaps the network %s", n.Subnet.String(), iface.Network.Name)
+		}
+	}
+
+	iface := &Interface{
+		Network: n,
+		IP:      n.GatewayIP.To4(),
+		MAC:     n.GatewayMAC,
+		Subnet:  n.Subnet,
+		arp:     make(map[string]net.HardwareAddr),
+	}
+	iface.port = &port{router: r, iface: iface}
+	if err := n.InsertModule("router:"+r.Name, iface.port); err != nil {
+		r.mu.Unlock()
+		return err
+	}
+	r.interfaces = append(r.interfaces, iface)
+	r.mu.Unlock()
+	return nil
+}
+
+// Detach disconnects the router from a network. Routes whose next hop is no
+// longer reachable are kept but ignored until the network is attached again.
+func (r *Router) Detach(n *network.Network) error {
+	r.mu.Lock()
+	var updated []*Interface
+	var removed *Interface
+	for _, iface := range r.interfaces {
+		if iface.Network == n {
+			removed = iface
+		} else {
+			updated = append(updated, iface)
+		}
+	}
+	r.interfaces = updated
+	r.mu.Unlock()
+
+	if removed == nil {
+		return errors.New("The router is not attached to this network")
+	}
+	n.RemoveModule(removed.port)
+	return nil
+}
+
+// AddRoute adds a static route to the routing table. The next hop must be
+// reachable through one of the networks the router is attached to.
+func (r *Router) AddRoute(destination string, nextHop string) error {
+	_, dst, err := net.ParseCIDR(destination)
+	if err != nil {
+		return err
+	}
+	gw := net.ParseIP(nextHop).To4()
+	if gw == nil {
+		return errors.New("Invalid next hop")
+	}
+
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.connected(gw) == nil {
+		return errors.New("The next hop is not reachable from an attached network")
+	}
+	for _, route := range r.routes {
+		if route.Destination.String() == dst.String() {
+			return errors.New("A route already exists for this destination")
+		}
+	}
+	r.routes = append(r.routes, Route{Destination: dst, NextHop: gw})
+	return nil
+}
+
+// Describe returns a human readable description of the interfaces and the
+// routing table of the router.
+func (r *Router) Describe() []string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	lines := []string{"-" + r.Name + "-------------------------------------------------------------------------------------------"}
+	lines = append(lines, "NETWORK	IP		MAC			SUBNET")
+	for _, iface := range r.interfaces {
+		lines = append(lines, iface.Network.Name+"	"+iface.IP.String()+"	"+iface.MAC.String()+"	"+iface.Subnet.String())
+	}
+	lines = append(lines, "DESTINATION		NEXT HOP")
+	for _, iface := range r.interfaces {
+		lines = append(lines, iface.Subnet.String()+"		connected ("+iface.Network.Name+")")
+	}
+	for _, route := range r.routes {
+		lines = append(lines, route.Destination.String()+"		"+route.NextHop.String())
+	}
+	return lines
+}
+
+// connected returns the interface whose subnet contains ip. The caller must
+// hold the router lock.
+func (r *Router) connected(ip net.IP) *Interface {
+	for _, iface := range r.interfaces {
+		if iface.Subnet.Contains(ip) {
+			return iface
+		}
+	}
+	return nil
+}
+
+// lookup selects the egress interface and the next hop for a destination
+// using the longest prefix match over connected networks and static routes.
+func (r *Router) lookup(dst net.IP) (*Interface, net.IP, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var bestIface *Interface
+	var bestHop net.IP
+	bestLen := -1
+	for _, iface := range r.interfaces {
+		if ones, _ := iface.Subnet.Mask.Size(); iface.Subnet.Contains(dst) && ones > bestLen {
+			bestIface, bestHop, bestLen = iface, dst, ones
+		}
+	}
+	for _, route := range r.routes {
+		if ones, _ := route.Destination.Mask.Size(); route.Destination.Contains(dst) && ones > bestLen {
+			if iface := r.connected(route.NextHop); iface != nil {
+				bestIface, bestHop, bestLen = iface, route.NextHop, ones
+			}
+		}
+	}
+	if bestIface == nil {
+		return nil, nil, errors.New("No route to host")
+	}
+	return bestIface, bestHop, nil
+}
+
+// isLocal reports whether ip is one of the addresses of the router.
+func (r *Router) isLocal(ip net.IP) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for _, iface := range r.interfaces {
+		if iface.IP.Equal(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// learn records the MAC address of a neighbour on an interface.
+func (r *Router) learn(iface *Interface, ip net.IP, mac net.HardwareAddr) {
+	if ip.IsUnspecified() || bytes.Equal(mac, iface.MAC) {
+		return
+	}
+	r.mu.Lock()
+	iface.arp[ip.String()] = append(net.HardwareAddr{}, mac...)
+	r.mu.Unlock()
+}
+
+// forget removes the MAC address of a neighbour from an interface.
+func (r *Router) forget(iface *Interface, ip string) {
+	r.mu.Lock()
+	delete(iface.arp, ip)
+	r.mu.Unlock()
+}
+
+// resolve returns the MAC address of a neighbour on an interface. The ARP
+// cache is used first, then the addresses known by the network. When the
+// neighbour is unknown, an ARP request is sent and an error is returned.
+func (r *Router) resolve(iface *Interface, ip net.IP) (net.HardwareAddr, error) {
+	r.mu.Lock()
+	mac, ok := iface.arp[ip.String()]
+	r.mu.Unlock()
+	if ok {
+		return mac, nil
+	}
+
+	if client, err := iface.Network.Clients.GetClientByIP(ip.String()); err == nil {
+		if mac, err := net.ParseMAC(client.VM.Mac); err == nil {
+			return mac, nil
+		}
+	}
+
+	request, err := craftArpRequest(iface, ip)
+	if err != nil {
+		return nil, err
+	}
+	if err := iface.Network.Inject(request); err != nil {
+		return nil, err
+	}
+	return nil, fmt.Errorf("Neighbour %s unknown on network %s", ip.String(), iface.Network.Name)
+}
+
+// forward routes an IPv4 frame received on the ingress interface.
+func (r *Router) forward(ingress *Interface, frame []byte) error {
+	if len(frame) < 14+20 {
+		return errors.New("Frame too short")
+	}
+	header := frame[14:]
+	ihl := int(header[0]&0x0f) * 4
+	total := int(binary.BigEndian.Uint16(header[2:4]))
+	if ihl < 20 || total < ihl || total > len(header) {
+		return errors.New("Malformed IPv4 header")
+	}
+	src := net.IP(header[12:16])
+	dst := net.IP(header[16:20])
+
+	if header[8] <= 1 {
+		reply, err := craftIcmpError(ingress, frame[:14+total], layers.ICMPv4TypeTimeExceeded, layers.ICMPv4CodeTTLExceeded, 0)
+		if err != nil {
+			return err
+		}
+		return ingress.Network.Inject(reply)
+	}
+
+	egress, nextHop, err := r.lookup(dst)
+	if err != nil {
+		reply, e := craftIcmpError(ingress, frame[:14+total], layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeNet, 0)
+		if e == nil {
+			ingress.Network.Inject(reply)
+		}
+		return fmt.Errorf("%s -> %s: %s", src.String(), dst.String(), err.Error())
+	}
+	// The VMs of the egress network drop the packets larger than its MTU
+	if mtu := egress.Network.MTU - 14; total > mtu {
+		if binary.BigEndian.Uint16(header[6:8])&0x4000 != 0 {
+			reply, e := craftIcmpError(ingress, frame[:14+total], layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded, uint16(mtu))
+			if e == nil {
+				ingress.Network.Inject(reply)
+			}
+		}
+		return fmt.Errorf("%s -> %s: packet of %d bytes larger than the MTU %d of %s", src.String(), dst.String(), total, mtu, egress.Network.Name)
+	}
+	mac, err := r.resolve(egress, nextHop)
+	if err != nil {
+		return err
+	}
+
+	out := make([]byte, 14+total)
+	copy(out, frame[:14+total])
+	copy(out[0:6], mac)
+	copy(out[6:12], egress.MAC)
+	out[14+8]--
+	out[14+10], out[14+11] = 0, 0
+	binary.BigEndian.PutUint16(out[14+10:14+12], checksum(out[14:14+ihl]))
+
+	return egress.Network.Inject(out)
+}
+
+// checksum computes the Internet checksum of data.
+func checksum(data []byte) uint16 {
+	var sum uint32
+	for i := 0; i+1 < len(data); i += 2 {
+		sum += uint32(binary.BigEndian.Uint16(data[i : i+2]))
+	}
+	if len(data)%2 == 1 {
+		sum += uint32(data[len(data)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = (sum & 0xffff) + (sum >> 16)
+	}
+	return ^uint16(sum)
+}
+
+// craftArpRequest builds an ARP request for ip sent from an interface.
+func craftArpRequest(iface *Interface, ip net.IP) ([]byte, error) {
+	eth := &layers.Ethernet{
+		SrcMAC:       iface.MAC,
+		DstMAC:       net.HardwareAddr{0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		EthernetType: layers.EthernetTypeARP,
+	}
+	arp := &layers.ARP{
+		AddrType:          layers.LinkTypeEthernet,
+		Protocol:          layers.EthernetTypeIPv4,
+		HwAddressSize:     6,
+		ProtAddressSize:   4,
+		Operation:         layers.ARPRequest,
+		SourceHwAddress:   iface.MAC,
+		SourceProtAddress: iface.IP.To4(),
+		DstHwAddress:      net.HardwareAddr{0, 0, 0, 0, 0, 0},
+		DstProtAddress:    ip.To4(),
+	}
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, arp); err != nil {
+		return nil, errors.New("Packet serialization error")
+	}
+	return buf.Bytes(), nil
+}
+
+// craftIcmpError builds an ICMP error message about frame, sent back to its
+// source from an interface. nextHopMTU is the MTU announced by the
+// fragmentation needed errors, 0 for the other errors.
+func craftIcmpError(iface *Interface, frame []byte, icmpType uint8, icmpCode uint8, nextHopMTU uint16) ([]byte, error) {
+	original := frame[14:]
+	ihl := int(original[0]&0x0f) * 4
+	quoted := ihl + 8
+	if quoted > len(original) {
+		quoted = len(original)
+	}
+
+	eth := &layers.Ethernet{
+		SrcMAC:       iface.MAC,
+		DstMAC:       net.HardwareAddr(frame[6:12]),
+		EthernetType: layers.EthernetTypeIPv4,
+	}
+	ip := &layers.IPv4{
+		Version:  4,
+		IHL:      5,
+		TTL:      64,
+		SrcIP:    iface.IP,
+		DstIP:    net.IP(original[12:16]),
+		Protocol: layers.IPProtocolICMPv4,
+	}
+	icmp := &layers.ICMPv4{TypeCode: layers.CreateICMPv4TypeCode(icmpType, icmpCode), Seq: nextHopMTU}
+
+	buf := gopacket.NewSerializeBuffer()
+	opts := gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}
+	if err := gopacket.SerializeLayers(buf, opts, eth, ip, icmp, gopacket.Payload(original[:quoted])); err != nil {
+		return nil, errors.New("Packet serialization error")
+	}
+	return buf.Bytes(), nil
+}
+
+// logForwardError reports a forwarding failure without interrupting the
+// network listener.
+func logForwardError(err error) {
+	log.Println("WARNING: router: ", err.Error())
+}
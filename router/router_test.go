@@ -0,0 +1,291 @@
+package router
+
+import (
+	"QemuUserNet/entities"
+	"QemuUserNet/modules"
+	"QemuUserNet/network"
+	"bytes"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/google/gopacket"
+	"github.com/google/gopacket/layers"
+)
+
+var (
+	vmA     = net.HardwareAddr{0x52, 0x54, 0, 0, 1, 10}
+	vmB     = net.HardwareAddr{0x52, 0x54, 0, 0, 2, 10}
+	routerB = net.HardwareAddr{0x52, 0x54, 0, 0, 2, 254}
+)
+
+// recordTransport keeps the frames sent to a port.
+type recordTransport struct {
+	mu     sync.Mutex
+	frames [][]byte
+}
+
+func (r *recordTransport) ReadFrame(buffer []byte) (int, error) { select {} }
+func (r *recordTransport) Close() error                         { return nil }
+
+func (r *recordTransport) WriteFrame(frame []byte) error {
+	r.mu.Lock()
+	r.frames = append(r.frames, append([]byte{}, frame...))
+	r.mu.Unlock()
+	return nil
+}
+
+// take returns the frames sent to the port since the last call.
+func (r *recordTransport) take() [][]byte {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	frames := r.frames
+	r.frames = nil
+	return frames
+}
+
+// testNetwork returns a network whose gateway is the first address of cidr.
+func testNetwork(t *testing.T, name string, cidr string, mtu int) *network.Network {
+	_, subnet, err := net.ParseCIDR(cidr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	gateway := append(net.IP{}, subnet.IP.To4()...)
+	gateway[3] = 1
+	return &network.Network{
+		Name:       name,
+		MTU:        mtu + 14,
+		Subnet:     subnet,
+		GatewayIP:  gateway,
+		GatewayMAC: net.HardwareAddr{0x52, 0x54, 0, 0xff, gateway[2], 1},
+		Clients:    &entities.Clients{},
+		Pipeline:   modules.NewPipeline(),
+	}
+}
+
+// addPort connects a VM with the addresses mac and ip to n and returns the
+// frames it receives.
+func addPort(t *testing.T, n *network.Network, id string, mac net.HardwareAddr, ip string) *recordTransport {
+	transport := &recordTransport{}
+	thread := entities.NewThread(entities.VM{ID: id, Mac: mac.String()}, transport, false)
+	if err := n.Clients.Add(thread); err != nil {
+		t.Fatal(err)
+	}
+	if err := n.Clients.SetIP(thread, ip, true); err != nil {
+		t.Fatal(err)
+	}
+	return transport
+}
+
+// testRouter attaches a router to net-a, 10.0.1.0/24, and to net-b,
+// 10.0.2.0/24 with an MTU of 576, each with a VM, net-b having a second
+// router at 10.0.2.254. 172.16.0.0/16 is routed through the second router,
+// 172.16.5.0/24 through 10.0.1.254, and 192.168.0.0/16 through a network
+// detached since.
+func testRouter(t *testing.T) (*Router, map[string]*recordTransport) {
+	a := testNetwork(t, "net-a", "10.0.1.0/24", entities.DefaultMTU)
+	b := testNetwork(t, "net-b", "10.0.2.0/24", 576)
+	c := testNetwork(t, "net-c", "10.0.3.0/24", entities.DefaultMTU)
+	ports := map[string]*recordTransport{
+		"vm-a":     addPort(t, a, "vm-a", vmA, "10.0.1.10"),
+		"vm-b":     addPort(t, b, "vm-b", vmB, "10.0.2.10"),
+		"router-b": addPort(t, b, "router-b", routerB, "10.0.2.254"),
+	}
+
+	r, _ := NewRouter("r1")
+	for _, n := range []*network.Network{a, b, c} {
+		if err := r.Attach(n); err != nil {
+			t.Fatal(err)
+		}
+	}
+	routes := [][2]string{
+		{"172.16.0.0/16", "10.0.2.254"},
+		{"172.16.5.0/24", "10.0.1.254"},
+		{"192.168.0.0/16", "10.0.3.254"},
+	}
+	for _, route := range routes {
+		if err := r.AddRoute(route[0], route[1]); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := r.Detach(c); err != nil {
+		t.Fatal(err)
+	}
+	return r, ports
+}
+
+// ipFrame builds a UDP packet of size bytes sent by the VM of net-a to dst
+// through the router.
+func ipFrame(t *testing.T, r *Router, dst net.IP, ttl uint8, size int, df bool) []byte {
+	ip := &layers.IPv4{Version: 4, IHL: 5, TTL: ttl, Protocol: layers.IPProtocolUDP, SrcIP: net.IP{10, 0, 1, 10}, DstIP: dst}
+	if df {
+		ip.Flags = layers.IPv4DontFragment
+	}
+	udp := &layers.UDP{SrcPort: 5000, DstPort: 5000}
+	udp.SetNetworkLayerForChecksum(ip)
+	eth := &layers.Ethernet{SrcMAC: vmA, DstMAC: r.interfaces[0].MAC, EthernetType: layers.EthernetTypeIPv4}
+	buf := gopacket.NewSerializeBuffer()
+	if err := gopacket.SerializeLayers(buf, gopacket.SerializeOptions{FixLengths: true, ComputeChecksums: true}, eth, ip, udp, gopacket.Payload(make([]byte, size-28))); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestLookup(t *testing.T) {
+	r, _ := testRouter(t)
+	tests := []struct {
+		name    string
+		dst     net.IP
+		network string
+		nextHop net.IP
+	}{
+		{"connected", net.IP{10, 0, 1, 20}, "net-a", net.IP{10, 0, 1, 20}},
+		{"other connected", net.IP{10, 0, 2, 20}, "net-b", net.IP{10, 0, 2, 20}},
+		{"static route", net.IP{172, 16, 9, 9}, "net-b", net.IP{10, 0, 2, 254}},
+		{"longest prefix", net.IP{172, 16, 5, 9}, "net-a", net.IP{10, 0, 1, 254}},
+		{"next hop detached", net.IP{192, 168, 1, 1}, "", nil},
+		{"no route", net.IP{8, 8, 8, 8}, "", nil},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			iface, nextHop, err := r.lookup(test.dst)
+			if test.network == "" {
+				if err == nil {
+					t.Fatalf("routed to %s through %s", nextHop, iface.Network.Name)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if iface.Network.Name != test.network || !nextHop.Equal(test.nextHop) {
+				t.Fatalf("routed to %s through %s, want %s through %s", nextHop, iface.Network.Name, test.nextHop, test.network)
+			}
+		})
+	}
+}
+
+func TestForward(t *testing.T) {
+	r, ports := testRouter(t)
+	tests := []struct {
+		name  string
+		dst   net.IP
+		ttl   uint8
+		size  int
+		df    bool
+		ports []string              // Ports receiving a frame
+		mac   net.HardwareAddr      // Destination of a forwarded packet
+		icmp  layers.ICMPv4TypeCode // ICMP error sent back, if mac and arp are not set
+		mtu   uint16                // MTU announced by the ICMP error
+		arp   bool                  // ARP request sent instead of the packet
+		err   bool
+	}{
+		{"connected", net.IP{10, 0, 2, 10}, 64, 100, false, []string{"vm-b"}, vmB, 0, 0, false, false},
+		{"static route", net.IP{172, 16, 9, 9}, 64, 100, false, []string{"router-b"}, routerB, 0, 0, false, false},
+		{"ttl expired", net.IP{10, 0, 2, 10}, 1, 100, false, []string{"vm-a"}, nil,
+			layers.CreateICMPv4TypeCode(layers.ICMPv4TypeTimeExceeded, layers.ICMPv4CodeTTLExceeded), 0, false, false},
+		{"no route", net.IP{8, 8, 8, 8}, 64, 100, false, []string{"vm-a"}, nil,
+			layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeNet), 0, false, true},
+		{"fragmentation needed", net.IP{10, 0, 2, 10}, 64, 1000, true, []string{"vm-a"}, nil,
+			layers.CreateICMPv4TypeCode(layers.ICMPv4TypeDestinationUnreachable, layers.ICMPv4CodeFragmentationNeeded), 576, false, true},
+		{"too large", net.IP{10, 0, 2, 10}, 64, 1000, false, nil, nil, 0, 0, false, true},
+		{"largest", net.IP{10, 0, 2, 10}, 64, 576, true, []string{"vm-b"}, vmB, 0, 0, false, false},
+		{"unknown neighbour", net.IP{10, 0, 2, 99}, 64, 100, false, []string{"vm-b", "router-b"}, nil, 0, 0, true, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			frame := ipFrame(t, r, test.dst, test.ttl, test.size, test.df)
+			if err := r.forward(r.interfaces[0], frame); (err != nil) != test.err {
+				t.Fatalf("error %v, want an error %v", err, test.err)
+			}
+			var out []byte
+			for id, port := range ports {
+				frames := port.take()
+				want := 0
+				for _, p := range test.ports {
+					if p == id {
+						want = 1
+					}
+				}
+				if len(frames) != want {
+					t.Fatalf("%d frames sent to %s, want %d", len(frames), id, want)
+				}
+				if want == 1 {
+					out = frames[0]
+				}
+			}
+			if out == nil {
+				return
+			}
+			packet := gopacket.NewPacket(out, layers.LayerTypeEthernet, gopacket.Default)
+
+			if test.arp {
+				arp, ok := packet.Layer(layers.LayerTypeARP).(*layers.ARP)
+				if !ok || arp.Operation != layers.ARPRequest || !net.IP(arp.DstProtAddress).Equal(test.dst) {
+					t.Fatalf("no ARP request for %s", test.dst)
+				}
+				return
+			}
+
+			ip, ok := packet.Layer(layers.LayerTypeIPv4).(*layers.IPv4)
+			if !ok {
+				t.Fatal("no IPv4 packet sent")
+			}
+			if test.mac != nil {
+				// The packet is forwarded with a TTL decremented and the
+				// checksum of the header computed again
+				if !bytes.Equal(out[0:6], test.mac) || !bytes.Equal(out[6:12], r.interfaces[1].MAC) {
+					t.Fatalf("forwarded from %s to %s", net.HardwareAddr(out[6:12]), net.HardwareAddr(out[0:6]))
+				}
+				if ip.TTL != test.ttl-1 {
+					t.Fatalf("TTL %d, want %d", ip.TTL, test.ttl-1)
+				}
+				if sum := checksum(out[14:34]); sum != 0 {
+					t.Fatalf("invalid header checksum %#04x", ip.Checksum)
+				}
+				if !bytes.Equal(out[34:], frame[34:]) {
+					t.Fatal("payload modified")
+				}
+				return
+			}
+
+			// The ICMP error is sent back to the VM and quotes the packet
+			icmp, ok := packet.Layer(layers.LayerTypeICMPv4).(*layers.ICMPv4)
+			if !ok {
+				t.Fatal("no ICMP error sent")
+			}
+			if !bytes.Equal(out[0:6], vmA) || !ip.SrcIP.Equal(r.interfaces[0].IP) || !ip.DstIP.Equal(net.IP{10, 0, 1, 10}) {
+				t.Fatalf("ICMP error sent from %s to %s", ip.SrcIP, ip.DstIP)
+			}
+			if icmp.TypeCode != test.icmp || icmp.Seq != test.mtu {
+				t.Fatalf("ICMP %s with MTU %d, want %s with MTU %d", icmp.TypeCode, icmp.Seq, test.icmp, test.mtu)
+			}
+			if !bytes.Equal(icmp.Payload, frame[14:14+28]) {
+				t.Fatal("the packet is not quoted")
+			}
+		})
+	}
+}
+
+func TestChecksum(t *testing.T) {
+	header := ipFrame(t, &Router{interfaces: []*Interface{{MAC: vmB}}}, net.IP{10, 0, 2, 10}, 64, 100, false)[14:34]
+	computed := uint16(header[10])<<8 | uint16(header[11])
+	header[10], header[11] = 0, 0
+	tests := []struct {
+		name string
+		data []byte
+		sum  uint16
+	}{
+		{"rfc 1071", []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}, 0x220d},
+		{"odd length", []byte{0x01}, 0xfeff},
+		{"carry", []byte{0xff, 0xff, 0x00, 0x01}, 0xfffe},
+		{"gopacket header", header, computed},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if sum := checksum(test.data); sum != test.sum {
+				t.Fatalf("checksum %#04x, want %#04x", sum, test.sum)
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+package tools
+
+import (
+	"errors"
+	"net"
+	"os"
+	"syscall"
+	"time"
+)
+
+// A client passes a file opened in its process, such as a TAP device, to the
+// daemon over a Unix SEQPACKET socket the client listens on: the daemon
+// connects to it and receives the file with SCM_RIGHTS. The number of a file
+// descriptor means nothing in another process.
+const fileTimeout = 5 * time.Second
+
+// ListenFile listens on the Unix socket path to pass a file to the daemon.
+// Only the processes of the same user can connect to it.
+func ListenFile(path string) (*net.UnixListener, error) {
+	os.Remove(path)
+	listener, err := net.ListenUnix("unixpacket", &net.UnixAddr{Name: path, Net: "unixpacket"})
+	if err != nil {
+		return nil, err
+	}
+	if err := os.Chmod(path, 0600); err != nil {
+		listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// SendFile passes file to the first process connecting to listener.
+func SendFile(listener *net.UnixListener, file *os.File) error {
+	listener.SetDeadline(time.Now().Add(fileTimeout))
+	conn, err := listener.AcceptUnix()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(fileTimeout))
+	_, _, err = conn.WriteMsgUnix([]byte{0}, syscall.UnixRights(int(file.Fd())), nil)
+	return err
+}
+
+// ReceiveFile connects to the socket path a client listens on and receives
+// the file it passes. Returns the file descriptor, owned by the caller.
+func ReceiveFile(path string) (int, error) {
+	conn, err := net.DialUnix("unixpacket", nil, &net.UnixAddr{Name: path, Net: "unixpacket"})
+	if err != nil {
+		return -1, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(fileTimeout))
+
+	buffer, oob := make([]byte, 1), make([]byte, syscall.CmsgSpace(4))
+	_, oobn, flags, _, err := conn.ReadMsgUnix(buffer, oob)
+	if err != nil {
+		return -1, err
+	}
+	messages, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return -1, err
+	}
+	var fds []int
+	for i := range messages {
+		rights, err := syscall.ParseUnixRights(&messages[i])
+		if err != nil {
+			continue
+		}
+		fds = append(fds, rights...)
+	}
+	if len(fds) != 1 || flags&syscall.MSG_CTRUNC != 0 {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		return -1, errors.New("Expected one file from the client")
+	}
+	syscall.CloseOnExec(fds[0])
+	return fds[0], nil
+}
@@ -0,0 +1,360 @@
+package tools
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+)
+
+// Formats of the network arguments returned for a VM.
+const (
+	FormatCLI  = "cli"  // Options of the QEMU command line in the key=value syntax
+	FormatJSON = "json" // Options of the QEMU command line in the JSON syntax
+	FormatQMP  = "qmp"  // QMP commands hot-plugging the network card, one per line
+	FormatXML  = "xml"  // <interface> element of a libvirt domain
+)
+
+// QemuNIC describes the netdev and the network card of a VM to generate the
+// QEMU arguments of.
+type QemuNIC struct {
+	Transport    string // Transport of the frames: dgram, stream, udp or vhost-user
+	NetdevID     string // id of the netdev
+	RemoteSocket string // Socket of the daemon, a path or an address for udp
+	LocalSocket  string // Socket of QEMU, a path or an address for udp
+	Mac          string // MAC address of the card
+	Model        string // Device model of the card
+	Bus          string // PCI bus of the card
+	Addr         string // PCI slot and function of the card
+	Queues       int    // Number of queue pairs
+	Romfile      string // Option ROM of the card, "none" to disable it
+	BootIndex    int    // Boot priority of the card, 0 to not boot from it
+}
+
+// field is a member of a JSON object whose members keep their order.
+type field struct {
+	key   string
+	value interface{}
+}
+
+// object is a JSON object whose members keep their order.
+type object []field
+
+// MarshalJSON encodes the members of the object in order.
+func (o object) MarshalJSON() ([]byte, error) {
+	var buffer bytes.Buffer
+	buffer.WriteByte('{')
+	for i, f := range o {
+		if i > 0 {
+			buffer.WriteByte(',')
+		}
+		key, _ := json.Marshal(f.key)
+		value, err := json.Marshal(f.value)
+		if err != nil {
+			return nil, err
+		}
+		buffer.Write(key)
+		buffer.WriteByte(':')
+		buffer.Write(value)
+	}
+	buffer.WriteByte('}')
+	return buffer.Bytes(), nil
+}
+
+// CraftQemuNetworkArgs returns the arguments connecting a VM to the daemon,
+// in one of the formats FormatCLI, FormatJSON, FormatQMP or FormatXML.
+func CraftQemuNetworkArgs(format string, nic QemuNIC) ([]byte, error) {
+	if nic.Queues > 1 && nic.Transport != "vhost-user" {
+		return nil, errors.New("Several queues require the vhost-user transport")
+	}
+	switch format {
+	case "", FormatCLI:
+		return craftCLI(nic)
+	case FormatJSON:
+		return craftJSON(nic)
+	case FormatQMP:
+		return craftQMP(nic)
+	case FormatXML:
+		return craftXML(nic)
+	default:
+		return nil, errors.New("Unknown format, expected cli, json, qmp or xml")
+	}
+}
+
+// DeviceID returns the id given to the network card of a netdev when it is
+// hot-plugged.
+func DeviceID(netdevID string) string {
+	return "dev-" + netdevID
+}
+
+// ChardevID returns the id of the character device of a vhost-user netdev.
+func ChardevID(netdevID string) string {
+	return "chr-" + netdevID
+}
+
+// QmpCommand is a command of the QEMU Machine Protocol.
+type QmpCommand struct {
+	Execute   string         `json:"execute"`   // Name of the command
+	Arguments json.Marshaler `json:"arguments"` // Arguments of the command
+}
+
+// netdevObject returns the options of the netdev of a VM.
+func netdevObject(nic QemuNIC) (object, error) {
+	switch nic.Transport {
+	case "dgram":
+		return object{
+			{"type", "dgram"}, {"id", nic.NetdevID},
+			{"remote", object{{"type", "unix"}, {"path", nic.RemoteSocket}}},
+			{"local", object{{"type", "unix"}, {"path", nic.LocalSocket}}},
+		}, nil
+	case "stream":
+		return object{
+			{"type", "stream"}, {"id", nic.NetdevID}, {"server", false},
+			{"addr", object{{"type", "unix"}, {"path", nic.RemoteSocket}}},
+		}, nil
+	case "udp":
+		return object{{"type", "socket"}, {"id", nic.NetdevID}, {"udp", nic.RemoteSocket}, {"localaddr", nic.LocalSocket}}, nil
+	case "vhost-user":
+		netdev := object{{"type", "vhost-user"}, {"id", nic.NetdevID}, {"chardev", ChardevID(nic.NetdevID)}}
+		if nic.Queues > 1 {
+			netdev = append(netdev, field{"queues", nic.Queues})
+		}
+		return netdev, nil
+	default:
+		return nil, fmt.Errorf("Unknown transport %s", nic.Transport)
+	}
+}
+
+// deviceObject returns the properties of the network card of a VM.
+func deviceObject(nic QemuNIC) object {
+	device := object{{"driver", nic.Model}, {"netdev", nic.NetdevID}, {"mac", nic.Mac}}
+	if nic.Bus != "" {
+		device = append(device, field{"bus", nic.Bus})
+	}
+	if nic.Addr != "" {
+		device = append(device, field{"addr", nic.Addr})
+	}
+	if nic.Romfile == "none" {
+		device = append(device, field{"romfile", ""})
+	} else if nic.Romfile != "" {
+		device = append(device, field{"romfile", nic.Romfile})
+	}
+	if nic.BootIndex > 0 {
+		device = append(device, field{"bootindex", nic.BootIndex})
+	}
+	if nic.Queues > 1 {
+		// One vector per queue, plus the configuration and control queues
+		device = append(device, field{"mq", true}, field{"vectors", 2*nic.Queues + 2})
+	}
+	return device
+}
+
+// keyValues encodes an object in the key=value syntax of the QEMU command
+// line, nested objects being flattened with dotted keys. The commas of the
+// values, such as those of a path, are escaped.
+func keyValues(o object, prefix string) []string {
+	var options []string
+	for _, f := range o {
+		switch v := f.value.(type) {
+		case object:
+			options = append(options, keyValues(v, prefix+f.key+".")...)
+		case bool:
+			if v {
+				options = append(options, prefix+f.key+"=on")
+			} else {
+				options = append(options, prefix+f.key+"=off")
+			}
+		default:
+			options = append(options, prefix+f.key+"="+escapeOption(fmt.Sprint(v)))
+		}
+	}
+	return options
+}
+
+// escapeOption escapes a value of the key=value syntax, where a comma is
+// written as two commas.
+func escapeOption(value string) string {
+	return strings.ReplaceAll(value, ",", ",,")
+}
+
+// chardevOption returns the -chardev option of the vhost-user socket.
+func chardevOption(nic QemuNIC) string {
+	return "-chardev socket,id=" + escapeOption(ChardevID(nic.NetdevID)) + ",path=" + escapeOption(nic.RemoteSocket)
+}
+
+// craftCLI returns the options of the command line in the key=value syntax.
+func craftCLI(nic QemuNIC) ([]byte, error) {
+	netdev, err := netdevObject(nic)
+	if err != nil {
+		return nil, err
+	}
+	device := deviceObject(nic)
+	args := []string{
+		"-netdev " + netdev[0].value.(string) + "," + strings.Join(keyValues(netdev[1:], ""), ","),
+		"-device " + nic.Model + "," + strings.Join(keyValues(device[1:], ""), ","),
+	}
+	if nic.Transport == "vhost-user" {
+		args = append([]string{chardevOption(nic)}, args...)
+	}
+	return []byte(strings.Join(args, " ")), nil
+}
+
+// craftJSON returns the options of the command line in the JSON syntax. The
+// -chardev option has no JSON syntax and keeps the key=value syntax.
+func craftJSON(nic QemuNIC) ([]byte, error) {
+	netdev, err := netdevObject(nic)
+	if err != nil {
+		return nil, err
+	}
+	netdevJSON, err := json.Marshal(netdev)
+	if err != nil {
+		return nil, err
+	}
+	deviceJSON, err := json.Marshal(deviceObject(nic))
+	if err != nil {
+		return nil, err
+	}
+	args := []string{"-netdev " + string(netdevJSON), "-device " + string(deviceJSON)}
+	if nic.Transport == "vhost-user" {
+		args = append([]string{chardevOption(nic)}, args...)
+	}
+	return []byte(strings.Join(args, " ")), nil
+}
+
+// craftQMP returns the QMP commands adding the netdev and the network card
+// to a running VM, one command per line.
+func craftQMP(nic QemuNIC) ([]byte, error) {
+	commands, err := QmpAddCommands(nic)
+	if err != nil {
+		return nil, err
+	}
+	var lines []string
+	for _, command := range commands {
+		line, err := json.Marshal(command)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, string(line))
+	}
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// QmpAddCommands returns the QMP commands adding the netdev and the network
+// card of a VM, in the order they must be executed.
+func QmpAddCommands(nic QemuNIC) ([]QmpCommand, error) {
+	netdev, err := netdevObject(nic)
+	if err != nil {
+		return nil, err
+	}
+	device := append(object{{"id", DeviceID(nic.NetdevID)}}, deviceObject(nic)...)
+
+	var commands []QmpCommand
+	if nic.Transport == "vhost-user" {
+		commands = append(commands, QmpCommand{"chardev-add", object{
+			{"id", ChardevID(nic.NetdevID)},
+			{"backend", object{{"type", "socket"}, {"data", object{
+				{"addr", object{{"type", "unix"}, {"data", object{{"path", nic.RemoteSocket}}}}},
+				{"server", false},
+			}}}},
+		}})
+	}
+	commands = append(commands, QmpCommand{"netdev_add", netdev}, QmpCommand{"device_add", device})
+	return commands, nil
+}
+
+// craftXML returns the <interface> element of a libvirt domain. libvirt has
+// no interface type for the Unix socket transports, only udp and vhost-user
+// are supported.
+func craftXML(nic QemuNIC) ([]byte, error) {
+	escape := func(s string) string {
+		var buffer bytes.Buffer
+		xml.EscapeText(&buffer, []byte(s))
+		return buffer.String()
+	}
+
+	var lines []string
+	switch nic.Transport {
+	case "vhost-user":
+		lines = append(lines, "<interface type='vhostuser'>",
+			"  <mac address='"+nic.Mac+"'/>",
+			"  <source type='unix' path='"+escape(nic.RemoteSocket)+"' mode='client'/>")
+	case "udp":
+		remoteHost, remotePort, err := net.SplitHostPort(nic.RemoteSocket)
+		if err != nil {
+			return nil, err
+		}
+		localHost, localPort, err := net.SplitHostPort(nic.LocalSocket)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, "<interface type='udp'>",
+			"  <mac address='"+nic.Mac+"'/>",
+			"  <source address='"+remoteHost+"' port='"+remotePort+"'>",
+			"    <local address='"+localHost+"' port='"+localPort+"'/>",
+			"  </source>")
+	default:
+		return nil, errors.New("libvirt has no interface type for the " + nic.Transport + " transport, use udp or vhost-user")
+	}
+
+	model := nic.Model
+	if strings.HasPrefix(model, "virtio-net") {
+		model = "virtio"
+	}
+	lines = append(lines, "  <model type='"+escape(model)+"'/>")
+	if nic.Queues > 1 {
+		lines = append(lines, "  <driver queues='"+strconv.Itoa(nic.Queues)+"'/>")
+	}
+	if nic.Romfile == "none" {
+		lines = append(lines, "  <rom enabled='no'/>")
+	} else if nic.Romfile != "" {
+		lines = append(lines, "  <rom file='"+escape(nic.Romfile)+"'/>")
+	}
+	if nic.BootIndex > 0 {
+		lines = append(lines, "  <boot order='"+strconv.Itoa(nic.BootIndex)+"'/>")
+	}
+	if nic.Model == "virtio-net-device" {
+		lines = append(lines, "  <address type='virtio-mmio'/>")
+	} else if nic.Bus != "" || nic.Addr != "" {
+		address, err := pciAddress(nic.Bus, nic.Addr)
+		if err != nil {
+			return nil, err
+		}
+		lines = append(lines, "  "+address)
+	}
+	lines = append(lines, "</interface>")
+	return []byte(strings.Join(lines, "\n")), nil
+}
+
+// pciAddress converts the bus and the addr properties of a QEMU device to a
+// libvirt <address> element. Only the pci.N and pcie.N buses can be
+// converted.
+func pciAddress(bus string, addr string) (string, error) {
+	busIndex := uint64(0)
+	if bus != "" {
+		index := strings.TrimPrefix(strings.TrimPrefix(bus, "pcie."), "pci.")
+		value, err := strconv.ParseUint(index, 0, 8)
+		if err != nil || index == bus {
+			return "", errors.New("Only the pci.N and pcie.N buses can be converted to libvirt addresses")
+		}
+		busIndex = value
+	}
+	if addr == "" {
+		return "", errors.New("libvirt addresses need the slot of the card")
+	}
+	slotPart, functionPart, _ := strings.Cut(addr, ".")
+	slot, err := strconv.ParseUint(slotPart, 0, 5)
+	if err != nil {
+		return "", errors.New("Invalid PCI slot " + slotPart)
+	}
+	function := uint64(0)
+	if functionPart != "" {
+		if function, err = strconv.ParseUint(functionPart, 0, 3); err != nil {
+			return "", errors.New("Invalid PCI function " + functionPart)
+		}
+	}
+	return fmt.Sprintf("<address type='pci' domain='0x0000' bus='%#02x' slot='%#02x' function='%#x'/>", busIndex, slot, function), nil
+}
@@ -0,0 +1,36 @@
+package tools
+
+import (
+	"strings"
+	"testing"
+)
+
+// TestCraftCLI checks the escaping of the commas of the values in the
+// key=value syntax.
+func TestCraftCLI(t *testing.T) {
+	tests := []struct {
+		name string
+		nic  QemuNIC
+		want string
+	}{
+		{"dgram", QemuNIC{Transport: "dgram", NetdevID: "net0", RemoteSocket: "/tmp/a.sock", LocalSocket: "/tmp/b.sock", Mac: "52:54:00:12:34:56", Model: "virtio-net-pci"},
+			"-netdev dgram,id=net0,remote.type=unix,remote.path=/tmp/a.sock,local.type=unix,local.path=/tmp/b.sock"},
+		{"comma in a socket", QemuNIC{Transport: "stream", NetdevID: "net0", RemoteSocket: "/tmp/a,b.sock", Mac: "52:54:00:12:34:56", Model: "virtio-net-pci"},
+			"addr.path=/tmp/a,,b.sock"},
+		{"comma in the romfile", QemuNIC{Transport: "dgram", NetdevID: "net0", Mac: "52:54:00:12:34:56", Model: "e1000", Romfile: "/roms/e1000,v2.rom"},
+			"-device e1000,netdev=net0,mac=52:54:00:12:34:56,romfile=/roms/e1000,,v2.rom"},
+		{"comma in a vhost-user socket", QemuNIC{Transport: "vhost-user", NetdevID: "net0", RemoteSocket: "/run/a,b.sock", Mac: "52:54:00:12:34:56", Model: "virtio-net-pci"},
+			"-chardev socket,id=chr-net0,path=/run/a,,b.sock "},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			out, err := CraftQemuNetworkArgs(FormatCLI, test.nic)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !strings.Contains(string(out), test.want) {
+				t.Fatalf("%s, want %s", out, test.want)
+			}
+		})
+	}
+}
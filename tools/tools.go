@@ -26,20 +26,6 @@ func GenerateMACAddress() (string, error) {
 	return fmt.Sprintf("%02x:%02x:%02x:%02x:%02x:%02x", mac[0], mac[1], mac[2], mac[3], mac[4], mac[5]), nil
 }
 
-// CraftQemuNetworkCommand constructs a QEMU network command string.
-func CraftQemuNetworkCommand(socket string, socketRemote string, socketLocal string, mac string) []byte {
-	return []byte("-netdev dgram,id=" +
-		socket +
-		",remote.type=unix,remote.path=" +
-		socketRemote +
-		",local.type=unix,local.path=" +
-		socketLocal +
-		" -device virtio-net,netdev=" +
-		socket +
-		",mac=" +
-		mac)
-}
-
 // IsUsableIP checks if an IP address is usable (not loopback, multicast, etc.).
 func IsUsableIP(ipStr string) bool {
 	ip := net.ParseIP(ipStr)
@@ -125,6 +111,24 @@ func GenerateIPRange(rangeStr string) ([]net.IP, error) {
 	return ips, nil
 }
 
+// FormatMAC formats a 6-byte MAC address into buf like
+// net.HardwareAddr.String, without allocating. Returns the formatted address,
+// empty if mac is not 6 bytes long.
+func FormatMAC(buf *[17]byte, mac net.HardwareAddr) []byte {
+	const digits = "0123456789abcdef"
+	if len(mac) != 6 {
+		return nil
+	}
+	for i, b := range mac {
+		if i > 0 {
+			buf[i*3-1] = ':'
+		}
+		buf[i*3] = digits[b>>4]
+		buf[i*3+1] = digits[b&0x0f]
+	}
+	return buf[:]
+}
+
 // IsBroadcastMAC checks if the given MAC address is a broadcast MAC address.
 func IsBroadcastMAC(macStr string) (bool, error) {
 	mac, err := net.ParseMAC(macStr)